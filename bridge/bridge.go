@@ -0,0 +1,309 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bridge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// ClientFactory creates the websocket client of a bridged connection, e.g.
+// to configure tls or keepalive. events must be passed to the client.
+type ClientFactory func(events websocket.Events) *websocket.Client
+
+// ConnStats are the counters of one bridged connection. BytesIn were read
+// from the tcp peer and sent to the websocket, BytesOut went the other way.
+type ConnStats struct {
+	Id          int
+	RemoteAddr  string
+	ConnectedAt time.Time
+	BytesIn     uint64
+	BytesOut    uint64
+}
+
+type conn struct {
+	id          int
+	remote      string
+	connectedAt time.Time
+	in, out     atomic.Uint64
+}
+
+func (c *conn) stats() ConnStats {
+	return ConnStats{
+		Id:          c.id,
+		RemoteAddr:  c.remote,
+		ConnectedAt: c.connectedAt,
+		BytesIn:     c.in.Load(),
+		BytesOut:    c.out.Load(),
+	}
+}
+
+// countingReader and countingWriter add the transferred bytes to a counter.
+type countingReader struct {
+	r     io.Reader
+	count *atomic.Uint64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *atomic.Uint64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count.Add(uint64(n))
+	return n, err
+}
+
+// connectEvents notes the connect of a bridge client, so a shutdown during
+// the dial can wait for it before disconnecting.
+type connectEvents struct {
+	connected chan struct{}
+	once      sync.Once
+}
+
+func (e *connectEvents) OnReceive(msg websocket.Message)  {}
+func (e *connectEvents) OnDisconnect(id int)              {}
+func (e *connectEvents) OnFailure(exited bool, err error) {}
+func (e *connectEvents) OnConnect(id int) {
+	e.once.Do(func() { close(e.connected) })
+}
+
+// Bridge accepts tcp connections and relays each over its own websocket
+// connection as binary messages, until either side closes.
+type Bridge struct {
+	listener net.Listener
+	wsURL    string
+	header   map[string]string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock     sync.Mutex
+	factory  ClientFactory
+	limit    int
+	onClose  func(ConnStats)
+	conns    map[int]*conn
+	nextId   int
+	rejected uint64
+}
+
+// ListenTCP listens on addr and bridges every accepted connection to wsURL,
+// sending header with each handshake. Configure the bridge right after
+// creating it, the settings apply to the connections accepted afterwards.
+func ListenTCP(addr string, wsURL string,
+	header map[string]string) (*Bridge, error) {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Bridge{
+		listener: listener,
+		wsURL:    wsURL,
+		header:   header,
+		ctx:      ctx,
+		cancel:   cancel,
+		conns:    make(map[int]*conn),
+		factory: func(events websocket.Events) *websocket.Client {
+			return websocket.NewClient(false, events)
+		},
+	}
+
+	b.wg.Add(1)
+	go b.acceptLoop()
+
+	return b, nil
+}
+
+// SetClientFactory replaces the default client, which validates the server
+// certificate and has no further settings.
+func (b *Bridge) SetClientFactory(factory ClientFactory) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.factory = factory
+}
+
+// SetMaxConnections limits the concurrently bridged connections, further
+// ones are closed right after accepting. 0 disables the limit.
+func (b *Bridge) SetMaxConnections(limit int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.limit = limit
+}
+
+// SetOnClose installs a hook called with the final counters of each
+// bridged connection.
+func (b *Bridge) SetOnClose(hook func(ConnStats)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.onClose = hook
+}
+
+func (b *Bridge) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// Connections returns the counters of the active connections, ordered by
+// id.
+func (b *Bridge) Connections() []ConnStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	stats := make([]ConnStats, 0, len(b.conns))
+	for _, c := range b.conns {
+		stats = append(stats, c.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Id < stats[j].Id })
+	return stats
+}
+
+// Rejected returns the number of connections closed due to the limit.
+func (b *Bridge) Rejected() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.rejected
+}
+
+// Close stops accepting, ends all active bridges and waits for them.
+func (b *Bridge) Close() error {
+	err := b.listener.Close()
+	b.cancel()
+	b.wg.Wait()
+	return err
+}
+
+func (b *Bridge) acceptLoop() {
+	defer b.wg.Done()
+
+	for {
+		tcp, err := b.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+
+		c, factory, ok := b.register(tcp)
+		if !ok {
+			tcp.Close()
+			continue
+		}
+
+		b.wg.Add(1)
+		go b.relay(tcp, c, factory)
+	}
+}
+
+func (b *Bridge) register(tcp net.Conn) (*conn, ClientFactory, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.limit > 0 && len(b.conns) >= b.limit {
+		b.rejected++
+		return nil, nil, false
+	}
+
+	b.nextId++
+	c := &conn{
+		id:          b.nextId,
+		remote:      tcp.RemoteAddr().String(),
+		connectedAt: time.Now(),
+	}
+	b.conns[c.id] = c
+	return c, b.factory, true
+}
+
+func (b *Bridge) unregister(c *conn) {
+	b.lock.Lock()
+	delete(b.conns, c.id)
+	hook := b.onClose
+	b.lock.Unlock()
+
+	if hook != nil {
+		hook(c.stats())
+	}
+}
+
+func (b *Bridge) relay(tcp net.Conn, c *conn, factory ClientFactory) {
+	defer b.wg.Done()
+	defer b.unregister(c)
+
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+
+	events := &connectEvents{connected: make(chan struct{})}
+	client := factory(events)
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		defer cancel()
+		_ = client.ConnectAndServe(b.wsURL, b.header)
+	}()
+
+	_ = websocket.Pipe(ctx, client,
+		countingReader{r: tcp, count: &c.in},
+		countingWriter{w: tcp, count: &c.out},
+		websocket.PipeOptions{Framing: websocket.FramingChunk})
+
+	// unblocks the read of the pipe
+	tcp.Close()
+
+	select {
+	case <-served:
+		return
+	case <-events.connected:
+	}
+	_ = client.Disconnect()
+	<-served
+}
@@ -0,0 +1,278 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bridge
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const testUrl = "ws://localhost:33243/bridge"
+
+// echoEvents sends received messages back to the sending client.
+type echoEvents struct {
+	server *websocket.Server
+}
+
+func (e *echoEvents) OnReceive(msg websocket.Message) {
+	_ = e.server.Send(msg.ClientId, &msg)
+}
+func (e *echoEvents) OnDisconnect(id int)              {}
+func (e *echoEvents) OnConnect(id int)                 {}
+func (e *echoEvents) OnFailure(exited bool, err error) {}
+
+func startEchoServer(t *testing.T) {
+	events := &echoEvents{}
+	events.server = websocket.NewServer(testUrl, events)
+	go func() { _ = events.server.ListenAndServe() }()
+	t.Cleanup(func() { events.server.Close() })
+	time.Sleep(200 * time.Millisecond)
+}
+
+func echo(t *testing.T, conn net.Conn, text string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, len(text))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != text {
+		t.Errorf("got %q, want %q", buf, text)
+	}
+}
+
+func expectEOF(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	startEchoServer(t)
+
+	b, err := ListenTCP("127.0.0.1:0", testUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetMaxConnections(1)
+	closed := make(chan ConnStats, 1)
+	b.SetOnClose(func(stats ConnStats) { closed <- stats })
+
+	first, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, first, "hello")
+	echo(t, first, "world!")
+
+	conns := b.Connections()
+	if len(conns) != 1 || conns[0].BytesIn != 11 || conns[0].BytesOut != 11 {
+		t.Errorf("unexpected connections: %+v", conns)
+	}
+
+	// over the limit
+	second, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEOF(t, second)
+	second.Close()
+	if b.Rejected() != 1 {
+		t.Errorf("rejected %d, want 1", b.Rejected())
+	}
+
+	first.Close()
+	select {
+	case stats := <-closed:
+		if stats.BytesIn != 11 || stats.BytesOut != 11 {
+			t.Errorf("unexpected final counters: %+v", stats)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close hook not called")
+	}
+
+	// shutdown ends active bridges
+	third, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, third, "again")
+
+	done := make(chan error, 1)
+	go func() { done <- b.Close() }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("close hangs")
+	}
+	expectEOF(t, third)
+	third.Close()
+
+	if len(b.Connections()) != 0 {
+		t.Errorf("connections left: %+v", b.Connections())
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	var lock sync.Mutex
+	attempts := make(map[string]int)
+	received := make(chan *http.Request, 16)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		attempts[string(body)]++
+		n := attempts[string(body)]
+		lock.Unlock()
+
+		switch {
+		case string(body) == "bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case string(body) == "down", string(body) == "flaky" && n < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			received <- r
+		}
+	}))
+	defer target.Close()
+
+	deadLetters := make(chan error, 4)
+	webhook := NewWebhook(target.URL, WebhookOptions{
+		Header:     http.Header{"Authorization": {"Bearer token"}},
+		MaxRetries: 2,
+		Backoff:    utils.Backoff{Initial: 10 * time.Millisecond},
+		OnDeadLetter: func(msg websocket.Message, err error) {
+			deadLetters <- err
+		},
+	})
+	defer webhook.Close()
+
+	webhook.OnReceive(websocket.Message{
+		MessageType: websocket.TextMessage, Data: []byte("hello"), ClientId: 7})
+	select {
+	case r := <-received:
+		if r.Header.Get(HeaderClientId) != "7" || r.Header.Get(HeaderMessageType) != "text" ||
+			r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, r.Header.Get(HeaderTimestamp)); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not posted")
+	}
+
+	webhook.OnReceive(websocket.Message{MessageType: websocket.BinaryMessage, Data: []byte("flaky")})
+	select {
+	case r := <-received:
+		if r.Header.Get(HeaderMessageType) != "binary" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not retried")
+	}
+
+	for _, body := range []string{"bad", "down"} {
+		webhook.OnReceive(websocket.Message{MessageType: websocket.TextMessage, Data: []byte(body)})
+		select {
+		case err := <-deadLetters:
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Errorf("%s: dead letter with %v", body, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no dead letter", body)
+		}
+	}
+	lock.Lock()
+	if attempts["bad"] != 1 || attempts["down"] != 3 {
+		t.Errorf("attempts %v", attempts)
+	}
+	lock.Unlock()
+	if webhook.Delivered() != 2 {
+		t.Errorf("%d delivered", webhook.Delivered())
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	blocked, release := make(chan struct{}, 1), make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blocked <- struct{}{}
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	deadLetters := make(chan error, 4)
+	webhook := NewWebhook(target.URL, WebhookOptions{
+		Concurrency: 1,
+		QueueSize:   1,
+		OnDeadLetter: func(msg websocket.Message, err error) {
+			deadLetters <- err
+		},
+	})
+
+	msg := websocket.Message{MessageType: websocket.TextMessage, Data: []byte("x")}
+	webhook.OnReceive(msg)
+	<-blocked
+	webhook.OnReceive(msg) // queued
+	webhook.OnReceive(msg)
+	if webhook.Dropped() != 1 {
+		t.Errorf("%d dropped", webhook.Dropped())
+	}
+
+	_ = webhook.Close()
+	webhook.OnReceive(msg)
+	if webhook.Dropped() != 2 {
+		t.Errorf("%d dropped after close", webhook.Dropped())
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-deadLetters:
+			if !errors.Is(err, ErrWebhookClosed) {
+				t.Error("expected closed, got ", err)
+			}
+		default:
+			t.Fatal("pending message not dead lettered")
+		}
+	}
+}
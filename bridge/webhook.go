@@ -0,0 +1,260 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Headers of the webhook requests.
+const (
+	HeaderClientId    = "X-Websocket-Client-Id"
+	HeaderMessageType = "X-Websocket-Message-Type"
+	HeaderTimestamp   = "X-Websocket-Timestamp"
+)
+
+const (
+	DefaultWebhookConcurrency = 4
+	DefaultWebhookQueue       = 256
+	DefaultWebhookRetries     = 3
+	DefaultWebhookTimeout     = 10 * time.Second
+)
+
+var ErrWebhookClosed = errors.New("webhook closed")
+
+// StatusError is the response of a failed webhook request.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook responded %d %s", e.StatusCode,
+		http.StatusText(e.StatusCode))
+}
+
+// WebhookOptions configure a Webhook, zero values select the defaults.
+type WebhookOptions struct {
+	// Client sends the requests, by default one with DefaultWebhookTimeout.
+	Client *http.Client
+	// Header is added to each request, e.g. for authorization.
+	Header      http.Header
+	Concurrency int
+	// QueueSize limits the messages waiting for a request, further ones
+	// are dropped.
+	QueueSize int
+	// MaxRetries after the first attempt of a message failed with a 5xx
+	// status or without response. A negative value disables retries.
+	MaxRetries int
+	// Backoff is copied for each message to delay its retries.
+	Backoff utils.Backoff
+	// OnDeadLetter receives the messages given up, with the last error.
+	OnDeadLetter func(msg websocket.Message, err error)
+}
+
+type webhookItem struct {
+	msg        websocket.Message
+	receivedAt time.Time
+}
+
+// Webhook posts each received message to an http endpoint. Messages are
+// queued, so the read loop never waits for a request.
+type Webhook struct {
+	target string
+	opts   WebhookOptions
+	queue  chan webhookItem
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock      sync.RWMutex
+	closed    bool
+	dropped   atomic.Uint64
+	delivered atomic.Uint64
+}
+
+// NewWebhook starts the workers posting to target, stop them by Close.
+func NewWebhook(target string, opts WebhookOptions) *Webhook {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultWebhookConcurrency
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultWebhookQueue
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultWebhookRetries
+	}
+
+	w := &Webhook{
+		target: target,
+		opts:   opts,
+		queue:  make(chan webhookItem, opts.QueueSize),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	w.wg.Add(opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go w.worker()
+	}
+	return w
+}
+
+// Dropped returns the number of messages dropped due to a full queue or
+// after Close.
+func (w *Webhook) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Delivered returns the number of messages posted successfully.
+func (w *Webhook) Delivered() uint64 {
+	return w.delivered.Load()
+}
+
+// Close cancels the pending requests and waits for the workers. Messages
+// not delivered yet go to OnDeadLetter with ErrWebhookClosed.
+func (w *Webhook) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.queue)
+	w.lock.Unlock()
+
+	w.cancel()
+	w.wg.Wait()
+	return nil
+}
+
+func (w *Webhook) OnReceive(msg websocket.Message) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+	select {
+	case w.queue <- webhookItem{msg: msg, receivedAt: time.Now()}:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *Webhook) OnConnect(id int)                 {}
+func (w *Webhook) OnDisconnect(id int)              {}
+func (w *Webhook) OnFailure(exited bool, err error) {}
+
+func (w *Webhook) worker() {
+	defer w.wg.Done()
+
+	for item := range w.queue {
+		if err := w.deliver(item); err != nil {
+			if w.opts.OnDeadLetter != nil {
+				w.opts.OnDeadLetter(item.msg, err)
+			}
+			continue
+		}
+		w.delivered.Add(1)
+	}
+}
+
+// deliver posts the message, retrying failures worth it.
+func (w *Webhook) deliver(item webhookItem) error {
+	backoff := w.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		if w.ctx.Err() != nil {
+			return ErrWebhookClosed
+		}
+		err := w.post(item)
+		if err == nil {
+			return nil
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode < 500 {
+			return err
+		}
+		if attempt >= w.opts.MaxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(backoff.Next())
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			timer.Stop()
+			return ErrWebhookClosed
+		}
+	}
+}
+
+func (w *Webhook) post(item webhookItem) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.target,
+		bytes.NewReader(item.msg.Data))
+	if err != nil {
+		return err
+	}
+	for key, values := range w.opts.Header {
+		req.Header[key] = values
+	}
+	messageType, contentType := "binary", "application/octet-stream"
+	if item.msg.MessageType == websocket.TextMessage {
+		messageType, contentType = "text", "text/plain; charset=utf-8"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderClientId, strconv.Itoa(item.msg.ClientId))
+	req.Header.Set(HeaderMessageType, messageType)
+	req.Header.Set(HeaderTimestamp, item.receivedAt.UTC().Format(time.RFC3339Nano))
+
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return ErrWebhookClosed
+		}
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// setupClientTLS loads the root cas and the client certificate of cfg.
+func setupClientTLS(client *websocket.Client, cfg config) error {
+	for _, path := range cfg.rootCAs {
+		if err := client.AddRootCaFile(path); err != nil {
+			return fmt.Errorf("--root-ca: %w", err)
+		}
+	}
+
+	if cfg.clientCert != "" {
+		certPEM, keyPEM, err := utils.LoadKeyPair(cfg.clientCert, cfg.clientKey)
+		if err != nil {
+			return fmt.Errorf("--client-cert/--client-key: %w", err)
+		}
+		if err = client.SetClientCertificate(certPEM, keyPEM); err != nil {
+			return fmt.Errorf("--client-cert/--client-key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexSum := make([]string, len(sum))
+	for i, b := range sum {
+		hexSum[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexSum, ":")
+}
+
+func subjectAltNames(cert *x509.Certificate) string {
+	var names []string
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// printCertChain prints the peer chain of a tls handshake and the result
+// of verifying it.
+func printCertChain(out *printer, state tls.ConnectionState,
+	verifyErr error, skipVerify bool) {
+
+	out.Printf(markerEvent, "peer certificate chain:")
+	for i, cert := range state.PeerCertificates {
+		out.Printf(markerEvent, "  #%d subject: %s", i, cert.Subject)
+		out.Printf(markerEvent, "     issuer:  %s", cert.Issuer)
+		out.Printf(markerEvent, "     sans:    %s", subjectAltNames(cert))
+		out.Printf(markerEvent, "     valid:   %s - %s",
+			cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		if i == 0 {
+			out.Printf(markerEvent, "     sha256:  %s", fingerprint(cert))
+		}
+	}
+
+	switch {
+	case verifyErr == nil:
+		out.Printf(markerEvent, "certificate verification ok")
+	case skipVerify:
+		out.Printf(markerEvent, "certificate verification skipped, would fail: %v",
+			verifyErr)
+	default:
+		out.Printf(markerEvent, "certificate verification failed: %v", verifyErr)
+	}
+}
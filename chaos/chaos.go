@@ -0,0 +1,215 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package chaos misbehaves on purpose, for testing how an application
+// copes: received messages are delayed, dropped or duplicated, and
+// connections are disconnected. All decisions come from a seeded random
+// source, so a run with the same seed and the same messages repeats them.
+package chaos
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Distribution draws a duration from r.
+type Distribution func(r *rand.Rand) time.Duration
+
+func Fixed(d time.Duration) Distribution {
+	return func(*rand.Rand) time.Duration { return d }
+}
+
+// Uniform draws from [min, max).
+func Uniform(min, max time.Duration) Distribution {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// Normal draws from a normal distribution, negative durations are 0.
+func Normal(mean, stddev time.Duration) Distribution {
+	return func(r *rand.Rand) time.Duration {
+		d := mean + time.Duration(r.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+func Exponential(mean time.Duration) Distribution {
+	return func(r *rand.Rand) time.Duration {
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+}
+
+// Config sets the faults injected. Rates are probabilities from 0 to 1 per
+// received message. Latency delays each delivered message in the read
+// loop, so the order is kept. DisconnectAfter is drawn for each connection,
+// its disconnect needs a hook, see Events.SetDisconnect.
+type Config struct {
+	Seed            int64
+	Latency         Distribution
+	DropRate        float64
+	DuplicateRate   float64
+	DisconnectAfter Distribution
+}
+
+// Counters are the faults injected so far.
+type Counters struct {
+	Delayed      uint64
+	Dropped      uint64
+	Duplicated   uint64
+	Disconnected uint64
+}
+
+// Events injects the faults into the events passed on to the wrapped
+// handler.
+type Events struct {
+	inner  websocket.Events
+	config Config
+
+	lock       sync.Mutex
+	rand       *rand.Rand
+	disconnect func(id int)
+	timers     map[int]*time.Timer
+
+	delayed      atomic.Uint64
+	dropped      atomic.Uint64
+	duplicated   atomic.Uint64
+	disconnected atomic.Uint64
+}
+
+// Wrap returns events misbehaving as configured. Install it with
+// SetEventHandler on a server or client.
+func Wrap(events websocket.Events, config Config) *Events {
+	return &Events{
+		inner:  events,
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+		timers: make(map[int]*time.Timer),
+	}
+}
+
+// SetDisconnect sets how a connection is disconnected, e.g. the server's
+// Disconnect or websockettest's Break. Without it no connection is
+// disconnected.
+func (e *Events) SetDisconnect(fn func(id int)) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.disconnect = fn
+}
+
+func (e *Events) Counters() Counters {
+	return Counters{
+		Delayed:      e.delayed.Load(),
+		Dropped:      e.dropped.Load(),
+		Duplicated:   e.duplicated.Load(),
+		Disconnected: e.disconnected.Load(),
+	}
+}
+
+func (e *Events) OnReceive(msg websocket.Message) {
+	e.receive(msg, e.inner.OnReceive)
+}
+
+func (e *Events) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	ctxEvents, ok := e.inner.(websocket.CtxEvents)
+	if !ok {
+		e.OnReceive(msg)
+		return
+	}
+	e.receive(msg, func(msg websocket.Message) { ctxEvents.OnReceiveCtx(ctx, msg) })
+}
+
+func (e *Events) receive(msg websocket.Message, deliver func(msg websocket.Message)) {
+	e.lock.Lock()
+	drop := e.rand.Float64() < e.config.DropRate
+	duplicate := e.rand.Float64() < e.config.DuplicateRate
+	var delay time.Duration
+	if e.config.Latency != nil {
+		delay = e.config.Latency(e.rand)
+	}
+	e.lock.Unlock()
+
+	if drop {
+		e.dropped.Add(1)
+		return
+	}
+	if delay > 0 {
+		e.delayed.Add(1)
+		time.Sleep(delay)
+	}
+	deliver(msg)
+	if duplicate {
+		e.duplicated.Add(1)
+		deliver(msg)
+	}
+}
+
+func (e *Events) OnConnect(id int) {
+	e.inner.OnConnect(id)
+
+	if e.config.DisconnectAfter == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.timers[id] = time.AfterFunc(e.config.DisconnectAfter(e.rand), func() {
+		e.lock.Lock()
+		fn := e.disconnect
+		e.lock.Unlock()
+
+		if fn != nil {
+			e.disconnected.Add(1)
+			fn(id)
+		}
+	})
+}
+
+func (e *Events) OnDisconnect(id int) {
+	e.lock.Lock()
+	if timer := e.timers[id]; timer != nil {
+		timer.Stop()
+		delete(e.timers, id)
+	}
+	e.lock.Unlock()
+
+	e.inner.OnDisconnect(id)
+}
+
+func (e *Events) OnFailure(exited bool, err error) {
+	e.inner.OnFailure(exited, err)
+}
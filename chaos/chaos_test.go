@@ -0,0 +1,120 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// run feeds n messages through chaos events and returns what was passed on.
+func run(config Config, n int) ([]string, Counters) {
+	recorder := websocket.NewRingBufferEvents(nil, n)
+	events := Wrap(recorder, config)
+	for i := 0; i < n; i++ {
+		events.OnReceive(websocket.Message{MessageType: websocket.TextMessage, Data: []byte(fmt.Sprint(i))})
+	}
+	var delivered []string
+	for _, msg := range recorder.Snapshot() {
+		delivered = append(delivered, string(msg.Data))
+	}
+	return delivered, events.Counters()
+}
+
+func TestDropAndDuplicate(t *testing.T) {
+	config := Config{Seed: 42, DropRate: 0.2, DuplicateRate: 0.1}
+	delivered, counters := run(config, 1000)
+
+	if counters.Dropped < 150 || counters.Dropped > 250 ||
+		counters.Duplicated < 50 || counters.Duplicated > 150 {
+		t.Errorf("counters %+v", counters)
+	}
+	if uint64(len(delivered)) != 1000-counters.Dropped+counters.Duplicated {
+		t.Errorf("%d delivered with %+v", len(delivered), counters)
+	}
+
+	// the same seed repeats the faults
+	again, againCounters := run(config, 1000)
+	if !reflect.DeepEqual(again, delivered) || againCounters != counters {
+		t.Error("seed not reproduced")
+	}
+	config.Seed++
+	if other, _ := run(config, 1000); reflect.DeepEqual(other, delivered) {
+		t.Error("other seed with the same faults")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	start := time.Now()
+	delivered, counters := run(Config{Latency: Fixed(5 * time.Millisecond)}, 4)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("delivered in %v", elapsed)
+	}
+	if !reflect.DeepEqual(delivered, []string{"0", "1", "2", "3"}) || counters.Delayed != 4 {
+		t.Errorf("delivered %v with %+v", delivered, counters)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if d := Uniform(time.Millisecond, 2*time.Millisecond)(r); d < time.Millisecond || d >= 2*time.Millisecond {
+			t.Fatalf("uniform %v", d)
+		}
+		if d := Normal(0, time.Second)(r); d < 0 {
+			t.Fatalf("normal %v", d)
+		}
+		if d := Exponential(time.Millisecond)(r); d < 0 {
+			t.Fatalf("exponential %v", d)
+		}
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	events := Wrap(websocket.NewRingBufferEvents(nil, 1), Config{DisconnectAfter: Fixed(time.Millisecond)})
+	disconnected := make(chan int, 1)
+	events.SetDisconnect(func(id int) { disconnected <- id })
+
+	events.OnConnect(7)
+	select {
+	case id := <-disconnected:
+		if id != 7 {
+			t.Errorf("disconnected %d", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not disconnected")
+	}
+	// a connection ending first is not disconnected
+	events.OnConnect(8)
+	events.OnDisconnect(8)
+	time.Sleep(10 * time.Millisecond)
+	if counters := events.Counters(); counters.Disconnected != 1 || len(disconnected) != 0 {
+		t.Errorf("counters %+v", counters)
+	}
+}
@@ -0,0 +1,110 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package codec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/fxamacker/cbor/v2"
+)
+
+var ErrTooLarge = errors.New("message too large")
+
+// CBOROptions limits the messages CBOR decodes, zero values keep the
+// defaults. MaxDepth is the nesting of arrays, maps and tags, MaxElements
+// the length of an array or map.
+type CBOROptions struct {
+	MaxSize     int
+	MaxDepth    int
+	MaxElements int
+}
+
+const (
+	DefaultCBORMaxSize     = 1 << 20
+	DefaultCBORMaxDepth    = 32
+	DefaultCBORMaxElements = 65536
+)
+
+type cborCodec struct {
+	maxSize int
+	encode  cbor.EncMode
+	decode  cbor.DecMode
+}
+
+// CBOR encodes values as CBOR (RFC 8949) in binary messages, with the
+// default limits. Encoding is core deterministic, decoding accepts
+// definite and indefinite length items. Struct fields use the cbor tag, or
+// else the json tag, or else the field name.
+var CBOR Codec
+
+func init() {
+	var err error
+	if CBOR, err = NewCBOR(CBOROptions{}); err != nil {
+		panic(err)
+	}
+}
+
+// NewCBOR returns a CBOR codec with other limits.
+func NewCBOR(opts CBOROptions) (Codec, error) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultCBORMaxSize
+	}
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = DefaultCBORMaxDepth
+	}
+	if opts.MaxElements == 0 {
+		opts.MaxElements = DefaultCBORMaxElements
+	}
+
+	encode, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	decode, err := cbor.DecOptions{
+		MaxNestedLevels:  opts.MaxDepth,
+		MaxArrayElements: opts.MaxElements,
+		MaxMapPairs:      opts.MaxElements,
+		IndefLength:      cbor.IndefLengthAllowed,
+	}.DecMode()
+	if err != nil {
+		return nil, err
+	}
+	return &cborCodec{maxSize: opts.MaxSize, encode: encode, decode: decode}, nil
+}
+
+func (c *cborCodec) Marshal(v any) ([]byte, int, error) {
+	data, err := c.encode.Marshal(v)
+	return data, websocket.BinaryMessage, err
+}
+
+func (c *cborCodec) Unmarshal(data []byte, messageType int, v any) error {
+	if len(data) > c.maxSize {
+		return fmt.Errorf("cbor: %d bytes: %w", len(data), ErrTooLarge)
+	}
+	return c.decode.Unmarshal(data, v)
+}
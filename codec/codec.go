@@ -0,0 +1,279 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package codec
+
+import (
+	"io"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Codec encodes values into message payloads, messageType being the
+// websocket frame type to send them with.
+type Codec interface {
+	Marshal(v any) (data []byte, messageType int, err error)
+	Unmarshal(data []byte, messageType int, v any) error
+}
+
+// StreamCodec is a Codec which also encodes to and decodes from streams.
+// Values are then sent in frames as they are encoded.
+type StreamCodec interface {
+	Codec
+	MessageType() int
+	Encode(w io.Writer, v any) error
+	Decode(r io.Reader, v any) error
+}
+
+// SessionCodec is a Codec with state per connection, like a gob stream.
+// The helpers create a session per connection, so a reconnect starts new
+// streams on both sides. Received messages must then be decoded in order,
+// each exactly once.
+type SessionCodec interface {
+	Codec
+	NewSession() Codec
+}
+
+// session is the state of a SessionCodec for one connection. The lock
+// keeps encoding and sending in order.
+type session struct {
+	codec Codec
+	lock  sync.Mutex
+}
+
+func (s *session) send(v any, send func(msg *websocket.Message) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, messageType, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return send(&websocket.Message{MessageType: messageType, Data: data})
+}
+
+// Client sends values encoded with a codec and decodes received messages.
+// For a SessionCodec it wraps the client's event handler to start a
+// session with each connection.
+type Client struct {
+	ws    *websocket.Client
+	codec Codec
+	inner websocket.Events
+
+	lock    sync.Mutex
+	session *session
+}
+
+func NewClient(ws *websocket.Client, codec Codec) *Client {
+	c := &Client{ws: ws, codec: codec}
+	if sessionCodec, ok := codec.(SessionCodec); ok {
+		c.session = &session{codec: sessionCodec.NewSession()}
+		c.inner = ws.EventHandler()
+		ws.SetEventHandler(c)
+	}
+	return c
+}
+
+func (c *Client) current() *session {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.session
+}
+
+func (c *Client) Send(v any) error {
+	if session := c.current(); session != nil {
+		return session.send(v, func(msg *websocket.Message) error {
+			return c.ws.Send(*msg)
+		})
+	}
+
+	if stream, ok := c.codec.(StreamCodec); ok {
+		w, err := c.ws.NextWriter(stream.MessageType())
+		if err != nil {
+			return err
+		}
+		return encodeTo(w, stream, v)
+	}
+
+	data, messageType, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.ws.Send(websocket.Message{MessageType: messageType, Data: data})
+}
+
+// Decode unmarshals a received message into v.
+func (c *Client) Decode(msg websocket.Message, v any) error {
+	if session := c.current(); session != nil {
+		return session.codec.Unmarshal(msg.Data, msg.MessageType, v)
+	}
+	return c.codec.Unmarshal(msg.Data, msg.MessageType, v)
+}
+
+func (c *Client) OnConnect(id int) {
+	c.lock.Lock()
+	c.session = &session{codec: c.codec.(SessionCodec).NewSession()}
+	c.lock.Unlock()
+
+	c.inner.OnConnect(id)
+}
+
+func (c *Client) OnReceive(msg websocket.Message) {
+	c.inner.OnReceive(msg)
+}
+
+func (c *Client) OnDisconnect(id int) {
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
+
+// Server is the server side of Client, with a session per client for a
+// SessionCodec.
+type Server struct {
+	ws    *websocket.Server
+	codec Codec
+	inner websocket.Events
+
+	lock     sync.Mutex
+	sessions map[int]*session
+}
+
+func NewServer(ws *websocket.Server, codec Codec) *Server {
+	s := &Server{ws: ws, codec: codec}
+	if _, ok := codec.(SessionCodec); ok {
+		s.sessions = make(map[int]*session)
+		s.inner = ws.EventHandler()
+		ws.SetEventHandler(s)
+	}
+	return s
+}
+
+func (s *Server) session(clientId int) (*session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session := s.sessions[clientId]
+	if session == nil {
+		return nil, websocket.ErrNoClient
+	}
+	return session, nil
+}
+
+func (s *Server) Send(clientId int, v any) error {
+	if s.sessions != nil {
+		session, err := s.session(clientId)
+		if err != nil {
+			return err
+		}
+		return session.send(v, func(msg *websocket.Message) error {
+			return s.ws.Send(clientId, msg)
+		})
+	}
+
+	if stream, ok := s.codec.(StreamCodec); ok {
+		w, err := s.ws.NextWriter(clientId, stream.MessageType())
+		if err != nil {
+			return err
+		}
+		return encodeTo(w, stream, v)
+	}
+
+	data, messageType, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.ws.Send(clientId, &websocket.Message{MessageType: messageType, Data: data})
+}
+
+// Broadcast encodes v once and sends it to all clients. With a
+// SessionCodec it is encoded for each client, the first error is returned.
+func (s *Server) Broadcast(v any) error {
+	if s.sessions != nil {
+		var firstErr error
+		for _, client := range s.ws.Clients() {
+			if err := s.Send(client.Id, v); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	data, messageType, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.ws.Broadcast(&websocket.Message{MessageType: messageType, Data: data})
+	return nil
+}
+
+func (s *Server) Decode(msg websocket.Message, v any) error {
+	if s.sessions != nil {
+		session, err := s.session(msg.ClientId)
+		if err != nil {
+			return err
+		}
+		return session.codec.Unmarshal(msg.Data, msg.MessageType, v)
+	}
+	return s.codec.Unmarshal(msg.Data, msg.MessageType, v)
+}
+
+func (s *Server) OnConnect(id int) {
+	s.lock.Lock()
+	s.sessions[id] = &session{codec: s.codec.(SessionCodec).NewSession()}
+	s.lock.Unlock()
+
+	s.inner.OnConnect(id)
+}
+
+func (s *Server) OnDisconnect(id int) {
+	s.inner.OnDisconnect(id)
+
+	s.lock.Lock()
+	delete(s.sessions, id)
+	s.lock.Unlock()
+}
+
+func (s *Server) OnReceive(msg websocket.Message) {
+	s.inner.OnReceive(msg)
+}
+
+func (s *Server) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
+
+// encodeTo encodes v to the message writer w and closes it. A failing
+// encoder leaves a truncated message, which the peer fails to decode.
+func encodeTo(w io.WriteCloser, stream StreamCodec, v any) error {
+	err := stream.Encode(w, v)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
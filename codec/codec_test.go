@@ -0,0 +1,394 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const testUrl = "ws://localhost:33248/codec"
+
+// failure waits for the next envelope error reported to events.
+func failure(t *testing.T, events *websockettest.Recorder) *EnvelopeError {
+	t.Helper()
+	for {
+		var envelopeErr *EnvelopeError
+		if errors.As(events.WaitForFailure(t, time.Second).Err, &envelopeErr) {
+			return envelopeErr
+		}
+	}
+}
+
+func TestProto(t *testing.T) {
+	serverEvents := websockettest.NewRecorder()
+	ws := websocket.NewServer(testUrl, serverEvents)
+	server := NewProtoServer(ws)
+	server.Register(&wrapperspb.StringValue{})
+	serverReceived := make(chan proto.Message, 4)
+	server.OnMessage(func(clientId int, m proto.Message) { serverReceived <- m })
+	go func() { _ = ws.ListenAndServe() }()
+	defer ws.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	events := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, events)
+	client := NewProtoClient(wsClient)
+	client.Register(&wrapperspb.StringValue{})
+	clientReceived := make(chan proto.Message, 4)
+	client.OnMessage(func(m proto.Message) { clientReceived <- m })
+	go func() { _ = wsClient.ConnectAndServe(testUrl, nil) }()
+	defer wsClient.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	if err := client.Send(wrapperspb.String("hi")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-serverReceived:
+		if m.(*wrapperspb.StringValue).GetValue() != "hi" {
+			t.Errorf("got %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server received nothing")
+	}
+
+	if err := server.Broadcast(wrapperspb.String("all")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-clientReceived:
+		if m.(*wrapperspb.StringValue).GetValue() != "all" {
+			t.Errorf("got %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client received nothing")
+	}
+
+	// unknown types and broken envelopes are reported with the envelope
+	_ = client.Send(wrapperspb.Int64(7))
+	envelopeErr := failure(t, serverEvents)
+	if !errors.Is(envelopeErr, ErrUnknownType) ||
+		!strings.HasSuffix(envelopeErr.TypeURL, "google.protobuf.Int64Value") ||
+		len(envelopeErr.Envelope) == 0 {
+		t.Errorf("unexpected error %+v", envelopeErr)
+	}
+	garbage := []byte{0xff, 0xff, 0xff}
+	_ = wsClient.Send(websocket.Message{MessageType: websocket.BinaryMessage, Data: garbage})
+	envelopeErr = failure(t, serverEvents)
+	if envelopeErr.TypeURL != "" || string(envelopeErr.Envelope) != string(garbage) {
+		t.Errorf("unexpected error %+v", envelopeErr)
+	}
+
+	// text messages are passed on
+	_ = wsClient.SendTxt([]byte("plain"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "plain" {
+		t.Errorf("got %q", msg.Data)
+	}
+	select {
+	case m := <-serverReceived:
+		t.Errorf("unexpected %v", m)
+	default:
+	}
+}
+
+type telemetry struct {
+	Id     int       `json:"id"`
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+	Ok     bool      `json:"ok"`
+}
+
+// msgpackFixture is {"id": 1, "name": "sensor", "values": [1.5, 2.5],
+// "ok": true} assembled from the MessagePack specification, the way other
+// implementations pack it.
+var msgpackFixture = []byte{
+	0x84,           // fixmap, 4 entries
+	0xa2, 'i', 'd', // fixstr "id"
+	0x01,                     // positive fixint 1
+	0xa4, 'n', 'a', 'm', 'e', // fixstr "name"
+	0xa6, 's', 'e', 'n', 's', 'o', 'r', // fixstr "sensor"
+	0xa6, 'v', 'a', 'l', 'u', 'e', 's', // fixstr "values"
+	0x92,                                                 // fixarray, 2 items
+	0xcb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // float 64 1.5
+	0xcb, 0x40, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // float 64 2.5
+	0xa2, 'o', 'k', // fixstr "ok"
+	0xc3, // true
+}
+
+func TestMsgpack(t *testing.T) {
+	want := telemetry{Id: 1, Name: "sensor", Values: []float64{1.5, 2.5}, Ok: true}
+
+	var decoded telemetry
+	if err := Msgpack.Unmarshal(msgpackFixture, websocket.BinaryMessage, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %+v", decoded)
+	}
+	data, messageType, err := Msgpack.Marshal(want)
+	if err != nil || messageType != websocket.BinaryMessage {
+		t.Fatal(messageType, err)
+	}
+	if !bytes.Equal(data, msgpackFixture) {
+		t.Errorf("encoded % x\nwant    % x", data, msgpackFixture)
+	}
+
+	serverEvents := websockettest.NewRecorder()
+	ws := websocket.NewServer("ws://localhost:33249/msgpack", serverEvents)
+	server := NewServer(ws, Msgpack)
+	go func() { _ = ws.ListenAndServe() }()
+	defer ws.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	events := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, events)
+	client := NewClient(wsClient, Msgpack)
+	go func() { _ = wsClient.ConnectAndServe("ws://localhost:33249/msgpack", nil) }()
+	defer wsClient.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	if err = client.Send(want); err != nil {
+		t.Fatal(err)
+	}
+	msg := serverEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.BinaryMessage || !bytes.Equal(msg.Data, msgpackFixture) {
+		t.Errorf("received %d % x", msg.MessageType, msg.Data)
+	}
+
+	// large values are streamed in frames
+	large := telemetry{Name: "large", Values: make([]float64, 100000)}
+	if err = server.Send(msg.ClientId, large); err != nil {
+		t.Fatal(err)
+	}
+	decoded = telemetry{}
+	if err = client.Decode(events.WaitForMessage(t, time.Second), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != "large" || len(decoded.Values) != 100000 {
+		t.Errorf("decoded %s with %d values", decoded.Name, len(decoded.Values))
+	}
+
+	if err = server.Broadcast(want); err != nil {
+		t.Fatal(err)
+	}
+	decoded = telemetry{}
+	if err = client.Decode(events.WaitForMessage(t, time.Second), &decoded); err != nil ||
+		!reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+}
+
+func TestGob(t *testing.T) {
+	want := telemetry{Id: 1, Name: "sensor", Values: []float64{1.5, 2.5}, Ok: true}
+
+	// the type definition is only sent with the first value of a stream
+	sender := Gob.NewSession()
+	first, _, err := sender.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := sender.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) >= len(first) {
+		t.Errorf("second message %d bytes, first %d", len(second), len(first))
+	}
+	var decoded telemetry
+	if err = Gob.Unmarshal(second, websocket.BinaryMessage, &decoded); err == nil {
+		t.Error("decoded a message without type definition")
+	}
+	receiver := Gob.NewSession()
+	for _, data := range [][]byte{first, second} {
+		decoded = telemetry{}
+		if err = receiver.Unmarshal(data, websocket.BinaryMessage, &decoded); err != nil ||
+			!reflect.DeepEqual(decoded, want) {
+			t.Errorf("decoded %+v, %v", decoded, err)
+		}
+	}
+
+	serverEvents := websockettest.NewRecorder()
+	ws := websocket.NewServer("ws://localhost:33250/gob", serverEvents)
+	server := NewServer(ws, Gob)
+	go func() { _ = ws.ListenAndServe() }()
+	defer ws.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	events := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, events)
+	backoff := utils.NewBackoff()
+	backoff.Initial = 50 * time.Millisecond
+	wsClient.SetReconnect(backoff, 0)
+	client := NewClient(wsClient, Gob)
+	go func() { _ = wsClient.ConnectAndServe("ws://localhost:33250/gob", nil) }()
+	defer wsClient.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	exchange := func() int {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if err := client.Send(want); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var clientId int
+		for i := 0; i < 2; i++ {
+			msg := serverEvents.WaitForMessage(t, time.Second)
+			clientId = msg.ClientId
+			decoded := telemetry{}
+			if err := server.Decode(msg, &decoded); err != nil || !reflect.DeepEqual(decoded, want) {
+				t.Errorf("server decoded %+v, %v", decoded, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if err := server.Send(clientId, want); err != nil {
+				t.Fatal(err)
+			}
+			decoded := telemetry{}
+			if err := client.Decode(events.WaitForMessage(t, time.Second), &decoded); err != nil ||
+				!reflect.DeepEqual(decoded, want) {
+				t.Errorf("client decoded %+v, %v", decoded, err)
+			}
+		}
+		return clientId
+	}
+	clientId := exchange()
+
+	// both sides start new streams after a reconnect
+	if err = ws.Disconnect(clientId); err != nil {
+		t.Fatal(err)
+	}
+	events.WaitForDisconnect(t, time.Second)
+	events.WaitForConnect(t, 2*time.Second)
+	if exchange() == clientId {
+		t.Error("reconnected with the same client id")
+	}
+	if err = server.Send(clientId, want); !errors.Is(err, websocket.ErrNoClient) {
+		t.Errorf("send to the old client: %v", err)
+	}
+
+	if err = server.Broadcast(want); err != nil {
+		t.Fatal(err)
+	}
+	decoded = telemetry{}
+	if err = client.Decode(events.WaitForMessage(t, time.Second), &decoded); err != nil ||
+		!reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+}
+
+// cborFixture is telemetry{Id: 1, Name: "sensor", Values: {1.5, 2.5}, Ok:
+// true} in core deterministic encoding, see RFC 8949 section 4.2.1.
+var cborFixture = []byte{
+	0xa4,                 // map, 4 pairs, keys sorted by their encoding
+	0x62, 'i', 'd', 0x01, // "id": 1
+	0x62, 'o', 'k', 0xf5, // "ok": true
+	0x64, 'n', 'a', 'm', 'e', // "name"
+	0x66, 's', 'e', 'n', 's', 'o', 'r', // "sensor"
+	0x66, 'v', 'a', 'l', 'u', 'e', 's', // "values"
+	0x82,             // array, 2 items
+	0xf9, 0x3e, 0x00, // float 16 1.5
+	0xf9, 0x41, 0x00, // float 16 2.5
+}
+
+func TestCBOR(t *testing.T) {
+	want := telemetry{Id: 1, Name: "sensor", Values: []float64{1.5, 2.5}, Ok: true}
+
+	data, messageType, err := CBOR.Marshal(want)
+	if err != nil || messageType != websocket.BinaryMessage {
+		t.Fatal(messageType, err)
+	}
+	if !bytes.Equal(data, cborFixture) {
+		t.Errorf("encoded % x\nwant    % x", data, cborFixture)
+	}
+	var decoded telemetry
+	if err = CBOR.Unmarshal(cborFixture, websocket.BinaryMessage, &decoded); err != nil ||
+		!reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %+v, %v", decoded, err)
+	}
+
+	// examples of RFC 8949 appendix A
+	for _, test := range []struct {
+		data []byte
+		want any
+	}{
+		{[]byte{0x19, 0x03, 0xe8}, uint64(1000)},
+		{[]byte{0xf9, 0x3e, 0x00}, 1.5},
+		{[]byte{0x63, 0xe6, 0xb0, 0xb4}, "水"},
+		{[]byte{0x83, 0x01, 0x82, 0x02, 0x03, 0x82, 0x04, 0x05},
+			[]any{uint64(1), []any{uint64(2), uint64(3)}, []any{uint64(4), uint64(5)}}},
+		// indefinite length
+		{[]byte{0x5f, 0x42, 0x01, 0x02, 0x43, 0x03, 0x04, 0x05, 0xff},
+			[]byte{1, 2, 3, 4, 5}},
+		{[]byte{0x7f, 0x65, 's', 't', 'r', 'e', 'a', 0x64, 'm', 'i', 'n', 'g', 0xff},
+			"streaming"},
+		{[]byte{0x9f, 0x01, 0x82, 0x02, 0x03, 0x9f, 0x04, 0x05, 0xff, 0xff},
+			[]any{uint64(1), []any{uint64(2), uint64(3)}, []any{uint64(4), uint64(5)}}},
+		{[]byte{0xbf, 0x61, 'a', 0x01, 0x61, 'b', 0x9f, 0x02, 0x03, 0xff, 0xff},
+			map[any]any{"a": uint64(1), "b": []any{uint64(2), uint64(3)}}},
+	} {
+		var v any
+		if err = CBOR.Unmarshal(test.data, websocket.BinaryMessage, &v); err != nil ||
+			!reflect.DeepEqual(v, test.want) {
+			t.Errorf("% x decoded %#v, %v", test.data, v, err)
+		}
+	}
+
+	limited, err := NewCBOR(CBOROptions{MaxSize: 64, MaxDepth: 4, MaxElements: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v any
+	if err = limited.Unmarshal(make([]byte, 65), websocket.BinaryMessage, &v); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("oversized: %v", err)
+	}
+	nested := append(bytes.Repeat([]byte{0x81}, 5), 0x01)
+	if err = limited.Unmarshal(nested, websocket.BinaryMessage, &v); err == nil {
+		t.Error("decoded 5 nested arrays")
+	}
+	if err = limited.Unmarshal(nested[1:], websocket.BinaryMessage, &v); err != nil {
+		t.Errorf("4 nested arrays: %v", err)
+	}
+	// a small indefinite length array may not nest deeper either
+	indefinite := append(bytes.Repeat([]byte{0x9f}, 5), 0x01, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if err = limited.Unmarshal(indefinite, websocket.BinaryMessage, &v); err == nil {
+		t.Error("decoded 5 nested indefinite arrays")
+	}
+	if err = limited.Unmarshal(append([]byte{0x91}, make([]byte, 17)...), websocket.BinaryMessage, &v); err == nil {
+		t.Error("decoded an array of 17 elements")
+	}
+}
@@ -0,0 +1,97 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+type gobCodec struct{}
+
+// Gob encodes values with encoding/gob in binary messages. A gob stream
+// sends the definition of a type only with its first value, so the helpers
+// keep an encoder and decoder per connection, see SessionCodec. Marshal
+// and Unmarshal of Gob itself are self-contained, each message carries
+// its type definitions. Concrete types sent as interface values must be
+// registered with gob.Register.
+var Gob SessionCodec = gobCodec{}
+
+func (gobCodec) Marshal(v any) ([]byte, int, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), websocket.BinaryMessage, nil
+}
+
+func (gobCodec) Unmarshal(data []byte, messageType int, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) NewSession() Codec {
+	s := &gobSession{}
+	s.encoder = gob.NewEncoder(&s.encoded)
+	s.decoder = gob.NewDecoder(&s.received)
+	return s
+}
+
+// gobSession is one gob stream in each direction. Each message holds what
+// the encoder wrote for one value.
+type gobSession struct {
+	encodeLock sync.Mutex
+	encoded    bytes.Buffer
+	encoder    *gob.Encoder
+
+	decodeLock sync.Mutex
+	received   bytes.Buffer
+	decoder    *gob.Decoder
+}
+
+func (s *gobSession) Marshal(v any) ([]byte, int, error) {
+	s.encodeLock.Lock()
+	defer s.encodeLock.Unlock()
+
+	err := s.encoder.Encode(v)
+	data := append([]byte(nil), s.encoded.Bytes()...)
+	s.encoded.Reset()
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, websocket.BinaryMessage, nil
+}
+
+// Unmarshal decodes the next value of the stream, a nil v skips it.
+func (s *gobSession) Unmarshal(data []byte, messageType int, v any) error {
+	s.decodeLock.Lock()
+	defer s.decodeLock.Unlock()
+
+	s.received.Write(data)
+	return s.decoder.Decode(v)
+}
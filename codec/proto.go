@@ -0,0 +1,286 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package codec sends and receives typed messages. Protobuf messages are
+// wrapped in an envelope naming their type (google.protobuf.Any) and sent
+// as binary messages.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+var ErrUnknownType = errors.New("unknown message type")
+
+// EnvelopeError is reported by OnFailure for a received message which
+// could not be decoded. Envelope holds the message as received.
+type EnvelopeError struct {
+	ClientId int
+	TypeURL  string
+	Envelope []byte
+	Err      error
+}
+
+func (e *EnvelopeError) Error() string {
+	if e.TypeURL == "" {
+		return fmt.Sprintf("decode envelope: %v", e.Err)
+	}
+	return fmt.Sprintf("decode %s: %v", e.TypeURL, e.Err)
+}
+
+func (e *EnvelopeError) Unwrap() error {
+	return e.Err
+}
+
+// protoRegistry maps the full names of the registered types to them.
+type protoRegistry struct {
+	lock  sync.RWMutex
+	types map[protoreflect.FullName]protoreflect.MessageType
+}
+
+func newProtoRegistry() *protoRegistry {
+	return &protoRegistry{types: make(map[protoreflect.FullName]protoreflect.MessageType)}
+}
+
+func (r *protoRegistry) register(messages []proto.Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range messages {
+		messageType := m.ProtoReflect().Type()
+		r.types[messageType.Descriptor().FullName()] = messageType
+	}
+}
+
+func (r *protoRegistry) decode(msg websocket.Message) (proto.Message, error) {
+	envelope := &anypb.Any{}
+	if err := proto.Unmarshal(msg.Data, envelope); err != nil {
+		return nil, &EnvelopeError{ClientId: msg.ClientId, Envelope: msg.Data, Err: err}
+	}
+
+	// the type url ends with the full name of the type
+	name := envelope.TypeUrl[strings.LastIndex(envelope.TypeUrl, "/")+1:]
+	r.lock.RLock()
+	messageType, ok := r.types[protoreflect.FullName(name)]
+	r.lock.RUnlock()
+
+	fail := func(err error) (proto.Message, error) {
+		return nil, &EnvelopeError{
+			ClientId: msg.ClientId,
+			TypeURL:  envelope.TypeUrl,
+			Envelope: msg.Data,
+			Err:      err,
+		}
+	}
+	if !ok {
+		return fail(ErrUnknownType)
+	}
+	m := messageType.New().Interface()
+	if err := proto.Unmarshal(envelope.Value, m); err != nil {
+		return fail(err)
+	}
+	return m, nil
+}
+
+func encodeProto(m proto.Message) (*websocket.Message, error) {
+	envelope, err := anypb.New(m)
+	if err != nil {
+		return nil, err
+	}
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return &websocket.Message{MessageType: websocket.BinaryMessage, Data: data}, nil
+}
+
+// ProtoClient sends and receives protobuf messages over a client. It wraps
+// the client's event handler: binary messages are decoded, text messages
+// and all events are passed on.
+type ProtoClient struct {
+	inner    websocket.Events
+	ws       *websocket.Client
+	registry *protoRegistry
+
+	lock      sync.Mutex
+	onMessage func(m proto.Message)
+}
+
+// NewProtoClient installs the codec on ws. Create it before connecting.
+func NewProtoClient(ws *websocket.Client) *ProtoClient {
+	c := &ProtoClient{
+		inner:    ws.EventHandler(),
+		ws:       ws,
+		registry: newProtoRegistry(),
+	}
+	ws.SetEventHandler(c)
+	return c
+}
+
+// Register adds the types of messages to the ones decoded, other types are
+// reported as ErrUnknownType.
+func (c *ProtoClient) Register(messages ...proto.Message) {
+	c.registry.register(messages)
+}
+
+// OnMessage sets the hook receiving the decoded messages.
+func (c *ProtoClient) OnMessage(fn func(m proto.Message)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.onMessage = fn
+}
+
+func (c *ProtoClient) Send(m proto.Message) error {
+	msg, err := encodeProto(m)
+	if err != nil {
+		return err
+	}
+	return c.ws.Send(*msg)
+}
+
+func (c *ProtoClient) OnReceive(msg websocket.Message) {
+	if msg.MessageType != websocket.BinaryMessage {
+		c.inner.OnReceive(msg)
+		return
+	}
+
+	m, err := c.registry.decode(msg)
+	if err != nil {
+		c.inner.OnFailure(false, err)
+		return
+	}
+
+	c.lock.Lock()
+	fn := c.onMessage
+	c.lock.Unlock()
+	if fn != nil {
+		fn(m)
+	}
+}
+
+func (c *ProtoClient) OnConnect(id int) {
+	c.inner.OnConnect(id)
+}
+
+func (c *ProtoClient) OnDisconnect(id int) {
+	c.inner.OnDisconnect(id)
+}
+
+func (c *ProtoClient) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
+
+// ProtoServer is the server side of ProtoClient.
+type ProtoServer struct {
+	inner    websocket.Events
+	ws       *websocket.Server
+	registry *protoRegistry
+
+	lock      sync.Mutex
+	onMessage func(clientId int, m proto.Message)
+}
+
+// NewProtoServer installs the codec on ws. Create it before
+// ListenAndServe.
+func NewProtoServer(ws *websocket.Server) *ProtoServer {
+	s := &ProtoServer{
+		inner:    ws.EventHandler(),
+		ws:       ws,
+		registry: newProtoRegistry(),
+	}
+	ws.SetEventHandler(s)
+	return s
+}
+
+func (s *ProtoServer) Register(messages ...proto.Message) {
+	s.registry.register(messages)
+}
+
+// OnMessage sets the hook receiving the decoded messages with the id of
+// the sending client.
+func (s *ProtoServer) OnMessage(fn func(clientId int, m proto.Message)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onMessage = fn
+}
+
+func (s *ProtoServer) Send(clientId int, m proto.Message) error {
+	msg, err := encodeProto(m)
+	if err != nil {
+		return err
+	}
+	return s.ws.Send(clientId, msg)
+}
+
+func (s *ProtoServer) Broadcast(m proto.Message) error {
+	msg, err := encodeProto(m)
+	if err != nil {
+		return err
+	}
+	s.ws.Broadcast(msg)
+	return nil
+}
+
+func (s *ProtoServer) OnReceive(msg websocket.Message) {
+	if msg.MessageType != websocket.BinaryMessage {
+		s.inner.OnReceive(msg)
+		return
+	}
+
+	m, err := s.registry.decode(msg)
+	if err != nil {
+		s.inner.OnFailure(false, err)
+		return
+	}
+
+	s.lock.Lock()
+	fn := s.onMessage
+	s.lock.Unlock()
+	if fn != nil {
+		fn(msg.ClientId, m)
+	}
+}
+
+func (s *ProtoServer) OnConnect(id int) {
+	s.inner.OnConnect(id)
+}
+
+func (s *ProtoServer) OnDisconnect(id int) {
+	s.inner.OnDisconnect(id)
+}
+
+func (s *ProtoServer) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
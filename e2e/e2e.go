@@ -0,0 +1,133 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package e2e encrypts message payloads end to end, so they stay secret
+// also where TLS is terminated on the way. Each payload is sealed with a
+// random nonce sent in front of the ciphertext, received payloads are
+// authenticated before they are delivered.
+package e2e
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const nonceSize = 24
+
+var ErrDecrypt = errors.New("decryption failed")
+
+// DecryptError reports a received message which could not be decrypted.
+// It is not delivered.
+type DecryptError struct {
+	ClientId int
+	Err      error
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("message from %d: %v", e.ClientId, e.Err)
+}
+
+func (e *DecryptError) Unwrap() []error {
+	return []error{ErrDecrypt, e.Err}
+}
+
+// Cipher seals and opens message payloads. The message type is sealed
+// with the payload, the sealed message is binary.
+type Cipher interface {
+	Seal(msg websocket.Message) (websocket.Message, error)
+	Open(msg websocket.Message) (websocket.Message, error)
+}
+
+// sealFunc encrypts plain with nonce and appends it to out.
+type sealFunc func(out, plain []byte, nonce *[nonceSize]byte) []byte
+
+type openFunc func(out, sealed []byte, nonce *[nonceSize]byte) ([]byte, bool)
+
+type naclCipher struct {
+	seal sealFunc
+	open openFunc
+}
+
+// NewSecretBox encrypts with a key shared by both ends.
+func NewSecretBox(key [32]byte) Cipher {
+	return &naclCipher{
+		seal: func(out, plain []byte, nonce *[nonceSize]byte) []byte {
+			return secretbox.Seal(out, plain, nonce, &key)
+		},
+		open: func(out, sealed []byte, nonce *[nonceSize]byte) ([]byte, bool) {
+			return secretbox.Open(out, sealed, nonce, &key)
+		},
+	}
+}
+
+// NewBox encrypts between our key pair and the peer's one, keys as
+// generated by box.GenerateKey.
+func NewBox(ourPriv, theirPub [32]byte) Cipher {
+	var shared [32]byte
+	box.Precompute(&shared, &theirPub, &ourPriv)
+	return &naclCipher{
+		seal: func(out, plain []byte, nonce *[nonceSize]byte) []byte {
+			return box.SealAfterPrecomputation(out, plain, nonce, &shared)
+		},
+		open: func(out, sealed []byte, nonce *[nonceSize]byte) ([]byte, bool) {
+			return box.OpenAfterPrecomputation(out, sealed, nonce, &shared)
+		},
+	}
+}
+
+func (c *naclCipher) Seal(msg websocket.Message) (websocket.Message, error) {
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return msg, err
+	}
+	plain := make([]byte, 1+len(msg.Data))
+	plain[0] = byte(msg.MessageType)
+	copy(plain[1:], msg.Data)
+
+	msg.Data = c.seal(nonce[:], plain, &nonce)
+	msg.MessageType = websocket.BinaryMessage
+	return msg, nil
+}
+
+func (c *naclCipher) Open(msg websocket.Message) (websocket.Message, error) {
+	if len(msg.Data) < nonceSize {
+		return msg, ErrDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], msg.Data)
+	plain, ok := c.open(nil, msg.Data[nonceSize:], &nonce)
+	if !ok || len(plain) == 0 {
+		return msg, ErrDecrypt
+	}
+	msg.MessageType = int(plain[0])
+	msg.Data = plain[1:]
+	return msg, nil
+}
@@ -0,0 +1,148 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package e2e
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// failures waits for the next n failures, messages of different
+// connections arrive in any order.
+func failures(t *testing.T, r *websockettest.Recorder, n int) (errs []error) {
+	t.Helper()
+	for len(errs) < n {
+		errs = append(errs, r.WaitForFailure(t, time.Second).Err)
+	}
+	return errs
+}
+
+func testCiphers(t *testing.T, serverCipher, clientCipher, wrongCipher Cipher) {
+	serverEvents := websockettest.NewRecorder()
+	ws := websockettest.NewServer(serverEvents)
+	defer ws.Close()
+	server := NewServer(ws.Server, serverCipher)
+
+	clientEvents := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, clientEvents)
+	client := NewClient(wsClient, clientCipher)
+	clientId := ws.Connect(t, wsClient)
+	defer wsClient.Disconnect()
+
+	// eavesdrops on the broadcast and sends unencrypted
+	rawEvents := websockettest.NewRecorder()
+	raw := ws.NewClient(t, rawEvents)
+	defer raw.Disconnect()
+
+	wrongEvents := websockettest.NewRecorder()
+	wrongWs := websocket.NewClient(false, wrongEvents)
+	wrong := NewClient(wrongWs, wrongCipher)
+	ws.Connect(t, wrongWs)
+	defer wrongWs.Disconnect()
+
+	secret := []byte("attack at dawn")
+	if err := client.SendTxt(secret); err != nil {
+		t.Fatal(err)
+	}
+	msg := serverEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.TextMessage || !bytes.Equal(msg.Data, secret) ||
+		msg.ClientId != clientId {
+
+		t.Errorf("server received %+v", msg)
+	}
+
+	if err := server.Send(clientId, &websocket.Message{
+		MessageType: websocket.BinaryMessage, Data: secret}); err != nil {
+		t.Fatal(err)
+	}
+	msg = clientEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.BinaryMessage || !bytes.Equal(msg.Data, secret) {
+		t.Errorf("client received %+v", msg)
+	}
+
+	if err := server.Broadcast(&websocket.Message{
+		MessageType: websocket.TextMessage, Data: secret}); err != nil {
+		t.Fatal(err)
+	}
+	if msg = clientEvents.WaitForMessage(t, time.Second); !bytes.Equal(msg.Data, secret) {
+		t.Errorf("client received %q", msg.Data)
+	}
+	msg = rawEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.BinaryMessage || bytes.Contains(msg.Data, secret) {
+		t.Errorf("sent in plain: %+v", msg)
+	}
+	sealed := msg
+
+	// the wrong key and plain payloads fail without delivering anything
+	if errs := failures(t, wrongEvents, 1); len(errs) != 1 || !errors.Is(errs[0], ErrDecrypt) {
+		t.Errorf("wrong key failures: %v", errs)
+	}
+	if n := len(wrongEvents.Messages()); n != 0 {
+		t.Errorf("delivered %d messages with the wrong key", n)
+	}
+
+	_ = raw.SendTxt(secret)
+	tampered := append([]byte{}, sealed.Data...)
+	tampered[len(tampered)-1] ^= 1
+	_ = raw.Send(websocket.Message{MessageType: websocket.BinaryMessage, Data: tampered})
+	_ = raw.Send(websocket.Message{MessageType: websocket.BinaryMessage, Data: []byte("short")})
+	_ = wrong.SendTxt(secret)
+	errs := failures(t, serverEvents, 4)
+	if len(errs) != 4 {
+		t.Fatalf("server failures: %v", errs)
+	}
+	if n := len(serverEvents.Messages()); n != 1 {
+		t.Errorf("server delivered %d messages", n)
+	}
+	for _, err := range errs {
+		var decryptErr *DecryptError
+		if !errors.As(err, &decryptErr) || decryptErr.ClientId == clientId {
+			t.Errorf("unexpected failure %v", err)
+		}
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	var key, other [32]byte
+	_, _ = rand.Read(key[:])
+	_, _ = rand.Read(other[:])
+	testCiphers(t, NewSecretBox(key), NewSecretBox(key), NewSecretBox(other))
+}
+
+func TestBox(t *testing.T) {
+	serverPub, serverPriv, _ := box.GenerateKey(rand.Reader)
+	clientPub, clientPriv, _ := box.GenerateKey(rand.Reader)
+	_, otherPriv, _ := box.GenerateKey(rand.Reader)
+	testCiphers(t, NewBox(*serverPriv, *clientPub), NewBox(*clientPriv, *serverPub),
+		NewBox(*otherPriv, *serverPub))
+}
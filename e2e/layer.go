@@ -0,0 +1,123 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package e2e
+
+import (
+	"context"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// events decrypts received messages for the wrapped handler and reports
+// the ones failing as DecryptError.
+type events struct {
+	inner  websocket.Events
+	cipher Cipher
+}
+
+func (e *events) OnReceive(msg websocket.Message) {
+	e.OnReceiveCtx(context.Background(), msg)
+}
+
+func (e *events) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	plain, err := e.cipher.Open(msg)
+	if err != nil {
+		e.inner.OnFailure(false, &DecryptError{ClientId: msg.ClientId, Err: err})
+		return
+	}
+	if ctxInner, ok := e.inner.(websocket.CtxEvents); ok {
+		ctxInner.OnReceiveCtx(ctx, plain)
+		return
+	}
+	e.inner.OnReceive(plain)
+}
+
+func (e *events) OnConnect(id int) {
+	e.inner.OnConnect(id)
+}
+
+func (e *events) OnDisconnect(id int) {
+	e.inner.OnDisconnect(id)
+}
+
+func (e *events) OnFailure(exited bool, err error) {
+	e.inner.OnFailure(exited, err)
+}
+
+// Client encrypts what it sends and decrypts what the client's event
+// handler receives.
+type Client struct {
+	ws     *websocket.Client
+	cipher Cipher
+}
+
+func NewClient(ws *websocket.Client, cipher Cipher) *Client {
+	ws.SetEventHandler(&events{inner: ws.EventHandler(), cipher: cipher})
+	return &Client{ws: ws, cipher: cipher}
+}
+
+func (c *Client) Send(msg websocket.Message) error {
+	sealed, err := c.cipher.Seal(msg)
+	if err != nil {
+		return err
+	}
+	return c.ws.Send(sealed)
+}
+
+func (c *Client) SendTxt(message []byte) error {
+	return c.Send(websocket.Message{MessageType: websocket.TextMessage, Data: message})
+}
+
+// Server encrypts what it sends and decrypts what the server's event
+// handler receives, with the same cipher for all clients. Create it
+// before ListenAndServe.
+type Server struct {
+	ws     *websocket.Server
+	cipher Cipher
+}
+
+func NewServer(ws *websocket.Server, cipher Cipher) *Server {
+	ws.SetEventHandler(&events{inner: ws.EventHandler(), cipher: cipher})
+	return &Server{ws: ws, cipher: cipher}
+}
+
+func (s *Server) Send(clientId int, msg *websocket.Message) error {
+	sealed, err := s.cipher.Seal(*msg)
+	if err != nil {
+		return err
+	}
+	return s.ws.Send(clientId, &sealed)
+}
+
+// Broadcast sends one sealed message to all clients.
+func (s *Server) Broadcast(msg *websocket.Message) error {
+	sealed, err := s.cipher.Seal(*msg)
+	if err != nil {
+		return err
+	}
+	s.ws.Broadcast(&sealed)
+	return nil
+}
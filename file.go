@@ -0,0 +1,82 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const defaultMaxFileSize = 16 * 1024 * 1024
+
+// readFileMessage reads a whole file as one message. The message type is
+// binary if forced or if the content is not valid utf-8 or contains NUL.
+func readFileMessage(path string, forceBinary bool,
+	maxSize int64) (msg websocket.Message, err error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		return msg, fmt.Errorf("%s is a directory", path)
+	}
+	if maxSize > 0 && info.Size() > maxSize {
+		return msg, fmt.Errorf("file %s has %d bytes, exceeds limit of %d bytes",
+			path, info.Size(), maxSize)
+	}
+
+	msg.Data, err = os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	msg.MessageType = websocket.TextMessage
+	if forceBinary || !utf8.Valid(msg.Data) || bytes.IndexByte(msg.Data, 0) >= 0 {
+		msg.MessageType = websocket.BinaryMessage
+	}
+
+	return
+}
+
+func sendFile(client *websocket.Client, out *printer, path string,
+	forceBinary bool, maxSize int64) error {
+
+	msg, err := readFileMessage(path, forceBinary, maxSize)
+	if err != nil {
+		return err
+	}
+	if err = client.Send(msg); err != nil {
+		return err
+	}
+
+	out.Printf(markerTx, "sent %d bytes from %s", len(msg.Data), path)
+	return nil
+}
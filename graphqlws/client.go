@@ -0,0 +1,313 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Client runs subscriptions over a websocket client. It wraps the
+// client's event handler: protocol messages are consumed, every other
+// message and all events are passed on. After a reconnect it initializes
+// the connection again, the subscriptions end with the connection.
+type Client struct {
+	inner websocket.Events
+	ws    *websocket.Client
+
+	lock       sync.Mutex
+	ackTimeout time.Duration
+	init       json.RawMessage
+	initiated  bool
+	connection int
+	acked      bool
+	ack        chan struct{}
+	failed     chan error
+	nextId     uint64
+	subs       map[string]chan json.RawMessage
+}
+
+// NewClient installs the protocol on ws and offers its subprotocol.
+func NewClient(ws *websocket.Client) *Client {
+	c := &Client{
+		inner:      ws.EventHandler(),
+		ws:         ws,
+		ackTimeout: DefaultAckTimeout,
+		ack:        make(chan struct{}),
+		failed:     make(chan error, 1),
+		subs:       make(map[string]chan json.RawMessage),
+	}
+	ws.SetSubprotocols(Subprotocol)
+	ws.SetEventHandler(c)
+	return c
+}
+
+// SetAckTimeout sets how long to wait for connection_ack after
+// connection_init, the connection is closed then.
+func (c *Client) SetAckTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ackTimeout = timeout
+}
+
+// Connect connects to url and sends initPayload with connection_init. It
+// returns once the server acknowledged, the websocket client keeps serving
+// the connection in the background until Close.
+func (c *Client) Connect(ctx context.Context, url string, initPayload any) error {
+	init, err := marshalPayload(initPayload)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.init = init
+	c.initiated = true
+	ack := c.ack
+	c.lock.Unlock()
+	select {
+	case <-c.failed:
+	default:
+	}
+
+	go func() {
+		if err := c.ws.ConnectAndServe(url, nil); err != nil {
+			c.fail(err)
+		}
+	}()
+
+	select {
+	case <-ack:
+		return nil
+	case err = <-c.failed:
+		return err
+	case <-ctx.Done():
+		_ = c.ws.Disconnect()
+		return ctx.Err()
+	}
+}
+
+// Close ends the connection and its subscriptions.
+func (c *Client) Close() error {
+	return c.ws.Disconnect()
+}
+
+func (c *Client) fail(err error) {
+	select {
+	case c.failed <- err:
+	default:
+	}
+}
+
+// Subscribe starts an operation. Its results are delivered on the
+// returned channel, which is closed when the server completes the
+// operation or ctx is done. An error of the server is delivered as result
+// with errors before.
+func (c *Client) Subscribe(ctx context.Context, query string,
+	vars map[string]any) (<-chan json.RawMessage, error) {
+
+	payload, err := json.Marshal(SubscribePayload{Query: query, Variables: vars})
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if !c.acked {
+		c.lock.Unlock()
+		return nil, ErrNotAcknowledged
+	}
+	c.nextId++
+	id := strconv.FormatUint(c.nextId, 10)
+	// one more for the last result, see finish
+	results := make(chan json.RawMessage, ResultBuffer+1)
+	c.subs[id] = results
+	c.lock.Unlock()
+
+	if err = c.send(message{Id: id, Type: typeSubscribe, Payload: payload}); err != nil {
+		c.end(id)
+		return nil, err
+	}
+
+	go func() {
+		<-ctx.Done()
+		if c.end(id) {
+			_ = c.send(message{Id: id, Type: typeComplete})
+		}
+	}()
+	return results, nil
+}
+
+// end closes the results of a subscription and reports whether it was
+// still running.
+func (c *Client) end(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	results, ok := c.subs[id]
+	if ok {
+		delete(c.subs, id)
+		close(results)
+	}
+	return ok
+}
+
+// deliver passes a result of a subscription on. One finding the buffer
+// full completes the operation with an overflow error instead.
+func (c *Client) deliver(id string, result json.RawMessage) {
+	c.lock.Lock()
+	results, ok := c.subs[id]
+	full := ok && len(results) >= ResultBuffer
+	if ok && !full {
+		results <- result
+	}
+	c.lock.Unlock()
+	if !full {
+		return
+	}
+
+	if c.finish(id, errorResult([]GraphQLError{{Message: ErrResultOverflow.Error()}})) {
+		_ = c.send(message{Id: id, Type: typeComplete})
+	}
+}
+
+// finish delivers the last result of a subscription and ends it. The slot
+// deliver keeps free takes it. It reports whether the subscription was
+// still running.
+func (c *Client) finish(id string, result json.RawMessage) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	results, ok := c.subs[id]
+	if ok {
+		results <- result
+		delete(c.subs, id)
+		close(results)
+	}
+	return ok
+}
+
+// errorResult is an execution result carrying errors only.
+func errorResult(errors any) json.RawMessage {
+	result, _ := json.Marshal(struct {
+		Errors any `json:"errors"`
+	}{errors})
+	return result
+}
+
+func (c *Client) send(msg message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.ws.SendTxt(data)
+}
+
+func (c *Client) OnReceive(msg websocket.Message) {
+	var gqlMsg message
+	if msg.MessageType != websocket.TextMessage ||
+		json.Unmarshal(msg.Data, &gqlMsg) != nil || gqlMsg.Type == "" {
+		c.inner.OnReceive(msg)
+		return
+	}
+
+	switch gqlMsg.Type {
+	case typeConnectionAck:
+		c.lock.Lock()
+		if !c.acked {
+			c.acked = true
+			close(c.ack)
+		}
+		c.lock.Unlock()
+	case typePing:
+		_ = c.send(message{Type: typePong, Payload: gqlMsg.Payload})
+	case typePong:
+	case typeNext:
+		if gqlMsg.Payload != nil {
+			c.deliver(gqlMsg.Id, gqlMsg.Payload)
+		}
+	case typeError:
+		c.finish(gqlMsg.Id, errorResult(gqlMsg.Payload))
+	case typeComplete:
+		c.end(gqlMsg.Id)
+	default:
+		c.inner.OnReceive(msg)
+	}
+}
+
+// OnConnect sends connection_init if Connect was called and watches for
+// the acknowledgement.
+func (c *Client) OnConnect(id int) {
+	c.lock.Lock()
+	c.connection++
+	connection := c.connection
+	initiated, init, timeout := c.initiated, c.init, c.ackTimeout
+	c.lock.Unlock()
+
+	c.inner.OnConnect(id)
+	if !initiated {
+		return
+	}
+
+	if err := c.send(message{Type: typeConnectionInit, Payload: init}); err != nil {
+		c.inner.OnFailure(false, err)
+	}
+	time.AfterFunc(timeout, func() {
+		c.lock.Lock()
+		timedOut := c.connection == connection && !c.acked
+		c.lock.Unlock()
+		if timedOut {
+			c.inner.OnFailure(false, ErrAckTimeout)
+			c.fail(ErrAckTimeout)
+			_ = c.ws.Disconnect()
+		}
+	})
+}
+
+// OnDisconnect ends all subscriptions.
+func (c *Client) OnDisconnect(id int) {
+	c.lock.Lock()
+	c.connection++
+	if c.acked {
+		c.acked = false
+		c.ack = make(chan struct{})
+	}
+	for subId, results := range c.subs {
+		delete(c.subs, subId)
+		close(results)
+	}
+	c.lock.Unlock()
+
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,89 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package graphqlws implements the graphql-transport-ws protocol for
+// GraphQL subscriptions on top of the websocket client. A minimal server
+// is included, e.g. for tests.
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Subprotocol is negotiated in the handshake.
+const Subprotocol = "graphql-transport-ws"
+
+// Message types of the protocol.
+const (
+	typeConnectionInit = "connection_init"
+	typeConnectionAck  = "connection_ack"
+	typePing           = "ping"
+	typePong           = "pong"
+	typeSubscribe      = "subscribe"
+	typeNext           = "next"
+	typeError          = "error"
+	typeComplete       = "complete"
+)
+
+// DefaultAckTimeout is how long a client waits for connection_ack.
+const DefaultAckTimeout = 10 * time.Second
+
+// ResultBuffer is the number of results a subscription buffers. A result
+// beyond it completes the operation: the client sends complete and
+// delivers an execution result with ErrResultOverflow as its error last.
+const ResultBuffer = 64
+
+var (
+	ErrNotAcknowledged = errors.New("connection not acknowledged")
+	ErrAckTimeout      = errors.New("connection_ack timed out")
+	ErrResultOverflow  = errors.New("results not read, operation completed")
+)
+
+type message struct {
+	Id      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// SubscribePayload is the operation of a subscribe message.
+type SubscribePayload struct {
+	OperationName string         `json:"operationName,omitempty"`
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+// GraphQLError is an error of an execution result.
+type GraphQLError struct {
+	Message string `json:"message"`
+}
+
+func marshalPayload(payload any) (json.RawMessage, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	return json.Marshal(payload)
+}
@@ -0,0 +1,178 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+func timeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func newClient(t *testing.T, ws *websockettest.ServerConn) *Client {
+	wsClient := websocket.NewClient(false, websockettest.NewRecorder())
+	wsClient.SetNetDial(ws.NetDial())
+	client := NewClient(wsClient)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSubscriptions(t *testing.T) {
+	ws := websockettest.NewServer(websockettest.NewRecorder())
+	defer ws.Close()
+	cancelled := make(chan struct{})
+	server := NewServer(ws.Server, func(ctx context.Context, clientId int,
+		op SubscribePayload, next func(result any) error) error {
+
+		switch op.Query {
+		case "subscription { count }":
+			to, _ := op.Variables["to"].(float64)
+			for i := 1; i <= int(to); i++ {
+				if err := next(map[string]any{"data": map[string]int{"count": i}}); err != nil {
+					return err
+				}
+			}
+			return nil
+		case "subscription { wait }":
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		default:
+			return errors.New("unknown field")
+		}
+	})
+	server.SetOnInit(func(clientId int, payload json.RawMessage) error {
+		if string(payload) != `{"token":"secret"}` {
+			return errors.New("unauthorized")
+		}
+		return nil
+	})
+	ctx := timeout(t)
+
+	client := newClient(t, ws)
+	if _, err := client.Subscribe(ctx, "subscription { count }", nil); !errors.Is(err, ErrNotAcknowledged) {
+		t.Error("subscribed before the ack: ", err)
+	}
+	if err := client.Connect(ctx, websockettest.URL, map[string]string{"token": "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := client.Subscribe(ctx, "subscription { count }", map[string]any{"to": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []string
+	for result := range results {
+		received = append(received, string(result))
+	}
+	if len(received) != 3 || received[2] != `{"data":{"count":3}}` {
+		t.Errorf("received %q", received)
+	}
+
+	// results not read complete the operation
+	results, _ = client.Subscribe(ctx, "subscription { count }",
+		map[string]any{"to": ResultBuffer + 10})
+	for len(results) <= ResultBuffer && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	received = received[:0]
+	for result := range results {
+		received = append(received, string(result))
+	}
+	if len(received) != ResultBuffer+1 || received[ResultBuffer] !=
+		`{"errors":[{"message":"`+ErrResultOverflow.Error()+`"}]}` {
+		t.Errorf("received %d results, last %q", len(received), received[len(received)-1])
+	}
+
+	results, _ = client.Subscribe(ctx, "subscription { nope }", nil)
+	if result := <-results; string(result) != `{"errors":[{"message":"unknown field"}]}` {
+		t.Errorf("error result %s", result)
+	}
+	if _, open := <-results; open {
+		t.Error("subscription not ended by the error")
+	}
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	results, _ = client.Subscribe(waitCtx, "subscription { wait }", nil)
+	cancel()
+	if _, open := <-results; open {
+		t.Error("subscription not ended by cancel")
+	}
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Fatal("resolver not cancelled")
+	}
+
+	// a rejected init is no ack
+	rejected := newClient(t, ws)
+	rejected.SetAckTimeout(100 * time.Millisecond)
+	if err = rejected.Connect(ctx, websockettest.URL, nil); err == nil {
+		t.Error("connected without token")
+	}
+}
+
+func TestAckAndPing(t *testing.T) {
+	serverEvents := websockettest.NewRecorder()
+	ws := websockettest.NewServer(serverEvents)
+	defer ws.Close()
+	ctx := timeout(t)
+
+	client := newClient(t, ws)
+	client.SetAckTimeout(50 * time.Millisecond)
+	if err := client.Connect(ctx, websockettest.URL, nil); !errors.Is(err, ErrAckTimeout) {
+		t.Error("expected ack timeout, got ", err)
+	}
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != `{"type":"connection_init"}` {
+		t.Errorf("server received %s", msg.Data)
+	}
+
+	client = newClient(t, ws)
+	connected := make(chan error, 1)
+	go func() { connected <- client.Connect(ctx, websockettest.URL, nil) }()
+	init := serverEvents.WaitForMessage(t, time.Second)
+	_ = ws.Send(init.ClientId, &websocket.Message{MessageType: websocket.TextMessage,
+		Data: []byte(`{"type":"connection_ack"}`)})
+	if err := <-connected; err != nil {
+		t.Fatal(err)
+	}
+
+	_ = ws.Send(init.ClientId, &websocket.Message{MessageType: websocket.TextMessage,
+		Data: []byte(`{"type":"ping","payload":{"n":1}}`)})
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != `{"type":"pong","payload":{"n":1}}` {
+		t.Errorf("server received %s", msg.Data)
+	}
+}
@@ -0,0 +1,213 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package graphqlws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// ResolveFunc runs a subscription, sending each result by next until it
+// returns. ctx is cancelled when the client completes the operation or
+// disconnects. A returned error is sent to the client as error message.
+type ResolveFunc func(ctx context.Context, clientId int, op SubscribePayload,
+	next func(result any) error) error
+
+type serverConn struct {
+	acked bool
+	ops   map[string]context.CancelFunc
+}
+
+// Server is a minimal graphql-transport-ws server: it acknowledges the
+// connections, answers pings and runs subscriptions by a ResolveFunc.
+// Protocol violations disconnect the client.
+type Server struct {
+	inner   websocket.Events
+	ws      *websocket.Server
+	resolve ResolveFunc
+
+	lock   sync.Mutex
+	onInit func(clientId int, payload json.RawMessage) error
+	conns  map[int]*serverConn
+}
+
+// NewServer installs the protocol on ws and accepts its subprotocol.
+// Create it before ListenAndServe.
+func NewServer(ws *websocket.Server, resolve ResolveFunc) *Server {
+	s := &Server{
+		inner:   ws.EventHandler(),
+		ws:      ws,
+		resolve: resolve,
+		conns:   make(map[int]*serverConn),
+	}
+	ws.SetSubprotocols(Subprotocol)
+	ws.SetEventHandler(s)
+	return s
+}
+
+// SetOnInit sets a hook checking the payload of connection_init, the
+// client is disconnected if it returns an error.
+func (s *Server) SetOnInit(fn func(clientId int, payload json.RawMessage) error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onInit = fn
+}
+
+func (s *Server) send(clientId int, msg message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.ws.Send(clientId, &websocket.Message{MessageType: websocket.TextMessage, Data: data})
+}
+
+func (s *Server) OnReceive(msg websocket.Message) {
+	var gqlMsg message
+	if msg.MessageType != websocket.TextMessage ||
+		json.Unmarshal(msg.Data, &gqlMsg) != nil || gqlMsg.Type == "" {
+		s.inner.OnReceive(msg)
+		return
+	}
+	id := msg.ClientId
+
+	s.lock.Lock()
+	conn := s.conns[id]
+	onInit := s.onInit
+	s.lock.Unlock()
+	if conn == nil {
+		return
+	}
+
+	switch gqlMsg.Type {
+	case typeConnectionInit:
+		s.lock.Lock()
+		initiated := conn.acked
+		s.lock.Unlock()
+		if initiated || (onInit != nil && onInit(id, gqlMsg.Payload) != nil) {
+			_ = s.ws.Disconnect(id)
+			return
+		}
+		s.lock.Lock()
+		conn.acked = true
+		s.lock.Unlock()
+		_ = s.send(id, message{Type: typeConnectionAck})
+	case typePing:
+		_ = s.send(id, message{Type: typePong, Payload: gqlMsg.Payload})
+	case typePong:
+	case typeSubscribe:
+		s.subscribe(id, conn, gqlMsg)
+	case typeComplete:
+		s.lock.Lock()
+		cancel := conn.ops[gqlMsg.Id]
+		delete(conn.ops, gqlMsg.Id)
+		s.lock.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	default:
+		_ = s.ws.Disconnect(id)
+	}
+}
+
+func (s *Server) subscribe(clientId int, conn *serverConn, msg message) {
+	var op SubscribePayload
+	s.lock.Lock()
+	_, exists := conn.ops[msg.Id]
+	valid := conn.acked && !exists && msg.Id != "" && json.Unmarshal(msg.Payload, &op) == nil
+	ctx, cancel := context.WithCancel(context.Background())
+	if valid {
+		conn.ops[msg.Id] = cancel
+	}
+	s.lock.Unlock()
+	if !valid {
+		cancel()
+		_ = s.ws.Disconnect(clientId)
+		return
+	}
+
+	go func() {
+		defer cancel()
+		err := s.resolve(ctx, clientId, op, func(result any) error {
+			payload, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return s.send(clientId, message{Id: msg.Id, Type: typeNext, Payload: payload})
+		})
+
+		// nothing to send if the client completed
+		s.lock.Lock()
+		_, running := conn.ops[msg.Id]
+		delete(conn.ops, msg.Id)
+		s.lock.Unlock()
+		if !running {
+			return
+		}
+		if err != nil {
+			payload, _ := json.Marshal([]GraphQLError{{Message: err.Error()}})
+			_ = s.send(clientId, message{Id: msg.Id, Type: typeError, Payload: payload})
+			return
+		}
+		_ = s.send(clientId, message{Id: msg.Id, Type: typeComplete})
+	}()
+}
+
+func (s *Server) OnConnect(id int) {
+	s.lock.Lock()
+	s.conns[id] = &serverConn{ops: make(map[string]context.CancelFunc)}
+	s.lock.Unlock()
+
+	s.inner.OnConnect(id)
+}
+
+// OnDisconnect cancels the subscriptions of the client.
+func (s *Server) OnDisconnect(id int) {
+	var cancels []context.CancelFunc
+	s.lock.Lock()
+	if conn := s.conns[id]; conn != nil {
+		for _, cancel := range conn.ops {
+			cancels = append(cancels, cancel)
+		}
+	}
+	delete(s.conns, id)
+	s.lock.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	s.inner.OnDisconnect(id)
+}
+
+func (s *Server) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,267 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package journal records sessions to a file and replays them. A journal
+// is json lines, starting with a header naming the format version:
+//
+//	{"journal":1,"started":"2024-05-01T12:00:00Z"}
+//	{"ts":"...","dir":"out","message":{"type":"text","client":0,...}}
+//	{"ts":"...","dir":"in","event":{"type":"connect","id":1}}
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Version is the format version written, readers accept it and older.
+const Version = 1
+
+var (
+	ErrFormat  = errors.New("not a journal")
+	ErrVersion = errors.New("unsupported journal version")
+)
+
+type Direction string
+
+const (
+	Inbound  Direction = "in"
+	Outbound Direction = "out"
+)
+
+type header struct {
+	Journal int       `json:"journal"`
+	Started time.Time `json:"started"`
+}
+
+// Record is one entry of a journal. Exactly one of Message and Event is
+// set, events are inbound.
+type Record struct {
+	Time      time.Time          `json:"ts"`
+	Direction Direction          `json:"dir"`
+	Message   *websocket.Message `json:"message,omitempty"`
+	Event     *websocket.Event   `json:"event,omitempty"`
+}
+
+// Sender sends a message, like websocket.Client.
+type Sender interface {
+	Send(msg websocket.Message) error
+}
+
+// Writer records a session. As Events it records what is received, Sender
+// records what is sent.
+type Writer struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	err     error
+}
+
+// NewWriter writes the header to w right away.
+func NewWriter(w io.Writer) *Writer {
+	j := &Writer{encoder: json.NewEncoder(w)}
+	j.err = j.encoder.Encode(header{Journal: Version, Started: time.Now()})
+	return j
+}
+
+// Err returns the first error writing the journal, later records are not
+// written.
+func (j *Writer) Err() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.err
+}
+
+func (j *Writer) write(record Record) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.err != nil {
+		return
+	}
+	record.Time = time.Now()
+	j.err = j.encoder.Encode(record)
+}
+
+func (j *Writer) OnReceive(msg websocket.Message) {
+	j.write(Record{Direction: Inbound, Message: &msg})
+}
+
+func (j *Writer) OnConnect(id int) {
+	j.write(Record{Direction: Inbound, Event: &websocket.Event{Type: websocket.Connect, Id: id}})
+}
+
+func (j *Writer) OnDisconnect(id int) {
+	j.write(Record{Direction: Inbound, Event: &websocket.Event{Type: websocket.Disconnect, Id: id}})
+}
+
+func (j *Writer) OnFailure(exited bool, err error) {
+	evnt := websocket.Event{Type: websocket.Failure, Id: websocket.ClientIdOf(err), Err: err,
+		Kind: websocket.KindOf(err)}
+	if exited {
+		evnt.Type = websocket.FailureWithExit
+	}
+	j.write(Record{Direction: Inbound, Event: &evnt})
+}
+
+// Events records what inner receives before passing it on.
+func (j *Writer) Events(inner websocket.Events) websocket.Events {
+	return &recordingEvents{journal: j, inner: inner}
+}
+
+type recordingEvents struct {
+	journal *Writer
+	inner   websocket.Events
+}
+
+func (r *recordingEvents) OnReceive(msg websocket.Message) {
+	r.OnReceiveCtx(context.Background(), msg)
+}
+
+func (r *recordingEvents) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	r.journal.OnReceive(msg)
+	if ctxInner, ok := r.inner.(websocket.CtxEvents); ok {
+		ctxInner.OnReceiveCtx(ctx, msg)
+		return
+	}
+	r.inner.OnReceive(msg)
+}
+
+func (r *recordingEvents) OnConnect(id int) {
+	r.journal.OnConnect(id)
+	r.inner.OnConnect(id)
+}
+
+func (r *recordingEvents) OnDisconnect(id int) {
+	r.journal.OnDisconnect(id)
+	r.inner.OnDisconnect(id)
+}
+
+func (r *recordingEvents) OnFailure(exited bool, err error) {
+	r.journal.OnFailure(exited, err)
+	r.inner.OnFailure(exited, err)
+}
+
+// Sender records the messages sent successfully by target.
+func (j *Writer) Sender(target Sender) Sender {
+	return &recordingSender{journal: j, target: target}
+}
+
+type recordingSender struct {
+	journal *Writer
+	target  Sender
+}
+
+func (r *recordingSender) Send(msg websocket.Message) error {
+	if err := r.target.Send(msg); err != nil {
+		return err
+	}
+	r.journal.write(Record{Direction: Outbound, Message: &msg})
+	return nil
+}
+
+// Reader reads a journal record by record.
+type Reader struct {
+	decoder *json.Decoder
+	Version int
+	Started time.Time
+}
+
+// NewReader reads the header, it fails with ErrFormat or ErrVersion.
+func NewReader(r io.Reader) (*Reader, error) {
+	decoder := json.NewDecoder(r)
+	var h header
+	if err := decoder.Decode(&h); err != nil || h.Journal == 0 {
+		return nil, ErrFormat
+	}
+	if h.Journal > Version {
+		return nil, fmt.Errorf("%w %d", ErrVersion, h.Journal)
+	}
+	return &Reader{decoder: decoder, Version: h.Journal, Started: h.Started}, nil
+}
+
+// Next returns the next record, io.EOF at the end of the journal.
+func (r *Reader) Next() (record Record, err error) {
+	err = r.decoder.Decode(&record)
+	return record, err
+}
+
+// ReadAll returns all records of a journal.
+func ReadAll(r io.Reader) ([]Record, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// Replay sends the outbound messages of a journal to target, keeping the
+// time between them divided by speed. A speed of 0 or less sends without
+// delay.
+func Replay(r io.Reader, target Sender, speed float64) error {
+	reader, err := NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	var last time.Time
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Direction != Outbound || record.Message == nil {
+			continue
+		}
+
+		if !last.IsZero() && speed > 0 {
+			time.Sleep(time.Duration(float64(record.Time.Sub(last)) / speed))
+		}
+		last = record.Time
+		if err = target.Send(*record.Message); err != nil {
+			return err
+		}
+	}
+}
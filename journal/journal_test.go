@@ -0,0 +1,134 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package journal
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+// echoEvents sends received messages back.
+type echoEvents struct {
+	*websockettest.Recorder
+	server *websockettest.ServerConn
+}
+
+func (e *echoEvents) OnReceive(msg websocket.Message) {
+	e.Recorder.OnReceive(msg)
+	_ = e.server.Send(msg.ClientId, &msg)
+}
+
+// timedSender notes when messages are sent.
+type timedSender struct {
+	lock     sync.Mutex
+	messages []websocket.Message
+	times    []time.Time
+}
+
+func (s *timedSender) Send(msg websocket.Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.messages = append(s.messages, msg)
+	s.times = append(s.times, time.Now())
+	return nil
+}
+
+func TestJournal(t *testing.T) {
+	serverEvents := &echoEvents{Recorder: websockettest.NewRecorder()}
+	ws := websockettest.NewServer(serverEvents)
+	serverEvents.server = ws
+	defer ws.Close()
+
+	var buf bytes.Buffer
+	journal := NewWriter(&buf)
+	clientEvents := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, journal.Events(clientEvents))
+	ws.Connect(t, wsClient)
+	sender := journal.Sender(wsClient)
+
+	_ = sender.Send(websocket.Message{MessageType: websocket.TextMessage, Data: []byte("first")})
+	clientEvents.WaitForMessage(t, time.Second)
+	time.Sleep(100 * time.Millisecond)
+	_ = sender.Send(websocket.Message{MessageType: websocket.BinaryMessage, Data: []byte{0, 1}})
+	clientEvents.WaitForMessage(t, time.Second)
+	_ = wsClient.Disconnect()
+	if err := journal.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadAll(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary []string
+	for _, record := range records {
+		if record.Message != nil {
+			summary = append(summary, string(record.Direction)+" "+string(record.Message.Data))
+		} else {
+			summary = append(summary, string(record.Direction)+" "+record.Event.Type.String())
+		}
+	}
+	expected := "in connect,out first,in first,out \x00\x01,in \x00\x01,in failure_with_exit,in disconnect"
+	if strings.Join(summary, ",") != expected {
+		t.Errorf("recorded %q", summary)
+	}
+
+	replayed := &timedSender{}
+	if err = Replay(bytes.NewReader(buf.Bytes()), replayed, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed.messages) != 2 || string(replayed.messages[0].Data) != "first" ||
+		replayed.messages[1].MessageType != websocket.BinaryMessage {
+		t.Fatalf("replayed %+v", replayed.messages)
+	}
+	if gap := replayed.times[1].Sub(replayed.times[0]); gap < 45*time.Millisecond || gap > 95*time.Millisecond {
+		t.Errorf("replayed with a gap of %v", gap)
+	}
+
+	replayed = &timedSender{}
+	start := time.Now()
+	_ = Replay(bytes.NewReader(buf.Bytes()), replayed, 0)
+	if elapsed := time.Since(start); len(replayed.messages) != 2 || elapsed > 40*time.Millisecond {
+		t.Errorf("replayed %d messages in %v", len(replayed.messages), elapsed)
+	}
+}
+
+func TestReaderVersion(t *testing.T) {
+	if _, err := NewReader(strings.NewReader(`{"journal":2}`)); !errors.Is(err, ErrVersion) {
+		t.Error("expected unsupported version, got ", err)
+	}
+	if _, err := NewReader(strings.NewReader(`{"ts":"2024-01-01T00:00:00Z"}`)); !errors.Is(err, ErrFormat) {
+		t.Error("expected no journal, got ", err)
+	}
+}
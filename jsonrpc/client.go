@@ -0,0 +1,271 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// NotificationBuffer is the channel capacity of a subscription. A JSON-RPC
+// notification has no id, so there is no response to tell the server it
+// was not taken: one for a full channel is not delivered, counted by
+// ClientRPC.Dropped and reported to OnFailure as ErrNotificationDropped.
+// Responses to calls are read on meanwhile.
+const NotificationBuffer = 64
+
+// ClientRPC correlates calls and responses on a websocket client. It wraps
+// the client's event handler: responses to pending calls and notifications
+// are consumed, every other message and all events are passed on.
+type ClientRPC struct {
+	inner websocket.Events
+	ws    *websocket.Client
+
+	lock          sync.Mutex
+	connected     bool
+	nextId        uint64
+	pending       map[uint64]chan *message
+	subscriptions map[string][]chan Notification
+	dropped       atomic.Uint64
+}
+
+// NewClientRPC installs the rpc layer on ws. Create it before connecting.
+func NewClientRPC(ws *websocket.Client) *ClientRPC {
+	c := &ClientRPC{
+		inner:         ws.EventHandler(),
+		ws:            ws,
+		pending:       make(map[uint64]chan *message),
+		subscriptions: make(map[string][]chan Notification),
+	}
+	ws.SetEventHandler(c)
+	return c
+}
+
+// Call sends a request and waits for its response or until ctx is done.
+// The result is decoded into result unless it is nil. A response with an
+// error object is returned as *RPCError.
+func (c *ClientRPC) Call(ctx context.Context, method string,
+	params any, result any) error {
+
+	rawParams, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	if !c.connected {
+		c.lock.Unlock()
+		return ErrNotConnected
+	}
+	c.nextId++
+	id := c.nextId
+	response := make(chan *message, 1)
+	c.pending[id] = response
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	if err = c.send(message{
+		Id:     json.RawMessage(strconv.FormatUint(id, 10)),
+		Method: method,
+		Params: rawParams,
+	}); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case resp, ok := <-response:
+		if !ok {
+			return ErrDisconnected
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || resp.Result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+}
+
+// Notify sends a notification, a request without response.
+func (c *ClientRPC) Notify(method string, params any) error {
+	rawParams, err := marshalParams(params)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	connected := c.connected
+	c.lock.Unlock()
+	if !connected {
+		return ErrNotConnected
+	}
+
+	return c.send(message{Method: method, Params: rawParams})
+}
+
+// Subscribe delivers notifications of the server for method on the
+// returned channel until cancel is called, which also closes the channel.
+func (c *ClientRPC) Subscribe(method string) (notifications <-chan Notification,
+	cancel func()) {
+
+	ch := make(chan Notification, NotificationBuffer)
+
+	c.lock.Lock()
+	c.subscriptions[method] = append(c.subscriptions[method], ch)
+	c.lock.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			subs := c.subscriptions[method]
+			for i, sub := range subs {
+				if sub == ch {
+					c.subscriptions[method] = append(subs[:i:i], subs[i+1:]...)
+					break
+				}
+			}
+			if len(c.subscriptions[method]) == 0 {
+				delete(c.subscriptions, method)
+			}
+			close(ch)
+		})
+	}
+}
+
+func (c *ClientRPC) send(msg message) error {
+	msg.JSONRPC = Version
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.ws.SendTxt(data)
+}
+
+func (c *ClientRPC) OnReceive(msg websocket.Message) {
+	var rpcMsg message
+	if msg.MessageType != websocket.TextMessage ||
+		json.Unmarshal(msg.Data, &rpcMsg) != nil || rpcMsg.JSONRPC != Version {
+		c.inner.OnReceive(msg)
+		return
+	}
+
+	switch {
+	case rpcMsg.isNotification():
+		c.notify(Notification{Method: rpcMsg.Method, Params: rpcMsg.Params})
+	case rpcMsg.isRequest():
+		// calls from the server are not supported
+		c.inner.OnReceive(msg)
+	default:
+		if !c.respond(&rpcMsg) {
+			// not for one of our calls, e.g. timed out
+			c.inner.OnReceive(msg)
+		}
+	}
+}
+
+func (c *ClientRPC) notify(notification Notification) {
+	dropped := 0
+	c.lock.Lock()
+	for _, ch := range c.subscriptions[notification.Method] {
+		select {
+		case ch <- notification:
+		default:
+			dropped++
+		}
+	}
+	c.lock.Unlock()
+
+	if dropped > 0 {
+		c.dropped.Add(uint64(dropped))
+		c.inner.OnFailure(false, fmt.Errorf("%s for %d subscriptions: %w",
+			notification.Method, dropped, ErrNotificationDropped))
+	}
+}
+
+// Dropped returns the number of notifications not delivered to a full
+// subscription so far, counted per subscription.
+func (c *ClientRPC) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+func (c *ClientRPC) respond(resp *message) bool {
+	id, err := strconv.ParseUint(string(resp.Id), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	c.lock.Lock()
+	response, ok := c.pending[id]
+	delete(c.pending, id)
+	c.lock.Unlock()
+
+	if ok {
+		response <- resp
+	}
+	return ok
+}
+
+func (c *ClientRPC) OnConnect(id int) {
+	c.lock.Lock()
+	c.connected = true
+	c.lock.Unlock()
+
+	c.inner.OnConnect(id)
+}
+
+// OnDisconnect fails all pending calls with ErrDisconnected.
+func (c *ClientRPC) OnDisconnect(id int) {
+	c.lock.Lock()
+	c.connected = false
+	for callId, response := range c.pending {
+		close(response)
+		delete(c.pending, callId)
+	}
+	c.lock.Unlock()
+
+	c.inner.OnDisconnect(id)
+}
+
+func (c *ClientRPC) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
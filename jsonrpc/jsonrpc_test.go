@@ -0,0 +1,321 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+// rawServer answers requests without the server rpc layer: add sums two
+// numbers, slow answers after the delay in the params, fail returns an
+// error object and ping sends a "pong" notification.
+type rawServer struct {
+	*websockettest.Recorder
+	server *websocket.Server
+}
+
+func (r *rawServer) OnReceive(msg websocket.Message) {
+	r.Recorder.OnReceive(msg)
+
+	var req message
+	if json.Unmarshal(msg.Data, &req) != nil || req.Id == nil {
+		return
+	}
+	resp := message{JSONRPC: Version, Id: req.Id}
+
+	switch req.Method {
+	case "add":
+		var params [2]int
+		_ = json.Unmarshal(req.Params, &params)
+		resp.Result, _ = json.Marshal(params[0] + params[1])
+	case "slow":
+		var delay time.Duration
+		_ = json.Unmarshal(req.Params, &delay)
+		go func() {
+			time.Sleep(delay)
+			resp.Result = req.Params
+			data, _ := json.Marshal(resp)
+			_ = r.server.Send(msg.ClientId, &websocket.Message{
+				MessageType: websocket.TextMessage, Data: data})
+		}()
+		return
+	case "fail":
+		resp.Error = &RPCError{Code: 42, Message: "failed",
+			Data: json.RawMessage(`"details"`)}
+	case "ping":
+		data, _ := json.Marshal(message{JSONRPC: Version, Method: "pong"})
+		_ = r.server.Send(msg.ClientId, &websocket.Message{
+			MessageType: websocket.TextMessage, Data: data})
+		resp.Result = json.RawMessage("null")
+	case "hangup":
+		_ = r.server.Disconnect(msg.ClientId)
+		return
+	default:
+		resp.Error = &RPCError{Code: CodeMethodNotFound, Message: "method not found"}
+	}
+
+	data, _ := json.Marshal(resp)
+	_ = r.server.Send(msg.ClientId, &websocket.Message{
+		MessageType: websocket.TextMessage, Data: data})
+}
+
+func TestClientRPC(t *testing.T) {
+	raw := &rawServer{Recorder: websockettest.NewRecorder()}
+	raw.server = websocket.NewServer("ws://localhost:33240/rpc", raw)
+	go func() { _ = raw.server.ListenAndServe() }()
+	defer raw.server.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	events := websockettest.NewRecorder()
+	ws := websocket.NewClient(false, events)
+	rpc := NewClientRPC(ws)
+
+	if err := rpc.Call(context.Background(), "add", nil, nil); err != ErrNotConnected {
+		t.Error("expected not connected, got ", err)
+	}
+
+	go func() { _ = ws.ConnectAndServe("ws://localhost:33240/rpc", nil) }()
+	defer ws.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	var sum int
+	if err := rpc.Call(context.Background(), "add", []int{1, 2}, &sum); err != nil || sum != 3 {
+		t.Errorf("add: %d, %v", sum, err)
+	}
+
+	var rpcErr *RPCError
+	err := rpc.Call(context.Background(), "fail", nil, nil)
+	if !errors.As(err, &rpcErr) || rpcErr.Code != 42 || string(rpcErr.Data) != `"details"` {
+		t.Error("expected rpc error, got ", err)
+	}
+
+	// concurrent calls answered in reverse order
+	results := make(chan error, 3)
+	for _, delay := range []time.Duration{300, 200, 100} {
+		delay := delay * time.Millisecond
+		go func() {
+			var got time.Duration
+			err := rpc.Call(context.Background(), "slow", delay, &got)
+			if err == nil && got != delay {
+				err = errors.New("mixed up responses")
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := rpc.Call(ctx, "slow", time.Second, nil); err != context.DeadlineExceeded {
+		t.Error("expected deadline exceeded, got ", err)
+	}
+
+	notifications, unsubscribe := rpc.Subscribe("pong")
+	if err := rpc.Call(context.Background(), "ping", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notifications:
+		if n.Method != "pong" {
+			t.Error("unexpected notification ", n.Method)
+		}
+	case <-time.After(time.Second):
+		t.Error("no notification")
+	}
+	unsubscribe()
+	if _, ok := <-notifications; ok {
+		t.Error("channel not closed on unsubscribe")
+	}
+
+	if err := rpc.Notify("note", map[string]int{"a": 1}); err != nil {
+		t.Error(err)
+	}
+
+	// non rpc messages are passed on
+	_ = raw.server.Send(raw.WaitForConnect(t, time.Second), &websocket.Message{
+		MessageType: websocket.TextMessage, Data: []byte("plain")})
+	if msg := events.WaitForMessage(t, time.Second); string(msg.Data) != "plain" {
+		t.Errorf("unexpected message %q", msg.Data)
+	}
+
+	pending := make(chan error, 1)
+	go func() { pending <- rpc.Call(context.Background(), "slow", time.Second, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	if err := rpc.Call(context.Background(), "hangup", nil, nil); err != ErrDisconnected {
+		t.Error("expected disconnected, got ", err)
+	}
+	if err := <-pending; err != ErrDisconnected {
+		t.Error("pending call: expected disconnected, got ", err)
+	}
+}
+
+func TestNotificationDropped(t *testing.T) {
+	events := websockettest.NewRecorder()
+	rpc := NewClientRPC(websocket.NewClient(false, events))
+	notifications, unsubscribe := rpc.Subscribe("tick")
+	defer unsubscribe()
+
+	for i := 0; i <= NotificationBuffer; i++ {
+		rpc.notify(Notification{Method: "tick"})
+	}
+	if evnt := events.WaitForFailure(t, time.Second); !errors.Is(evnt.Err, ErrNotificationDropped) {
+		t.Error("expected a dropped notification, got ", evnt.Err)
+	}
+	if n := rpc.Dropped(); n != 1 {
+		t.Errorf("%d dropped", n)
+	}
+	if n := len(notifications); n != NotificationBuffer {
+		t.Errorf("%d buffered", n)
+	}
+}
+
+type addParams struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func TestServerRPC(t *testing.T) {
+	wsServer := websocket.NewServer("ws://localhost:33241/rpc", websockettest.NewRecorder())
+	rpcServer := NewServerRPC(wsServer)
+	defer rpcServer.Close()
+
+	mustRegister := func(name string, fn any) {
+		if err := rpcServer.Register(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustRegister("math.add", func(ctx context.Context, p addParams) (int, error) {
+		return p.A + p.B, nil
+	})
+	mustRegister("sleep", func(ctx context.Context, d time.Duration) error {
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+		}
+		return nil
+	})
+	mustRegister("teapot", func(ctx context.Context) (string, error) {
+		return "", &RPCError{Code: 418, Message: "teapot"}
+	})
+	mustRegister("clientId", func(ctx context.Context) (bool, error) {
+		_, ok := websocket.ClientIdFromContext(ctx)
+		return ok, nil
+	})
+	if rpcServer.Register("bad", func(a int) int { return a }) == nil {
+		t.Error("expected error for invalid signature")
+	}
+
+	go func() { _ = wsServer.ListenAndServe() }()
+	defer wsServer.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	events := websockettest.NewRecorder()
+	ws := websocket.NewClient(false, events)
+	rpc := NewClientRPC(ws)
+	go func() { _ = ws.ConnectAndServe("ws://localhost:33241/rpc", nil) }()
+	defer ws.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	ctx := context.Background()
+	var sum int
+	if err := rpc.Call(ctx, "math.add", addParams{A: 2, B: 3}, &sum); err != nil || sum != 5 {
+		t.Errorf("math.add: %d, %v", sum, err)
+	}
+	var hasId bool
+	if err := rpc.Call(ctx, "clientId", nil, &hasId); err != nil || !hasId {
+		t.Errorf("no client id in handler context: %v", err)
+	}
+
+	var rpcErr *RPCError
+	checkCode := func(err error, code int) {
+		t.Helper()
+		if !errors.As(err, &rpcErr) || rpcErr.Code != code {
+			t.Errorf("expected code %d, got %v", code, err)
+		}
+	}
+	checkCode(rpc.Call(ctx, "teapot", nil, nil), 418)
+	checkCode(rpc.Call(ctx, "nope", nil, nil), CodeMethodNotFound)
+	checkCode(rpc.Call(ctx, "math.add", "text", nil), CodeInvalidParams)
+
+	// a slow call does not hold up others
+	slow := make(chan error, 1)
+	go func() { slow <- rpc.Call(ctx, "sleep", 500*time.Millisecond, nil) }()
+	start := time.Now()
+	if err := rpc.Call(ctx, "math.add", addParams{}, nil); err != nil {
+		t.Error(err)
+	}
+	if time.Since(start) > 300*time.Millisecond {
+		t.Error("call blocked by a slow handler")
+	}
+	if err := <-slow; err != nil {
+		t.Error(err)
+	}
+
+	// raw batch, parse error and invalid request
+	for _, tc := range []struct{ request, response string }{
+		{`[{"jsonrpc":"2.0","id":1,"method":"math.add","params":{"a":1,"b":1}},` +
+			`{"jsonrpc":"2.0","method":"math.add"},` +
+			`{"jsonrpc":"2.0","id":2,"method":"nope"}]`,
+			`[{"jsonrpc":"2.0","id":1,"result":2},` +
+				`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"method not found: nope"}}]`},
+		{`{"jsonrpc":"2.0",`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"unexpected end of JSON input"}}`},
+		{`[]`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty batch"}}`},
+		{`{"jsonrpc":"1.0","id":7,"method":"math.add"}`,
+			`{"jsonrpc":"2.0","id":7,"error":{"code":-32600,"message":"invalid request"}}`},
+	} {
+		_ = ws.SendTxt([]byte(tc.request))
+		if msg := events.WaitForMessage(t, time.Second); string(msg.Data) != tc.response {
+			t.Errorf("%s:\n got %s\nwant %s", tc.request, msg.Data, tc.response)
+		}
+	}
+
+	notifications, unsubscribe := rpc.Subscribe("tick")
+	defer unsubscribe()
+	if err := rpcServer.NotifyAll("tick", []int{1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-notifications:
+		if string(n.Params) != "[1]" {
+			t.Errorf("unexpected params %s", n.Params)
+		}
+	case <-time.After(time.Second):
+		t.Error("no notification")
+	}
+}
@@ -0,0 +1,352 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// DefaultWorkers is the number of requests a ServerRPC handles concurrently.
+const DefaultWorkers = 8
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// method is a registered handler. params is nil if it takes none.
+type method struct {
+	fn        reflect.Value
+	params    reflect.Type
+	hasResult bool
+}
+
+// newMethod checks the signature of fn, one of
+//
+//	func(ctx context.Context, params P) (R, error)
+//	func(ctx context.Context, params P) error
+//	func(ctx context.Context) (R, error)
+//	func(ctx context.Context) error
+func newMethod(fn any) (*method, error) {
+	fnType := reflect.TypeOf(fn)
+	if fnType == nil || fnType.Kind() != reflect.Func {
+		return nil, errors.New("handler is not a function")
+	}
+	if fnType.NumIn() < 1 || fnType.NumIn() > 2 || fnType.In(0) != contextType {
+		return nil, errors.New("handler must take a context and optional params")
+	}
+	if fnType.NumOut() < 1 || fnType.NumOut() > 2 ||
+		fnType.Out(fnType.NumOut()-1) != errorType {
+		return nil, errors.New("handler must return an optional result and an error")
+	}
+
+	m := &method{
+		fn:        reflect.ValueOf(fn),
+		hasResult: fnType.NumOut() == 2,
+	}
+	if fnType.NumIn() == 2 {
+		m.params = fnType.In(1)
+	}
+	return m, nil
+}
+
+func (m *method) call(ctx context.Context, rawParams json.RawMessage) (
+	result json.RawMessage, rpcErr *RPCError) {
+
+	args := []reflect.Value{reflect.ValueOf(ctx)}
+	if m.params != nil {
+		params := reflect.New(m.params)
+		if len(rawParams) > 0 {
+			if err := json.Unmarshal(rawParams, params.Interface()); err != nil {
+				return nil, &RPCError{Code: CodeInvalidParams, Message: err.Error()}
+			}
+		}
+		args = append(args, params.Elem())
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			result, rpcErr = nil, &RPCError{
+				Code:    CodeInternalError,
+				Message: fmt.Sprintf("panic: %v", recovered),
+			}
+		}
+	}()
+
+	out := m.fn.Call(args)
+	if err, _ := out[len(out)-1].Interface().(error); err != nil {
+		if errors.As(err, &rpcErr) {
+			return nil, rpcErr
+		}
+		return nil, &RPCError{Code: CodeInternalError, Message: err.Error()}
+	}
+
+	result = json.RawMessage("null")
+	if m.hasResult {
+		data, err := json.Marshal(out[0].Interface())
+		if err != nil {
+			return nil, &RPCError{Code: CodeInternalError, Message: err.Error()}
+		}
+		result = data
+	}
+	return result, nil
+}
+
+type job struct {
+	ctx context.Context
+	msg websocket.Message
+}
+
+// ServerRPC dispatches JSON-RPC requests received by a websocket server to
+// registered handlers, running on a pool of DefaultWorkers goroutines. It
+// wraps the server's event handler: text messages are handled as requests,
+// binary messages and all events are passed on.
+type ServerRPC struct {
+	inner websocket.Events
+	ws    *websocket.Server
+
+	lock    sync.RWMutex
+	methods map[string]*method
+
+	jobs chan job
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// NewServerRPC installs the rpc layer on ws and starts the workers. Create
+// it before ListenAndServe.
+func NewServerRPC(ws *websocket.Server) *ServerRPC {
+	s := &ServerRPC{
+		inner:   ws.EventHandler(),
+		ws:      ws,
+		methods: make(map[string]*method),
+		jobs:    make(chan job),
+		done:    make(chan struct{}),
+	}
+	ws.SetEventHandler(s)
+
+	for i := 0; i < DefaultWorkers; i++ {
+		s.wg.Add(1)
+		go s.work()
+	}
+	return s
+}
+
+// Register makes fn callable as name. See newMethod for the accepted
+// signatures. Params are decoded from json into the params type, a returned
+// *RPCError is sent as is, other errors as CodeInternalError.
+func (s *ServerRPC) Register(name string, fn any) error {
+	m, err := newMethod(fn)
+	if err != nil {
+		return fmt.Errorf("register %s: %w", name, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.methods[name] = m
+	return nil
+}
+
+// Notify sends a notification to one client.
+func (s *ServerRPC) Notify(clientId int, method string, params any) error {
+	data, err := marshalNotification(method, params)
+	if err != nil {
+		return err
+	}
+	return s.ws.Send(clientId, &websocket.Message{
+		MessageType: websocket.TextMessage,
+		Data:        data,
+	})
+}
+
+// NotifyAll broadcasts a notification to all clients.
+func (s *ServerRPC) NotifyAll(method string, params any) error {
+	data, err := marshalNotification(method, params)
+	if err != nil {
+		return err
+	}
+	s.ws.Broadcast(&websocket.Message{
+		MessageType: websocket.TextMessage,
+		Data:        data,
+	})
+	return nil
+}
+
+// Close stops the workers after the running requests are done.
+func (s *ServerRPC) Close() {
+	s.once.Do(func() { close(s.done) })
+	s.wg.Wait()
+}
+
+func marshalNotification(method string, params any) ([]byte, error) {
+	rawParams, err := marshalParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(message{JSONRPC: Version, Method: method, Params: rawParams})
+}
+
+func (s *ServerRPC) work() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case j := <-s.jobs:
+			if response := s.handle(j.ctx, j.msg.Data); response != nil {
+				_ = s.ws.Send(j.msg.ClientId, &websocket.Message{
+					MessageType: websocket.TextMessage,
+					Data:        response,
+				})
+			}
+		}
+	}
+}
+
+// handle processes a request or batch and returns the response, nil if
+// there is nothing to answer.
+func (s *ServerRPC) handle(ctx context.Context, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		response := s.handleOne(ctx, data)
+		if response == nil {
+			return nil
+		}
+		out, _ := json.Marshal(response)
+		return out
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		out, _ := json.Marshal(errorResponse(nil, CodeParseError, err.Error()))
+		return out
+	}
+	if len(batch) == 0 {
+		out, _ := json.Marshal(errorResponse(nil, CodeInvalidRequest, "empty batch"))
+		return out
+	}
+
+	var responses []*message
+	for _, request := range batch {
+		if response := s.handleOne(ctx, request); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	out, _ := json.Marshal(responses)
+	return out
+}
+
+func (s *ServerRPC) handleOne(ctx context.Context, data []byte) *message {
+	var req message
+	if err := json.Unmarshal(data, &req); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return errorResponse(nil, CodeParseError, err.Error())
+		}
+		return errorResponse(nil, CodeInvalidRequest, err.Error())
+	}
+	if req.JSONRPC != Version || req.Method == "" {
+		return errorResponse(req.Id, CodeInvalidRequest, "invalid request")
+	}
+
+	s.lock.RLock()
+	m, ok := s.methods[req.Method]
+	s.lock.RUnlock()
+
+	var response *message
+	if !ok {
+		response = errorResponse(req.Id, CodeMethodNotFound,
+			"method not found: "+req.Method)
+	} else {
+		result, rpcErr := m.call(ctx, req.Params)
+		response = &message{JSONRPC: Version, Id: req.Id, Result: result, Error: rpcErr}
+	}
+
+	if req.isNotification() {
+		return nil
+	}
+	return response
+}
+
+func errorResponse(id json.RawMessage, code int, text string) *message {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &message{
+		JSONRPC: Version,
+		Id:      id,
+		Error:   &RPCError{Code: code, Message: text},
+	}
+}
+
+func (s *ServerRPC) OnReceive(msg websocket.Message) {
+	s.OnReceiveCtx(context.Background(), msg)
+}
+
+// OnReceiveCtx queues text messages for the workers. The context passed to
+// handlers ends with the connection and carries the client id, see
+// websocket.ClientIdFromContext.
+func (s *ServerRPC) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	if msg.MessageType != websocket.TextMessage {
+		if inner, ok := s.inner.(websocket.CtxEvents); ok {
+			inner.OnReceiveCtx(ctx, msg)
+		} else {
+			s.inner.OnReceive(msg)
+		}
+		return
+	}
+
+	select {
+	case s.jobs <- job{ctx: ctx, msg: msg}:
+	case <-s.done:
+	}
+}
+
+func (s *ServerRPC) OnConnect(id int) {
+	s.inner.OnConnect(id)
+}
+
+func (s *ServerRPC) OnDisconnect(id int) {
+	s.inner.OnDisconnect(id)
+}
+
+func (s *ServerRPC) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,288 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const loadReportInterval = time.Second
+
+type loadStats struct {
+	connected     atomic.Int64
+	everConnected atomic.Bool
+	sent          atomic.Uint64
+	received      atomic.Uint64
+	errors        atomic.Uint64
+	closing       atomic.Bool
+
+	lock      sync.Mutex
+	latencies []time.Duration
+	window    []time.Duration
+}
+
+func (s *loadStats) addLatency(latency time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.latencies = append(s.latencies, latency)
+	s.window = append(s.window, latency)
+}
+
+// takeWindow returns the latencies since the last call.
+func (s *loadStats) takeWindow() []time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	window := s.window
+	s.window = nil
+	return window
+}
+
+func (s *loadStats) allLatencies() []time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]time.Duration(nil), s.latencies...)
+}
+
+// formatPercentiles renders p50/p90/p99 of latencies, or an empty string
+// if nothing was echoed.
+func formatPercentiles(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return ""
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100].Round(time.Microsecond)
+	}
+	return fmt.Sprintf(", latency p50 %v p90 %v p99 %v",
+		percentile(50), percentile(90), percentile(99))
+}
+
+// loadClient is one connection of the load test. Echoed messages are
+// matched in order against the pending send times to measure latency.
+type loadClient struct {
+	stats   *loadStats
+	message []byte
+	client  *websocket.Client
+	up      atomic.Bool
+	dialed  atomic.Bool
+
+	lock    sync.Mutex
+	pending []time.Time
+}
+
+func (l *loadClient) OnReceive(msg websocket.Message) {
+	l.stats.received.Add(1)
+
+	if !bytes.HasSuffix(msg.Data, l.message) {
+		return
+	}
+	l.lock.Lock()
+	if len(l.pending) > 0 {
+		l.stats.addLatency(time.Since(l.pending[0]))
+		l.pending = l.pending[1:]
+	}
+	l.lock.Unlock()
+}
+
+func (l *loadClient) OnConnect(id int) {
+	l.up.Store(true)
+	l.dialed.Store(true)
+	l.stats.everConnected.Store(true)
+	l.stats.connected.Add(1)
+}
+
+func (l *loadClient) OnDisconnect(id int) {
+	l.up.Store(false)
+	l.stats.connected.Add(-1)
+
+	l.lock.Lock()
+	l.pending = nil
+	l.lock.Unlock()
+}
+
+func (l *loadClient) OnFailure(exited bool, err error) {
+	if l.stats.closing.Load() {
+		return
+	}
+	l.stats.errors.Add(1)
+}
+
+func (l *loadClient) send() {
+	if !l.up.Load() {
+		return
+	}
+
+	l.lock.Lock()
+	l.pending = append(l.pending, time.Now())
+	l.lock.Unlock()
+
+	if err := l.client.SendTxt(l.message); err != nil {
+		l.stats.errors.Add(1)
+		return
+	}
+	l.stats.sent.Add(1)
+}
+
+// loadTest opens cfg.clients connections to the same url and reports
+// throughput until ctx is done or 'exit' is entered.
+func loadTest(ctx context.Context, cfg config, std streams) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	out := newPrinter(std.diag, cfg.output, cfg.timestamps.String())
+	stats := &loadStats{}
+	clients := make([]*loadClient, cfg.clients)
+
+	var wg sync.WaitGroup
+
+	for i := range clients {
+		l := &loadClient{stats: stats, message: []byte(cfg.message)}
+		l.client = websocket.NewClient(cfg.skipVerify, l)
+		if err := setupClientTLS(l.client, cfg); err != nil {
+			return withExitCode(exitUsage, err)
+		}
+		l.client.SetKeepalive(cfg.ping, cfg.pingTimeout)
+		l.client.SetReadLimit(cfg.maxSize)
+		if cfg.reconnect {
+			backoff := utils.NewBackoff()
+			backoff.Initial = cfg.reconnectDelay
+			l.client.SetReconnect(backoff, cfg.reconnectMax)
+		}
+		clients[i] = l
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := l.client.ConnectAndServeWithHeader(cfg.address, cfg.header)
+			// read failures are already counted by OnFailure
+			if err != nil && !l.dialed.Load() {
+				stats.errors.Add(1)
+			}
+		}()
+
+		if cfg.message != "" && cfg.interval > 0 {
+			go func() {
+				ticker := time.NewTicker(cfg.interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						l.send()
+					}
+				}
+			}()
+		}
+	}
+
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
+
+	start := time.Now()
+	ticker := time.NewTicker(loadReportInterval)
+	defer ticker.Stop()
+
+	lines := readLines(os.Stdin)
+	var lastSent, lastReceived uint64
+	last := start
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-allDone:
+			break loop
+		case txt, ok := <-lines:
+			if !ok {
+				if stdinInteractive() {
+					break loop
+				}
+				lines = nil
+				continue
+			}
+			if txt == "exit" {
+				break loop
+			}
+		case now := <-ticker.C:
+			sent, received := stats.sent.Load(), stats.received.Load()
+			elapsed := now.Sub(last).Seconds()
+			out.Printf(markerEvent,
+				"clients %d/%d connected, tx %.1f/s, rx %.1f/s, errors %d%s",
+				stats.connected.Load(), cfg.clients,
+				float64(sent-lastSent)/elapsed,
+				float64(received-lastReceived)/elapsed,
+				stats.errors.Load(), formatPercentiles(stats.takeWindow()))
+			lastSent, lastReceived, last = sent, received, now
+		}
+	}
+
+	cancel()
+	stats.closing.Store(true)
+
+	var closing sync.WaitGroup
+	for _, l := range clients {
+		closing.Add(1)
+		go func(l *loadClient) {
+			defer closing.Done()
+			_ = l.client.Disconnect()
+		}(l)
+	}
+	closing.Wait()
+	wg.Wait()
+
+	elapsed := time.Since(start).Seconds()
+	out.Printf(markerEvent,
+		"final: %d clients, %.1fs, tx %d (%.1f/s), rx %d (%.1f/s), errors %d%s",
+		cfg.clients, elapsed,
+		stats.sent.Load(), float64(stats.sent.Load())/elapsed,
+		stats.received.Load(), float64(stats.received.Load())/elapsed,
+		stats.errors.Load(), formatPercentiles(stats.allLatencies()))
+
+	if !stats.everConnected.Load() {
+		return withExitCode(exitDial, errors.New("no client could connect"))
+	}
+	return nil
+}
@@ -26,11 +26,22 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"math/big"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/ChrIgiSta/go-easy-websockets/utils"
 	"github.com/ChrIgiSta/go-easy-websockets/websocket"
@@ -38,61 +49,294 @@ import (
 	ccrypt "github.com/ChrIgiSta/go-utils/crypto"
 )
 
+// defaultMaxSize is the default read limit for received messages.
+const defaultMaxSize = 16 * 1024 * 1024
+
+// streams are the writers of the cli: data gets received messages, json
+// records and replies, diag the human readable status and warnings. In
+// --json, --request and --stdio mode diag is stderr, so only data ends up
+// on stdout.
+type streams struct {
+	data io.Writer
+	diag io.Writer
+}
+
+func newStreams(cfg config, stdout io.Writer, stderr io.Writer) streams {
+	std := streams{data: stdout, diag: stdout}
+	if cfg.json || cfg.request != "" || cfg.stdio {
+		std.diag = stderr
+	}
+	return std
+}
+
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+func (h headerFlag) Set(value string) error {
+	key, val, found := strings.Cut(value, ":")
+	key = strings.TrimSpace(key)
+	if !found || key == "" {
+		return fmt.Errorf("invalid header %q, expected \"Key: Value\"", value)
+	}
+	http.Header(h).Add(key, strings.TrimSpace(val))
+	return nil
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+type config struct {
+	address     string
+	server      bool
+	skipVerify  bool
+	certPath    string
+	keyPath     string
+	header      http.Header
+	sendFile    string
+	binary      bool
+	maxFileSize int64
+	maxSize     int64
+	output      string
+
+	reconnect      bool
+	reconnectMax   int
+	reconnectDelay time.Duration
+
+	ping        time.Duration
+	pingTimeout time.Duration
+
+	echo       bool
+	echoPrefix string
+
+	wait           time.Duration
+	expectResponse bool
+
+	timestamps timestampFlag
+	json       bool
+
+	clients  int
+	message  string
+	interval time.Duration
+	count    int
+
+	showCert     bool
+	origin       string
+	subprotocols stringList
+
+	verbose countFlag
+	quiet   bool
+
+	rootCAs           stringList
+	clientCert        string
+	clientKey         string
+	requireClientCert bool
+	clientCA          string
+
+	noSummary bool
+
+	auth     string
+	authHash string
+
+	script []scriptStep
+
+	request string
+	expect  string
+	timeout time.Duration
+
+	stdio bool
+}
+
+var hashAlgos = map[string]websocket.HashAlgo{
+	"none":   websocket.HashAlgoNone,
+	"md5":    websocket.HashAlgoMD5,
+	"sha256": websocket.HashAlgoSHA256,
+}
+
+// authHeader splits --auth into header key and value.
+func (c config) authHeader() (key string, value string, algo websocket.HashAlgo) {
+	key, value, _ = strings.Cut(c.auth, "=")
+	return strings.TrimSpace(key), value, hashAlgos[c.authHash]
+}
+
+// echoEvents writes every received message back to its sender.
+type echoEvents struct {
+	websocket.Events
+	server *websocket.Server
+	out    *printer
+	prefix string
+}
+
+func (e *echoEvents) OnReceive(msg websocket.Message) {
+	reply := msg
+	if msg.MessageType == websocket.TextMessage && e.prefix != "" {
+		reply.Data = append([]byte(e.prefix), msg.Data...)
+	}
+	if err := e.server.Send(msg.ClientId, &reply); err != nil {
+		e.out.Printf(markerEvent, "echo to <%d>: %v", msg.ClientId, err)
+	} else {
+		e.out.Sent(reply)
+	}
+	e.Events.OnReceive(msg)
+}
+
+// connectionState tracks whether the client is currently connected and
+// closes connected on the first connect event. onConnect, if set, runs
+// before the connect event is passed on.
+type connectionState struct {
+	websocket.Events
+	connected chan struct{}
+	once      sync.Once
+	up        atomic.Bool
+	onConnect func(id int)
+}
+
+func newConnectionState(events websocket.Events) *connectionState {
+	return &connectionState{
+		Events:    events,
+		connected: make(chan struct{}),
+	}
+}
+
+func (c *connectionState) OnConnect(id int) {
+	if c.onConnect != nil {
+		c.onConnect(id)
+	}
+	c.up.Store(true)
+	c.once.Do(func() { close(c.connected) })
+	c.Events.OnConnect(id)
+}
+
+func (c *connectionState) OnDisconnect(id int) {
+	c.up.Store(false)
+	c.Events.OnDisconnect(id)
+}
+
 func main() {
 
-	var (
-		serverAddress          string
-		server, skipValidation bool
-		err                    error
-		cert, key              string
-	)
+	ctx, stop := signal.NotifyContext(context.Background(),
+		os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	serverAddress, server, skipValidation, cert, key, err = parseArgs()
-	if err != nil || serverAddress == "" {
-		fmt.Println(err)
-		help()
-		os.Exit(-1)
+	cfg, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		help(os.Stdout)
+		os.Exit(exitUsage)
 	}
+	std := newStreams(cfg, os.Stdout, os.Stderr)
+	websocket.SetLogger(cliLogger{w: os.Stderr})
+	websocket.SetLogLevel(logLevel(cfg.quiet, int(cfg.verbose)))
 
-	if _, err = utils.StringToUrl(serverAddress); err != nil {
-		fmt.Println(err)
-		help()
-		os.Exit(-1)
+	_, schemeInferred, err := utils.ParseWsAddress(cfg.address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		help(std.diag)
+		os.Exit(exitUsage)
+	}
+	if schemeInferred && !cfg.quiet {
+		fmt.Fprintln(std.diag, "WARNING: no scheme given, using unencrypted ws://")
 	}
 
-	if server {
-		err = serve(serverAddress, []byte(cert), []byte(key))
+	if cfg.server {
+		var certPEM, keyPEM []byte
+
+		if cfg.certPath != "" {
+			certPEM, keyPEM, err = utils.LoadKeyPair(cfg.certPath, cfg.keyPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitUsage)
+			}
+		}
+		err = serve(ctx, cfg, std, certPEM, keyPEM)
+	} else if cfg.clients > 0 {
+		err = loadTest(ctx, cfg, std)
+	} else if cfg.request != "" {
+		err = sendRequest(ctx, cfg, std)
+	} else if cfg.stdio {
+		err = pipeStdio(ctx, cfg, std)
 	} else {
-		err = connect(serverAddress, skipValidation)
+		err = connect(ctx, cfg, std)
 	}
 
+	stop()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		fmt.Fprintln(os.Stderr, err)
 	}
 
-	os.Exit(0)
+	os.Exit(exitCode(err))
 }
 
-func serve(address string, cert []byte, key []byte) (err error) {
+func serve(ctx context.Context, cfg config, std streams, cert []byte,
+	key []byte) (err error) {
 
 	var (
 		messageCh chan websocket.Message
 		eventCh   chan websocket.Event
-
-		done bool
 	)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	messageCh = make(chan websocket.Message, 1024)
 	eventCh = make(chan websocket.Event, 1024)
 
-	eventToCh := websocket.NewEventsToChannel(messageCh, eventCh)
-	server := websocket.NewServer(address, eventToCh)
+	var events websocket.Events = websocket.NewEventsToChannel(messageCh, eventCh)
 
-	tls := utils.TlsScheme(address)
-	if tls {
+	out := newPrinter(std.diag, cfg.output, cfg.timestamps.String())
+	if cfg.json {
+		out.SetJSON(std.data)
+	}
+	if cfg.quiet {
+		out.SetQuiet()
+	}
+
+	echo := &echoEvents{Events: events, out: out, prefix: cfg.echoPrefix}
+	if cfg.echo {
+		events = echo
+	}
+
+	var server *websocket.Server
+
+	if len(cfg.subprotocols) > 0 {
+		state := newConnectionState(events)
+		state.onConnect = func(id int) {
+			out.Printf(markerEvent, "client <%d> subprotocol: %q",
+				id, server.Subprotocol(id))
+		}
+		events = state
+	}
+
+	server = websocket.NewServer(cfg.address, events)
+	if server == nil {
+		return errors.New("invalid listen address")
+	}
+	echo.server = server
+	if cfg.auth != "" {
+		server.SetAuthHeader(websocket.NewAuthHeader(cfg.authHeader()))
+	}
+	server.SetSubprotocols(cfg.subprotocols...)
+
+	secure, err := utils.IsSecureURL(cfg.address)
+	if err != nil {
+		return
+	}
+	if secure {
 		if len(cert) == 0 || len(key) == 0 {
-			fmt.Println("WARNING: using tls without providing a certificate. generate a self signed one.")
+			if !cfg.quiet {
+				fmt.Fprintln(std.diag, "WARNING: using tls without providing a certificate. generate a self signed one.")
+			}
 			cert, key, err = ccrypt.CreateSelfsignedX509Certificate(big.NewInt(123),
 				100, ccrypt.KeyLength4096Bit,
 				ccrypt.CertificateSubject{
@@ -100,168 +344,608 @@ func serve(address string, cert []byte, key []byte) (err error) {
 					Country:      "CH",
 					Province:     "Zurich",
 					Locality:     "Zurich",
-					CommonName:   address,
+					CommonName:   cfg.address,
 				})
 
 			if err != nil {
 				return
 			}
 		}
-		server.SetupTls(cert, key)
+		if err = server.SetupTls(cert, key); err != nil {
+			return
+		}
 	}
 
-	go func() {
-		err = server.ListenAndServe()
+	if cfg.requireClientCert {
+		if !secure {
+			return withExitCode(exitUsage,
+				errors.New("--require-client-cert needs a wss:// listen address"))
+		}
+		clientCA, err := os.ReadFile(cfg.clientCA)
 		if err != nil {
-			fmt.Println(err)
+			return withExitCode(exitUsage, fmt.Errorf("--client-ca: %w", err))
 		}
+		if err = server.RequireClientCert(clientCA); err != nil {
+			return withExitCode(exitUsage, fmt.Errorf("--client-ca: %w", err))
+		}
+	}
+
+	server.SetKeepalive(cfg.ping, cfg.pingTimeout)
+	server.SetReadLimit(cfg.maxSize)
+	server.SetOnPong(out.Pong)
+
+	listenDone := make(chan error, 1)
+	go func() {
+		listenDone <- server.ListenAndServe()
 	}()
 
-	go handleMessagesAndEvents(&done, messageCh, eventCh)
+	printerDone := make(chan struct{})
+	go func() {
+		defer close(printerDone)
+		handleMessagesAndEvents(ctx, out, messageCh, eventCh, nil, nil)
+	}()
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() && !done {
-		txt := scanner.Text()
-		switch txt {
-		case "exit":
-			server.Close()
-			done = true
-		default:
-			server.Broadcast(&websocket.Message{
-				MessageType: 1,
+	lines := readLines(os.Stdin)
+	interactive := stdinInteractive()
+
+	var listenErr error
+	listening := true
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case listenErr = <-listenDone:
+			// stdin can't reach anyone anymore
+			listening = false
+			break loop
+		case txt, ok := <-lines:
+			if !ok {
+				if interactive {
+					break loop
+				}
+				// piped input is done, keep serving until interrupted
+				lines = nil
+				continue
+			}
+			if txt == "exit" {
+				break loop
+			}
+			if strings.HasPrefix(txt, `\`) {
+				serverCommand(server, out, txt)
+				continue
+			}
+			msg := websocket.Message{
+				MessageType: websocket.TextMessage,
 				Data:        []byte(txt),
-			})
+			}
+			server.Broadcast(&msg)
+			out.Sent(msg)
 		}
 	}
 
-	return
+	server.Close()
+	if listening {
+		listenErr = <-listenDone
+		if errors.Is(listenErr, http.ErrServerClosed) {
+			listenErr = nil
+		}
+	}
+	cancel()
+	<-printerDone
+
+	if listenErr != nil {
+		return fmt.Errorf("listen on %s: %w", cfg.address, listenErr)
+	}
+	return nil
 }
 
-func connect(serverAddress string, skipValidation bool) (err error) {
+func connect(ctx context.Context, cfg config, std streams) (err error) {
 
 	var (
 		messageCh chan websocket.Message
 		eventCh   chan websocket.Event
 
-		done bool
+		sendErr  error
+		serveErr error
+		lost     bool
 	)
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	messageCh = make(chan websocket.Message, 1024)
 	eventCh = make(chan websocket.Event, 1024)
 
-	eventToCh := websocket.NewEventsToChannel(messageCh, eventCh)
-	client := websocket.NewClient(skipValidation, eventToCh)
+	state := newConnectionState(
+		websocket.NewEventsToChannel(messageCh, eventCh))
+	client := websocket.NewClient(cfg.skipVerify, state)
+	out := newPrinter(std.diag, cfg.output, cfg.timestamps.String())
+	if cfg.json {
+		out.SetJSON(std.data)
+	}
+	if cfg.quiet {
+		out.SetQuiet()
+	}
 
-	go func() {
-		err = client.ConnectAndServe(serverAddress, nil)
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	if err = setupClientTLS(client, cfg); err != nil {
+		return withExitCode(exitUsage, err)
+	}
 
-	go handleMessagesAndEvents(&done, messageCh, eventCh)
+	client.SetKeepalive(cfg.ping, cfg.pingTimeout)
+	client.SetReadLimit(cfg.maxSize)
+	client.SetOnPong(out.Pong)
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() && !done {
-		txt := scanner.Text()
-		switch txt {
-		case "exit":
-			_ = client.Disconnect()
-			done = true
-		default:
-			err = client.SendTxt([]byte(txt))
-			if err != nil {
-				fmt.Println(err)
+	var mismatch atomic.Bool
+	if len(cfg.subprotocols) > 0 {
+		client.SetSubprotocols(cfg.subprotocols...)
+		state.onConnect = func(id int) {
+			protocol := client.Subprotocol()
+			if protocol != "" {
+				out.Printf(markerEvent, "subprotocol: %s", protocol)
+				return
 			}
+			out.Printf(markerEvent, "subprotocol mismatch: offered %s, server selected none",
+				cfg.subprotocols.String())
+			mismatch.Store(true)
+			go func() { _ = client.Disconnect() }()
 		}
 	}
 
-	return
-}
+	if cfg.showCert {
+		client.SetOnTLSHandshake(func(state tls.ConnectionState, verifyErr error) {
+			printCertChain(out, state, verifyErr, cfg.skipVerify)
+		})
+	}
 
-func handleMessagesAndEvents(done *bool,
-	messageCh <-chan websocket.Message,
-	eventCh <-chan websocket.Event) {
+	if cfg.reconnect {
+		backoff := utils.NewBackoff()
+		backoff.Initial = cfg.reconnectDelay
+		client.SetReconnect(backoff, cfg.reconnectMax)
+		client.SetOnReconnecting(func(attempt int, delay time.Duration, _ error) {
+			out.Printf(markerEvent, "reconnecting in %v (attempt %d)",
+				delay.Round(time.Millisecond), attempt)
+		})
+	}
 
-	for !*done {
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		serveErr = client.ConnectAndServeWithHeader(cfg.address, cfg.header)
+	}()
+
+	received := make(chan struct{}, 1)
+	var inbox chan websocket.Message
+	if len(cfg.script) > 0 {
+		inbox = make(chan websocket.Message, 1024)
+	}
+	printerDone := make(chan struct{})
+	go func() {
+		defer close(printerDone)
+		handleMessagesAndEvents(ctx, out, messageCh, eventCh, received, inbox)
+	}()
+
+	if cfg.sendFile != "" {
 		select {
-		case msg := <-messageCh:
-			fmt.Printf("rx from client: %s\r\n", string(msg.Data))
-		case evnt := <-eventCh:
-			switch evnt.Type {
-			case websocket.Connect:
-				fmt.Println("connected")
-			case websocket.Disconnect:
-				fmt.Println("disconnected")
-			case websocket.Failure:
-				fmt.Println("failure ", evnt.Err)
+		case <-ctx.Done():
+		case <-serveDone:
+		case <-state.connected:
+			if sendErr = sendFile(client, out, cfg.sendFile, cfg.binary,
+				cfg.maxFileSize); sendErr != nil {
+				out.Printf(markerEvent, "%v", sendErr)
 			}
 		}
 	}
-}
 
-func parseArgs() (serverAddress string, server, skipVerify bool, certPath, keyPath string, err error) {
-	var ignore bool
+	var repeatDone chan struct{}
+	if cfg.message != "" {
+		repeatDone = make(chan struct{})
+		go func() {
+			defer close(repeatDone)
+			repeatSend(ctx, client, state, out, cfg)
+		}()
+	}
 
-	args := os.Args[1:]
+	var (
+		scriptDone chan struct{}
+		scriptErr  error
+	)
+	if len(cfg.script) > 0 {
+		scriptDone = make(chan struct{})
+		go func() {
+			defer close(scriptDone)
+			select {
+			case <-ctx.Done():
+			case <-serveDone:
+			case <-state.connected:
+				scriptErr = runScript(ctx, client, out, cfg.script, inbox, cfg.wait)
+			}
+		}()
+	}
 
-	if len(args) < 1 {
-		return "", false, false, "", "", errors.New("missing args")
+	var lines <-chan string
+	if scriptDone == nil {
+		// stdin is ignored while a script runs
+		lines = readLines(os.Stdin)
 	}
+	interactive := stdinInteractive()
 
-	for idx, arg := range args {
-		if ignore {
-			ignore = false
-			continue
+	// piped input may arrive before the handshake is done
+	if !interactive {
+		select {
+		case <-ctx.Done():
+		case <-serveDone:
+		case <-state.connected:
 		}
+	}
 
-		switch arg {
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-serveDone:
+			lost = true
+			break loop
+		case <-scriptDone:
+			break loop
+		case <-repeatDone:
+			if e := waitForResponse(ctx, received, cfg.wait,
+				cfg.expectResponse); e != nil && sendErr == nil {
+				sendErr = e
+			}
+			break loop
+		case txt, ok := <-lines:
+			if !ok && repeatDone != nil && !interactive {
+				// keep sending, the input is not needed
+				lines = nil
+				continue
+			}
+			if !ok {
+				if !interactive {
+					if e := waitForResponse(ctx, received, cfg.wait,
+						cfg.expectResponse); e != nil && sendErr == nil {
+						sendErr = e
+					}
+				}
+				break loop
+			}
 
-		case "-l", "--listen":
-			server = true
-			if len(args) < idx+2 {
-				return "", false, false, "", "",
-					errors.New("missing parameter for listen")
+			var e error
+			switch {
+			case txt == "exit":
+				break loop
+			case !state.up.Load():
+				e = errors.New("not connected, input rejected")
+			case strings.HasPrefix(txt, "/file "):
+				e = sendFile(client, out, strings.TrimSpace(txt[len("/file "):]),
+					cfg.binary, cfg.maxFileSize)
+			default:
+				msg := websocket.Message{
+					MessageType: websocket.TextMessage,
+					Data:        []byte(txt),
+				}
+				if e = client.Send(msg); e == nil {
+					out.Sent(msg)
+				}
 			}
-			ignore = true
-			serverAddress = args[idx+1]
-
-		case "-c", "--connect":
-			server = false
-			if len(args) < idx+2 {
-				return "", false, false, "", "",
-					errors.New("missing parameter for connect")
+			if e != nil {
+				out.Printf(markerEvent, "%v", e)
+				sendErr = e
 			}
-			ignore = true
-			serverAddress = args[idx+1]
+		}
+	}
 
-		case "-k", "--skip-verify":
-			skipVerify = true
+	_ = client.Disconnect()
+	<-serveDone
+	cancel()
+	<-printerDone
+	if scriptDone != nil {
+		// scriptErr is set by the script goroutine
+		<-scriptDone
+	}
 
-		case "--cert":
-			if len(args) < idx+2 {
-				return "", false, false, "", "",
-					errors.New("missing parameter for certificate")
-			}
-			ignore = true
-			certPath = args[idx+1]
+	if !cfg.noSummary {
+		printSummary(out, client.Stats())
+	}
+
+	if mismatch.Load() {
+		return withExitCode(exitDial, errors.New("subprotocol mismatch"))
+	}
+	if lost {
+		if serveErr == nil {
+			serveErr = errors.New("connection closed")
+		}
+		if websocket.KindOf(serveErr) == websocket.KindAuthRejected {
+			serveErr = fmt.Errorf("%w, server answered 401/403, check --auth",
+				serveErr)
+		}
+		select {
+		case <-state.connected:
+			return withExitCode(connectionExitCode(serveErr, true), serveErr)
+		default:
+			return withExitCode(connectionExitCode(serveErr, false), serveErr)
+		}
+	}
+	if scriptErr != nil {
+		return scriptErr
+	}
+	if sendErr != nil && !interactive {
+		return sendErr
+	}
+	return nil
+}
+
+// handleMessagesAndEvents prints incoming traffic until ctx is done and
+// flushes what is still buffered afterwards. inbox, if set, gets a copy of
+// every message without blocking. received, if set, is signalled
+// without blocking on every message.
+func handleMessagesAndEvents(ctx context.Context, out *printer,
+	messageCh <-chan websocket.Message,
+	eventCh <-chan websocket.Event,
+	received chan<- struct{}, inbox chan<- websocket.Message) {
 
-		case "--key":
-			if len(args) < idx+2 {
-				return "", false, false, "", "",
-					errors.New("missing parameter for private key")
+	printMessage := func(msg websocket.Message) {
+		out.Received(msg)
+		if inbox != nil {
+			select {
+			case inbox <- msg:
+			default:
+			}
+		}
+		if received != nil {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}
+	for {
+		select {
+		case msg := <-messageCh:
+			printMessage(msg)
+		case evnt := <-eventCh:
+			out.Event(evnt)
+		case <-ctx.Done():
+			for {
+				select {
+				case msg := <-messageCh:
+					printMessage(msg)
+				case evnt := <-eventCh:
+					out.Event(evnt)
+				default:
+					return
+				}
 			}
-			ignore = true
-			keyPath = args[idx+1]
 		}
 	}
+}
+
+func parseArgs(args []string) (cfg config, err error) {
+	var listen, connect string
+
+	cfg.header = make(http.Header)
+
+	flags := flag.NewFlagSet("easy-websockets", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+
+	flags.StringVar(&listen, "l", "", "")
+	flags.StringVar(&listen, "listen", "", "")
+	flags.StringVar(&connect, "c", "", "")
+	flags.StringVar(&connect, "connect", "", "")
+	flags.BoolVar(&cfg.skipVerify, "k", false, "")
+	flags.BoolVar(&cfg.skipVerify, "skip-verify", false, "")
+	flags.StringVar(&cfg.certPath, "cert", "", "")
+	flags.StringVar(&cfg.keyPath, "key", "", "")
+	flags.Var(headerFlag(cfg.header), "header", "")
+	flags.StringVar(&cfg.sendFile, "send-file", "", "")
+	flags.BoolVar(&cfg.binary, "binary", false, "")
+	flags.Int64Var(&cfg.maxFileSize, "max-file-size", defaultMaxFileSize, "")
+	flags.Int64Var(&cfg.maxSize, "max-size", defaultMaxSize, "")
+	flags.StringVar(&cfg.output, "output", outputText, "")
+	flags.BoolVar(&cfg.reconnect, "reconnect", false, "")
+	flags.IntVar(&cfg.reconnectMax, "reconnect-max", 0, "")
+	flags.DurationVar(&cfg.reconnectDelay, "reconnect-delay",
+		utils.DefaultBackoffInitial, "")
+	flags.BoolVar(&cfg.echo, "echo", false, "")
+	flags.StringVar(&cfg.echoPrefix, "echo-prefix", "", "")
+	flags.DurationVar(&cfg.ping, "ping", 0, "")
+	flags.DurationVar(&cfg.pingTimeout, "ping-timeout", 0, "")
+	flags.DurationVar(&cfg.wait, "wait", defaultWait, "")
+	flags.BoolVar(&cfg.expectResponse, "expect-response", false, "")
+	flags.Var(&cfg.timestamps, "timestamps", "")
+	flags.BoolVar(&cfg.json, "json", false, "")
+	flags.IntVar(&cfg.clients, "clients", 0, "")
+	flags.StringVar(&cfg.message, "message", "", "")
+	flags.DurationVar(&cfg.interval, "interval", 0, "")
+	flags.IntVar(&cfg.count, "count", 0, "")
+	flags.BoolVar(&cfg.showCert, "show-cert", false, "")
+	flags.StringVar(&cfg.origin, "origin", "", "")
+	flags.Var(&cfg.subprotocols, "subprotocol", "")
+	flags.Var(&cfg.verbose, "v", "")
+	flags.Var(&cfg.verbose, "verbose", "")
+	flags.BoolVar(&cfg.quiet, "quiet", false, "")
+	flags.Var(&cfg.rootCAs, "root-ca", "")
+	flags.StringVar(&cfg.clientCert, "client-cert", "", "")
+	flags.StringVar(&cfg.clientKey, "client-key", "", "")
+	flags.BoolVar(&cfg.requireClientCert, "require-client-cert", false, "")
+	flags.StringVar(&cfg.clientCA, "client-ca", "", "")
+	flags.BoolVar(&cfg.noSummary, "no-summary", false, "")
+	flags.StringVar(&cfg.auth, "auth", "", "")
+	flags.StringVar(&cfg.authHash, "auth-hash", "none", "")
+	script := flags.String("script", "", "")
+	flags.StringVar(&cfg.request, "request", "", "")
+	flags.StringVar(&cfg.expect, "expect", "", "")
+	flags.DurationVar(&cfg.timeout, "timeout", 0, "")
+	flags.BoolVar(&cfg.stdio, "stdio", false, "")
+
+	if len(args) < 1 {
+		return cfg, errors.New("missing args")
+	}
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+
+	switch {
+	case flags.NArg() > 0:
+		return cfg, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	case listen != "" && connect != "":
+		return cfg, errors.New("either listen or connect, not both")
+	case listen != "":
+		cfg.server = true
+		cfg.address = listen
+	case connect != "":
+		cfg.address = connect
+	default:
+		return cfg, errors.New("missing listen or connect address")
+	}
+
+	if cfg.maxSize < 0 {
+		return cfg, errors.New("--max-size must not be negative")
+	}
+	if cfg.ping > 0 && cfg.pingTimeout == 0 {
+		cfg.pingTimeout = 2 * cfg.ping
+	}
+	if !validOutputFormat(cfg.output) {
+		return cfg, fmt.Errorf("unknown output format %q", cfg.output)
+	}
+	if !cfg.server && cfg.echo {
+		return cfg, errors.New("--echo is only supported in server mode")
+	}
+	if cfg.server && cfg.sendFile != "" {
+		return cfg, errors.New("--send-file is only supported in client mode")
+	}
+	if cfg.server && cfg.expectResponse {
+		return cfg, errors.New("--expect-response is only supported in client mode")
+	}
+	if cfg.server && cfg.showCert {
+		return cfg, errors.New("--show-cert is only supported in client mode")
+	}
+	if cfg.origin != "" {
+		if cfg.server {
+			return cfg, errors.New("--origin is only supported in client mode")
+		}
+		if err = checkOrigin(cfg.origin); err != nil {
+			return
+		}
+		cfg.header.Set("Origin", cfg.origin)
+	}
+	if cfg.quiet && cfg.verbose > 0 {
+		return cfg, errors.New("either --quiet or --verbose, not both")
+	}
+	if cfg.server && len(cfg.rootCAs) > 0 {
+		return cfg, errors.New("--root-ca is only supported in client mode")
+	}
+	if (cfg.clientCert == "") != (cfg.clientKey == "") {
+		return cfg, errors.New("--client-cert and --client-key must be given together")
+	}
+	if cfg.server && cfg.clientCert != "" {
+		return cfg, errors.New("--client-cert is only supported in client mode")
+	}
+	if cfg.requireClientCert != (cfg.clientCA != "") {
+		return cfg, errors.New("--require-client-cert and --client-ca must be given together")
+	}
+	if !cfg.server && cfg.requireClientCert {
+		return cfg, errors.New("--require-client-cert is only supported in server mode")
+	}
+	if cfg.server && (cfg.message != "" || cfg.interval > 0) {
+		return cfg, errors.New("--message and --interval are only supported in client mode")
+	}
+	if cfg.clients == 0 && (cfg.message != "") != (cfg.interval > 0) {
+		return cfg, errors.New("--message and --interval must be given together")
+	}
+	if cfg.count < 0 {
+		return cfg, errors.New("--count must not be negative")
+	}
+	if cfg.count > 0 && cfg.message == "" {
+		return cfg, errors.New("--count needs --message and --interval")
+	}
+	if _, ok := hashAlgos[cfg.authHash]; !ok {
+		return cfg, fmt.Errorf("unknown --auth-hash %q, expected none, md5 or sha256",
+			cfg.authHash)
+	}
+	if cfg.auth != "" {
+		key, value, algo := cfg.authHeader()
+		if key == "" || !strings.Contains(cfg.auth, "=") {
+			return cfg, fmt.Errorf("invalid --auth %q, expected <header>=<value>",
+				cfg.auth)
+		}
+		if !cfg.server {
+			hashed, _ := websocket.HashAuthValue(value, algo)
+			cfg.header.Set(key, hashed)
+		}
+	}
+	if *script != "" {
+		if cfg.server || cfg.clients > 0 {
+			return cfg, errors.New("--script is only supported in client mode")
+		}
+		if cfg.message != "" {
+			return cfg, errors.New("either --script or --message, not both")
+		}
+		if cfg.script, err = loadScript(*script); err != nil {
+			return
+		}
+	}
+	if cfg.request != "" {
+		if cfg.server || cfg.clients > 0 {
+			return cfg, errors.New("--request is only supported in client mode")
+		}
+		if cfg.script != nil || cfg.message != "" || cfg.sendFile != "" {
+			return cfg, errors.New("--request can't be combined with --script, --message or --send-file")
+		}
+		if cfg.timeout < 0 {
+			return cfg, errors.New("--timeout must not be negative")
+		}
+		if cfg.timeout == 0 {
+			cfg.timeout = defaultRequestTimeout
+		}
+	} else if cfg.expect != "" || cfg.timeout != 0 {
+		return cfg, errors.New("--expect and --timeout need --request")
+	}
+	if cfg.stdio {
+		if cfg.server || cfg.clients > 0 {
+			return cfg, errors.New("--stdio is only supported in client mode")
+		}
+		if cfg.script != nil || cfg.message != "" || cfg.sendFile != "" ||
+			cfg.request != "" || cfg.json {
+			return cfg, errors.New("--stdio can't be combined with --script, --message, --send-file, --request or --json")
+		}
+	}
+	if cfg.server && cfg.clients > 0 {
+		return cfg, errors.New("--clients is only supported in client mode")
+	}
+	if cfg.clients < 0 {
+		return cfg, errors.New("--clients must not be negative")
+	}
+	if (cfg.certPath == "") != (cfg.keyPath == "") {
+		return cfg, errors.New("--cert and --key must be given together")
+	}
 
 	return
 }
 
-func help() {
-	fmt.Println("GoLang Easy Websockets by ChrIgiSta")
-	fmt.Println(`
+// checkOrigin validates an --origin value. Unusual schemes are allowed to
+// test the servers policy but get a warning.
+func checkOrigin(origin string) error {
+	if origin == "null" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin %q: %w", origin, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		fmt.Fprintf(os.Stderr, "WARNING: unusual origin scheme %q\n", u.Scheme)
+	}
+	return nil
+}
+
+func help(w io.Writer) {
+	fmt.Fprintln(w, "GoLang Easy Websockets by ChrIgiSta")
+	fmt.Fprintln(w, `
       ________________________   ___ _     ________________  _  ____
      / _____  _  ____________/  / __|_|   /_______________  | | ___/
     ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
@@ -270,28 +954,91 @@ func help() {
     (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
 
 	                                  Copyright © 2024, Staufi Tech`)
-	fmt.Println("How To Use:")
-	fmt.Println(`
+	fmt.Fprintln(w, "How To Use:")
+	fmt.Fprintln(w, `
 	Server:
 
 	Flags         	Parameters
 	-l, --listen: 	<ws://localhost:12345/path>`)
 
-	fmt.Println(`
+	fmt.Fprintln(w, `
 	Client:
 
 	Flags         	Parameters
 	-c, --connect: 	<ws://10.100.23.1:12345/path>`)
 
-	fmt.Println(`
+	fmt.Fprintln(w, `
 	Optional:
 
 	Flags         		Parameters
 	--cert: 			</path/to/cert.pem>
 	--key: 				</path/to/key.pem>
 	-k, --skip-verify	skip validation of servers certificate
+	--header: 			<"Key: Value"> handshake header, repeatable
+	--send-file: 		</path/to/file> send a file as one message after connect
+	--binary			send files as binary message (default: detect)
+	--max-file-size: 	<bytes> largest file to send (default 16 MiB)
+	--max-size: 		<bytes> largest message to receive, bigger ones close
+						the connection (default 16 MiB, 0: no limit)
+	--output: 			<text|hex|base64> rendering of received payloads
+	--reconnect			reconnect with backoff after the connection is lost
+	--reconnect-max: 	<n> give up after n failed attempts (default 0: never)
+	--reconnect-delay: 	<duration> initial reconnect delay (default 500ms)
+	--ping: 			<duration> send ping frames at this interval
+	--ping-timeout: 	<duration> missing pong deadline (default 2x ping)
+	--echo				server: send received messages back to the sender
+	--echo-prefix: 		<text> server: prefix for echoed text messages
+	--wait: 			<duration> client: linger after EOF on piped input (default 1s)
+	--expect-response	client: after EOF wait for a message, fail after --wait
+	--timestamps[=rel]	prefix lines with a time and <<, >> or ** marker
+	--json				print messages and events as json lines, rest to stderr
+	--clients: 			<n> client: load test with n concurrent connections
+	--message: 			<text> client: message to repeat, {seq} and {ts} are
+						expanded (load test: sent by each client as is)
+	--interval: 		<duration> send --message at this interval
+	--count: 			<n> stop after n messages (default 0: forever)
+	--show-cert			client: print the servers certificate chain
+	--origin: 			<https://example.com> client: Origin header to send
+	--subprotocol: 		<name> client: offer, server: accept protocol, repeatable
+	--root-ca: 			</path/to/ca.pem> client: trust this ca, repeatable
+	--client-cert: 		</path/to/cert.pem> client: certificate for mutual tls
+	--client-key: 		</path/to/key.pem> client: key for --client-cert
+	--require-client-cert	server: require a client certificate (mutual tls)
+	--client-ca: 		</path/to/ca.pem> server: ca for client certificates
+	--no-summary		client: no session statistics on exit
+	--auth: 			<header>=<value> server: require, client: send header
+	--auth-hash: 		<none|md5|sha256> client sends the hex digest of the value
+	--script: 			<file> client: run a script after connect, stdin is
+						ignored. One step per line, # starts a comment:
+						send <text>, sendb64 <data>, wait <duration>,
+						expect <substring> [timeout] (default --wait), close
+	--request: 			<text> client: send, print the first reply to stdout
+						and exit, everything else goes to stderr
+	--timeout: 			<duration> --request: connect and reply deadline
+						(default 10s)
+	--expect: 			<text> --request: fail if the reply does not contain it
+	--stdio				client: pipe stdin and stdout through the connection
+						undecorated, lines as text messages (--binary: raw
+						chunks as binary messages), events go to stderr
+	-v, --verbose		more log output, repeat for debug (-v -v)
+	--quiet				only print received messages and fatal errors
+
+Commands (client):
+	/file <path>		send a file as one message
+
+Commands (server), other lines are broadcast:
+	\clients			list connected clients
+	\send <id> <text>	send to one client
+	\kick <id>			disconnect a client
+	\stats				print the server counters
 	
+Exit codes:
+	0 clean exit, 1 other error, 2 usage error, 3 connection or dial failure,
+	4 authentication rejected, 5 tls failure, 6 connection lost unexpectedly,
+	7 --request timed out
+
 Exiting:
-	just typing 'exit'`)
+	just typing 'exit', Ctrl-D or Ctrl-C. Piped input ends the client after
+	EOF and --wait, the server keeps running until interrupted.`)
 
 }
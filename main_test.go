@@ -0,0 +1,437 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+func TestHandleMessagesAndEventsShutdown(t *testing.T) {
+	var buf bytes.Buffer
+	out := newPrinter(&buf, outputText, timestampsOff)
+	messageCh := make(chan websocket.Message, 4)
+	eventCh := make(chan websocket.Event, 4)
+	received := make(chan struct{}, 1)
+	inbox := make(chan websocket.Message, 4)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleMessagesAndEvents(ctx, out, messageCh, eventCh, received, inbox)
+	}()
+
+	messageCh <- websocket.Message{MessageType: websocket.TextMessage, Data: []byte("first")}
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message not handled")
+	}
+
+	// buffered traffic is flushed after exit, then the loop returns
+	messageCh <- websocket.Message{MessageType: websocket.TextMessage, Data: []byte("last")}
+	eventCh <- websocket.Event{Type: websocket.Failure, Err: errors.New("lost")}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("loop still running after the context was cancelled")
+	}
+
+	output := buf.String()
+	for _, expected := range []string{"first", "last", "lost"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("%q missing in %q", expected, output)
+		}
+	}
+	if len(inbox) != 2 {
+		t.Errorf("%d messages in the inbox", len(inbox))
+	}
+
+	// nothing is consumed or printed after returning
+	messageCh <- websocket.Message{MessageType: websocket.TextMessage, Data: []byte("late")}
+	time.Sleep(50 * time.Millisecond)
+	if len(messageCh) != 1 || strings.Contains(buf.String(), "late") {
+		t.Error("message handled after the loop returned")
+	}
+}
+
+func TestServeListenFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	cfg, err := parseArgs([]string{"-l", "ws://" + taken.Addr().String() + "/", "--quiet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// piped input which stays open, serve keeps running on its own
+	stdin, pipe, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipe.Close()
+	defer func(orig *os.File) { os.Stdin = orig }(os.Stdin)
+	os.Stdin = stdin
+
+	done := make(chan error, 1)
+	std := streams{data: io.Discard, diag: io.Discard}
+	go func() { done <- serve(context.Background(), cfg, std, nil, nil) }()
+	select {
+	case err = <-done:
+		if err == nil || !strings.Contains(err.Error(), "listen") {
+			t.Errorf("expected the listen error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve kept running without a listener")
+	}
+}
+
+func TestStreams(t *testing.T) {
+	for _, tc := range []struct {
+		args       []string
+		diagStderr bool
+	}{
+		{[]string{"-c", "ws://localhost:1/"}, false},
+		{[]string{"-l", "ws://localhost:1/"}, false},
+		{[]string{"-c", "ws://localhost:1/", "--json"}, true},
+		{[]string{"-c", "ws://localhost:1/", "--request", "ping"}, true},
+		{[]string{"-c", "ws://localhost:1/", "--stdio"}, true},
+	} {
+		cfg, err := parseArgs(tc.args)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		std := newStreams(cfg, stdout, stderr)
+		if std.data != stdout {
+			t.Errorf("%v: data not on stdout", tc.args)
+		}
+		if (std.diag == stderr) != tc.diagStderr {
+			t.Errorf("%v: diagnostics on stderr %v, want %v", tc.args,
+				std.diag == stderr, tc.diagStderr)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.txt")
+	if err := os.WriteFile(script, []byte("send hello\nclose\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{}, "missing args"},
+		{[]string{"-k"}, "missing listen or connect address"},
+		{[]string{"-l", ":1", "-c", "ws://localhost:1/"}, "not both"},
+		{[]string{"-c", "ws://localhost:1/", "extra"}, "unexpected argument"},
+		{[]string{"-c", "ws://localhost:1/", "--header", "novalue"}, "invalid header"},
+		{[]string{"-c", "ws://localhost:1/", "--output", "octal"}, "unknown output format"},
+		{[]string{"-c", "ws://localhost:1/", "--output", "hex"}, ""},
+		{[]string{"-c", "ws://localhost:1/", "--timestamps=rel"}, ""},
+		{[]string{"-c", "ws://localhost:1/", "--timestamps=utc"}, "invalid timestamps"},
+		{[]string{"-c", "ws://localhost:1/", "--echo"}, "only supported in server mode"},
+		{[]string{"-l", ":1", "--echo", "--echo-prefix", "> "}, ""},
+		{[]string{"-l", ":1", "--send-file", "x"}, "only supported in client mode"},
+		{[]string{"-c", "ws://localhost:1/", "--origin", "localhost"}, "invalid origin"},
+		{[]string{"-l", ":1", "--origin", "http://localhost"}, "only supported in client mode"},
+		{[]string{"-c", "ws://localhost:1/", "-q", "-v"}, "flag provided but not defined"},
+		{[]string{"-c", "ws://localhost:1/", "--quiet", "-v"}, "either --quiet or --verbose"},
+		{[]string{"-c", "ws://localhost:1/", "--client-cert", "c.pem"}, "must be given together"},
+		{[]string{"-l", ":1", "--require-client-cert"}, "must be given together"},
+		{[]string{"-c", "ws://localhost:1/", "--message", "x"}, "must be given together"},
+		{[]string{"-c", "ws://localhost:1/", "--message", "x", "--interval", "1s"}, ""},
+		{[]string{"-c", "ws://localhost:1/", "--count", "3"}, "--count needs"},
+		{[]string{"-c", "ws://localhost:1/", "--auth-hash", "sha1"}, "unknown --auth-hash"},
+		{[]string{"-c", "ws://localhost:1/", "--auth", "token"}, "invalid --auth"},
+		{[]string{"-c", "ws://localhost:1/", "--script", script}, ""},
+		{[]string{"-l", ":1", "--script", script}, "only supported in client mode"},
+		{[]string{"-c", "ws://localhost:1/", "--request", "ping", "--message", "x",
+			"--interval", "1s"}, "can't be combined"},
+		{[]string{"-c", "ws://localhost:1/", "--expect", "pong"}, "need --request"},
+		{[]string{"-c", "ws://localhost:1/", "--stdio", "--json"}, "can't be combined"},
+		{[]string{"-l", ":1", "--clients", "2"}, "only supported in client mode"},
+		{[]string{"-l", ":1", "--cert", "c.pem"}, "must be given together"},
+	} {
+		_, err := parseArgs(tc.args)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%v: %v", tc.args, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%v: got error %v, want %q", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestParseArgsDefaults(t *testing.T) {
+	cfg, err := parseArgs([]string{"-c", "ws://localhost:1/",
+		"--header", "X-One: 1", "--header", "X-One:2",
+		"--origin", "http://localhost", "--auth", "X-Token=secret",
+		"--ping", "1s", "-v", "-v", "--request", "ping"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cfg.header.Values("X-One"); len(got) != 2 || got[0] != "1" || got[1] != "2" {
+		t.Errorf("header X-One %v", got)
+	}
+	if got := cfg.header.Get("Origin"); got != "http://localhost" {
+		t.Errorf("origin header %q", got)
+	}
+	if got := cfg.header.Get("X-Token"); got != "secret" {
+		t.Errorf("auth header %q", got)
+	}
+	if cfg.pingTimeout != 2*time.Second {
+		t.Errorf("ping timeout %v, want 2s", cfg.pingTimeout)
+	}
+	if cfg.verbose != 2 {
+		t.Errorf("verbose %d, want 2", cfg.verbose)
+	}
+	if cfg.timeout != defaultRequestTimeout {
+		t.Errorf("request timeout %v, want %v", cfg.timeout, defaultRequestTimeout)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		quiet   bool
+		verbose int
+		level   websocket.LogLevel
+	}{
+		{false, 0, websocket.LogLevelWarn},
+		{false, 1, websocket.LogLevelInfo},
+		{false, 3, websocket.LogLevelDebug},
+		{true, 0, websocket.LogLevelNone},
+	} {
+		if got := logLevel(tc.quiet, tc.verbose); got != tc.level {
+			t.Errorf("quiet %v verbose %d: level %v, want %v",
+				tc.quiet, tc.verbose, got, tc.level)
+		}
+	}
+}
+
+func TestFormatPayload(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		msg    websocket.Message
+		want   string
+	}{
+		{outputText, websocket.Message{Data: []byte("hi")}, "hi"},
+		{outputText, websocket.Message{Data: []byte("a\r\nb\tc\x1b[0m")}, `a\r\nb\tc\x1b[0m`},
+		{outputText, websocket.Message{Data: []byte{'o', 'k', 0xff}}, `ok\xff`},
+		{outputText, websocket.Message{Data: []byte("grüße")}, "grüße"},
+		{outputBase64, websocket.Message{MessageType: websocket.BinaryMessage,
+			Data: []byte{0, 1, 2}}, "binary, 3 bytes: AAEC"},
+		{outputHex, websocket.Message{MessageType: websocket.BinaryMessage,
+			Data: []byte("hi")}, "binary, 2 bytes\r\n" +
+			"00000000  68 69                                             |hi|"},
+	} {
+		if got := formatPayload(tc.format, tc.msg); got != tc.want {
+			t.Errorf("%s %q: got %q, want %q", tc.format, tc.msg.Data, got, tc.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOk},
+		{errFailed, exitFailure},
+		{withExitCode(exitTimeout, errFailed), exitTimeout},
+		{fmt.Errorf("request: %w", withExitCode(exitUsage, errFailed)), exitUsage},
+		{withExitCode(exitDial, nil), exitOk},
+	} {
+		if got := exitCode(tc.err); got != tc.code {
+			t.Errorf("%v: exit code %d, want %d", tc.err, got, tc.code)
+		}
+	}
+
+	if code := connectionExitCode(errFailed, false); code != exitDial {
+		t.Errorf("failed dial: exit code %d, want %d", code, exitDial)
+	}
+	if code := connectionExitCode(errFailed, true); code != exitConnectionLost {
+		t.Errorf("lost connection: exit code %d, want %d", code, exitConnectionLost)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, tc := range []struct {
+		template string
+		seq      int
+		want     string
+	}{
+		{"ping", 1, "ping"},
+		{"ping {seq}", 42, "ping 42"},
+		{"{seq}/{seq} at {ts}", 7, "7/7 at 2024-01-02T03:04:05Z"},
+		{"{sequence}", 1, "{sequence}"},
+	} {
+		if got := expandTemplate(tc.template, tc.seq, now); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		steps  []scriptStep
+		err    string
+	}{
+		{script: "# only a comment\n\n", err: "empty script"},
+		{script: "send hello world\nsendb64 AAEC\nwait 50ms\nclose\n", steps: []scriptStep{
+			{line: 1, op: scriptSend, arg: "hello world", data: []byte("hello world")},
+			{line: 2, op: scriptSendB64, arg: "AAEC", data: []byte{0, 1, 2}},
+			{line: 3, op: scriptWait, arg: "50ms", timeout: 50 * time.Millisecond},
+			{line: 4, op: scriptClose},
+		}},
+		{script: "  # login\nexpect welcome user 2s\nexpect done later\n", steps: []scriptStep{
+			{line: 2, op: scriptExpect, arg: "welcome user", timeout: 2 * time.Second},
+			{line: 3, op: scriptExpect, arg: "done later"},
+		}},
+		{script: "send a\nsendb64 !!\n", err: "line 2"},
+		{script: "wait soon\n", err: "line 1"},
+		{script: "expect\n", err: "missing substring"},
+		{script: "close now\n", err: "unexpected argument"},
+		{script: "sleep 1s\n", err: `unknown command "sleep"`},
+	} {
+		steps, err := parseScript(strings.NewReader(tc.script))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: got error %v, want %q", tc.script, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.script, err)
+			continue
+		}
+		if !reflect.DeepEqual(steps, tc.steps) {
+			t.Errorf("%q: got %+v, want %+v", tc.script, steps, tc.steps)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		origin string
+		valid  bool
+	}{
+		{"null", true},
+		{"http://localhost", true},
+		{"https://example.com:8443", true},
+		{"chrome-extension://abcdef", true},
+		{"localhost", false},
+		{"http://", false},
+		{"http://[::1", false},
+	} {
+		if err := checkOrigin(tc.origin); (err == nil) != tc.valid {
+			t.Errorf("%q: got error %v, want valid %v", tc.origin, err, tc.valid)
+		}
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	reply := websocket.Message{MessageType: websocket.TextMessage, Data: []byte("pong")}
+
+	for _, tc := range []struct {
+		cfg  config
+		want string
+	}{
+		{config{output: outputText}, "pong\n"},
+		{config{output: outputBase64}, "text, 4 bytes: cG9uZw==\n"},
+		{config{output: outputText, json: true}, `"data":"pong"`},
+	} {
+		var buf bytes.Buffer
+		if err := writeReply(&buf, tc.cfg, reply); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); !strings.Contains(got, tc.want) {
+			t.Errorf("%+v: got %q, want %q", tc.cfg, got, tc.want)
+		}
+	}
+}
+
+func TestFormatPercentiles(t *testing.T) {
+	if got := formatPercentiles(nil); got != "" {
+		t.Errorf("no latencies: got %q", got)
+	}
+
+	var latencies []time.Duration
+	for i := 100; i > 0; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	want := ", latency p50 50ms p90 90ms p99 99ms"
+	if got := formatPercentiles(latencies); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEchoFailureStillPrints(t *testing.T) {
+	var buf bytes.Buffer
+	out := newPrinter(&buf, outputText, timestampsOff)
+	recorder := websockettest.NewRecorder()
+	echo := &echoEvents{
+		Events: recorder,
+		server: websocket.NewServer("ws://localhost:1/", recorder),
+		out:    out,
+	}
+
+	// no client 7 is connected, the echo fails
+	echo.OnReceive(websocket.Message{ClientId: 7,
+		MessageType: websocket.TextMessage, Data: []byte("hello")})
+
+	if !strings.Contains(buf.String(), "echo to <7>") {
+		t.Errorf("echo error not logged: %q", buf.String())
+	}
+	if msgs := recorder.Messages(); len(msgs) != 1 || string(msgs[0].Data) != "hello" {
+		t.Errorf("message not passed on: %v", msgs)
+	}
+}
@@ -0,0 +1,260 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package metrics exposes the counters of websocket servers and clients as
+// prometheus collectors. Labels are bounded, there are none per client.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// SizeBuckets are the buckets of the message size histograms, 64 B to
+// 1 MiB.
+var SizeBuckets = prometheus.ExponentialBuckets(64, 4, 8)
+
+// observer wraps an event handler to observe the size of received messages
+// and a pong hook to observe round trip times.
+type observer struct {
+	inner websocket.Events
+	sizes prometheus.Histogram
+	rtt   prometheus.Histogram
+}
+
+func (o *observer) OnReceive(msg websocket.Message) {
+	o.OnReceiveCtx(context.Background(), msg)
+}
+
+func (o *observer) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	o.sizes.Observe(float64(len(msg.Data)))
+	if inner, ok := o.inner.(websocket.CtxEvents); ok {
+		inner.OnReceiveCtx(ctx, msg)
+	} else {
+		o.inner.OnReceive(msg)
+	}
+}
+
+func (o *observer) OnConnect(id int) {
+	o.inner.OnConnect(id)
+}
+
+func (o *observer) OnDisconnect(id int) {
+	o.inner.OnDisconnect(id)
+}
+
+func (o *observer) OnFailure(exited bool, err error) {
+	o.inner.OnFailure(exited, err)
+}
+
+func (o *observer) pongHook(next websocket.PongHook) websocket.PongHook {
+	return func(id int, rtt time.Duration) {
+		o.rtt.Observe(rtt.Seconds())
+		if next != nil {
+			next(id, rtt)
+		}
+	}
+}
+
+func newObserver(namespace string, labels prometheus.Labels,
+	inner websocket.Events) *observer {
+
+	return &observer{
+		inner: inner,
+		sizes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "received_message_size_bytes",
+			Help:        "Size of the received messages.",
+			Buckets:     SizeBuckets,
+			ConstLabels: labels,
+		}),
+		rtt: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Name:        "ping_rtt_seconds",
+			Help:        "Round trip time of keepalive pings.",
+			Buckets:     prometheus.DefBuckets,
+			ConstLabels: labels,
+		}),
+	}
+}
+
+func counter(desc *prometheus.Desc, value uint64,
+	labels ...string) prometheus.Metric {
+
+	return prometheus.MustNewConstMetric(desc, prometheus.CounterValue,
+		float64(value), labels...)
+}
+
+func gauge(desc *prometheus.Desc, value float64) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+}
+
+// ServerCollector reports the Stats of a server, labeled with its listen
+// address and path.
+type ServerCollector struct {
+	server   *websocket.Server
+	observer *observer
+
+	connections *prometheus.Desc
+	connects    *prometheus.Desc
+	messages    *prometheus.Desc
+	bytes       *prometheus.Desc
+	errors      *prometheus.Desc
+}
+
+// NewServerCollector wraps the event handler and pong hook of s to observe
+// message sizes and ping round trips. Create it before ListenAndServe.
+func NewServerCollector(s *websocket.Server) *ServerCollector {
+	const namespace = "websocket_server"
+	labels := prometheus.Labels{"address": s.Address(), "path": s.Path()}
+
+	c := &ServerCollector{
+		server:   s,
+		observer: newObserver(namespace, labels, s.EventHandler()),
+		connections: prometheus.NewDesc(namespace+"_connections",
+			"Currently connected clients.", nil, labels),
+		connects: prometheus.NewDesc(namespace+"_connections_total",
+			"Clients accepted.", nil, labels),
+		messages: prometheus.NewDesc(namespace+"_messages_total",
+			"Messages by direction.", []string{"direction"}, labels),
+		bytes: prometheus.NewDesc(namespace+"_bytes_total",
+			"Payload bytes by direction.", []string{"direction"}, labels),
+		errors: prometheus.NewDesc(namespace+"_errors_total",
+			"Failed broadcast sends and rejected upgrades.",
+			[]string{"type"}, labels),
+	}
+	s.SetEventHandler(c.observer)
+	s.SetOnPong(c.observer.pongHook(s.OnPong()))
+	return c
+}
+
+func (c *ServerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connections
+	ch <- c.connects
+	ch <- c.messages
+	ch <- c.bytes
+	ch <- c.errors
+	c.observer.sizes.Describe(ch)
+	c.observer.rtt.Describe(ch)
+}
+
+func (c *ServerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.server.Stats()
+
+	ch <- gauge(c.connections, float64(stats.Clients))
+	ch <- counter(c.connects, uint64(stats.Connects))
+	ch <- counter(c.messages, stats.MessagesReceived, "in")
+	ch <- counter(c.messages, stats.MessagesSent, "out")
+	ch <- counter(c.bytes, stats.BytesReceived, "in")
+	ch <- counter(c.bytes, stats.BytesSent, "out")
+	ch <- counter(c.errors, stats.BroadcastErrors, "broadcast")
+	ch <- counter(c.errors, stats.RejectedUpgrades, "rejected_upgrade")
+	c.observer.sizes.Collect(ch)
+	c.observer.rtt.Collect(ch)
+}
+
+// ClientCollector reports the Stats of a client, labeled with target.
+type ClientCollector struct {
+	client   *websocket.Client
+	observer *observer
+
+	connected  *prometheus.Desc
+	connects   *prometheus.Desc
+	reconnects *prometheus.Desc
+	messages   *prometheus.Desc
+	bytes      *prometheus.Desc
+}
+
+// NewClientCollector wraps the event handler and pong hook of c like
+// NewServerCollector. target names the client in the "target" label, e.g.
+// the url it connects to.
+func NewClientCollector(c *websocket.Client, target string) *ClientCollector {
+	const namespace = "websocket_client"
+	labels := prometheus.Labels{"target": target}
+
+	collector := &ClientCollector{
+		client:   c,
+		observer: newObserver(namespace, labels, c.EventHandler()),
+		connected: prometheus.NewDesc(namespace+"_connected",
+			"1 while a connection is up.", nil, labels),
+		connects: prometheus.NewDesc(namespace+"_connections_total",
+			"Connections established.", nil, labels),
+		reconnects: prometheus.NewDesc(namespace+"_reconnects_total",
+			"Connections established after the first.", nil, labels),
+		messages: prometheus.NewDesc(namespace+"_messages_total",
+			"Messages by direction.", []string{"direction"}, labels),
+		bytes: prometheus.NewDesc(namespace+"_bytes_total",
+			"Payload bytes by direction.", []string{"direction"}, labels),
+	}
+	c.SetEventHandler(collector.observer)
+	c.SetOnPong(collector.observer.pongHook(c.OnPong()))
+	return collector
+}
+
+func (c *ClientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.connects
+	ch <- c.reconnects
+	ch <- c.messages
+	ch <- c.bytes
+	c.observer.sizes.Describe(ch)
+	c.observer.rtt.Describe(ch)
+}
+
+func (c *ClientCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.Stats()
+
+	connected := 0.0
+	if stats.Connected {
+		connected = 1
+	}
+	ch <- gauge(c.connected, connected)
+	ch <- counter(c.connects, uint64(stats.Connects))
+	ch <- counter(c.reconnects, uint64(stats.Reconnects))
+	ch <- counter(c.messages, stats.MessagesReceived, "in")
+	ch <- counter(c.messages, stats.MessagesSent, "out")
+	ch <- counter(c.bytes, stats.BytesReceived, "in")
+	ch <- counter(c.bytes, stats.BytesSent, "out")
+	c.observer.sizes.Collect(ch)
+	c.observer.rtt.Collect(ch)
+}
+
+// EnablePrometheus serves the metrics of s in the prometheus format on
+// path of its listener, from an own registry. Call it before
+// ListenAndServe. It's a function as the websocket package does not depend
+// on prometheus.
+func EnablePrometheus(s *websocket.Server, path string) *ServerCollector {
+	collector := NewServerCollector(s)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	s.Handle(path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return collector
+}
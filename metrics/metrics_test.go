@@ -0,0 +1,109 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gathered(t *testing.T, registry *prometheus.Registry) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+func TestPrometheus(t *testing.T) {
+	serverEvents := websockettest.NewRecorder()
+	server := websocket.NewServer("ws://localhost:33245/ws", serverEvents)
+	EnablePrometheus(server, "/metrics")
+	go func() { _ = server.ListenAndServe() }()
+	defer server.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	events := websockettest.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetKeepalive(20*time.Millisecond, time.Second)
+	var pongs atomic.Int32
+	client.SetOnPong(func(id int, rtt time.Duration) { pongs.Add(1) })
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewClientCollector(client, "test"))
+
+	go func() { _ = client.ConnectAndServe("ws://localhost:33245/ws", nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	_ = client.SendTxt([]byte("hello"))
+	serverEvents.WaitForMessage(t, time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://localhost:33245/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`websocket_server_connections{address="localhost:33245",path="/ws"} 1`,
+		`websocket_server_messages_total{address="localhost:33245",direction="in",path="/ws"} 1`,
+		`websocket_server_bytes_total{address="localhost:33245",direction="in",path="/ws"} 5`,
+		`websocket_server_received_message_size_bytes_count{address="localhost:33245",path="/ws"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+
+	families := gathered(t, registry)
+	if got := families["websocket_client_connected"].GetMetric()[0].GetGauge().GetValue(); got != 1 {
+		t.Errorf("connected %v", got)
+	}
+	for _, metric := range families["websocket_client_messages_total"].GetMetric() {
+		if metric.GetLabel()[0].GetValue() == "out" && metric.GetCounter().GetValue() != 1 {
+			t.Errorf("messages out %v", metric.GetCounter().GetValue())
+		}
+	}
+	rtt := families["websocket_client_ping_rtt_seconds"].GetMetric()[0].GetHistogram()
+	if rtt.GetSampleCount() == 0 || pongs.Load() == 0 {
+		t.Errorf("pongs not observed: %d, chained hook %d", rtt.GetSampleCount(),
+			pongs.Load())
+	}
+}
@@ -0,0 +1,105 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mux
+
+import (
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Client opens channels over a client. It wraps the client's event
+// handler: frames are taken, other messages and all events are passed on.
+// The channels end with the connection, open them again after a
+// reconnect.
+type Client struct {
+	inner websocket.Events
+	ws    *websocket.Client
+
+	lock    sync.Mutex
+	session *session
+}
+
+// NewClient installs the mux on ws. Create it before connecting.
+func NewClient(ws *websocket.Client) *Client {
+	c := &Client{inner: ws.EventHandler(), ws: ws}
+	ws.SetEventHandler(c)
+	return c
+}
+
+func (c *Client) current() *session {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.session
+}
+
+// Open opens a channel named name on the server.
+func (c *Client) Open(name string) (Channel, error) {
+	session := c.current()
+	if session == nil {
+		return nil, websocket.ErrNotConnected
+	}
+	return session.open(name)
+}
+
+func (c *Client) OnReceive(msg websocket.Message) {
+	kind, id, payload, ok := decodeFrame(msg)
+	session := c.current()
+	if !ok || session == nil {
+		c.inner.OnReceive(msg)
+		return
+	}
+	if err := session.receive(kind, id, payload, nil); err != nil {
+		c.inner.OnFailure(false, err)
+	}
+}
+
+func (c *Client) OnConnect(id int) {
+	c.lock.Lock()
+	c.session = newSession(id, func(msg *websocket.Message) error {
+		return c.ws.Send(*msg)
+	})
+	c.lock.Unlock()
+
+	c.inner.OnConnect(id)
+}
+
+func (c *Client) OnDisconnect(id int) {
+	c.lock.Lock()
+	session := c.session
+	c.session = nil
+	c.lock.Unlock()
+	if session != nil {
+		session.close()
+	}
+
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
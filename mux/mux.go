@@ -0,0 +1,344 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package mux carries independent channels over one websocket connection.
+// The client opens channels by name, the server accepts them. Each message
+// is a binary frame starting with "MX", its kind and the channel id:
+//
+//	open:   name
+//	data:   message type byte, payload
+//	credit: uint32, messages the receiver consumed
+//	close:  -
+//
+// Integers are big endian. A side sends at most Window messages on a
+// channel ahead of the credits of the other side, so a channel which is
+// not read stalls only its own sender.
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const (
+	kindOpen byte = iota + 1
+	kindData
+	kindCredit
+	kindClose
+)
+
+// Window is the number of messages in flight per channel and direction.
+const Window = 16
+
+var (
+	ErrChannelClosed  = errors.New("channel closed")
+	ErrWindowExceeded = errors.New("channel window exceeded")
+)
+
+var magic = [2]byte{'M', 'X'}
+
+const headerSize = len(magic) + 1 + 4
+
+// Channel is one stream of a connection. Send blocks while the window of
+// the channel is used up. Receive returns the messages the peer sent, and
+// ErrChannelClosed once the channel is closed by either side or the
+// connection ended, and all messages were received. Done is closed at
+// that point already, while messages may still be queued.
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, msg websocket.Message) error
+	Receive(ctx context.Context) (websocket.Message, error)
+	Close() error
+	Done() <-chan struct{}
+}
+
+func encodeFrame(kind byte, id uint32, payload ...[]byte) *websocket.Message {
+	size := headerSize
+	for _, p := range payload {
+		size += len(p)
+	}
+	data := make([]byte, headerSize, size)
+	copy(data, magic[:])
+	data[len(magic)] = kind
+	binary.BigEndian.PutUint32(data[len(magic)+1:], id)
+	for _, p := range payload {
+		data = append(data, p...)
+	}
+	return &websocket.Message{MessageType: websocket.BinaryMessage, Data: data}
+}
+
+func decodeFrame(msg websocket.Message) (kind byte, id uint32, payload []byte, ok bool) {
+	data := msg.Data
+	if msg.MessageType != websocket.BinaryMessage || len(data) < headerSize ||
+		data[0] != magic[0] || data[1] != magic[1] {
+		return 0, 0, nil, false
+	}
+	kind = data[len(magic)]
+	if kind < kindOpen || kind > kindClose {
+		return 0, 0, nil, false
+	}
+	return kind, binary.BigEndian.Uint32(data[len(magic)+1:]), data[headerSize:], true
+}
+
+type channel struct {
+	session *session
+	id      uint32
+	name    string
+
+	done chan struct{}
+
+	lock     sync.Mutex
+	changed  chan struct{}
+	credit   int
+	queue    []websocket.Message
+	consumed int
+	closed   bool
+}
+
+func (c *channel) Name() string {
+	return c.name
+}
+
+func (c *channel) Done() <-chan struct{} {
+	return c.done
+}
+
+// notifyLocked wakes the goroutines waiting in Send and Receive.
+func (c *channel) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *channel) Send(ctx context.Context, msg websocket.Message) error {
+	for {
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			return ErrChannelClosed
+		}
+		if c.credit > 0 {
+			c.credit--
+			c.lock.Unlock()
+			return c.session.send(encodeFrame(kindData, c.id, []byte{byte(msg.MessageType)}, msg.Data))
+		}
+		changed := c.changed
+		c.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (c *channel) Receive(ctx context.Context) (websocket.Message, error) {
+	for {
+		c.lock.Lock()
+		if len(c.queue) > 0 {
+			msg := c.queue[0]
+			c.queue = c.queue[1:]
+			c.consumed++
+			grant := 0
+			if c.consumed >= Window/2 && !c.closed {
+				grant, c.consumed = c.consumed, 0
+			}
+			c.lock.Unlock()
+
+			if grant > 0 {
+				var credit [4]byte
+				binary.BigEndian.PutUint32(credit[:], uint32(grant))
+				_ = c.session.send(encodeFrame(kindCredit, c.id, credit[:]))
+			}
+			return msg, nil
+		}
+		if c.closed {
+			c.lock.Unlock()
+			return websocket.Message{}, ErrChannelClosed
+		}
+		changed := c.changed
+		c.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return websocket.Message{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Close closes the channel on both sides, messages not received yet are
+// dropped.
+func (c *channel) Close() error {
+	c.lock.Lock()
+	closed := c.closed
+	if !closed {
+		close(c.done)
+	}
+	c.closed = true
+	c.queue = nil
+	c.notifyLocked()
+	c.lock.Unlock()
+
+	if closed || !c.session.remove(c.id) {
+		return nil
+	}
+	return c.session.send(encodeFrame(kindClose, c.id))
+}
+
+// end closes the channel from the other side, queued messages can still
+// be received.
+func (c *channel) end() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.closed {
+		close(c.done)
+	}
+	c.closed = true
+	c.notifyLocked()
+}
+
+// session holds the channels of one connection.
+type session struct {
+	clientId int
+	send     func(msg *websocket.Message) error
+
+	lock     sync.Mutex
+	channels map[uint32]*channel
+	nextId   uint32
+	closed   bool
+}
+
+func newSession(clientId int, send func(msg *websocket.Message) error) *session {
+	return &session{clientId: clientId, send: send, channels: make(map[uint32]*channel)}
+}
+
+func (s *session) newChannel(id uint32, name string) *channel {
+	return &channel{session: s, id: id, name: name, done: make(chan struct{}),
+		changed: make(chan struct{}), credit: Window}
+}
+
+func (s *session) open(name string) (*channel, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, websocket.ErrNotConnected
+	}
+	s.nextId++
+	ch := s.newChannel(s.nextId, name)
+	s.channels[ch.id] = ch
+	s.lock.Unlock()
+
+	if err := s.send(encodeFrame(kindOpen, ch.id, []byte(name))); err != nil {
+		s.remove(ch.id)
+		return nil, err
+	}
+	return ch, nil
+}
+
+// remove reports whether the channel was still open.
+func (s *session) remove(id uint32) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.channels[id]
+	delete(s.channels, id)
+	return ok
+}
+
+// receive handles a frame, accept is called for channels opened by the
+// other side and nil where this is not allowed. Errors are violations of
+// the window, the connection stays up.
+func (s *session) receive(kind byte, id uint32, payload []byte,
+	accept func(ch *channel) bool) error {
+
+	s.lock.Lock()
+	ch := s.channels[id]
+	s.lock.Unlock()
+
+	switch {
+	case kind == kindOpen:
+		if ch != nil || accept == nil {
+			return s.send(encodeFrame(kindClose, id))
+		}
+		ch = s.newChannel(id, string(payload))
+		s.lock.Lock()
+		s.channels[id] = ch
+		s.lock.Unlock()
+		if !accept(ch) {
+			return ch.Close()
+		}
+	case ch == nil:
+		// closed meanwhile or never opened
+		if kind == kindData {
+			return s.send(encodeFrame(kindClose, id))
+		}
+	case kind == kindData:
+		if len(payload) == 0 {
+			return nil
+		}
+		ch.lock.Lock()
+		defer ch.lock.Unlock()
+		if len(ch.queue) >= Window {
+			return ErrWindowExceeded
+		}
+		ch.queue = append(ch.queue, websocket.Message{
+			MessageType: int(payload[0]),
+			Data:        payload[1:],
+			ClientId:    s.clientId,
+		})
+		ch.notifyLocked()
+	case kind == kindCredit:
+		if len(payload) < 4 {
+			return nil
+		}
+		ch.lock.Lock()
+		ch.credit += int(binary.BigEndian.Uint32(payload))
+		ch.notifyLocked()
+		ch.lock.Unlock()
+	case kind == kindClose:
+		s.remove(id)
+		ch.end()
+	}
+	return nil
+}
+
+// close ends all channels, the connection is gone.
+func (s *session) close() {
+	s.lock.Lock()
+	s.closed = true
+	channels := s.channels
+	s.channels = make(map[uint32]*channel)
+	s.lock.Unlock()
+
+	for _, ch := range channels {
+		ch.end()
+	}
+}
@@ -0,0 +1,217 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+type fixture struct {
+	server       *Server
+	client       *Client
+	ws           *websockettest.ServerConn
+	clientEvents *websockettest.Recorder
+	clientId     int
+}
+
+func setup(t *testing.T) *fixture {
+	t.Helper()
+	f := &fixture{clientEvents: websockettest.NewRecorder()}
+	f.ws = websockettest.NewServer(websockettest.NewRecorder())
+	t.Cleanup(func() { f.ws.Close() })
+	f.server = NewServer(f.ws.Server)
+
+	wsClient := websocket.NewClient(false, f.clientEvents)
+	f.client = NewClient(wsClient)
+	f.clientId = f.ws.Connect(t, wsClient)
+	t.Cleanup(func() { wsClient.Disconnect() })
+	return f
+}
+
+func timeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func text(s string) websocket.Message {
+	return websocket.Message{MessageType: websocket.TextMessage, Data: []byte(s)}
+}
+
+func TestChannels(t *testing.T) {
+	f := setup(t)
+	server, client, ws, clientId := f.server, f.client, f.ws, f.clientId
+	ctx := timeout(t)
+
+	// the server echoes with the channel name, except on "logs"
+	accepted := make(chan Channel, 4)
+	server.OnChannel(func(id int, ch Channel) {
+		if id != clientId {
+			t.Errorf("channel of %d", id)
+		}
+		accepted <- ch
+		if ch.Name() == "logs" {
+			return
+		}
+		for {
+			msg, err := ch.Receive(context.Background())
+			if err != nil {
+				return
+			}
+			msg.Data = append([]byte(ch.Name()+":"), msg.Data...)
+			_ = ch.Send(context.Background(), msg)
+		}
+	})
+
+	control, err := client.Open("control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	telemetry, err := client.Open("telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = control.Send(ctx, text("stop")); err != nil {
+		t.Fatal(err)
+	}
+	if err = telemetry.Send(ctx, websocket.Message{MessageType: websocket.BinaryMessage, Data: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := telemetry.Receive(ctx); err != nil || msg.MessageType != websocket.BinaryMessage ||
+		string(msg.Data) != "telemetry:\x01" {
+		t.Errorf("telemetry received %+v, %v", msg, err)
+	}
+	if msg, err := control.Receive(ctx); err != nil || msg.MessageType != websocket.TextMessage ||
+		string(msg.Data) != "control:stop" {
+		t.Errorf("control received %+v, %v", msg, err)
+	}
+
+	// a channel not read stalls its sender only
+	logs, err := client.Open("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < Window; i++ {
+		if err = logs.Send(ctx, text(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stalled, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err = logs.Send(stalled, text("more")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sent beyond the window: %v", err)
+	}
+	for i := 0; i < 2*Window; i++ {
+		if err = control.Send(ctx, text("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = control.Receive(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reading returns credits
+	var serverLogs Channel
+	for serverLogs == nil || serverLogs.Name() != "logs" {
+		serverLogs = <-accepted
+	}
+	for i := 0; i < Window; i++ {
+		if msg, err := serverLogs.Receive(ctx); err != nil || string(msg.Data) != fmt.Sprint(i) {
+			t.Fatalf("logs received %q, %v", msg.Data, err)
+		}
+	}
+	if err = logs.Send(ctx, text("more")); err != nil {
+		t.Error(err)
+	}
+
+	// close is signaled to the other side
+	if err = logs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-serverLogs.Done():
+	case <-ctx.Done():
+		t.Fatal("close not signaled by done")
+	}
+	if msg, err := serverLogs.Receive(ctx); err != nil || string(msg.Data) != "more" {
+		t.Errorf("logs received %q, %v", msg.Data, err)
+	}
+	if _, err = serverLogs.Receive(ctx); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("receive on a closed channel: %v", err)
+	}
+	if err = logs.Send(ctx, text("x")); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("send on a closed channel: %v", err)
+	}
+
+	// a message for an unknown channel is refused, the connection stays
+	if err = ws.Send(clientId, encodeFrame(kindData, 99, []byte{websocket.TextMessage}, []byte("?"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = control.Send(ctx, text("still")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := control.Receive(ctx); err != nil || string(msg.Data) != "control:still" {
+		t.Errorf("control received %q, %v", msg.Data, err)
+	}
+
+	// other messages are passed on
+	if err = ws.Send(clientId, &websocket.Message{MessageType: websocket.TextMessage, Data: []byte("plain")}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := f.clientEvents.WaitForMessage(t, time.Second); string(msg.Data) != "plain" {
+		t.Errorf("passed on %q", msg.Data)
+	}
+
+	// the channels end with the connection
+	if err = ws.Break(clientId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = telemetry.Receive(ctx); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("receive after disconnect: %v", err)
+	}
+	if _, err = client.Open("again"); !errors.Is(err, websocket.ErrNotConnected) {
+		t.Errorf("opened without connection: %v", err)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	f := setup(t)
+	ctx := timeout(t)
+
+	ch, err := f.client.Open("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ch.Receive(ctx); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("refused channel: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package mux
+
+import (
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Server accepts the channels opened by the clients.
+type Server struct {
+	inner websocket.Events
+	ws    *websocket.Server
+
+	lock      sync.Mutex
+	sessions  map[int]*session
+	onChannel func(clientId int, ch Channel)
+}
+
+// NewServer installs the mux on ws. Create it before ListenAndServe.
+func NewServer(ws *websocket.Server) *Server {
+	s := &Server{
+		inner:    ws.EventHandler(),
+		ws:       ws,
+		sessions: make(map[int]*session),
+	}
+	ws.SetEventHandler(s)
+	return s
+}
+
+// OnChannel sets the hook receiving the channels opened by the clients,
+// called in an own goroutine. Without a hook channels are refused.
+func (s *Server) OnChannel(fn func(clientId int, ch Channel)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onChannel = fn
+}
+
+func (s *Server) OnReceive(msg websocket.Message) {
+	kind, id, payload, ok := decodeFrame(msg)
+	s.lock.Lock()
+	session := s.sessions[msg.ClientId]
+	fn := s.onChannel
+	s.lock.Unlock()
+	if !ok || session == nil {
+		s.inner.OnReceive(msg)
+		return
+	}
+
+	err := session.receive(kind, id, payload, func(ch *channel) bool {
+		if fn == nil {
+			return false
+		}
+		go fn(msg.ClientId, ch)
+		return true
+	})
+	if err != nil {
+		s.inner.OnFailure(false, err)
+	}
+}
+
+func (s *Server) OnConnect(id int) {
+	s.lock.Lock()
+	s.sessions[id] = newSession(id, func(msg *websocket.Message) error {
+		return s.ws.Send(id, msg)
+	})
+	s.lock.Unlock()
+
+	s.inner.OnConnect(id)
+}
+
+func (s *Server) OnDisconnect(id int) {
+	s.lock.Lock()
+	session := s.sessions[id]
+	delete(s.sessions, id)
+	s.lock.Unlock()
+	if session != nil {
+		session.close()
+	}
+
+	s.inner.OnDisconnect(id)
+}
+
+func (s *Server) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
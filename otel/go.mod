@@ -0,0 +1,22 @@
+module github.com/ChrIgiSta/go-easy-websockets/otel
+
+go 1.21
+
+require (
+	github.com/ChrIgiSta/go-easy-websockets v0.0.0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/ChrIgiSta/go-utils v0.0.3 // indirect
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/gorilla/websocket v1.5.1 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+)
+
+replace github.com/ChrIgiSta/go-easy-websockets => ../
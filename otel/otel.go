@@ -0,0 +1,317 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package otel traces websocket connections and messages with
+// OpenTelemetry. Without a configured TracerProvider and propagator it
+// does nothing.
+package otel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	gootel "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/ChrIgiSta/go-easy-websockets/otel"
+
+// TraceField is the field of a JSON object message carrying its trace
+// context.
+var TraceField = "_trace"
+
+var ErrNoJSONObject = errors.New("message is no json object")
+
+type config struct {
+	provider     trace.TracerProvider
+	propagator   propagation.TextMapPropagator
+	messageSpans bool
+}
+
+type Option func(*config)
+
+// WithTracerProvider replaces the global TracerProvider.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(c *config) { c.provider = provider }
+}
+
+// WithPropagator replaces the global propagator for the trace context of
+// received messages.
+func WithPropagator(propagator propagation.TextMapPropagator) Option {
+	return func(c *config) { c.propagator = propagator }
+}
+
+// WithMessageSpans starts a span per received message. It continues the
+// trace context of the message, if any, and links the connection span.
+func WithMessageSpans() Option {
+	return func(c *config) { c.messageSpans = true }
+}
+
+// InjectTraceContext adds the trace context of ctx to the JSON object in
+// msg, using the global propagator.
+func InjectTraceContext(ctx context.Context, msg *websocket.Message) error {
+	return inject(gootel.GetTextMapPropagator(), ctx, msg)
+}
+
+// ExtractTraceContext returns ctx with the trace context of msg, if it is
+// a JSON object carrying one, using the global propagator.
+func ExtractTraceContext(ctx context.Context, msg websocket.Message) context.Context {
+	return extract(gootel.GetTextMapPropagator(), ctx, msg)
+}
+
+func inject(propagator propagation.TextMapPropagator, ctx context.Context,
+	msg *websocket.Message) error {
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Data, &object); err != nil || object == nil {
+		return ErrNoJSONObject
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+
+	field, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+	object[TraceField] = field
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	return nil
+}
+
+func extract(propagator propagation.TextMapPropagator, ctx context.Context,
+	msg websocket.Message) context.Context {
+
+	var envelope map[string]json.RawMessage
+	if json.Unmarshal(msg.Data, &envelope) != nil || envelope[TraceField] == nil {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{}
+	if json.Unmarshal(envelope[TraceField], &carrier) != nil {
+		return ctx
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+type connSpan struct {
+	ctx      context.Context
+	span     trace.Span
+	received int
+}
+
+// tracer wraps an event handler with a span per connection, from connect
+// to disconnect.
+type tracer struct {
+	cfg    config
+	tracer trace.Tracer
+	inner  websocket.Events
+	kind   trace.SpanKind
+	attrs  []attribute.KeyValue
+
+	lock  sync.Mutex
+	conns map[int]*connSpan
+	// last connected, failures without client id are recorded on it
+	last int
+}
+
+func newTracer(inner websocket.Events, kind trace.SpanKind,
+	attrs []attribute.KeyValue, opts []Option) *tracer {
+
+	cfg := config{
+		provider:   gootel.GetTracerProvider(),
+		propagator: gootel.GetTextMapPropagator(),
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return &tracer{
+		cfg:    cfg,
+		tracer: cfg.provider.Tracer(instrumentationName),
+		inner:  inner,
+		kind:   kind,
+		attrs:  attrs,
+		conns:  make(map[int]*connSpan),
+	}
+}
+
+func (t *tracer) conn(id int) *connSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.conns[id]
+}
+
+func (t *tracer) connContext(id int) context.Context {
+	if conn := t.conn(id); conn != nil {
+		return conn.ctx
+	}
+	return context.Background()
+}
+
+func (t *tracer) OnConnect(id int) {
+	ctx, span := t.tracer.Start(context.Background(), "websocket.connection",
+		trace.WithSpanKind(t.kind),
+		trace.WithAttributes(t.attrs...),
+		trace.WithAttributes(attribute.Int("websocket.client_id", id)))
+
+	t.lock.Lock()
+	t.conns[id] = &connSpan{ctx: ctx, span: span}
+	t.last = id
+	t.lock.Unlock()
+
+	t.inner.OnConnect(id)
+}
+
+func (t *tracer) OnDisconnect(id int) {
+	t.inner.OnDisconnect(id)
+
+	t.lock.Lock()
+	conn := t.conns[id]
+	delete(t.conns, id)
+	t.lock.Unlock()
+
+	if conn == nil {
+		return
+	}
+	conn.span.AddEvent("messages", trace.WithAttributes(
+		attribute.Int("websocket.messages.received", conn.received)))
+	conn.span.End()
+}
+
+func (t *tracer) OnFailure(exited bool, err error) {
+	t.lock.Lock()
+	conn := t.conns[t.last]
+	t.lock.Unlock()
+
+	if conn != nil && err != nil {
+		conn.span.RecordError(err)
+		if exited && websocket.KindOf(err) != websocket.KindNormalClosure {
+			conn.span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	t.inner.OnFailure(exited, err)
+}
+
+func (t *tracer) OnReceive(msg websocket.Message) {
+	t.OnReceiveCtx(context.Background(), msg)
+}
+
+func (t *tracer) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	t.lock.Lock()
+	conn := t.conns[msg.ClientId]
+	if conn != nil {
+		conn.received++
+	}
+	t.lock.Unlock()
+
+	if t.cfg.messageSpans {
+		parent := context.Background()
+		var links []trace.Link
+		if conn != nil {
+			parent = conn.ctx
+			links = append(links, trace.LinkFromContext(conn.ctx))
+		}
+		parent = extract(t.cfg.propagator, parent, msg)
+
+		var span trace.Span
+		_, span = t.tracer.Start(parent, "websocket.receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithLinks(links...),
+			trace.WithAttributes(
+				attribute.Int("websocket.client_id", msg.ClientId),
+				attribute.Int("websocket.message.type", msg.MessageType),
+				attribute.Int("websocket.message.size", len(msg.Data))))
+		defer span.End()
+		ctx = trace.ContextWithSpan(ctx, span)
+	}
+
+	if inner, ok := t.inner.(websocket.CtxEvents); ok {
+		inner.OnReceiveCtx(ctx, msg)
+	} else {
+		t.inner.OnReceive(msg)
+	}
+}
+
+// ServerTracer traces each client connection of a server.
+type ServerTracer struct {
+	*tracer
+}
+
+// NewServerTracer wraps the event handler of s. Create it before
+// ListenAndServe.
+func NewServerTracer(s *websocket.Server, opts ...Option) *ServerTracer {
+	t := &ServerTracer{newTracer(s.EventHandler(), trace.SpanKindServer,
+		[]attribute.KeyValue{
+			attribute.String("server.address", s.Address()),
+			attribute.String("url.path", s.Path()),
+		}, opts)}
+	s.SetEventHandler(t)
+	return t
+}
+
+// ConnectionContext returns a context with the connection span of a
+// client, e.g. to inject it into sent messages.
+func (t *ServerTracer) ConnectionContext(clientId int) context.Context {
+	return t.connContext(clientId)
+}
+
+// ClientTracer traces the connections of a client.
+type ClientTracer struct {
+	*tracer
+}
+
+// NewClientTracer wraps the event handler of c. Create it before
+// connecting.
+func NewClientTracer(c *websocket.Client, opts ...Option) *ClientTracer {
+	t := &ClientTracer{newTracer(c.EventHandler(), trace.SpanKindClient,
+		nil, opts)}
+	c.SetEventHandler(t)
+	return t
+}
+
+// ConnectionContext returns a context with the span of the current
+// connection.
+func (t *ClientTracer) ConnectionContext() context.Context {
+	t.lock.Lock()
+	last := t.last
+	t.lock.Unlock()
+
+	return t.connContext(last)
+}
@@ -0,0 +1,108 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package otel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+	gootel "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	gootel.SetTextMapPropagator(propagation.TraceContext{})
+
+	serverEvents := websockettest.NewRecorder()
+	server := websocket.NewServer("ws://localhost:33246/", serverEvents)
+	NewServerTracer(server, WithTracerProvider(provider), WithMessageSpans())
+	go func() { _ = server.ListenAndServe() }()
+	defer server.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// the global provider is a no-op
+	events := websockettest.NewRecorder()
+	client := websocket.NewClient(false, events)
+	clientTracer := NewClientTracer(client)
+	go func() { _ = client.ConnectAndServe("ws://localhost:33246/", nil) }()
+	events.WaitForConnect(t, time.Second)
+	if trace.SpanContextFromContext(clientTracer.ConnectionContext()).IsValid() {
+		t.Error("no-op tracer recorded a span")
+	}
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "send")
+	msg := websocket.Message{MessageType: websocket.TextMessage, Data: []byte(`{"x":1}`)}
+	if err := InjectTraceContext(ctx, &msg); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	extracted := trace.SpanContextFromContext(ExtractTraceContext(context.Background(), msg))
+	if extracted.TraceID() != parent.SpanContext().TraceID() {
+		t.Error("trace context not extracted")
+	}
+	noJSON := websocket.Message{Data: []byte("text")}
+	if err := InjectTraceContext(ctx, &noJSON); !errors.Is(err, ErrNoJSONObject) {
+		t.Errorf("expected ErrNoJSONObject, got %v", err)
+	}
+
+	_ = client.Send(msg)
+	serverEvents.WaitForMessage(t, time.Second)
+	_ = client.Disconnect()
+	serverEvents.WaitForDisconnect(t, time.Second)
+
+	var receive, connection sdktrace.ReadOnlySpan
+	for _, span := range spans.Ended() {
+		switch span.Name() {
+		case "websocket.receive":
+			receive = span
+		case "websocket.connection":
+			connection = span
+		}
+	}
+	if receive == nil || connection == nil {
+		t.Fatalf("spans missing: %v", spans.Ended())
+	}
+	if receive.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("message span does not continue the sent trace")
+	}
+	if len(receive.Links()) != 1 ||
+		receive.Links()[0].SpanContext.SpanID() != connection.SpanContext().SpanID() {
+		t.Error("message span not linked to the connection span")
+	}
+	if events := connection.Events(); len(events) != 1 ||
+		events[0].Attributes[0].Value.AsInt64() != 1 {
+		t.Errorf("unexpected connection events %v", events)
+	}
+}
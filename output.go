@@ -0,0 +1,380 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	gorilla "github.com/gorilla/websocket"
+)
+
+const (
+	outputText   = "text"
+	outputHex    = "hex"
+	outputBase64 = "base64"
+)
+
+const (
+	markerRx    = "<<"
+	markerTx    = ">>"
+	markerEvent = "**"
+)
+
+const (
+	timestampsOff = ""
+	timestampsAbs = "abs"
+	timestampsRel = "rel"
+)
+
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// timestampFlag is a flag usable as plain --timestamps or with a value
+// like --timestamps=rel.
+type timestampFlag string
+
+func (t *timestampFlag) String() string {
+	return string(*t)
+}
+
+func (t *timestampFlag) Set(value string) error {
+	switch value {
+	case "true", timestampsAbs:
+		*t = timestampsAbs
+	case timestampsRel:
+		*t = timestampsRel
+	case "false":
+		*t = timestampsOff
+	default:
+		return fmt.Errorf("invalid timestamps %q, expected abs or rel", value)
+	}
+	return nil
+}
+
+func (t *timestampFlag) IsBoolFlag() bool {
+	return true
+}
+
+// jsonRecord is one line of --json output.
+type jsonRecord struct {
+	Time      string  `json:"ts"`
+	Kind      string  `json:"kind"`
+	Direction string  `json:"direction,omitempty"`
+	Type      string  `json:"type,omitempty"`
+	Client    int     `json:"client,omitempty"`
+	Encoding  string  `json:"encoding,omitempty"`
+	Data      *string `json:"data,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	ErrorKind string  `json:"error_kind,omitempty"`
+	RttMs     float64 `json:"rtt_ms,omitempty"`
+}
+
+// printer serializes the CLI output. With timestamps enabled every line
+// gets a timestamp and a direction marker and sent messages are echoed.
+// In json mode messages and events are written as json lines to a
+// separate writer, all other lines still go to w.
+type printer struct {
+	lock       sync.Mutex
+	w          io.Writer
+	format     string
+	timestamps string
+	start      time.Time
+	json       *json.Encoder
+	quiet      bool
+}
+
+func newPrinter(w io.Writer, format string, timestamps string) *printer {
+	return &printer{
+		w:          w,
+		format:     format,
+		timestamps: timestamps,
+		start:      time.Now(),
+	}
+}
+
+// SetJSON switches messages and events to json lines written to w.
+func (p *printer) SetJSON(w io.Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.json = json.NewEncoder(w)
+}
+
+// SetQuiet suppresses everything but received messages.
+func (p *printer) SetQuiet() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.quiet = true
+}
+
+func (p *printer) writeJSON(record jsonRecord) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	_ = p.json.Encode(record)
+}
+
+func (p *printer) messageJSON(direction string, msg websocket.Message) {
+	record := jsonRecord{
+		Kind:      "message",
+		Direction: direction,
+		Type:      websocket.MessageTypeString(msg.MessageType),
+		Client:    msg.ClientId,
+		Encoding:  websocket.EncodingText,
+	}
+
+	data := string(msg.Data)
+	if msg.MessageType != websocket.TextMessage || !utf8.Valid(msg.Data) {
+		record.Encoding = websocket.EncodingBase64
+		data = base64.StdEncoding.EncodeToString(msg.Data)
+	}
+	record.Data = &data
+
+	p.writeJSON(record)
+}
+
+func (p *printer) Printf(marker string, format string, args ...any) {
+	p.lock.Lock()
+	quiet := p.quiet
+	p.lock.Unlock()
+
+	if !quiet {
+		p.printf(marker, format, args...)
+	}
+}
+
+func (p *printer) printf(marker string, format string, args ...any) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var prefix string
+	switch p.timestamps {
+	case timestampsAbs:
+		prefix = time.Now().Format(timestampLayout) + " " + marker + " "
+	case timestampsRel:
+		prefix = fmt.Sprintf("+%.3fs %s ", time.Since(p.start).Seconds(), marker)
+	}
+
+	fmt.Fprintf(p.w, prefix+format+"\r\n", args...)
+}
+
+func (p *printer) Received(msg websocket.Message) {
+	if p.json != nil {
+		p.messageJSON("rx", msg)
+		return
+	}
+	p.printf(markerRx, "rx from client: %s", formatPayload(p.format, msg))
+}
+
+func (p *printer) Sent(msg websocket.Message) {
+	if p.quiet {
+		return
+	}
+	if p.json != nil {
+		p.messageJSON("tx", msg)
+		return
+	}
+	if p.timestamps == timestampsOff {
+		return
+	}
+	p.Printf(markerTx, "tx: %s", formatPayload(p.format, msg))
+}
+
+func (p *printer) Event(evnt websocket.Event) {
+	if p.quiet {
+		return
+	}
+	if p.json != nil {
+		record := jsonRecord{
+			Kind:   evnt.Type.String(),
+			Client: evnt.Id,
+		}
+		if evnt.Err != nil {
+			record.Error = evnt.Err.Error()
+			if evnt.Kind != websocket.KindUnknown {
+				record.ErrorKind = evnt.Kind.String()
+			}
+		}
+		p.writeJSON(record)
+		return
+	}
+
+	// only our own --max-size, a peer closing with 1009 is a normal failure
+	if errors.Is(evnt.Err, gorilla.ErrReadLimit) {
+		p.Printf(markerEvent, "message exceeded limit, connection closed")
+		return
+	}
+
+	switch evnt.Type {
+	case websocket.Connect:
+		p.Printf(markerEvent, "connected")
+	case websocket.Disconnect:
+		p.Printf(markerEvent, "disconnected")
+	case websocket.Failure:
+		p.Printf(markerEvent, "failure %v", evnt.Err)
+	}
+}
+
+func (p *printer) Pong(id int, rtt time.Duration) {
+	if p.quiet {
+		return
+	}
+	if p.json != nil {
+		p.writeJSON(jsonRecord{
+			Kind:   "pong",
+			Client: id,
+			RttMs:  float64(rtt) / float64(time.Millisecond),
+		})
+		return
+	}
+	p.Printf(markerEvent, "pong from <%d>: rtt %v", id, rtt.Round(time.Microsecond))
+}
+
+func printSummary(out *printer, stats websocket.Stats) {
+	out.Printf(markerEvent, "session: sent %d messages (%d bytes), received %d messages (%d bytes)",
+		stats.MessagesSent, stats.BytesSent,
+		stats.MessagesReceived, stats.BytesReceived)
+	out.Printf(markerEvent, "session: connected %v, reconnects %d",
+		stats.ConnectedFor.Round(time.Millisecond), stats.Reconnects)
+	if stats.CloseCode != 0 {
+		out.Printf(markerEvent, "session: peer closed with %d %q",
+			stats.CloseCode, stats.CloseText)
+	}
+}
+
+// countFlag counts how often a flag like -v is given.
+type countFlag int
+
+func (c *countFlag) String() string {
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countFlag) Set(value string) error {
+	if value == "true" {
+		*c++
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid count %q", value)
+	}
+	*c = countFlag(n)
+	return nil
+}
+
+func (c *countFlag) IsBoolFlag() bool {
+	return true
+}
+
+// cliLogger writes the library log to stderr, keeping stdout for traffic.
+type cliLogger struct {
+	w io.Writer
+}
+
+func (l cliLogger) write(level string, module string, message string) {
+	fmt.Fprintf(l.w, "[%s] %s: %s\r\n", level, module, message)
+}
+
+func (l cliLogger) Debug(module string, message string) { l.write("debug", module, message) }
+func (l cliLogger) Info(module string, message string)  { l.write("info", module, message) }
+func (l cliLogger) Warn(module string, message string)  { l.write("warn", module, message) }
+func (l cliLogger) Error(module string, message string) { l.write("error", module, message) }
+
+// logLevel maps --quiet and the number of -v to the library log level.
+func logLevel(quiet bool, verbose int) websocket.LogLevel {
+	switch {
+	case quiet:
+		return websocket.LogLevelNone
+	case verbose >= 2:
+		return websocket.LogLevelDebug
+	case verbose == 1:
+		return websocket.LogLevelInfo
+	default:
+		return websocket.LogLevelWarn
+	}
+}
+
+func validOutputFormat(format string) bool {
+	switch format {
+	case outputText, outputHex, outputBase64:
+		return true
+	}
+	return false
+}
+
+// escapeControl replaces control characters and invalid utf-8 so the
+// payload can't mess up the terminal.
+func escapeControl(data []byte) string {
+	var builder strings.Builder
+
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&builder, "\\x%02x", data[0])
+		case r == '\n':
+			builder.WriteString("\\n")
+		case r == '\r':
+			builder.WriteString("\\r")
+		case r == '\t':
+			builder.WriteString("\\t")
+		case r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0):
+			fmt.Fprintf(&builder, "\\x%02x", r)
+		default:
+			builder.Write(data[:size])
+		}
+		data = data[size:]
+	}
+
+	return builder.String()
+}
+
+func formatPayload(format string, msg websocket.Message) string {
+	switch format {
+	case outputHex:
+		return fmt.Sprintf("%s, %d bytes\r\n%s",
+			websocket.MessageTypeString(msg.MessageType), len(msg.Data),
+			strings.TrimRight(hex.Dump(msg.Data), "\n"))
+	case outputBase64:
+		return fmt.Sprintf("%s, %d bytes: %s",
+			websocket.MessageTypeString(msg.MessageType), len(msg.Data),
+			base64.StdEncoding.EncodeToString(msg.Data))
+	default:
+		return escapeControl(msg.Data)
+	}
+}
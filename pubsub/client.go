@@ -0,0 +1,258 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Client subscribes to topics of a pub/sub Server. Subscriptions survive
+// reconnects, they are sent again on every connect. It wraps the client's
+// event handler: protocol frames are consumed, other messages and all
+// events are passed on.
+type Client struct {
+	inner websocket.Events
+	ws    *websocket.Client
+
+	lock          sync.Mutex
+	connected     bool
+	nextId        uint64
+	pending       map[uint64]chan frame
+	subscriptions map[string][]chan []byte
+	dropped       atomic.Uint64
+}
+
+// NewClient installs the pub/sub layer on ws. Create it before connecting.
+func NewClient(ws *websocket.Client) *Client {
+	c := &Client{
+		inner:         ws.EventHandler(),
+		ws:            ws,
+		pending:       make(map[uint64]chan frame),
+		subscriptions: make(map[string][]chan []byte),
+	}
+	ws.SetEventHandler(c)
+	return c
+}
+
+// Subscribe returns a channel receiving the data published to topic. The
+// first subscription of a topic is sent to the server and acknowledged if
+// connected, otherwise with the next connect. Further subscriptions of the
+// same topic get their own channel.
+func (c *Client) Subscribe(topic string) (<-chan []byte, error) {
+	ch := make(chan []byte, SubscriptionBuffer)
+
+	c.lock.Lock()
+	first := len(c.subscriptions[topic]) == 0
+	c.subscriptions[topic] = append(c.subscriptions[topic], ch)
+	connected := c.connected
+	c.lock.Unlock()
+
+	if !first || !connected {
+		return ch, nil
+	}
+
+	if err := c.request(frame{Type: TypeSubscribe, Topic: topic}); err != nil {
+		c.lock.Lock()
+		c.removeLocked(topic, ch)
+		c.lock.Unlock()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Unsubscribe closes all channels of topic and unsubscribes it on the
+// server.
+func (c *Client) Unsubscribe(topic string) error {
+	c.lock.Lock()
+	subs := c.subscriptions[topic]
+	delete(c.subscriptions, topic)
+	for _, ch := range subs {
+		close(ch)
+	}
+	connected := c.connected
+	c.lock.Unlock()
+
+	if len(subs) == 0 || !connected {
+		return nil
+	}
+	return c.request(frame{Type: TypeUnsubscribe, Topic: topic})
+}
+
+// Publish sends data to all subscribers of topic, including this client
+// if subscribed.
+func (c *Client) Publish(topic string, data []byte) error {
+	c.lock.Lock()
+	connected := c.connected
+	c.lock.Unlock()
+
+	if !connected {
+		return ErrNotConnected
+	}
+	return c.request(frame{Type: TypePublish, Topic: topic, Data: data})
+}
+
+// Dropped returns the number of publishes lost for full subscription
+// channels so far, counted per channel.
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+func (c *Client) removeLocked(topic string, ch chan []byte) {
+	subs := c.subscriptions[topic]
+	for i, sub := range subs {
+		if sub == ch {
+			c.subscriptions[topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(c.subscriptions[topic]) == 0 {
+		delete(c.subscriptions, topic)
+	}
+}
+
+// request sends a frame and waits for its ack.
+func (c *Client) request(out frame) error {
+	c.lock.Lock()
+	c.nextId++
+	out.Id = c.nextId
+	ack := make(chan frame, 1)
+	c.pending[out.Id] = ack
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, out.Id)
+		c.lock.Unlock()
+	}()
+
+	if err := c.send(out); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(AckTimeout)
+	defer timer.Stop()
+
+	select {
+	case in, ok := <-ack:
+		if !ok {
+			return ErrDisconnected
+		}
+		if in.Error != "" {
+			return errors.New(in.Error)
+		}
+		return nil
+	case <-timer.C:
+		return ErrAckTimeout
+	}
+}
+
+func (c *Client) send(out frame) error {
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return c.ws.SendTxt(data)
+}
+
+func (c *Client) OnReceive(msg websocket.Message) {
+	var in frame
+	if msg.MessageType != websocket.TextMessage ||
+		json.Unmarshal(msg.Data, &in) != nil {
+		c.inner.OnReceive(msg)
+		return
+	}
+
+	switch in.Type {
+	case TypeAck:
+		c.lock.Lock()
+		ack, ok := c.pending[in.Id]
+		delete(c.pending, in.Id)
+		c.lock.Unlock()
+		if ok {
+			ack <- in
+		}
+	case TypePublish:
+		dropped := 0
+		c.lock.Lock()
+		for _, ch := range c.subscriptions[in.Topic] {
+			select {
+			case ch <- in.Data:
+			default:
+				dropped++
+			}
+		}
+		c.lock.Unlock()
+		if dropped > 0 {
+			c.dropped.Add(uint64(dropped))
+			c.inner.OnFailure(false, fmt.Errorf("publish to %q dropped for %d subscriptions: %w",
+				in.Topic, dropped, ErrSubscriptionFull))
+		}
+	default:
+		c.inner.OnReceive(msg)
+	}
+}
+
+// OnConnect subscribes all topics again. The acks are not awaited, the
+// read loop only starts after OnConnect.
+func (c *Client) OnConnect(id int) {
+	c.lock.Lock()
+	c.connected = true
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	c.lock.Unlock()
+
+	for _, topic := range topics {
+		_ = c.send(frame{Type: TypeSubscribe, Topic: topic})
+	}
+
+	c.inner.OnConnect(id)
+}
+
+// OnDisconnect fails all requests waiting for an ack.
+func (c *Client) OnDisconnect(id int) {
+	c.lock.Lock()
+	c.connected = false
+	for reqId, ack := range c.pending {
+		close(ack)
+		delete(c.pending, reqId)
+	}
+	c.lock.Unlock()
+
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,75 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package pubsub implements topic based publish/subscribe on top of the
+// websocket client and server with a small json wire protocol:
+//
+//	{"type":"subscribe","id":1,"topic":"news"}
+//	{"type":"unsubscribe","id":2,"topic":"news"}
+//	{"type":"publish","id":3,"topic":"news","data":"<base64>"}
+//	{"type":"ack","id":3,"error":"<empty on success>"}
+//
+// The server sends publish frames without id to subscribers.
+package pubsub
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypePublish     = "publish"
+	TypeAck         = "ack"
+)
+
+// AckTimeout is how long a client waits for the server to acknowledge a
+// request.
+const AckTimeout = 5 * time.Second
+
+// SubscriptionBuffer is the channel capacity of a subscription. Publishes
+// are not acknowledged by the subscriber, one arriving at a full channel
+// is lost: it is counted by Client.Dropped and reported to OnFailure as
+// ErrSubscriptionFull, the read loop does not wait for the reader.
+const SubscriptionBuffer = 64
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrAckTimeout   = errors.New("no ack from server")
+	ErrDisconnected = errors.New("disconnected before the ack")
+	// ErrSubscriptionFull reports a publish dropped for a full channel.
+	ErrSubscriptionFull = errors.New("subscription full")
+)
+
+// frame is one message of the wire protocol. Data is base64 encoded by
+// encoding/json.
+type frame struct {
+	Type  string `json:"type"`
+	Id    uint64 `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
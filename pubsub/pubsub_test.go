@@ -0,0 +1,227 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+const testUrl = "ws://localhost:33242/pubsub"
+
+func startServer(t *testing.T) (*Server, *websockettest.Recorder) {
+	events := websockettest.NewRecorder()
+	ws := websocket.NewServer(testUrl, events)
+	server := NewServer(ws)
+	go func() { _ = ws.ListenAndServe() }()
+	t.Cleanup(func() { ws.Close() })
+	time.Sleep(200 * time.Millisecond)
+	return server, events
+}
+
+func connect(t *testing.T) (*Client, *websocket.Client) {
+	events := websockettest.NewRecorder()
+	ws := websocket.NewClient(false, events)
+	client := NewClient(ws)
+	go func() { _ = ws.ConnectAndServe(testUrl, nil) }()
+	t.Cleanup(func() { _ = ws.Disconnect() })
+	events.WaitForConnect(t, time.Second)
+	return client, ws
+}
+
+func receive(t *testing.T, ch <-chan []byte, want string) {
+	t.Helper()
+	select {
+	case data := <-ch:
+		if string(data) != want {
+			t.Errorf("got %q, want %q", data, want)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("%q not received", want)
+	}
+}
+
+func nothing(t *testing.T, ch <-chan []byte) {
+	t.Helper()
+	select {
+	case data := <-ch:
+		t.Errorf("unexpected %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	server, _ := startServer(t)
+	alice, _ := connect(t)
+	bob, _ := connect(t)
+
+	aliceNews, err := alice.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceNews2, _ := alice.Subscribe("news")
+	bobNews, _ := bob.Subscribe("news")
+	bobSport, _ := bob.Subscribe("sport")
+
+	if len(server.Subscribers("news")) != 2 || len(server.Topics()) != 2 {
+		t.Fatalf("unexpected subscriptions: %v %v",
+			server.Subscribers("news"), server.Topics())
+	}
+
+	// overlapping subscriptions
+	server.Publish("news", []byte("n1"))
+	receive(t, aliceNews, "n1")
+	receive(t, aliceNews2, "n1")
+	receive(t, bobNews, "n1")
+	nothing(t, bobSport)
+
+	if err = alice.Publish("sport", []byte("s1")); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, bobSport, "s1")
+	nothing(t, aliceNews)
+
+	// zero subscribers
+	server.Publish("weather", []byte("w1"))
+	if err = bob.Publish("weather", []byte("w2")); err != nil {
+		t.Error(err)
+	}
+	nothing(t, bobNews)
+
+	if err = alice.Unsubscribe("news"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-aliceNews; ok {
+		t.Error("channel not closed on unsubscribe")
+	}
+	server.Publish("news", []byte("n2"))
+	receive(t, bobNews, "n2")
+	if subs := server.Subscribers("news"); len(subs) != 1 {
+		t.Errorf("unexpected subscribers %v", subs)
+	}
+}
+
+func TestSubscriptionFull(t *testing.T) {
+	server, _ := startServer(t)
+	client, _ := connect(t)
+	events := client.inner.(*websockettest.Recorder)
+
+	news, err := client.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= SubscriptionBuffer; i++ {
+		server.Publish("news", []byte("n"))
+	}
+	if evnt := events.WaitForFailure(t, time.Second); !errors.Is(evnt.Err, ErrSubscriptionFull) {
+		t.Error("expected a full subscription, got ", evnt.Err)
+	}
+	if n := client.Dropped(); n != 1 {
+		t.Errorf("%d dropped", n)
+	}
+	if n := len(news); n != SubscriptionBuffer {
+		t.Errorf("%d buffered", n)
+	}
+}
+
+func TestUnsubscribeRace(t *testing.T) {
+	server, _ := startServer(t)
+	client, _ := connect(t)
+
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				server.Publish("race", []byte("x"))
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ch, err := client.Subscribe("race")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = client.Unsubscribe("race")
+				for range ch {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+}
+
+func TestCleanupAndResubscribe(t *testing.T) {
+	server, serverEvents := startServer(t)
+
+	events := websockettest.NewRecorder()
+	ws := websocket.NewClient(false, events)
+	backoff := utils.NewBackoff()
+	backoff.Initial = 50 * time.Millisecond
+	ws.SetReconnect(backoff, 0)
+	client := NewClient(ws)
+
+	// subscribed before connecting
+	ch, err := client.Subscribe("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = ws.ConnectAndServe(testUrl, nil) }()
+	defer ws.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	time.Sleep(100 * time.Millisecond)
+	server.Publish("topic", []byte("1"))
+	receive(t, ch, "1")
+
+	_ = server.ws.Disconnect(id)
+	serverEvents.WaitForDisconnect(t, time.Second)
+	if len(server.Topics()) != 0 {
+		t.Errorf("subscriptions left after disconnect: %v", server.Topics())
+	}
+
+	events.WaitForConnect(t, 2*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	server.Publish("topic", []byte("2"))
+	receive(t, ch, "2")
+}
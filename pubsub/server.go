@@ -0,0 +1,187 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Server tracks the topics each client subscribed and fans published
+// messages out to the subscribers only. It wraps the server's event
+// handler: protocol frames are consumed, other messages and all events are
+// passed on.
+type Server struct {
+	inner websocket.Events
+	ws    *websocket.Server
+
+	lock   sync.Mutex
+	topics map[string]map[int]struct{}
+	// clients maps a client to its topics, for the cleanup on disconnect
+	clients map[int]map[string]struct{}
+}
+
+// NewServer installs the pub/sub layer on ws. Create it before
+// ListenAndServe.
+func NewServer(ws *websocket.Server) *Server {
+	s := &Server{
+		inner:   ws.EventHandler(),
+		ws:      ws,
+		topics:  make(map[string]map[int]struct{}),
+		clients: make(map[int]map[string]struct{}),
+	}
+	ws.SetEventHandler(s)
+	return s
+}
+
+// Publish sends data to all subscribers of topic.
+func (s *Server) Publish(topic string, data []byte) {
+	out, err := json.Marshal(frame{Type: TypePublish, Topic: topic, Data: data})
+	if err != nil {
+		return
+	}
+	msg := &websocket.Message{MessageType: websocket.TextMessage, Data: out}
+
+	for _, id := range s.Subscribers(topic) {
+		// failing clients are cleaned up by their disconnect
+		_ = s.ws.Send(id, msg)
+	}
+}
+
+// Subscribers returns the ids of the clients subscribed to topic.
+func (s *Server) Subscribers(topic string) []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids := make([]int, 0, len(s.topics[topic]))
+	for id := range s.topics[topic] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Topics returns the topics with at least one subscriber.
+func (s *Server) Topics() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (s *Server) subscribe(clientId int, topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.topics[topic] == nil {
+		s.topics[topic] = make(map[int]struct{})
+	}
+	s.topics[topic][clientId] = struct{}{}
+	if s.clients[clientId] == nil {
+		s.clients[clientId] = make(map[string]struct{})
+	}
+	s.clients[clientId][topic] = struct{}{}
+}
+
+func (s *Server) unsubscribe(clientId int, topic string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removeLocked(clientId, topic)
+}
+
+func (s *Server) removeLocked(clientId int, topic string) {
+	delete(s.topics[topic], clientId)
+	if len(s.topics[topic]) == 0 {
+		delete(s.topics, topic)
+	}
+	delete(s.clients[clientId], topic)
+	if len(s.clients[clientId]) == 0 {
+		delete(s.clients, clientId)
+	}
+}
+
+func (s *Server) OnReceive(msg websocket.Message) {
+	var in frame
+	if msg.MessageType != websocket.TextMessage ||
+		json.Unmarshal(msg.Data, &in) != nil || in.Type == "" {
+		s.inner.OnReceive(msg)
+		return
+	}
+
+	ack := frame{Type: TypeAck, Id: in.Id}
+	switch {
+	case in.Type == TypeAck:
+		return
+	case in.Topic == "":
+		ack.Error = "missing topic"
+	case in.Type == TypeSubscribe:
+		s.subscribe(msg.ClientId, in.Topic)
+	case in.Type == TypeUnsubscribe:
+		s.unsubscribe(msg.ClientId, in.Topic)
+	case in.Type == TypePublish:
+		s.Publish(in.Topic, in.Data)
+	default:
+		ack.Error = fmt.Sprintf("unknown type %q", in.Type)
+	}
+
+	out, err := json.Marshal(ack)
+	if err != nil {
+		return
+	}
+	_ = s.ws.Send(msg.ClientId, &websocket.Message{
+		MessageType: websocket.TextMessage,
+		Data:        out,
+	})
+}
+
+func (s *Server) OnConnect(id int) {
+	s.inner.OnConnect(id)
+}
+
+// OnDisconnect drops all subscriptions of the client.
+func (s *Server) OnDisconnect(id int) {
+	s.lock.Lock()
+	for topic := range s.clients[id] {
+		s.removeLocked(id, topic)
+	}
+	s.lock.Unlock()
+
+	s.inner.OnDisconnect(id)
+}
+
+func (s *Server) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,362 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package redisbackend is a websocket.BroadcastBackend over Redis Pub/Sub,
+// speaking the Redis protocol directly instead of depending on a client
+// library.
+package redisbackend
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const DefaultDialTimeout = 5 * time.Second
+
+var ErrClosed = errors.New("backend closed")
+
+type Options struct {
+	// Password is sent with AUTH if not empty, Username with it for ACL
+	// users.
+	Username    string
+	Password    string
+	DialTimeout time.Duration
+}
+
+// envelope is the published payload.
+type envelope struct {
+	Type     int    `json:"type"`
+	Data     []byte `json:"data"`
+	ClientId int    `json:"client,omitempty"`
+	Origin   string `json:"origin"`
+}
+
+// Backend publishes over one connection and receives over another, which
+// reconnects with backoff and subscribes the channels again.
+type Backend struct {
+	addr string
+	opts Options
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	pubLock sync.Mutex
+	pub     *conn
+
+	subLock  sync.Mutex
+	sub      *conn
+	handlers map[string][]func(websocket.Message)
+}
+
+// New returns a backend for the Redis server at addr (host:port). It
+// connects on the first Publish or Subscribe.
+func New(addr string, opts Options) *Backend {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Backend{
+		addr:     addr,
+		opts:     opts,
+		ctx:      ctx,
+		cancel:   cancel,
+		handlers: make(map[string][]func(websocket.Message)),
+	}
+}
+
+func (b *Backend) Publish(channel string, msg websocket.Message) error {
+	payload, err := json.Marshal(envelope{
+		Type:     msg.MessageType,
+		Data:     msg.Data,
+		ClientId: msg.ClientId,
+		Origin:   msg.Origin,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+
+	if b.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if b.pub == nil {
+		if b.pub, err = dial(b.addr, b.opts); err != nil {
+			return err
+		}
+	}
+	if err = b.pub.command("PUBLISH", channel, string(payload)); err == nil {
+		_, err = b.pub.reply()
+	}
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// broken connection, dial again next time
+		b.pub.close()
+		b.pub = nil
+	}
+	return err
+}
+
+// Subscribe adds fn for channel. If subscribing fails, the channel is
+// subscribed with the next reconnect.
+func (b *Backend) Subscribe(channel string, fn func(websocket.Message)) error {
+	b.subLock.Lock()
+	defer b.subLock.Unlock()
+
+	if b.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	_, subscribed := b.handlers[channel]
+	b.handlers[channel] = append(b.handlers[channel], fn)
+
+	if b.sub == nil {
+		return b.connectSubscriber()
+	}
+	if subscribed {
+		return nil
+	}
+	return b.sub.command("SUBSCRIBE", channel)
+}
+
+// connectSubscriber dials, subscribes all channels and starts receiving.
+// The caller holds subLock.
+func (b *Backend) connectSubscriber() error {
+	c, err := dial(b.addr, b.opts)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"SUBSCRIBE"}
+	for channel := range b.handlers {
+		args = append(args, channel)
+	}
+	if err = c.command(args...); err != nil {
+		c.close()
+		return err
+	}
+
+	b.sub = c
+	b.wg.Add(1)
+	go b.receive(c)
+	return nil
+}
+
+func (b *Backend) receive(c *conn) {
+	defer b.wg.Done()
+
+	_ = b.readMessages(c)
+	c.close()
+
+	b.subLock.Lock()
+	if b.sub == c {
+		b.sub = nil
+	}
+	b.subLock.Unlock()
+
+	backoff := utils.NewBackoff()
+	for {
+		if backoff.Wait(b.ctx) != nil {
+			return
+		}
+
+		b.subLock.Lock()
+		if b.ctx.Err() != nil {
+			b.subLock.Unlock()
+			return
+		}
+		// a Subscribe may have connected meanwhile
+		var err error
+		if b.sub == nil {
+			err = b.connectSubscriber()
+		}
+		b.subLock.Unlock()
+
+		if err == nil {
+			return
+		}
+	}
+}
+
+func (b *Backend) readMessages(c *conn) error {
+	for {
+		value, err := c.reply()
+		if err != nil {
+			return err
+		}
+		push, ok := value.([]any)
+		if !ok || len(push) != 3 || push[0] != "message" {
+			continue
+		}
+		channel, _ := push[1].(string)
+		payload, _ := push[2].(string)
+
+		var env envelope
+		if err = json.Unmarshal([]byte(payload), &env); err != nil {
+			continue
+		}
+		msg := websocket.Message{
+			MessageType: env.Type,
+			Data:        env.Data,
+			ClientId:    env.ClientId,
+			Origin:      env.Origin,
+		}
+
+		b.subLock.Lock()
+		handlers := b.handlers[channel]
+		b.subLock.Unlock()
+		for _, fn := range handlers {
+			fn(msg)
+		}
+	}
+}
+
+// Close ends both connections and waits for the receiver.
+func (b *Backend) Close() error {
+	b.cancel()
+
+	b.pubLock.Lock()
+	if b.pub != nil {
+		b.pub.close()
+		b.pub = nil
+	}
+	b.pubLock.Unlock()
+
+	b.subLock.Lock()
+	if b.sub != nil {
+		b.sub.close()
+	}
+	b.subLock.Unlock()
+
+	b.wg.Wait()
+	return nil
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+}
+
+func dial(addr string, opts Options) (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{netConn: netConn, reader: bufio.NewReader(netConn)}
+
+	if opts.Password != "" {
+		args := []string{"AUTH", opts.Password}
+		if opts.Username != "" {
+			args = []string{"AUTH", opts.Username, opts.Password}
+		}
+		if err = c.command(args...); err == nil {
+			_, err = c.reply()
+		}
+		if err != nil {
+			c.close()
+			return nil, fmt.Errorf("auth: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (c *conn) close() {
+	_ = c.netConn.Close()
+}
+
+// command writes args as array of bulk strings.
+func (c *conn) command(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := c.netConn.Write(buf)
+	return err
+}
+
+// reply reads one value: string, int64, nil, []any or a redisError.
+func (c *conn) reply() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(rest)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
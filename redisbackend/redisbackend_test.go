@@ -0,0 +1,214 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package redisbackend
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// fakeRedis implements AUTH, SUBSCRIBE and PUBLISH of a Redis server.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	lock  sync.Mutex
+	conns []*conn
+	subs  map[string][]*conn
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: listener,
+		password: password,
+		subs:     make(map[string][]*conn),
+	}
+	t.Cleanup(func() { listener.Close(); f.kill() })
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c := &conn{netConn: netConn, reader: bufio.NewReader(netConn)}
+			f.lock.Lock()
+			f.conns = append(f.conns, c)
+			f.lock.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func bulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func (f *fakeRedis) serve(c *conn) {
+	for {
+		value, err := c.reply()
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range value.([]any) {
+			args = append(args, arg.(string))
+		}
+
+		f.lock.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] == f.password {
+				_, _ = c.netConn.Write([]byte("+OK\r\n"))
+			} else {
+				_, _ = c.netConn.Write([]byte("-WRONGPASS invalid password\r\n"))
+			}
+		case "SUBSCRIBE":
+			for i, channel := range args[1:] {
+				f.subs[channel] = append(f.subs[channel], c)
+				_, _ = c.netConn.Write([]byte("*3\r\n" + bulk("subscribe") +
+					bulk(channel) + ":" + strconv.Itoa(i+1) + "\r\n"))
+			}
+		case "PUBLISH":
+			for _, sub := range f.subs[args[1]] {
+				_, _ = sub.netConn.Write([]byte("*3\r\n" + bulk("message") +
+					bulk(args[1]) + bulk(args[2])))
+			}
+			_, _ = c.netConn.Write([]byte(":" +
+				strconv.Itoa(len(f.subs[args[1]])) + "\r\n"))
+		}
+		f.lock.Unlock()
+	}
+}
+
+func (f *fakeRedis) subscribers(channel string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.subs[channel])
+}
+
+// kill drops all connections.
+func (f *fakeRedis) kill() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, c := range f.conns {
+		c.close()
+	}
+	f.conns = nil
+	f.subs = make(map[string][]*conn)
+}
+
+func waitSubscribers(t *testing.T, f *fakeRedis, channel string, count int) {
+	t.Helper()
+	for start := time.Now(); f.subscribers(channel) != count; {
+		if time.Since(start) > 3*time.Second {
+			t.Fatalf("%d subscribers, want %d", f.subscribers(channel), count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, ch <-chan websocket.Message, want string) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		if string(msg.Data) != want || msg.MessageType != websocket.TextMessage ||
+			msg.Origin != "instance" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("%q not received", want)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	fake := startFakeRedis(t, "pw")
+	addr := fake.listener.Addr().String()
+
+	alice := New(addr, Options{Password: "pw"})
+	defer alice.Close()
+	bob := New(addr, Options{Password: "pw"})
+	defer bob.Close()
+
+	aliceCh := make(chan websocket.Message, 4)
+	bobCh := make(chan websocket.Message, 4)
+	if err := alice.Subscribe("room", func(msg websocket.Message) { aliceCh <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Subscribe("room", func(msg websocket.Message) { bobCh <- msg }); err != nil {
+		t.Fatal(err)
+	}
+	waitSubscribers(t, fake, "room", 2)
+
+	// the publisher receives its own message too
+	msg := websocket.Message{MessageType: websocket.TextMessage,
+		Data: []byte("hi"), Origin: "instance"}
+	if err := alice.Publish("room", msg); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, aliceCh, "hi")
+	receive(t, bobCh, "hi")
+
+	// subscriptions survive a reconnect
+	fake.kill()
+	waitSubscribers(t, fake, "room", 2)
+	msg.Data = []byte("again")
+	if err := bob.Publish("room", msg); err != nil {
+		// the publishing connection is dialed again with the next call
+		if err = bob.Publish("room", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive(t, aliceCh, "again")
+	receive(t, bobCh, "again")
+
+	wrong := New(addr, Options{Password: "wrong"})
+	defer wrong.Close()
+	var replyErr redisError
+	if err := wrong.Publish("room", msg); !errors.As(err, &replyErr) {
+		t.Errorf("expected auth error, got %v", err)
+	}
+
+	alice.Close()
+	if err := alice.Publish("room", msg); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// expandTemplate replaces the {seq} and {ts} placeholders of a --message
+// payload.
+func expandTemplate(template string, seq int, now time.Time) string {
+	return strings.NewReplacer(
+		"{seq}", strconv.Itoa(seq),
+		"{ts}", now.Format(time.RFC3339Nano),
+	).Replace(template)
+}
+
+// repeatSend sends cfg.message every cfg.interval until cfg.count messages
+// are sent (0: forever) or ctx is done. While disconnected sending pauses,
+// failed sends are retried on the next tick.
+func repeatSend(ctx context.Context, client *websocket.Client,
+	state *connectionState, out *printer, cfg config) {
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	total := "∞"
+	if cfg.count > 0 {
+		total = strconv.Itoa(cfg.count)
+	}
+
+	paused := false
+	for seq := 1; cfg.count == 0 || seq <= cfg.count; {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !state.up.Load() {
+				if !paused {
+					out.Printf(markerEvent, "not connected, sending paused")
+					paused = true
+				}
+				continue
+			}
+			if paused {
+				out.Printf(markerEvent, "connected, sending resumed")
+				paused = false
+			}
+
+			msg := websocket.Message{
+				MessageType: websocket.TextMessage,
+				Data:        []byte(expandTemplate(cfg.message, seq, now)),
+			}
+			if err := client.Send(msg); err != nil {
+				out.Printf(markerEvent, "send #%d: %v", seq, err)
+				continue
+			}
+			out.Sent(msg)
+			out.Printf(markerTx, "sent %d/%s", seq, total)
+			seq++
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const defaultRequestTimeout = 10 * time.Second
+
+// sendRequest connects, sends cfg.request and writes the first received
+// message to std.data. Everything else goes to std.diag. cfg.timeout covers
+// connecting and waiting for the reply.
+func sendRequest(ctx context.Context, cfg config, std streams) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	messageCh := make(chan websocket.Message, 16)
+	eventCh := make(chan websocket.Event, 16)
+
+	state := newConnectionState(
+		websocket.NewEventsToChannel(messageCh, eventCh))
+	client := websocket.NewClient(cfg.skipVerify, state)
+	out := newPrinter(std.diag, cfg.output, cfg.timestamps.String())
+	if cfg.quiet {
+		out.SetQuiet()
+	}
+
+	if err := setupClientTLS(client, cfg); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	client.SetReadLimit(cfg.maxSize)
+	if len(cfg.subprotocols) > 0 {
+		client.SetSubprotocols(cfg.subprotocols...)
+	}
+
+	go func() {
+		for evnt := range eventCh {
+			out.Event(evnt)
+		}
+	}()
+
+	var serveErr error
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		serveErr = client.ConnectAndServeWithHeader(cfg.address, cfg.header)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return requestTimeout(ctx, "connect")
+	case <-serveDone:
+		return withExitCode(connectionExitCode(serveErr, false), serveErr)
+	case <-state.connected:
+	}
+
+	msg := websocket.Message{
+		MessageType: websocket.TextMessage,
+		Data:        []byte(cfg.request),
+	}
+	if err := client.Send(msg); err != nil {
+		return withExitCode(exitConnectionLost, err)
+	}
+	out.Sent(msg)
+
+	var reply websocket.Message
+	select {
+	case <-ctx.Done():
+		_ = client.Disconnect()
+		return requestTimeout(ctx, "reply")
+	case <-serveDone:
+		if serveErr == nil {
+			serveErr = errors.New("connection closed before a reply")
+		}
+		return withExitCode(connectionExitCode(serveErr, true), serveErr)
+	case reply = <-messageCh:
+	}
+
+	_ = client.Disconnect()
+
+	if err := writeReply(std.data, cfg, reply); err != nil {
+		return err
+	}
+	if cfg.expect != "" && !bytes.Contains(reply.Data, []byte(cfg.expect)) {
+		return fmt.Errorf("reply does not contain %q", cfg.expect)
+	}
+	return nil
+}
+
+func requestTimeout(ctx context.Context, waitingFor string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return withExitCode(exitTimeout,
+			fmt.Errorf("timeout waiting for %s", waitingFor))
+	}
+	return ctx.Err()
+}
+
+// writeReply writes the payload as is for --output text, otherwise in the
+// selected encoding or as a json line.
+func writeReply(w io.Writer, cfg config, reply websocket.Message) error {
+	if cfg.json {
+		out := newPrinter(w, cfg.output, cfg.timestamps.String())
+		out.SetJSON(w)
+		out.Received(reply)
+		return nil
+	}
+
+	data := reply.Data
+	if cfg.output != outputText {
+		data = []byte(formatPayload(cfg.output, reply))
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const (
+	scriptSend    = "send"
+	scriptSendB64 = "sendb64"
+	scriptWait    = "wait"
+	scriptExpect  = "expect"
+	scriptClose   = "close"
+)
+
+// scriptStep is one line of a --script file.
+type scriptStep struct {
+	line    int
+	op      string
+	arg     string
+	data    []byte
+	timeout time.Duration
+}
+
+// loadScript reads and parses a --script file.
+func loadScript(path string) ([]scriptStep, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	steps, err := parseScript(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return steps, nil
+}
+
+// parseScript parses one step per line. Empty lines and lines starting
+// with # are skipped.
+func parseScript(r io.Reader) ([]scriptStep, error) {
+	var steps []scriptStep
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		txt := strings.TrimSpace(scanner.Text())
+		if txt == "" || strings.HasPrefix(txt, "#") {
+			continue
+		}
+
+		op, arg, _ := strings.Cut(txt, " ")
+		step := scriptStep{line: line, op: op, arg: strings.TrimSpace(arg)}
+
+		var err error
+		switch op {
+		case scriptSend:
+			step.data = []byte(step.arg)
+		case scriptSendB64:
+			step.data, err = base64.StdEncoding.DecodeString(step.arg)
+		case scriptWait:
+			step.timeout, err = time.ParseDuration(step.arg)
+		case scriptExpect:
+			// an optional trailing duration is the timeout
+			if i := strings.LastIndex(step.arg, " "); i > 0 {
+				if d, e := time.ParseDuration(step.arg[i+1:]); e == nil {
+					step.arg, step.timeout = strings.TrimSpace(step.arg[:i]), d
+				}
+			}
+			if step.arg == "" {
+				err = errors.New("missing substring")
+			}
+		case scriptClose:
+			if step.arg != "" {
+				err = errors.New("unexpected argument")
+			}
+		default:
+			err = fmt.Errorf("unknown command %q", op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("empty script")
+	}
+
+	return steps, nil
+}
+
+// runScript executes the steps in order. expect consumes messages from
+// inbox until one contains the substring and fails after its timeout,
+// or wait if none is given. The script ends after the last step or at close.
+func runScript(ctx context.Context, client *websocket.Client, out *printer,
+	steps []scriptStep, inbox <-chan websocket.Message, wait time.Duration) error {
+
+	for _, step := range steps {
+		switch step.op {
+		case scriptSend, scriptSendB64:
+			msg := websocket.Message{
+				MessageType: websocket.TextMessage,
+				Data:        step.data,
+			}
+			if step.op == scriptSendB64 {
+				msg.MessageType = websocket.BinaryMessage
+			}
+			if err := client.Send(msg); err != nil {
+				return fmt.Errorf("script line %d: %w", step.line, err)
+			}
+			out.Sent(msg)
+		case scriptWait:
+			timer := time.NewTimer(step.timeout)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		case scriptExpect:
+			timeout := step.timeout
+			if timeout == 0 {
+				timeout = wait
+			}
+			if err := expectMessage(ctx, inbox, step.arg, timeout); err != nil {
+				return fmt.Errorf("script line %d: %w", step.line, err)
+			}
+		case scriptClose:
+			return nil
+		}
+	}
+	return nil
+}
+
+func expectMessage(ctx context.Context, inbox <-chan websocket.Message,
+	substring string, timeout time.Duration) error {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-inbox:
+			if strings.Contains(string(msg.Data), substring) {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("expected %q, nothing matching received within %v",
+				substring, timeout)
+		}
+	}
+}
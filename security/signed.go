@@ -0,0 +1,287 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package security protects messages independent of the transport.
+package security
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const (
+	// MaxKeys is the number of keys active at once, the signing key and
+	// the one before or after it during a rotation.
+	MaxKeys = 2
+
+	// MaxSenders is the number of signing peers whose counters are kept.
+	// The least recently heard one is forgotten for a new one, its
+	// counter still bounds the counters accepted from unknown senders.
+	MaxSenders = 1024
+
+	headerSize = 1 + 8 + 8
+	tagSize    = sha256.Size
+)
+
+var (
+	ErrMissingTag  = errors.New("message without integrity tag")
+	ErrBadTag      = errors.New("bad integrity tag")
+	ErrUnknownKey  = errors.New("unknown key id")
+	ErrReplay      = errors.New("replayed message")
+	ErrTooManyKeys = errors.New("too many active keys")
+	ErrKeyInUse    = errors.New("key id in use")
+)
+
+// SignedEvents delivers only messages carrying a valid HMAC-SHA256 tag to
+// the wrapped handler. Rejected messages are reported as failures. The
+// tag covers the random id of the signing SignedEvents and its counter.
+// The counter of a sender has to increase over all its connections, so a
+// recorded message can not be replayed, neither after a reconnect. It
+// starts at the clock, a restarted sender continues above the counters
+// of the senders forgotten meanwhile.
+//
+// Messages are signed by Sign or Send. A signed message starts with the
+// key id, the sender id and the counter, the tag follows the payload.
+//
+// To rotate keys without dropping connections, AddKey the new key on all
+// peers, then UseKey it for signing and finally RemoveKey the old one.
+type SignedEvents struct {
+	inner websocket.Events
+
+	lock    sync.Mutex
+	keys    map[byte][]byte
+	signing byte
+	sender  uint64
+	counter uint64
+	// received holds the highest counter of each sender, floor the one
+	// of the senders forgotten
+	received   map[uint64]*senderMark
+	floor      uint64
+	heard      uint64
+	maxSenders int
+	sendLock   sync.Mutex
+	rejected   atomic.Uint64
+}
+
+type senderMark struct {
+	counter uint64
+	// heard orders the senders by their last message
+	heard uint64
+}
+
+// NewSignedEvents signs and verifies with key, its key id is 0.
+func NewSignedEvents(inner websocket.Events, key []byte) *SignedEvents {
+	var sender [8]byte
+	_, _ = rand.Read(sender[:])
+	return &SignedEvents{
+		inner:      inner,
+		keys:       map[byte][]byte{0: key},
+		sender:     binary.BigEndian.Uint64(sender[:]),
+		counter:    uint64(time.Now().UnixNano()),
+		received:   make(map[uint64]*senderMark),
+		maxSenders: MaxSenders,
+	}
+}
+
+// AddKey accepts messages signed with key, without signing with it yet.
+func (s *SignedEvents) AddKey(id byte, key []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[id]; ok {
+		return ErrKeyInUse
+	}
+	if len(s.keys) >= MaxKeys {
+		return ErrTooManyKeys
+	}
+	s.keys[id] = key
+	return nil
+}
+
+// UseKey signs with an added key from now on.
+func (s *SignedEvents) UseKey(id byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	s.signing = id
+	return nil
+}
+
+// RemoveKey stops accepting a key, except the signing one.
+func (s *SignedEvents) RemoveKey(id byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.keys[id]; !ok {
+		return ErrUnknownKey
+	}
+	if id == s.signing {
+		return ErrKeyInUse
+	}
+	delete(s.keys, id)
+	return nil
+}
+
+// Rejected returns the number of messages not delivered so far.
+func (s *SignedEvents) Rejected() uint64 {
+	return s.rejected.Load()
+}
+
+func tag(key []byte, messageType int, header []byte, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{byte(messageType)})
+	mac.Write(header)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// Sign returns a copy of msg signed with the current key and the next
+// counter. Signed messages must be sent in the order they were signed,
+// Send takes care of that.
+func (s *SignedEvents) Sign(msg websocket.Message) websocket.Message {
+	s.lock.Lock()
+	id, key := s.signing, s.keys[s.signing]
+	s.counter++
+	counter := s.counter
+	s.lock.Unlock()
+
+	data := make([]byte, headerSize, headerSize+len(msg.Data)+tagSize)
+	data[0] = id
+	binary.BigEndian.PutUint64(data[1:], s.sender)
+	binary.BigEndian.PutUint64(data[9:], counter)
+	data = append(data, msg.Data...)
+	msg.Data = append(data, tag(key, msg.MessageType, data[:headerSize], msg.Data)...)
+	return msg
+}
+
+// Send signs msg and sends it with send, e.g. Client.Send. Concurrent
+// calls are serialized, so the counters arrive in order.
+func (s *SignedEvents) Send(send func(websocket.Message) error, msg websocket.Message) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	return send(s.Sign(msg))
+}
+
+// verify returns the payload of a signed message.
+func (s *SignedEvents) verify(msg websocket.Message) ([]byte, error) {
+	if len(msg.Data) < headerSize+tagSize {
+		return nil, ErrMissingTag
+	}
+	header := msg.Data[:headerSize]
+	payload := msg.Data[headerSize : len(msg.Data)-tagSize]
+	got := msg.Data[len(msg.Data)-tagSize:]
+	sender := binary.BigEndian.Uint64(header[1:])
+	counter := binary.BigEndian.Uint64(header[9:])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key, ok := s.keys[header[0]]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if !hmac.Equal(got, tag(key, msg.MessageType, header, payload)) {
+		return nil, ErrBadTag
+	}
+	mark, ok := s.received[sender]
+	if !ok && counter <= s.floor || ok && counter <= mark.counter {
+		return nil, ErrReplay
+	}
+	if !ok {
+		if len(s.received) >= s.maxSenders {
+			s.forgetLocked()
+		}
+		mark = &senderMark{}
+		s.received[sender] = mark
+	}
+	s.heard++
+	mark.counter, mark.heard = counter, s.heard
+	return payload, nil
+}
+
+// forgetLocked drops the least recently heard sender, keeping its counter
+// in the floor.
+func (s *SignedEvents) forgetLocked() {
+	var oldest uint64
+	var oldestMark *senderMark
+	for sender, mark := range s.received {
+		if oldestMark == nil || mark.heard < oldestMark.heard {
+			oldest, oldestMark = sender, mark
+		}
+	}
+	delete(s.received, oldest)
+	if oldestMark.counter > s.floor {
+		s.floor = oldestMark.counter
+	}
+}
+
+func (s *SignedEvents) reject(msg websocket.Message, err error) {
+	s.rejected.Add(1)
+	s.inner.OnFailure(false, fmt.Errorf("message from %d: %w", msg.ClientId, err))
+}
+
+func (s *SignedEvents) OnReceive(msg websocket.Message) {
+	s.OnReceiveCtx(context.Background(), msg)
+}
+
+func (s *SignedEvents) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	payload, err := s.verify(msg)
+	if err != nil {
+		s.reject(msg, err)
+		return
+	}
+	msg.Data = payload
+	if ctxInner, ok := s.inner.(websocket.CtxEvents); ok {
+		ctxInner.OnReceiveCtx(ctx, msg)
+		return
+	}
+	s.inner.OnReceive(msg)
+}
+
+func (s *SignedEvents) OnConnect(id int) {
+	s.inner.OnConnect(id)
+}
+
+func (s *SignedEvents) OnDisconnect(id int) {
+	s.inner.OnDisconnect(id)
+}
+
+func (s *SignedEvents) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
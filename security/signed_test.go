@@ -0,0 +1,214 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+func text(s string) websocket.Message {
+	return websocket.Message{MessageType: websocket.TextMessage, Data: []byte(s)}
+}
+
+func TestSignedEvents(t *testing.T) {
+	key := []byte("shared secret")
+	serverEvents, clientEvents := websockettest.NewRecorder(), websockettest.NewRecorder()
+	serverSigned := NewSignedEvents(serverEvents, key)
+	clientSigned := NewSignedEvents(clientEvents, key)
+	ws, client := websockettest.NewPair(t, serverSigned, clientSigned)
+	defer ws.Close()
+	defer client.Disconnect()
+
+	if err := clientSigned.Send(client.Send, text("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "hello" {
+		t.Errorf("server received %q", msg.Data)
+	}
+	err := serverSigned.Send(func(msg websocket.Message) error {
+		return ws.Send(client.ClientId, &msg)
+	}, text("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := clientEvents.WaitForMessage(t, time.Second); string(msg.Data) != "world" {
+		t.Errorf("client received %q", msg.Data)
+	}
+
+	signed := clientSigned.Sign(text("once"))
+	tampered := clientSigned.Sign(text("tampered"))
+	tampered.Data[headerSize] = 'T'
+	forged := NewSignedEvents(websockettest.NewRecorder(), []byte("wrong")).Sign(text("forged"))
+	unknown := NewSignedEvents(websockettest.NewRecorder(), key)
+	_ = unknown.AddKey(7, key)
+	_ = unknown.UseKey(7)
+
+	rejected := []struct {
+		msg websocket.Message
+		err error
+	}{
+		{signed, nil},
+		{signed, ErrReplay},
+		{text("unsigned"), ErrMissingTag},
+		{tampered, ErrBadTag},
+		{forged, ErrBadTag},
+		{unknown.Sign(text("unknown")), ErrUnknownKey},
+	}
+	for _, c := range rejected {
+		if err = client.Send(c.msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = clientSigned.Send(client.Send, text("last"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "once" {
+		t.Errorf("server received %q", msg.Data)
+	}
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "last" {
+		t.Errorf("delivered %q", msg.Data)
+	}
+	if n := serverSigned.Rejected(); n != 5 {
+		t.Errorf("%d rejected", n)
+	}
+	var failures []error
+	for _, evnt := range serverEvents.EventsSeen() {
+		if evnt.Type == websocket.Failure {
+			failures = append(failures, evnt.Err)
+		}
+	}
+	if len(failures) != 5 {
+		t.Fatalf("failures: %v", failures)
+	}
+	for i, c := range rejected[1:] {
+		if !errors.Is(failures[i], c.err) {
+			t.Errorf("expected %v, got %v", c.err, failures[i])
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldKey, newKey := []byte("old"), []byte("new")
+	serverEvents := websockettest.NewRecorder()
+	serverSigned := NewSignedEvents(serverEvents, oldKey)
+	clientSigned := NewSignedEvents(websockettest.NewRecorder(), oldKey)
+	ws, client := websockettest.NewPair(t, serverSigned, clientSigned)
+	defer ws.Close()
+	defer client.Disconnect()
+
+	for _, s := range []*SignedEvents{serverSigned, clientSigned} {
+		if err := s.AddKey(1, newKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := serverSigned.AddKey(2, newKey); !errors.Is(err, ErrTooManyKeys) {
+		t.Error("expected too many keys, got ", err)
+	}
+	if err := serverSigned.AddKey(1, newKey); !errors.Is(err, ErrKeyInUse) {
+		t.Error("expected key in use, got ", err)
+	}
+
+	_ = clientSigned.Send(client.Send, text("old"))
+	if err := clientSigned.UseKey(1); err != nil {
+		t.Fatal(err)
+	}
+	_ = clientSigned.Send(client.Send, text("new"))
+	for _, expected := range []string{"old", "new"} {
+		if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != expected {
+			t.Errorf("received %q, expected %q", msg.Data, expected)
+		}
+	}
+
+	if err := clientSigned.RemoveKey(1); !errors.Is(err, ErrKeyInUse) {
+		t.Error("removed the signing key: ", err)
+	}
+	if err := serverSigned.RemoveKey(0); !errors.Is(err, ErrKeyInUse) {
+		t.Error("removed the signing key: ", err)
+	}
+	_ = serverSigned.UseKey(1)
+	if err := serverSigned.RemoveKey(0); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = clientSigned.UseKey(0)
+	_ = clientSigned.Send(client.Send, text("retired"))
+	_ = clientSigned.UseKey(1)
+	_ = clientSigned.Send(client.Send, text("still connected"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "still connected" {
+		t.Errorf("received %q", msg.Data)
+	}
+	if n := serverSigned.Rejected(); n != 1 {
+		t.Errorf("%d rejected", n)
+	}
+}
+
+func TestReplayAfterReconnect(t *testing.T) {
+	key := []byte("shared secret")
+	serverEvents := websockettest.NewRecorder()
+	serverSigned := NewSignedEvents(serverEvents, key)
+	clientSigned := NewSignedEvents(websockettest.NewRecorder(), key)
+	ws, client := websockettest.NewPair(t, serverSigned, clientSigned)
+	defer ws.Close()
+
+	recorded := clientSigned.Sign(text("recorded"))
+	if err := client.Send(recorded); err != nil {
+		t.Fatal(err)
+	}
+	serverEvents.WaitForMessage(t, time.Second)
+	_ = client.Disconnect()
+	serverEvents.WaitForDisconnect(t, time.Second)
+
+	again := ws.NewClient(t, clientSigned)
+	defer again.Disconnect()
+	_ = again.Send(recorded)
+	_ = clientSigned.Send(again.Send, text("continued"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "continued" {
+		t.Errorf("received %q", msg.Data)
+	}
+	if evnt := serverEvents.WaitForFailure(t, time.Second); !errors.Is(evnt.Err, ErrReplay) {
+		t.Error("expected replay, got ", evnt.Err)
+	}
+
+	// a restarted sender replaces the forgotten one, whose counter stays
+	serverSigned.lock.Lock()
+	serverSigned.maxSenders = 1
+	serverSigned.lock.Unlock()
+	restarted := NewSignedEvents(websockettest.NewRecorder(), key)
+	_ = restarted.Send(again.Send, text("restarted"))
+	_ = again.Send(recorded)
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "restarted" {
+		t.Errorf("received %q", msg.Data)
+	}
+	if evnt := serverEvents.WaitForFailure(t, time.Second); !errors.Is(evnt.Err, ErrReplay) {
+		t.Error("expected replay of a forgotten sender, got ", evnt.Err)
+	}
+	if n := serverSigned.Rejected(); n != 2 {
+		t.Errorf("%d rejected", n)
+	}
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const serverCommandHelp = `commands: \clients, \send <id> <text>, \kick <id>, \stats, ` +
+	`anything else is broadcast`
+
+// serverCommand runs an interactive server command, a line starting
+// with a backslash. Unknown commands and bad arguments print the help.
+func serverCommand(server *websocket.Server, out *printer, line string) {
+	cmd, args, _ := strings.Cut(strings.TrimPrefix(line, `\`), " ")
+
+	switch cmd {
+	case "clients":
+		clients := server.Clients()
+		if len(clients) == 0 {
+			out.Printf(markerEvent, "no clients connected")
+		}
+		for _, client := range clients {
+			out.Printf(markerEvent, "%d\t%s\tconnected %s (%v)", client.Id,
+				client.RemoteAddr, client.ConnectedAt.Format(time.TimeOnly),
+				time.Since(client.ConnectedAt).Round(time.Second))
+		}
+	case "send":
+		idArg, txt, _ := strings.Cut(args, " ")
+		id, ok := parseClientId(idArg)
+		if !ok {
+			out.Printf(markerEvent, "%s", serverCommandHelp)
+			return
+		}
+		msg := websocket.Message{
+			MessageType: websocket.TextMessage,
+			Data:        []byte(txt),
+			ClientId:    id,
+		}
+		if err := server.Send(id, &msg); err != nil {
+			out.Printf(markerEvent, "send to <%d>: %v", id, err)
+			return
+		}
+		out.Sent(msg)
+	case "kick":
+		id, ok := parseClientId(args)
+		if !ok {
+			out.Printf(markerEvent, "%s", serverCommandHelp)
+			return
+		}
+		if err := server.Disconnect(id); err != nil {
+			out.Printf(markerEvent, "kick <%d>: %v", id, err)
+			return
+		}
+		out.Printf(markerEvent, "kicked <%d>", id)
+	case "stats":
+		stats := server.Stats()
+		out.Printf(markerEvent, "clients: %d connected, %d total",
+			stats.Clients, stats.Connects)
+		out.Printf(markerEvent, "sent %d messages (%d bytes), received %d messages (%d bytes)",
+			stats.MessagesSent, stats.BytesSent,
+			stats.MessagesReceived, stats.BytesReceived)
+	default:
+		out.Printf(markerEvent, "%s", serverCommandHelp)
+	}
+}
+
+func parseClientId(arg string) (int, bool) {
+	id, err := strconv.Atoi(strings.TrimSpace(arg))
+	return id, err == nil
+}
@@ -0,0 +1,132 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// lingerReader delays the EOF of piped input by wait, so replies to the
+// last messages are still written.
+type lingerReader struct {
+	io.Reader
+	ctx  context.Context
+	wait time.Duration
+}
+
+func (l lingerReader) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	if errors.Is(err, io.EOF) {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case <-l.ctx.Done():
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
+
+// pipeStdio connects stdin and stdout to the websocket without any
+// decoration, events go to stderr. Piped input ends after EOF and --wait. Lines are sent as text messages, with
+// --binary stdin is sent in binary chunks and messages are written as is.
+func pipeStdio(ctx context.Context, cfg config, std streams) error {
+	eventCh := make(chan websocket.Event, 16)
+
+	state := newConnectionState(websocket.NewEventsToChannel(nil, eventCh))
+	client := websocket.NewClient(cfg.skipVerify, state)
+	out := newPrinter(std.diag, cfg.output, cfg.timestamps.String())
+	if cfg.quiet {
+		out.SetQuiet()
+	}
+
+	if err := setupClientTLS(client, cfg); err != nil {
+		return withExitCode(exitUsage, err)
+	}
+	client.SetKeepalive(cfg.ping, cfg.pingTimeout)
+	client.SetReadLimit(cfg.maxSize)
+	if len(cfg.subprotocols) > 0 {
+		client.SetSubprotocols(cfg.subprotocols...)
+	}
+
+	go func() {
+		for evnt := range eventCh {
+			out.Event(evnt)
+		}
+	}()
+
+	var serveErr error
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		serveErr = client.ConnectAndServeWithHeader(cfg.address, cfg.header)
+	}()
+
+	opts := websocket.PipeOptions{Framing: websocket.FramingLine}
+	if cfg.binary {
+		opts.Framing = websocket.FramingChunk
+	}
+
+	var stdin io.Reader = os.Stdin
+	if !stdinInteractive() {
+		stdin = lingerReader{Reader: os.Stdin, ctx: ctx, wait: cfg.wait}
+	}
+
+	pipeDone := make(chan error, 1)
+	go func() {
+		pipeDone <- websocket.Pipe(ctx, client, stdin, std.data, opts)
+	}()
+
+	var err error
+	select {
+	case <-serveDone:
+		return withExitCode(connectionExitCode(serveErr, false), serveErr)
+	case err = <-pipeDone:
+	}
+
+	select {
+	case <-serveDone:
+		// the connection ended the pipe
+		if serveErr != nil && websocket.KindOf(serveErr) != websocket.KindNormalClosure {
+			return withExitCode(connectionExitCode(serveErr, true), serveErr)
+		}
+		return nil
+	default:
+	}
+
+	_ = client.Disconnect()
+	<-serveDone
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,576 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stomp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Subprotocols are offered in the handshake, as Web-STOMP servers expect.
+var Subprotocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// MessageBuffer is the channel capacity of a subscription. A message for a
+// full channel ends the subscription with an *OverflowError, it is nacked
+// in the client ack modes so the server redelivers it.
+const MessageBuffer = 64
+
+type AckMode string
+
+const (
+	AckAuto             AckMode = "auto"
+	AckClient           AckMode = "client"
+	AckClientIndividual AckMode = "client-individual"
+)
+
+var (
+	ErrNotConnected     = errors.New("stomp session not connected")
+	ErrSessionEnded     = errors.New("stomp session ended")
+	ErrHeartBeatTimeout = errors.New("stomp heart-beat timed out")
+	ErrOverflow         = errors.New("stomp subscription overflowed")
+)
+
+// OverflowError is reported to OnFailure when a subscription was ended
+// because its channel was full. It matches ErrOverflow.
+type OverflowError struct {
+	Subscription string
+	Destination  string
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("stomp subscription %s of %s overflowed", e.Subscription, e.Destination)
+}
+
+func (e *OverflowError) Unwrap() error {
+	return ErrOverflow
+}
+
+// Error is an ERROR frame of the server.
+type Error struct {
+	Message string
+	Body    []byte
+}
+
+func (e *Error) Error() string {
+	if len(e.Body) > 0 {
+		return fmt.Sprintf("stomp error: %s: %s", e.Message, e.Body)
+	}
+	return "stomp error: " + e.Message
+}
+
+// HeartBeat are the intervals of the heart-beat header, 0 disables a
+// direction.
+type HeartBeat struct {
+	Send    time.Duration
+	Receive time.Duration
+}
+
+type ConnectOptions struct {
+	// Host is the virtual host, "/" by default.
+	Host     string
+	Login    string
+	Passcode string
+	// HeartBeat is what the client offers, the server may ask for less.
+	HeartBeat HeartBeat
+	// Header is added to the CONNECT frame.
+	Header map[string]string
+}
+
+// Message is a MESSAGE frame of a subscription.
+type Message struct {
+	Destination  string
+	MessageId    string
+	Subscription string
+	ContentType  string
+	Header       map[string]string
+	Body         []byte
+
+	client *Client
+}
+
+// Ack acknowledges the message of a subscription in client mode, it does
+// nothing for auto mode.
+func (m Message) Ack() error {
+	return m.acknowledge(CmdAck)
+}
+
+func (m Message) Nack() error {
+	return m.acknowledge(CmdNack)
+}
+
+func (m Message) acknowledge(command string) error {
+	id, ok := m.Header["ack"]
+	if !ok || m.client == nil {
+		return nil
+	}
+	return m.client.send(&Frame{Command: command, Header: map[string]string{"id": id}})
+}
+
+// Client runs a STOMP session over a websocket client. It wraps the
+// client's event handler: frames are consumed, every other message and all
+// events are passed on. The session ends with the connection, Connect
+// again after a reconnect.
+type Client struct {
+	inner websocket.Events
+	ws    *websocket.Client
+
+	writeLock sync.Mutex
+	lastSent  time.Time
+
+	lock         sync.Mutex
+	connected    chan *Frame
+	session      bool
+	stop         chan struct{}
+	lastReceived time.Time
+	nextId       uint64
+	subs         map[string]*subscription
+	receipts     map[string]chan error
+}
+
+type subscription struct {
+	destination string
+	messages    chan Message
+}
+
+// NewClient installs the protocol on ws. Create it before connecting for
+// the subprotocol to be offered.
+func NewClient(ws *websocket.Client) *Client {
+	c := &Client{
+		inner:    ws.EventHandler(),
+		ws:       ws,
+		subs:     make(map[string]*subscription),
+		receipts: make(map[string]chan error),
+	}
+	ws.SetSubprotocols(Subprotocols...)
+	ws.SetEventHandler(c)
+	return c
+}
+
+func (c *Client) send(frame *Frame) error {
+	data := frame.Encode()
+	messageType := websocket.TextMessage
+	if !utf8.Valid(data) {
+		messageType = websocket.BinaryMessage
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.ws.Send(websocket.Message{MessageType: messageType, Data: data}); err != nil {
+		return err
+	}
+	c.lastSent = time.Now()
+	return nil
+}
+
+// negotiate returns the interval of one direction, the longer of what
+// both sides want or 0 if one does not.
+func negotiate(ours time.Duration, theirs time.Duration) time.Duration {
+	if ours <= 0 || theirs <= 0 {
+		return 0
+	}
+	if theirs > ours {
+		return theirs
+	}
+	return ours
+}
+
+func parseHeartBeat(header string) (hb HeartBeat) {
+	send, receive, _ := strings.Cut(header, ",")
+	if ms, err := strconv.Atoi(strings.TrimSpace(send)); err == nil {
+		hb.Send = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.Atoi(strings.TrimSpace(receive)); err == nil {
+		hb.Receive = time.Duration(ms) * time.Millisecond
+	}
+	return hb
+}
+
+// Connect starts the session on the connected websocket client and
+// negotiates the heart-beats. An ERROR frame is returned as *Error.
+func (c *Client) Connect(ctx context.Context, opts ConnectOptions) error {
+	if opts.Host == "" {
+		opts.Host = "/"
+	}
+	header := map[string]string{
+		"accept-version": "1.2",
+		"host":           opts.Host,
+		"heart-beat": fmt.Sprintf("%d,%d", opts.HeartBeat.Send.Milliseconds(),
+			opts.HeartBeat.Receive.Milliseconds()),
+	}
+	for key, value := range opts.Header {
+		header[key] = value
+	}
+	if opts.Login != "" {
+		header["login"] = opts.Login
+		header["passcode"] = opts.Passcode
+	}
+
+	connected := make(chan *Frame, 1)
+	c.lock.Lock()
+	c.connected = connected
+	c.lock.Unlock()
+
+	if err := c.send(&Frame{Command: CmdConnect, Header: header}); err != nil {
+		return err
+	}
+
+	var frame *Frame
+	select {
+	case frame = <-connected:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if frame.Command == CmdError {
+		return &Error{Message: frame.Header["message"], Body: frame.Body}
+	}
+
+	server := parseHeartBeat(frame.Header["heart-beat"])
+	outgoing := negotiate(opts.HeartBeat.Send, server.Receive)
+	incoming := negotiate(opts.HeartBeat.Receive, server.Send)
+
+	c.lock.Lock()
+	c.session = true
+	c.stop = make(chan struct{})
+	c.lastReceived = time.Now()
+	stop := c.stop
+	c.lock.Unlock()
+
+	if outgoing > 0 || incoming > 0 {
+		go c.heartBeat(stop, outgoing, incoming)
+	}
+	return nil
+}
+
+// heartBeat sends an EOL if nothing was sent for outgoing, and ends the
+// session if nothing was received for twice incoming.
+func (c *Client) heartBeat(stop chan struct{}, outgoing, incoming time.Duration) {
+	tick := outgoing
+	if tick <= 0 || (incoming > 0 && incoming < tick) {
+		tick = incoming
+	}
+	ticker := time.NewTicker(tick / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			silent := now.Sub(c.lastReceived)
+			c.lock.Unlock()
+			if incoming > 0 && silent > 2*incoming {
+				c.inner.OnFailure(false, ErrHeartBeatTimeout)
+				c.endSession(ErrHeartBeatTimeout)
+				return
+			}
+
+			c.writeLock.Lock()
+			idle := now.Sub(c.lastSent)
+			c.writeLock.Unlock()
+			if outgoing > 0 && idle >= outgoing {
+				c.writeLock.Lock()
+				if c.ws.Send(websocket.Message{MessageType: websocket.TextMessage,
+					Data: []byte{'\n'}}) == nil {
+					c.lastSent = now
+				}
+				c.writeLock.Unlock()
+			}
+		}
+	}
+}
+
+func (c *Client) inSession() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.session
+}
+
+// Send sends body to dest, without waiting for the server.
+func (c *Client) Send(dest string, contentType string, body []byte) error {
+	if !c.inSession() {
+		return ErrNotConnected
+	}
+	return c.send(sendFrame(dest, contentType, body))
+}
+
+func sendFrame(dest string, contentType string, body []byte) *Frame {
+	header := map[string]string{"destination": dest}
+	if contentType != "" {
+		header["content-type"] = contentType
+	}
+	return &Frame{Command: CmdSend, Header: header, Body: body}
+}
+
+// SendReceipt sends like Send and waits for the server's receipt. An
+// ERROR frame for it is returned as *Error.
+func (c *Client) SendReceipt(ctx context.Context, dest string, contentType string,
+	body []byte) error {
+
+	return c.request(ctx, sendFrame(dest, contentType, body))
+}
+
+// request sends frame with a receipt header and waits for the receipt.
+func (c *Client) request(ctx context.Context, frame *Frame) error {
+	c.lock.Lock()
+	if !c.session {
+		c.lock.Unlock()
+		return ErrNotConnected
+	}
+	c.nextId++
+	receiptId := "receipt-" + strconv.FormatUint(c.nextId, 10)
+	receipt := make(chan error, 1)
+	c.receipts[receiptId] = receipt
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.receipts, receiptId)
+		c.lock.Unlock()
+	}()
+
+	frame.Header["receipt"] = receiptId
+	if err := c.send(frame); err != nil {
+		return err
+	}
+	select {
+	case err := <-receipt:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe delivers the messages of dest on the returned channel, which
+// is closed by Unsubscribe or when the session ends. Messages of the
+// client ack modes must be acknowledged by Message.Ack.
+func (c *Client) Subscribe(dest string, ack AckMode) (<-chan Message, error) {
+	if ack == "" {
+		ack = AckAuto
+	}
+
+	c.lock.Lock()
+	if !c.session {
+		c.lock.Unlock()
+		return nil, ErrNotConnected
+	}
+	c.nextId++
+	id := "sub-" + strconv.FormatUint(c.nextId, 10)
+	sub := &subscription{destination: dest, messages: make(chan Message, MessageBuffer)}
+	c.subs[id] = sub
+	c.lock.Unlock()
+
+	err := c.send(&Frame{Command: CmdSubscribe, Header: map[string]string{
+		"id": id, "destination": dest, "ack": string(ack)}})
+	if err != nil {
+		c.lock.Lock()
+		c.removeLocked(id)
+		c.lock.Unlock()
+		return nil, err
+	}
+	return sub.messages, nil
+}
+
+// Unsubscribe ends all subscriptions of dest.
+func (c *Client) Unsubscribe(dest string) error {
+	var ids []string
+	c.lock.Lock()
+	for id, sub := range c.subs {
+		if sub.destination == dest {
+			ids = append(ids, id)
+			c.removeLocked(id)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, id := range ids {
+		if err := c.send(&Frame{Command: CmdUnsubscribe,
+			Header: map[string]string{"id": id}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) removeLocked(id string) {
+	if sub, ok := c.subs[id]; ok {
+		delete(c.subs, id)
+		close(sub.messages)
+	}
+}
+
+// Disconnect ends the session gracefully, after the server confirmed it
+// received all frames. The websocket connection stays up.
+func (c *Client) Disconnect(ctx context.Context) error {
+	err := c.request(ctx, &Frame{Command: CmdDisconnect, Header: map[string]string{}})
+	c.endSession(ErrSessionEnded)
+	return err
+}
+
+// endSession closes the subscriptions and fails the pending receipts.
+func (c *Client) endSession(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.session = false
+	for id := range c.subs {
+		c.removeLocked(id)
+	}
+	for id, receipt := range c.receipts {
+		receipt <- err
+		delete(c.receipts, id)
+	}
+}
+
+func (c *Client) OnReceive(msg websocket.Message) {
+	frames, err := Decode(msg.Data)
+	if err != nil {
+		c.inner.OnReceive(msg)
+		return
+	}
+
+	c.lock.Lock()
+	c.lastReceived = time.Now()
+	c.lock.Unlock()
+
+	for i := range frames {
+		c.handle(&frames[i])
+	}
+}
+
+func (c *Client) handle(frame *Frame) {
+	switch frame.Command {
+	case CmdConnected:
+		c.connect(frame)
+	case CmdMessage:
+		c.message(frame)
+	case CmdReceipt:
+		c.receipt(frame.Header["receipt-id"], nil)
+	case CmdError:
+		stompErr := &Error{Message: frame.Header["message"], Body: frame.Body}
+		if c.connect(frame) || c.receipt(frame.Header["receipt-id"], stompErr) {
+			return
+		}
+		// the server closes the connection after an error
+		c.inner.OnFailure(false, stompErr)
+		c.endSession(stompErr)
+	}
+}
+
+// message delivers a MESSAGE frame. A full subscription is ended instead
+// of blocking the read loop or losing the frame silently.
+func (c *Client) message(frame *Frame) {
+	id := frame.Header["subscription"]
+	c.lock.Lock()
+	sub, ok := c.subs[id]
+	if ok {
+		select {
+		case sub.messages <- Message{
+			Destination:  frame.Header["destination"],
+			MessageId:    frame.Header["message-id"],
+			Subscription: id,
+			ContentType:  frame.Header["content-type"],
+			Header:       frame.Header,
+			Body:         frame.Body,
+			client:       c,
+		}:
+			c.lock.Unlock()
+			return
+		default:
+			c.removeLocked(id)
+		}
+	}
+	c.lock.Unlock()
+
+	// a frame nobody can acknowledge any more goes back to the server
+	if ackId, ack := frame.Header["ack"]; ack {
+		if err := c.send(&Frame{Command: CmdNack,
+			Header: map[string]string{"id": ackId}}); err != nil {
+			c.inner.OnFailure(false, err)
+		}
+	}
+	if !ok {
+		return
+	}
+	if err := c.send(&Frame{Command: CmdUnsubscribe,
+		Header: map[string]string{"id": id}}); err != nil {
+		c.inner.OnFailure(false, err)
+	}
+	c.inner.OnFailure(false, &OverflowError{Subscription: id, Destination: sub.destination})
+}
+
+// connect passes the answer to a pending Connect.
+func (c *Client) connect(frame *Frame) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.connected == nil {
+		return false
+	}
+	c.connected <- frame
+	c.connected = nil
+	return true
+}
+
+func (c *Client) receipt(id string, err error) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	receipt, ok := c.receipts[id]
+	if ok {
+		receipt <- err
+		delete(c.receipts, id)
+	}
+	return ok
+}
+
+func (c *Client) OnConnect(id int) {
+	c.inner.OnConnect(id)
+}
+
+// OnDisconnect ends the session.
+func (c *Client) OnDisconnect(id int) {
+	c.endSession(ErrSessionEnded)
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
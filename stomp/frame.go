@@ -0,0 +1,205 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package stomp speaks STOMP 1.2 over a websocket client, e.g. to the
+// Web-STOMP endpoints of message brokers. Each websocket message carries
+// one frame, or a heart-beat.
+package stomp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Commands of the frames.
+const (
+	CmdConnect     = "CONNECT"
+	CmdConnected   = "CONNECTED"
+	CmdSend        = "SEND"
+	CmdSubscribe   = "SUBSCRIBE"
+	CmdUnsubscribe = "UNSUBSCRIBE"
+	CmdAck         = "ACK"
+	CmdNack        = "NACK"
+	CmdDisconnect  = "DISCONNECT"
+	CmdMessage     = "MESSAGE"
+	CmdReceipt     = "RECEIPT"
+	CmdError       = "ERROR"
+)
+
+var ErrFrame = errors.New("malformed stomp frame")
+
+// Frame is a STOMP frame. Of repeated headers only the first is kept, as
+// the specification asks.
+type Frame struct {
+	Command string
+	Header  map[string]string
+	Body    []byte
+}
+
+// escapes do not apply to CONNECT and CONNECTED frames.
+var (
+	escaper   = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+	unescapes = map[byte]byte{'\\': '\\', 'r': '\r', 'n': '\n', 'c': ':'}
+)
+
+func escaped(command string) bool {
+	return command != CmdConnect && command != CmdConnected
+}
+
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("%w: escape at the end of %q", ErrFrame, s)
+		}
+		c, ok := unescapes[s[i]]
+		if !ok {
+			return "", fmt.Errorf("%w: undefined escape \\%c", ErrFrame, s[i])
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// Encode returns the frame with its headers sorted. A content-length is
+// added for bodies, so they may contain NUL.
+func (f *Frame) Encode() []byte {
+	var b bytes.Buffer
+	b.WriteString(f.Command)
+	b.WriteByte('\n')
+
+	keys := make([]string, 0, len(f.Header))
+	for key := range f.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "content-length" {
+			continue
+		}
+		value := f.Header[key]
+		if escaped(f.Command) {
+			key, value = escaper.Replace(key), escaper.Replace(value)
+		}
+		b.WriteString(key)
+		b.WriteByte(':')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	if len(f.Body) > 0 {
+		b.WriteString("content-length:")
+		b.WriteString(strconv.Itoa(len(f.Body)))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(f.Body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+// cutLine returns the line without EOL, which may be \n or \r\n.
+func cutLine(data []byte) (line []byte, rest []byte, ok bool) {
+	line, rest, ok = bytes.Cut(data, []byte{'\n'})
+	return bytes.TrimSuffix(line, []byte{'\r'}), rest, ok
+}
+
+// Decode returns the frames in data, skipping heart-beats. data must hold
+// complete frames.
+func Decode(data []byte) ([]Frame, error) {
+	var frames []Frame
+	for {
+		// EOLs are heart-beats or padding between frames
+		data = bytes.TrimLeft(data, "\r\n")
+		if len(data) == 0 {
+			return frames, nil
+		}
+		frame, rest, err := decodeFrame(data)
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+		data = rest
+	}
+}
+
+func decodeFrame(data []byte) (frame Frame, rest []byte, err error) {
+	line, data, ok := cutLine(data)
+	if !ok || len(line) == 0 {
+		return frame, nil, fmt.Errorf("%w: no command", ErrFrame)
+	}
+	frame.Command = string(line)
+	frame.Header = make(map[string]string)
+
+	for {
+		line, data, ok = cutLine(data)
+		if !ok {
+			return frame, nil, fmt.Errorf("%w: headers not terminated", ErrFrame)
+		}
+		if len(line) == 0 {
+			break
+		}
+		key, value, found := strings.Cut(string(line), ":")
+		if !found {
+			return frame, nil, fmt.Errorf("%w: header %q", ErrFrame, line)
+		}
+		if escaped(frame.Command) {
+			if key, err = unescape(key); err != nil {
+				return frame, nil, err
+			}
+			if value, err = unescape(value); err != nil {
+				return frame, nil, err
+			}
+		}
+		if _, repeated := frame.Header[key]; !repeated {
+			frame.Header[key] = value
+		}
+	}
+
+	end := bytes.IndexByte(data, 0)
+	if length, ok := frame.Header["content-length"]; ok {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n >= len(data) || data[n] != 0 {
+			return frame, nil, fmt.Errorf("%w: content-length %q", ErrFrame, length)
+		}
+		end = n
+	}
+	if end < 0 {
+		return frame, nil, fmt.Errorf("%w: body not terminated", ErrFrame)
+	}
+	frame.Body = data[:end]
+	return frame, data[end+1:], nil
+}
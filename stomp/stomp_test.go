@@ -0,0 +1,341 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stomp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+func TestFrames(t *testing.T) {
+	frame := Frame{
+		Command: CmdSend,
+		Header:  map[string]string{"destination": "/queue/a:b\nc", "x-empty": ""},
+		Body:    []byte("with\x00nul"),
+	}
+	data := frame.Encode()
+	if !bytes.Contains(data, []byte(`destination:/queue/a\cb\nc`)) {
+		t.Errorf("header not escaped: %q", data)
+	}
+	// a heart-beat between two frames
+	data = append(append(data, "\n\r\n"...), (&Frame{Command: CmdReceipt,
+		Header: map[string]string{"receipt-id": "1"}}).Encode()...)
+
+	frames, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("decoded %d frames", len(frames))
+	}
+	if frames[0].Header["destination"] != "/queue/a:b\nc" ||
+		string(frames[0].Body) != "with\x00nul" || frames[1].Header["receipt-id"] != "1" {
+		t.Errorf("decoded %+v", frames)
+	}
+
+	frames, err = Decode([]byte("CONNECTED\nversion:1.2\nsession:a\\b\n\n\x00"))
+	if err != nil || frames[0].Header["session"] != `a\b` {
+		t.Error("connect frames are not escaped: ", frames, err)
+	}
+	frames, err = Decode([]byte("MESSAGE\nkey:one\nkey:two\n\nbody\x00"))
+	if err != nil || frames[0].Header["key"] != "one" || string(frames[0].Body) != "body" {
+		t.Error("repeated header: ", frames, err)
+	}
+	for _, bad := range []string{"SEND\ndestination:/a\n\nno nul", "SEND\nbad\\x:1\n\n\x00",
+		"SEND\ncontent-length:9\n\nshort\x00", "SEND\nnocolon\n\n\x00"} {
+		if _, err = Decode([]byte(bad)); !errors.Is(err, ErrFrame) {
+			t.Errorf("decoded %q: %v", bad, err)
+		}
+	}
+
+	if frames, err = Decode([]byte("\n\n")); err != nil || len(frames) != 0 {
+		t.Error("heart-beat: ", frames, err)
+	}
+}
+
+func TestHeartBeatNegotiation(t *testing.T) {
+	hb := parseHeartBeat("100, 2000")
+	if hb.Send != 100*time.Millisecond || hb.Receive != 2*time.Second {
+		t.Errorf("parsed %+v", hb)
+	}
+	if negotiate(time.Second, 2*time.Second) != 2*time.Second ||
+		negotiate(time.Second, 0) != 0 || negotiate(0, time.Second) != 0 {
+		t.Error("negotiated wrong intervals")
+	}
+}
+
+// broker is a minimal STOMP server.
+type broker struct {
+	websocket.Events
+	server *websocket.Server
+
+	lock       sync.Mutex
+	heartBeat  string
+	subs       map[string]map[int]string
+	acks       []string
+	heartBeats int
+}
+
+func newBroker(heartBeat string) (*broker, *websockettest.ServerConn) {
+	b := &broker{
+		Events:    websockettest.NewRecorder(),
+		heartBeat: heartBeat,
+		subs:      make(map[string]map[int]string),
+	}
+	ws := websockettest.NewServer(b)
+	b.server = ws.Server
+	return b, ws
+}
+
+func (b *broker) reply(id int, frame *Frame) {
+	_ = b.server.Send(id, &websocket.Message{MessageType: websocket.TextMessage,
+		Data: frame.Encode()})
+}
+
+func (b *broker) OnReceive(msg websocket.Message) {
+	frames, err := Decode(msg.Data)
+	if err != nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(frames) == 0 {
+		b.heartBeats++
+	}
+	for _, frame := range frames {
+		switch frame.Command {
+		case CmdConnect:
+			if frame.Header["passcode"] != "secret" {
+				b.reply(msg.ClientId, &Frame{Command: CmdError,
+					Header: map[string]string{"message": "bad login"}})
+				continue
+			}
+			b.reply(msg.ClientId, &Frame{Command: CmdConnected, Header: map[string]string{
+				"version": "1.2", "heart-beat": b.heartBeat}})
+		case CmdSubscribe:
+			dest := frame.Header["destination"]
+			if b.subs[dest] == nil {
+				b.subs[dest] = make(map[int]string)
+			}
+			b.subs[dest][msg.ClientId] = frame.Header["id"]
+		case CmdUnsubscribe:
+			for _, subs := range b.subs {
+				if subs[msg.ClientId] == frame.Header["id"] {
+					delete(subs, msg.ClientId)
+				}
+			}
+		case CmdSend:
+			dest := frame.Header["destination"]
+			if dest == "/forbidden" {
+				b.reply(msg.ClientId, &Frame{Command: CmdError, Header: map[string]string{
+					"message": "forbidden", "receipt-id": frame.Header["receipt"]}})
+				continue
+			}
+			for id, sub := range b.subs[dest] {
+				b.reply(id, &Frame{Command: CmdMessage, Header: map[string]string{
+					"destination": dest, "subscription": sub, "message-id": "m1",
+					"ack": "a1", "content-type": frame.Header["content-type"]},
+					Body: frame.Body})
+			}
+		case CmdAck, CmdNack:
+			b.acks = append(b.acks, frame.Command+" "+frame.Header["id"])
+		}
+		if receipt, ok := frame.Header["receipt"]; ok && frame.Command != CmdSend ||
+			ok && frame.Header["destination"] != "/forbidden" {
+			b.reply(msg.ClientId, &Frame{Command: CmdReceipt,
+				Header: map[string]string{"receipt-id": receipt}})
+		}
+	}
+}
+
+func newClient(t *testing.T, ws *websockettest.ServerConn) (*Client, *websockettest.Recorder) {
+	recorder := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, recorder)
+	client := NewClient(wsClient)
+	ws.Connect(t, wsClient)
+	t.Cleanup(func() { _ = wsClient.Disconnect() })
+	return client, recorder
+}
+
+func timeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestClient(t *testing.T) {
+	b, ws := newBroker("0,0")
+	defer ws.Close()
+	ctx := timeout(t)
+
+	client, _ := newClient(t, ws)
+	if _, err := client.Subscribe("/topic/a", AckAuto); !errors.Is(err, ErrNotConnected) {
+		t.Error("subscribed without session: ", err)
+	}
+	var stompErr *Error
+	if err := client.Connect(ctx, ConnectOptions{Login: "user"}); !errors.As(err, &stompErr) ||
+		stompErr.Message != "bad login" {
+		t.Fatal("connected with a bad login: ", err)
+	}
+	if err := client.Connect(ctx, ConnectOptions{Login: "user", Passcode: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := client.Subscribe("/topic/a", AckClientIndividual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the receipt confirms the subscription was processed before
+	if err = client.SendReceipt(ctx, "/topic/a", "application/octet-stream",
+		[]byte{0xff, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-messages
+	if msg.Destination != "/topic/a" || msg.ContentType != "application/octet-stream" ||
+		!bytes.Equal(msg.Body, []byte{0xff, 0x00}) {
+		t.Errorf("received %+v", msg)
+	}
+	if err = msg.Ack(); err != nil {
+		t.Error(err)
+	}
+
+	if err = client.SendReceipt(ctx, "/forbidden", "", nil); !errors.As(err, &stompErr) ||
+		stompErr.Message != "forbidden" {
+		t.Error("receipt error: ", err)
+	}
+
+	if err = client.Unsubscribe("/topic/a"); err != nil {
+		t.Error(err)
+	}
+	if _, open := <-messages; open {
+		t.Error("unsubscribed channel open")
+	}
+
+	if err = client.Disconnect(ctx); err != nil {
+		t.Error(err)
+	}
+	if err = client.Send("/topic/a", "", nil); !errors.Is(err, ErrNotConnected) {
+		t.Error("sent after disconnect: ", err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.acks) != 1 || b.acks[0] != "ACK a1" {
+		t.Errorf("acks %q", b.acks)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	b, ws := newBroker("0,0")
+	defer ws.Close()
+	ctx := timeout(t)
+
+	client, recorder := newClient(t, ws)
+	if err := client.Connect(ctx, ConnectOptions{Login: "user", Passcode: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := client.Subscribe("/topic/a", AckClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= MessageBuffer; i++ {
+		if err = client.SendReceipt(ctx, "/topic/a", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := 0
+	for range messages {
+		received++
+	}
+	if received != MessageBuffer {
+		t.Errorf("received %d messages", received)
+	}
+	var overflow *OverflowError
+	evnt := recorder.WaitForFailure(t, time.Second)
+	if !errors.As(evnt.Err, &overflow) || overflow.Destination != "/topic/a" {
+		t.Error("no overflow failure: ", evnt.Err)
+	}
+	// the broker processed the NACK and UNSUBSCRIBE before the receipt
+	if err = client.SendReceipt(ctx, "/topic/b", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.acks) != 1 || b.acks[0] != "NACK a1" || len(b.subs["/topic/a"]) != 0 {
+		t.Errorf("acks %q, subscriptions %v", b.acks, b.subs)
+	}
+}
+
+func TestHeartBeat(t *testing.T) {
+	// the broker wants heart-beats every 20ms but never sends any
+	b, ws := newBroker("50,20")
+	defer ws.Close()
+	ctx := timeout(t)
+
+	client, recorder := newClient(t, ws)
+	err := client.Connect(ctx, ConnectOptions{Login: "user", Passcode: "secret",
+		HeartBeat: HeartBeat{Send: 10 * time.Millisecond, Receive: 50 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := client.Subscribe("/topic/a", AckAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case _, open := <-messages:
+		if open {
+			t.Error("received a message")
+		}
+	case <-ctx.Done():
+		t.Fatal("session not ended by the missing heart-beats")
+	}
+	timedOut := false
+	for _, evnt := range recorder.EventsSeen() {
+		timedOut = timedOut || errors.Is(evnt.Err, ErrHeartBeatTimeout)
+	}
+	if !timedOut {
+		t.Error("no heart-beat failure: ", recorder.EventsSeen())
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.heartBeats < 2 {
+		t.Errorf("sent %d heart-beats", b.heartBeats)
+	}
+}
@@ -0,0 +1,97 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stream
+
+import (
+	"context"
+
+	"github.com/ChrIgiSta/go-easy-websockets/codec"
+	"github.com/ChrIgiSta/go-easy-websockets/mux"
+)
+
+// Stream is the client side of a stream. Cancelling the context of Send
+// or Recv closes the stream, the handler's context is cancelled then.
+type Stream[Req, Resp any] interface {
+	Send(ctx context.Context, req Req) error
+	// Recv returns io.EOF once the handler returned without error, an
+	// *Error if it failed.
+	Recv(ctx context.Context) (Resp, error)
+	// CloseSend tells the handler that no more requests follow.
+	CloseSend(ctx context.Context) error
+	// Close ends the stream in both directions.
+	Close() error
+}
+
+// Client opens streams over a mux client.
+type Client struct {
+	mux   *mux.Client
+	codec codec.Codec
+}
+
+// NewClient encodes the values with c, nil selects codec.JSON. The server
+// must use the same codec.
+func NewClient(m *mux.Client, c codec.Codec) *Client {
+	return &Client{mux: m, codec: c}
+}
+
+// Open starts a stream to the handler of method.
+func Open[Req, Resp any](client *Client, method string) (Stream[Req, Resp], error) {
+	ch, err := client.mux.Open(channelPrefix + method)
+	if err != nil {
+		return nil, err
+	}
+	return &clientStream[Req, Resp]{conn: newConn(ch, client.codec, method)}, nil
+}
+
+type clientStream[Req, Resp any] struct {
+	*conn
+}
+
+// cancelled closes the stream if err is from a cancelled context.
+func (s *clientStream[Req, Resp]) cancelled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		_ = s.close()
+		return ctx.Err()
+	}
+	return err
+}
+
+func (s *clientStream[Req, Resp]) Send(ctx context.Context, req Req) error {
+	return s.cancelled(ctx, s.send(ctx, req))
+}
+
+func (s *clientStream[Req, Resp]) Recv(ctx context.Context) (resp Resp, err error) {
+	err = s.cancelled(ctx, s.recv(ctx, &resp))
+	return resp, err
+}
+
+func (s *clientStream[Req, Resp]) CloseSend(ctx context.Context) error {
+	return s.cancelled(ctx, s.closeSend(ctx))
+}
+
+func (s *clientStream[Req, Resp]) Close() error {
+	return s.close()
+}
@@ -0,0 +1,158 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/codec"
+	"github.com/ChrIgiSta/go-easy-websockets/mux"
+)
+
+var ErrUnknownMethod = errors.New("unknown method")
+
+// ServerStream is the handler side of a stream. Its context is cancelled
+// when the client closes the stream or disconnects.
+type ServerStream[Req, Resp any] interface {
+	Context() context.Context
+	ClientId() int
+	// Recv returns io.EOF after the client's CloseSend.
+	Recv() (Req, error)
+	Send(resp Resp) error
+	// CloseSend ends the responses before the handler returns.
+	CloseSend() error
+}
+
+type handler func(ctx context.Context, clientId int, c *conn) error
+
+// Server runs the handlers of the streams opened over a mux server.
+type Server struct {
+	codec codec.Codec
+
+	lock      sync.Mutex
+	handlers  map[string]handler
+	onChannel func(clientId int, ch mux.Channel)
+}
+
+// NewServer takes over the channels of m, see OnChannel for others. c
+// must match the codec of the clients, nil selects codec.JSON.
+func NewServer(m *mux.Server, c codec.Codec) *Server {
+	s := &Server{codec: c, handlers: make(map[string]handler)}
+	m.OnChannel(s.accept)
+	return s
+}
+
+// OnChannel sets the hook receiving the channels which are no streams.
+// Without a hook they are closed.
+func (s *Server) OnChannel(fn func(clientId int, ch mux.Channel)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onChannel = fn
+}
+
+// Handle registers the handler of method, replacing a previous one. The
+// stream ends when fn returns, with its error reported to the client.
+func Handle[Req, Resp any](server *Server, method string,
+	fn func(ctx context.Context, stream ServerStream[Req, Resp]) error) {
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.handlers[method] = func(ctx context.Context, clientId int, c *conn) error {
+		return fn(ctx, &serverStream[Req, Resp]{conn: c, ctx: ctx, clientId: clientId})
+	}
+}
+
+func (s *Server) accept(clientId int, ch mux.Channel) {
+	method, isStream := strings.CutPrefix(ch.Name(), channelPrefix)
+	s.lock.Lock()
+	fn := s.handlers[method]
+	onChannel := s.onChannel
+	s.lock.Unlock()
+
+	if !isStream {
+		if onChannel != nil {
+			onChannel(clientId, ch)
+		} else {
+			_ = ch.Close()
+		}
+		return
+	}
+
+	// cancelled with the channel, the handler's end is sent until then
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ch.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	c := newConn(ch, s.codec, method)
+	err := ErrUnknownMethod
+	if fn != nil {
+		err = fn(ctx, clientId, c)
+	}
+	if err != nil {
+		_ = c.fail(ctx, err)
+	} else {
+		_ = c.closeSend(ctx)
+	}
+	_ = c.close()
+}
+
+type serverStream[Req, Resp any] struct {
+	*conn
+	ctx      context.Context
+	clientId int
+}
+
+func (s *serverStream[Req, Resp]) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream[Req, Resp]) ClientId() int {
+	return s.clientId
+}
+
+func (s *serverStream[Req, Resp]) Recv() (req Req, err error) {
+	err = s.recv(s.ctx, &req)
+	return req, err
+}
+
+func (s *serverStream[Req, Resp]) Send(resp Resp) error {
+	return s.send(s.ctx, resp)
+}
+
+func (s *serverStream[Req, Resp]) CloseSend() error {
+	return s.closeSend(s.ctx)
+}
@@ -0,0 +1,186 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package stream runs long-lived typed streams over mux channels. A client
+// opens a stream to a method, then both sides send values of their type
+// until they half-close by CloseSend. The server ends a stream by
+// returning from the handler, an error is reported to the client without
+// affecting the other streams of the connection.
+//
+// Each message of the stream's channel starts with its kind:
+//
+//	data:  value encoded by the codec
+//	end:   -
+//	error: message
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/codec"
+	"github.com/ChrIgiSta/go-easy-websockets/mux"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+const (
+	kindData byte = iota + 1
+	kindEnd
+	kindError
+)
+
+// channelPrefix marks the mux channels of streams.
+const channelPrefix = "stream:"
+
+var (
+	// ErrStreamClosed is returned by Send after CloseSend or Close, or
+	// once the other side ended the stream.
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamReset is returned by Recv if the stream ended without end
+	// or error, e.g. by a cancel or the connection closing.
+	ErrStreamReset = errors.New("stream reset")
+)
+
+// Error is the error a server handler ended a stream with.
+type Error struct {
+	Method  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("stream %s: %s", e.Method, e.Message)
+}
+
+// conn is one side of a stream. Send and Recv may be called concurrently
+// with each other, but not each with itself.
+type conn struct {
+	ch     mux.Channel
+	codec  codec.Codec
+	method string
+
+	lock       sync.Mutex
+	sendClosed bool
+	recvErr    error
+}
+
+func newConn(ch mux.Channel, c codec.Codec, method string) *conn {
+	if c == nil {
+		c = codec.JSON
+	}
+	if session, ok := c.(codec.SessionCodec); ok {
+		c = session.NewSession()
+	}
+	return &conn{ch: ch, codec: c, method: method}
+}
+
+func (c *conn) sendFrame(ctx context.Context, kind byte, messageType int, payload []byte) error {
+	c.lock.Lock()
+	closed := c.sendClosed
+	if kind != kindData {
+		c.sendClosed = true
+	}
+	c.lock.Unlock()
+	if closed {
+		return ErrStreamClosed
+	}
+
+	data := make([]byte, 1+len(payload))
+	data[0] = kind
+	copy(data[1:], payload)
+	err := c.ch.Send(ctx, websocket.Message{MessageType: messageType, Data: data})
+	if errors.Is(err, mux.ErrChannelClosed) {
+		return ErrStreamClosed
+	}
+	return err
+}
+
+func (c *conn) send(ctx context.Context, v any) error {
+	data, messageType, err := c.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.sendFrame(ctx, kindData, messageType, data)
+}
+
+func (c *conn) closeSend(ctx context.Context) error {
+	return c.sendFrame(ctx, kindEnd, websocket.BinaryMessage, nil)
+}
+
+func (c *conn) fail(ctx context.Context, err error) error {
+	return c.sendFrame(ctx, kindError, websocket.TextMessage, []byte(err.Error()))
+}
+
+// recv decodes the next value into v. It returns io.EOF after the other
+// side's CloseSend, and keeps returning the error ending the stream.
+func (c *conn) recv(ctx context.Context, v any) error {
+	c.lock.Lock()
+	err := c.recvErr
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.ch.Receive(ctx)
+	switch {
+	case errors.Is(err, mux.ErrChannelClosed):
+		return c.endRecv(ErrStreamReset)
+	case err != nil:
+		return err
+	case len(msg.Data) == 0:
+		return c.endRecv(ErrStreamReset)
+	}
+
+	switch msg.Data[0] {
+	case kindData:
+		return c.codec.Unmarshal(msg.Data[1:], msg.MessageType, v)
+	case kindEnd:
+		return c.endRecv(io.EOF)
+	case kindError:
+		return c.endRecv(&Error{Method: c.method, Message: string(msg.Data[1:])})
+	default:
+		return c.endRecv(ErrStreamReset)
+	}
+}
+
+func (c *conn) endRecv(err error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.recvErr == nil {
+		c.recvErr = err
+	}
+	return c.recvErr
+}
+
+func (c *conn) close() error {
+	c.lock.Lock()
+	c.sendClosed = true
+	c.lock.Unlock()
+
+	return c.ch.Close()
+}
@@ -0,0 +1,182 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/mux"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+type line struct {
+	N    int    `json:"n"`
+	Text string `json:"text"`
+}
+
+func setup(t *testing.T) (*Server, *Client) {
+	t.Helper()
+	ws := websockettest.NewServer(websockettest.NewRecorder())
+	t.Cleanup(func() { ws.Close() })
+	server := NewServer(mux.NewServer(ws.Server), nil)
+
+	wsClient := websocket.NewClient(false, websockettest.NewRecorder())
+	client := NewClient(mux.NewClient(wsClient), nil)
+	ws.Connect(t, wsClient)
+	t.Cleanup(func() { wsClient.Disconnect() })
+	return server, client
+}
+
+func timeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestStreams(t *testing.T) {
+	server, client := setup(t)
+	ctx := timeout(t)
+
+	Handle(server, "upper", func(ctx context.Context, s ServerStream[string, line]) error {
+		for n := 0; ; n++ {
+			text, err := s.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = s.Send(line{N: n, Text: strings.ToUpper(text)}); err != nil {
+				return err
+			}
+		}
+	})
+	Handle(server, "logs.tail", func(ctx context.Context, s ServerStream[int, line]) error {
+		count, err := s.Recv()
+		if err != nil {
+			return err
+		}
+		for n := 0; n < count; n++ {
+			if err = s.Send(line{N: n}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	Handle(server, "fail", func(ctx context.Context, s ServerStream[string, string]) error {
+		return errors.New("boom")
+	})
+
+	upper, err := Open[string, line](client, "upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"a", "b", "c"} {
+		if err = upper.Send(ctx, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = upper.CloseSend(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = upper.Send(ctx, "d"); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("send after close send: %v", err)
+	}
+	for n, expected := range []string{"A", "B", "C"} {
+		if l, err := upper.Recv(ctx); err != nil || l.N != n || l.Text != expected {
+			t.Errorf("received %+v, %v", l, err)
+		}
+	}
+	if _, err = upper.Recv(ctx); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// more than the window of the channel
+	tail, _ := Open[int, line](client, "logs.tail")
+	_ = tail.Send(ctx, 3*mux.Window)
+	for n := 0; n < 3*mux.Window; n++ {
+		if l, err := tail.Recv(ctx); err != nil || l.N != n {
+			t.Fatalf("received %+v, %v", l, err)
+		}
+	}
+	if _, err = tail.Recv(ctx); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// errors end only their stream
+	for method, message := range map[string]string{"fail": "boom", "nope": ErrUnknownMethod.Error()} {
+		s, _ := Open[string, string](client, method)
+		_, err = s.Recv(ctx)
+		var streamErr *Error
+		if !errors.As(err, &streamErr) || streamErr.Method != method || streamErr.Message != message {
+			t.Errorf("%s: %v", method, err)
+		}
+	}
+	again, _ := Open[string, line](client, "upper")
+	_ = again.Send(ctx, "still")
+	if l, err := again.Recv(ctx); err != nil || l.Text != "STILL" {
+		t.Errorf("received %+v, %v", l, err)
+	}
+	_ = again.Close()
+}
+
+func TestCancel(t *testing.T) {
+	server, client := setup(t)
+
+	handlerDone := make(chan error, 1)
+	Handle(server, "wait", func(ctx context.Context, s ServerStream[string, string]) error {
+		<-ctx.Done()
+		handlerDone <- ctx.Err()
+		return ctx.Err()
+	})
+
+	s, err := Open[string, string](client, "wait")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = s.Recv(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	select {
+	case err = <-handlerDone:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("handler ended with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler not cancelled")
+	}
+	if err = s.Send(context.Background(), "x"); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("send after cancel: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package transfer sends files in chunks over a websocket client, resuming
+// after a reconnect. Each frame is a binary message starting with "FT" and
+// its kind, followed by the 16 byte file id:
+//
+//	chunk:  offset uint64, size uint64, sha256 [32]byte, data
+//	ack:    offset uint64, the bytes the receiver has written
+//	resume: -, asks the receiver for an ack of its offset
+//	reject: reason, the transfer failed on the receiver
+//
+// Integers are big endian.
+package transfer
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+const (
+	KindChunk byte = iota + 1
+	KindAck
+	KindResume
+	KindReject
+)
+
+// DefaultChunkSize is used by SendFile for a chunk size of 0.
+const DefaultChunkSize = 64 * 1024
+
+// Window is the number of chunks sent ahead of the acknowledgements.
+const Window = 8
+
+// MaxCompleted is the number of finished files a Receiver acknowledges
+// again to a sender resuming them.
+const MaxCompleted = 1024
+
+var (
+	ErrChecksum = errors.New("sha256 mismatch")
+	ErrSize     = errors.New("more data than the file size")
+)
+
+var magic = [2]byte{'F', 'T'}
+
+const (
+	idSize     = 16
+	headerSize = len(magic) + 1 + idSize
+	chunkSize  = headerSize + 8 + 8 + 32
+)
+
+// FileId identifies a transfer, also across reconnects.
+type FileId [idSize]byte
+
+func newFileId() (id FileId) {
+	_, _ = rand.Read(id[:])
+	return
+}
+
+func (id FileId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// frame is one message of the wire protocol, the fields of its kind set.
+type frame struct {
+	kind   byte
+	id     FileId
+	offset uint64
+	size   uint64
+	sum    [32]byte
+	data   []byte
+	reason string
+}
+
+func (f *frame) encode() []byte {
+	buf := make([]byte, headerSize, chunkSize+len(f.data))
+	copy(buf, magic[:])
+	buf[len(magic)] = f.kind
+	copy(buf[len(magic)+1:], f.id[:])
+
+	switch f.kind {
+	case KindChunk:
+		buf = binary.BigEndian.AppendUint64(buf, f.offset)
+		buf = binary.BigEndian.AppendUint64(buf, f.size)
+		buf = append(buf, f.sum[:]...)
+		buf = append(buf, f.data...)
+	case KindAck:
+		buf = binary.BigEndian.AppendUint64(buf, f.offset)
+	case KindReject:
+		buf = append(buf, f.reason...)
+	}
+	return buf
+}
+
+// decodeFrame returns false for data which is no frame, e.g. other
+// messages of the application.
+func decodeFrame(data []byte) (f frame, ok bool) {
+	if len(data) < headerSize || data[0] != magic[0] || data[1] != magic[1] {
+		return f, false
+	}
+	f.kind = data[len(magic)]
+	copy(f.id[:], data[len(magic)+1:])
+	data = data[headerSize:]
+
+	switch f.kind {
+	case KindChunk:
+		if len(data) < chunkSize-headerSize {
+			return f, false
+		}
+		f.offset = binary.BigEndian.Uint64(data)
+		f.size = binary.BigEndian.Uint64(data[8:])
+		copy(f.sum[:], data[16:])
+		f.data = data[48:]
+	case KindAck:
+		if len(data) < 8 {
+			return f, false
+		}
+		f.offset = binary.BigEndian.Uint64(data)
+	case KindResume:
+	case KindReject:
+		f.reason = string(data)
+	default:
+		return f, false
+	}
+	return f, true
+}
@@ -0,0 +1,331 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// File is a file being received. Path is set for the default temp file.
+type File struct {
+	Id       FileId
+	ClientId int
+	Size     int64
+	SHA256   [32]byte
+	Path     string
+}
+
+// OpenFunc returns the writer for a new file. A writer implementing
+// io.Closer is closed when the transfer ends.
+type OpenFunc func(file *File) (io.Writer, error)
+
+// incoming is the state of a file being received. The lock is held while
+// a chunk is written, a reconnected sender may overlap the old connection.
+// w is nil if opening the file failed.
+type incoming struct {
+	lock   sync.Mutex
+	file   File
+	w      io.Writer
+	offset uint64
+	hash   hash.Hash
+}
+
+// Receiver reassembles the files sent by SendFile. It wraps the event
+// handler of a server or client: chunks are taken, other messages and all
+// events are passed on. The state of unfinished files is kept, so a
+// sender reconnecting resumes. The last MaxCompleted finished files are
+// remembered for their senders missing the final ack.
+type Receiver struct {
+	inner websocket.Events
+	reply func(clientId int, msg *websocket.Message) error
+
+	lock      sync.Mutex
+	files     map[FileId]*incoming
+	completed map[FileId]uint64
+	// completedOrder is the order completed was filled in
+	completedOrder []FileId
+	open           OpenFunc
+	onProgress     func(file File, received int64)
+	onComplete     func(file File, err error)
+}
+
+func newReceiver(inner websocket.Events,
+	reply func(clientId int, msg *websocket.Message) error) *Receiver {
+
+	return &Receiver{
+		inner:     inner,
+		reply:     reply,
+		files:     make(map[FileId]*incoming),
+		completed: make(map[FileId]uint64),
+		open:      openTemp,
+	}
+}
+
+// NewServerReceiver installs a receiver on s. Create it before
+// ListenAndServe.
+func NewServerReceiver(s *websocket.Server) *Receiver {
+	r := newReceiver(s.EventHandler(), s.Send)
+	s.SetEventHandler(r)
+	return r
+}
+
+// NewClientReceiver installs a receiver on c. Create it before connecting.
+func NewClientReceiver(c *websocket.Client) *Receiver {
+	r := newReceiver(c.EventHandler(), func(clientId int, msg *websocket.Message) error {
+		return c.Send(*msg)
+	})
+	c.SetEventHandler(r)
+	return r
+}
+
+// openTemp writes a file to a new temp file, the default.
+func openTemp(file *File) (io.Writer, error) {
+	f, err := os.CreateTemp("", "transfer-*")
+	if err != nil {
+		return nil, err
+	}
+	file.Path = f.Name()
+	return f, nil
+}
+
+// SetOpen sets where files are written, instead of temp files.
+func (r *Receiver) SetOpen(open OpenFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.open = open
+}
+
+func (r *Receiver) SetOnProgress(hook func(file File, received int64)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onProgress = hook
+}
+
+// SetOnComplete sets the hook called once a file was received, err being
+// ErrChecksum if it does not match its sha256. A temp file is removed on
+// errors, else it belongs to the hook.
+func (r *Receiver) SetOnComplete(hook func(file File, err error)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.onComplete = hook
+}
+
+func (r *Receiver) send(clientId int, f *frame) {
+	_ = r.reply(clientId, &websocket.Message{
+		MessageType: websocket.BinaryMessage,
+		Data:        f.encode(),
+	})
+}
+
+func (r *Receiver) OnReceive(msg websocket.Message) {
+	r.OnReceiveCtx(context.Background(), msg)
+}
+
+func (r *Receiver) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	f, ok := decodeFrame(msg.Data)
+	if !ok || msg.MessageType != websocket.BinaryMessage ||
+		(f.kind != KindChunk && f.kind != KindResume) {
+		if ctxInner, ok := r.inner.(websocket.CtxEvents); ok {
+			ctxInner.OnReceiveCtx(ctx, msg)
+			return
+		}
+		r.inner.OnReceive(msg)
+		return
+	}
+
+	// the first chunk inserts the file, a racing one finds it
+	r.lock.Lock()
+	in := r.files[f.id]
+	done, completed := r.completed[f.id]
+	started := in == nil && !completed && f.kind == KindChunk && f.offset == 0
+	if started {
+		in = r.insertLocked(msg.ClientId, &f)
+	}
+	r.lock.Unlock()
+
+	ack := &frame{kind: KindAck, id: f.id}
+	switch {
+	case completed:
+		ack.offset = done
+		r.send(msg.ClientId, ack)
+		return
+	case f.kind == KindResume || (in == nil && f.offset != 0):
+		// unknown files restart at 0
+		if in != nil {
+			in.lock.Lock()
+			ack.offset = in.offset
+			in.lock.Unlock()
+		}
+		r.send(msg.ClientId, ack)
+		return
+	case started:
+		// in is locked by insertLocked
+		defer in.lock.Unlock()
+		if err := r.start(in); err != nil {
+			r.send(msg.ClientId, &frame{kind: KindReject, id: f.id, reason: err.Error()})
+			return
+		}
+	default:
+		in.lock.Lock()
+		defer in.lock.Unlock()
+	}
+
+	if in.w == nil {
+		// the racing first chunk failed to open the file
+		r.send(msg.ClientId, &frame{kind: KindReject, id: f.id, reason: "file not opened"})
+		return
+	}
+	if f.offset != in.offset {
+		// a chunk sent before the resume, or after the file ended
+		ack.offset = in.offset
+		r.send(msg.ClientId, ack)
+		return
+	}
+	in.file.ClientId = msg.ClientId
+	if in.offset+uint64(len(f.data)) > f.size {
+		r.finish(in, ErrSize)
+		return
+	}
+	if _, err := in.w.Write(f.data); err != nil {
+		r.finish(in, err)
+		return
+	}
+	in.hash.Write(f.data)
+	in.offset += uint64(len(f.data))
+
+	r.lock.Lock()
+	onProgress := r.onProgress
+	r.lock.Unlock()
+	if onProgress != nil {
+		onProgress(in.file, int64(in.offset))
+	}
+
+	if in.offset == f.size {
+		var err error
+		if !bytes.Equal(in.hash.Sum(nil), in.file.SHA256[:]) {
+			err = ErrChecksum
+		}
+		r.finish(in, err)
+		if err != nil {
+			return
+		}
+	}
+	ack.offset = in.offset
+	r.send(msg.ClientId, ack)
+}
+
+// insertLocked adds a new file, locked until start opened it.
+func (r *Receiver) insertLocked(clientId int, f *frame) *incoming {
+	in := &incoming{
+		file: File{
+			Id:       f.id,
+			ClientId: clientId,
+			Size:     int64(f.size),
+			SHA256:   f.sum,
+		},
+		hash: sha256.New(),
+	}
+	in.lock.Lock()
+	r.files[f.id] = in
+	return in
+}
+
+// start opens the writer of an inserted file, the file is removed again
+// if that fails.
+func (r *Receiver) start(in *incoming) error {
+	r.lock.Lock()
+	open := r.open
+	r.lock.Unlock()
+
+	w, err := open(&in.file)
+	if err != nil {
+		r.lock.Lock()
+		delete(r.files, in.file.Id)
+		r.lock.Unlock()
+		return err
+	}
+	in.w = w
+	return nil
+}
+
+// finish ends a transfer, a failed one is rejected.
+func (r *Receiver) finish(in *incoming, err error) {
+	if closer, ok := in.w.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil && in.file.Path != "" {
+		os.Remove(in.file.Path)
+	}
+
+	r.lock.Lock()
+	delete(r.files, in.file.Id)
+	if err == nil {
+		r.completeLocked(in.file.Id, in.offset)
+	}
+	onComplete := r.onComplete
+	r.lock.Unlock()
+
+	if err != nil {
+		r.send(in.file.ClientId, &frame{kind: KindReject, id: in.file.Id, reason: err.Error()})
+	}
+	if onComplete != nil {
+		onComplete(in.file, err)
+	}
+}
+
+// completeLocked remembers a finished file, forgetting the oldest one
+// beyond MaxCompleted. Its sender resuming later starts over.
+func (r *Receiver) completeLocked(id FileId, size uint64) {
+	if len(r.completedOrder) >= MaxCompleted {
+		delete(r.completed, r.completedOrder[0])
+		r.completedOrder = r.completedOrder[1:]
+	}
+	r.completed[id] = size
+	r.completedOrder = append(r.completedOrder, id)
+}
+
+func (r *Receiver) OnConnect(id int) {
+	r.inner.OnConnect(id)
+}
+
+func (r *Receiver) OnDisconnect(id int) {
+	r.inner.OnDisconnect(id)
+}
+
+func (r *Receiver) OnFailure(exited bool, err error) {
+	r.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,251 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// ProgressHook receives the bytes acknowledged so far by the receiver.
+type ProgressHook func(path string, acked, total int64)
+
+// outgoing is the state of a transfer in SendFile, updated by the acks.
+type outgoing struct {
+	lock     sync.Mutex
+	acked    uint64
+	acks     uint64
+	rejected error
+	notify   chan struct{}
+}
+
+// Sender sends files over a client. It wraps the client's event handler:
+// acknowledgements are taken, other messages and all events are passed on.
+type Sender struct {
+	inner  websocket.Events
+	client *websocket.Client
+
+	lock       sync.Mutex
+	connected  bool
+	connChange chan struct{}
+	transfers  map[FileId]*outgoing
+	onProgress ProgressHook
+}
+
+// NewSender installs the sender on c. Create it before connecting.
+func NewSender(c *websocket.Client) *Sender {
+	s := &Sender{
+		inner:      c.EventHandler(),
+		client:     c,
+		connChange: make(chan struct{}),
+		transfers:  make(map[FileId]*outgoing),
+	}
+	c.SetEventHandler(s)
+	return s
+}
+
+func (s *Sender) SetOnProgress(hook ProgressHook) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onProgress = hook
+}
+
+// state returns whether the client is connected and a channel closed on
+// the next connect or disconnect.
+func (s *Sender) state() (bool, <-chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.connected, s.connChange
+}
+
+func (s *Sender) setConnected(connected bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.connected = connected
+	close(s.connChange)
+	s.connChange = make(chan struct{})
+}
+
+// SendFile sends the file at path in chunks of chunkSize and returns once
+// the receiver verified it. A reconnect of the client resumes at the
+// offset the receiver acknowledges. It waits for a connection, until ctx
+// is done.
+func SendFile(ctx context.Context, sender *Sender, path string, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	chunk := frame{kind: KindChunk, id: newFileId(), size: uint64(size)}
+	copy(chunk.sum[:], hash.Sum(nil))
+
+	transfer := &outgoing{notify: make(chan struct{}, 1)}
+	sender.lock.Lock()
+	sender.transfers[chunk.id] = transfer
+	sender.lock.Unlock()
+	defer func() {
+		sender.lock.Lock()
+		delete(sender.transfers, chunk.id)
+		sender.lock.Unlock()
+	}()
+
+	buf := make([]byte, chunkSize)
+	var sent, progress uint64
+	sentAny := false
+	resumeAfter := uint64(0)
+	resuming := false
+
+	connected, connChange := sender.state()
+	for {
+		transfer.lock.Lock()
+		acked, acks, rejected := transfer.acked, transfer.acks, transfer.rejected
+		transfer.lock.Unlock()
+
+		if rejected != nil {
+			return rejected
+		}
+		if resuming && acks > resumeAfter {
+			// the receiver has exactly acked
+			resuming = false
+			sent = acked
+			sentAny = acked > 0
+		}
+		if acked > progress {
+			progress = acked
+			sender.lock.Lock()
+			hook := sender.onProgress
+			sender.lock.Unlock()
+			if hook != nil {
+				hook(path, int64(acked), size)
+			}
+		}
+		if sentAny && !resuming && acks > 0 && acked == chunk.size {
+			return nil
+		}
+
+		for connected && !resuming && (sent < chunk.size || !sentAny) &&
+			sent-acked < uint64(Window*chunkSize) {
+
+			n, err := file.ReadAt(buf, int64(sent))
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			chunk.offset = sent
+			chunk.data = buf[:n]
+			if err = sender.client.Send(websocket.Message{
+				MessageType: websocket.BinaryMessage,
+				Data:        chunk.encode(),
+			}); err != nil {
+				// resumed after the reconnect
+				break
+			}
+			sent += uint64(n)
+			sentAny = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-transfer.notify:
+		case <-connChange:
+			connected, connChange = sender.state()
+			if connected {
+				resume := frame{kind: KindResume, id: chunk.id}
+				if err := sender.client.Send(websocket.Message{
+					MessageType: websocket.BinaryMessage,
+					Data:        resume.encode(),
+				}); err == nil {
+					resuming = true
+					resumeAfter = acks
+				}
+			}
+		}
+	}
+}
+
+func (s *Sender) OnReceive(msg websocket.Message) {
+	f, ok := decodeFrame(msg.Data)
+	if !ok || msg.MessageType != websocket.BinaryMessage ||
+		(f.kind != KindAck && f.kind != KindReject) {
+		s.inner.OnReceive(msg)
+		return
+	}
+
+	s.lock.Lock()
+	transfer := s.transfers[f.id]
+	s.lock.Unlock()
+	if transfer == nil {
+		return
+	}
+
+	transfer.lock.Lock()
+	if f.kind == KindReject {
+		transfer.rejected = fmt.Errorf("rejected %s: %s", f.id, f.reason)
+	} else {
+		transfer.acked = f.offset
+		transfer.acks++
+	}
+	transfer.lock.Unlock()
+
+	select {
+	case transfer.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Sender) OnConnect(id int) {
+	s.setConnected(true)
+	s.inner.OnConnect(id)
+}
+
+func (s *Sender) OnDisconnect(id int) {
+	s.setConnected(false)
+	s.inner.OnDisconnect(id)
+}
+
+func (s *Sender) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
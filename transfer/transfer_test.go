@@ -0,0 +1,253 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+// writeFile writes size random bytes to a temp file.
+func writeFile(t *testing.T, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+// buffer collects a received file.
+type buffer struct {
+	lock sync.Mutex
+	bytes.Buffer
+}
+
+func (b *buffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func setup(t *testing.T) (*websockettest.ServerConn, *Receiver, *Sender, *websockettest.Recorder) {
+	t.Helper()
+	server := websockettest.NewServer(websockettest.NewRecorder())
+	t.Cleanup(func() { server.Close() })
+	receiver := NewServerReceiver(server.Server)
+
+	events := websockettest.NewRecorder()
+	client := websocket.NewClient(false, events)
+	backoff := utils.NewBackoff()
+	backoff.Initial = 10 * time.Millisecond
+	client.SetReconnect(backoff, 0)
+	sender := NewSender(client)
+	server.Connect(t, client)
+	t.Cleanup(func() { client.Disconnect() })
+	return server, receiver, sender, events
+}
+
+func TestSendFile(t *testing.T) {
+	_, receiver, sender, _ := setup(t)
+	path, data := writeFile(t, 300*1024+7)
+
+	completed := make(chan File, 1)
+	receiver.SetOnComplete(func(file File, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		completed <- file
+	})
+	var progress []int64
+	sender.SetOnProgress(func(p string, acked, total int64) {
+		if p != path || total != int64(len(data)) {
+			t.Errorf("progress of %s, %d", p, total)
+		}
+		progress = append(progress, acked)
+	})
+
+	if err := SendFile(context.Background(), sender, path, 16*1024); err != nil {
+		t.Fatal(err)
+	}
+	file := <-completed
+	defer os.Remove(file.Path)
+	received, err := os.ReadFile(file.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) || file.SHA256 != sha256.Sum256(data) {
+		t.Errorf("received %d bytes", len(received))
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != int64(len(data)) {
+		t.Errorf("progress %v", progress)
+	}
+
+	// an empty file
+	empty, _ := writeFile(t, 0)
+	if err = SendFile(context.Background(), sender, empty, 0); err != nil {
+		t.Fatal(err)
+	}
+	if file = <-completed; file.Size != 0 {
+		t.Errorf("size %d", file.Size)
+	}
+	os.Remove(file.Path)
+}
+
+func TestResume(t *testing.T) {
+	server, receiver, sender, events := setup(t)
+	path, data := writeFile(t, 100*1024)
+
+	var received buffer
+	receiver.SetOpen(func(file *File) (io.Writer, error) { return &received, nil })
+	broken := false
+	receiver.SetOnProgress(func(file File, n int64) {
+		if !broken && n >= 30*1024 {
+			broken = true
+			if err := server.Break(file.ClientId); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := SendFile(ctx, sender, path, 4*1024); err != nil {
+		t.Fatal(err)
+	}
+	// each byte was written once
+	if !bytes.Equal(received.Bytes(), data) {
+		t.Errorf("received %d bytes", received.Len())
+	}
+	events.WaitForConnect(t, time.Second)
+	events.WaitForDisconnect(t, time.Second)
+	events.WaitForConnect(t, time.Second)
+}
+
+func TestReject(t *testing.T) {
+	_, receiver, sender, _ := setup(t)
+	path, _ := writeFile(t, 1024)
+
+	receiver.SetOpen(func(file *File) (io.Writer, error) { return nil, errors.New("disk full") })
+	err := SendFile(context.Background(), sender, path, 0)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("sent with %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	var replies []frame
+	receiver := newReceiver(websockettest.NewRecorder(), func(clientId int, msg *websocket.Message) error {
+		f, ok := decodeFrame(msg.Data)
+		if !ok {
+			t.Fatalf("reply % x", msg.Data)
+		}
+		replies = append(replies, f)
+		return nil
+	})
+	var completeErr error
+	receiver.SetOnComplete(func(file File, err error) {
+		completeErr = err
+		if _, statErr := os.Stat(file.Path); !os.IsNotExist(statErr) {
+			t.Errorf("temp file left: %v", statErr)
+		}
+	})
+
+	chunk := frame{kind: KindChunk, id: newFileId(), size: 4, data: []byte("data")}
+	receiver.OnReceive(websocket.Message{MessageType: websocket.BinaryMessage, Data: chunk.encode()})
+	if !errors.Is(completeErr, ErrChecksum) || len(replies) != 1 ||
+		replies[0].kind != KindReject || replies[0].reason != ErrChecksum.Error() {
+		t.Errorf("completed with %v, replies %+v", completeErr, replies)
+	}
+
+	// other messages are passed on
+	other := []byte("FT")
+	receiver.OnReceive(websocket.Message{MessageType: websocket.BinaryMessage, Data: other})
+	if messages := receiver.inner.(*websockettest.Recorder).Messages(); len(messages) != 1 {
+		t.Errorf("passed on %d messages", len(messages))
+	}
+}
+
+func TestReceiverState(t *testing.T) {
+	receiver := newReceiver(websockettest.NewRecorder(),
+		func(clientId int, msg *websocket.Message) error { return nil })
+	var opens sync.WaitGroup
+	opened := 0
+	receiver.SetOpen(func(file *File) (io.Writer, error) {
+		opened++
+		// the racing chunk arrives while the file is opened
+		opens.Wait()
+		return &buffer{}, nil
+	})
+
+	// racing first chunks open the file once
+	chunk := frame{kind: KindChunk, id: newFileId(), size: 8, data: []byte("data")}
+	msg := websocket.Message{MessageType: websocket.BinaryMessage, Data: chunk.encode()}
+	var received sync.WaitGroup
+	opens.Add(1)
+	for i := 0; i < 2; i++ {
+		received.Add(1)
+		go func() {
+			defer received.Done()
+			receiver.OnReceive(msg)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	opens.Done()
+	received.Wait()
+	if opened != 1 || len(receiver.files) != 1 || receiver.files[chunk.id].offset != 4 {
+		t.Errorf("opened %d times, files %v", opened, receiver.files)
+	}
+
+	// only the latest completed files are remembered
+	var first FileId
+	for i := 0; i <= MaxCompleted; i++ {
+		chunk = frame{kind: KindChunk, id: newFileId(), size: 4, data: []byte("data"),
+			sum: sha256.Sum256([]byte("data"))}
+		if i == 0 {
+			first = chunk.id
+		}
+		receiver.OnReceive(websocket.Message{MessageType: websocket.BinaryMessage,
+			Data: chunk.encode()})
+	}
+	if _, ok := receiver.completed[first]; ok || len(receiver.completed) != MaxCompleted {
+		t.Errorf("%d completed, the first one kept: %v", len(receiver.completed), ok)
+	}
+}
@@ -0,0 +1,223 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package typed sends and receives values of one type over a websocket
+// client or server, encoded by a codec.Codec.
+package typed
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ChrIgiSta/go-easy-websockets/codec"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// ReceiveBuffer is the channel capacity for received values. Values for a
+// full channel are dropped with ErrBufferFull rather than blocking the
+// read loop.
+var ReceiveBuffer = 64
+
+var ErrBufferFull = errors.New("receive buffer full")
+
+// ReceiveError is a received message which could not be delivered, because
+// it could not be decoded or the receive channel was full.
+type ReceiveError struct {
+	ClientId int
+	Message  websocket.Message
+	Err      error
+}
+
+func (e *ReceiveError) Error() string {
+	return fmt.Sprintf("receive from %d: %v", e.ClientId, e.Err)
+}
+
+func (e *ReceiveError) Unwrap() error {
+	return e.Err
+}
+
+// Received is a value received by a Server.
+type Received[T any] struct {
+	ClientId int
+	Value    T
+}
+
+// errorHook routes receive errors to a callback, or else to the wrapped
+// event handler as failure. The connection stays up either way.
+type errorHook struct {
+	lock    sync.Mutex
+	onError func(err *ReceiveError)
+}
+
+func (h *errorHook) set(fn func(err *ReceiveError)) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.onError = fn
+}
+
+func (h *errorHook) report(inner websocket.Events, err *ReceiveError) {
+	h.lock.Lock()
+	fn := h.onError
+	h.lock.Unlock()
+
+	if fn != nil {
+		fn(err)
+	} else {
+		inner.OnFailure(false, err)
+	}
+}
+
+// Client sends and receives values of type T. It wraps the client's event
+// handler: all received messages are decoded, events are passed on.
+type Client[T any] struct {
+	inner    websocket.Events
+	codec    *codec.Client
+	received chan T
+	errors   errorHook
+}
+
+// NewClient installs the wrapper on ws, a nil c encodes as codec.JSON.
+// Create it before connecting.
+func NewClient[T any](ws *websocket.Client, c codec.Codec) *Client[T] {
+	if c == nil {
+		c = codec.JSON
+	}
+	client := &Client[T]{
+		codec:    codec.NewClient(ws, c),
+		received: make(chan T, ReceiveBuffer),
+	}
+	client.inner = ws.EventHandler()
+	ws.SetEventHandler(client)
+	return client
+}
+
+// OnError sets the callback for messages which could not be delivered.
+func (c *Client[T]) OnError(fn func(err *ReceiveError)) {
+	c.errors.set(fn)
+}
+
+func (c *Client[T]) Send(v T) error {
+	return c.codec.Send(v)
+}
+
+// Receive returns the channel of the received values.
+func (c *Client[T]) Receive() <-chan T {
+	return c.received
+}
+
+func (c *Client[T]) OnReceive(msg websocket.Message) {
+	var v T
+	if err := c.codec.Decode(msg, &v); err != nil {
+		c.errors.report(c.inner, &ReceiveError{ClientId: msg.ClientId, Message: msg, Err: err})
+		return
+	}
+
+	select {
+	case c.received <- v:
+	default:
+		c.errors.report(c.inner, &ReceiveError{ClientId: msg.ClientId, Message: msg, Err: ErrBufferFull})
+	}
+}
+
+func (c *Client[T]) OnConnect(id int) {
+	c.inner.OnConnect(id)
+}
+
+func (c *Client[T]) OnDisconnect(id int) {
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client[T]) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
+
+// Server is the server side of Client.
+type Server[T any] struct {
+	inner    websocket.Events
+	codec    *codec.Server
+	received chan Received[T]
+	errors   errorHook
+}
+
+// NewServer installs the wrapper on ws, a nil c encodes as codec.JSON.
+// Create it before ListenAndServe.
+func NewServer[T any](ws *websocket.Server, c codec.Codec) *Server[T] {
+	if c == nil {
+		c = codec.JSON
+	}
+	server := &Server[T]{
+		codec:    codec.NewServer(ws, c),
+		received: make(chan Received[T], ReceiveBuffer),
+	}
+	server.inner = ws.EventHandler()
+	ws.SetEventHandler(server)
+	return server
+}
+
+func (s *Server[T]) OnError(fn func(err *ReceiveError)) {
+	s.errors.set(fn)
+}
+
+func (s *Server[T]) Send(clientId int, v T) error {
+	return s.codec.Send(clientId, v)
+}
+
+func (s *Server[T]) Broadcast(v T) error {
+	return s.codec.Broadcast(v)
+}
+
+// Receive returns the channel of the received values with the ids of the
+// sending clients.
+func (s *Server[T]) Receive() <-chan Received[T] {
+	return s.received
+}
+
+func (s *Server[T]) OnReceive(msg websocket.Message) {
+	var v T
+	if err := s.codec.Decode(msg, &v); err != nil {
+		s.errors.report(s.inner, &ReceiveError{ClientId: msg.ClientId, Message: msg, Err: err})
+		return
+	}
+
+	select {
+	case s.received <- Received[T]{ClientId: msg.ClientId, Value: v}:
+	default:
+		s.errors.report(s.inner, &ReceiveError{ClientId: msg.ClientId, Message: msg, Err: ErrBufferFull})
+	}
+}
+
+func (s *Server[T]) OnConnect(id int) {
+	s.inner.OnConnect(id)
+}
+
+func (s *Server[T]) OnDisconnect(id int) {
+	s.inner.OnDisconnect(id)
+}
+
+func (s *Server[T]) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
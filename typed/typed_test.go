@@ -0,0 +1,131 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package typed
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/codec"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+type reading struct {
+	Sensor string  `json:"sensor"`
+	Value  float64 `json:"value"`
+}
+
+func receive[V any](t *testing.T, ch <-chan V) V {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+	}
+	var v V
+	return v
+}
+
+func TestTyped(t *testing.T) {
+	for _, c := range []codec.Codec{nil, codec.Msgpack, codec.Gob} {
+		serverEvents := websockettest.NewRecorder()
+		ws := websockettest.NewServer(serverEvents)
+		server := NewServer[reading](ws.Server, c)
+		serverErrors := make(chan *ReceiveError, 1)
+		server.OnError(func(err *ReceiveError) { serverErrors <- err })
+
+		events := websockettest.NewRecorder()
+		wsClient := websocket.NewClient(false, events)
+		client := NewClient[reading](wsClient, c)
+		ws.Connect(t, wsClient)
+
+		want := reading{Sensor: "temp", Value: 21.5}
+		if err := client.Send(want); err != nil {
+			t.Fatal(err)
+		}
+		received := receive(t, server.Receive())
+		if received.Value != want {
+			t.Errorf("%T: server received %+v", c, received.Value)
+		}
+
+		if err := server.Send(received.ClientId, reading{Sensor: "reply"}); err != nil {
+			t.Fatal(err)
+		}
+		if v := receive(t, client.Receive()); v.Sensor != "reply" {
+			t.Errorf("%T: client received %+v", c, v)
+		}
+		if err := server.Broadcast(want); err != nil {
+			t.Fatal(err)
+		}
+		if v := receive(t, client.Receive()); v != want {
+			t.Errorf("%T: client received %+v", c, v)
+		}
+
+		// undecodable messages go to the error callback, or else to the
+		// failure event, the connection stays up
+		if err := wsClient.Send(websocket.Message{MessageType: websocket.TextMessage, Data: []byte("{")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := receive(t, serverErrors); err.ClientId != received.ClientId || string(err.Message.Data) != "{" {
+			t.Errorf("%T: error %+v", c, err)
+		}
+		if c == nil {
+			if err := ws.Send(received.ClientId, &websocket.Message{MessageType: websocket.TextMessage, Data: []byte("[1]")}); err != nil {
+				t.Fatal(err)
+			}
+			var receiveErr *ReceiveError
+			if evnt := events.WaitForFailure(t, time.Second); !errors.As(evnt.Err, &receiveErr) {
+				t.Error("unexpected failure: ", evnt.Err)
+			}
+			if err := client.Send(want); err != nil {
+				t.Fatal(err)
+			}
+			if v := receive(t, server.Receive()); v.Value != want {
+				t.Errorf("received %+v after an error", v.Value)
+			}
+		}
+
+		wsClient.Disconnect()
+		ws.Close()
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	ws := websocket.NewClient(false, websockettest.NewRecorder())
+	client := NewClient[int](ws, nil)
+	var dropped []*ReceiveError
+	client.OnError(func(err *ReceiveError) { dropped = append(dropped, err) })
+
+	for i := 0; i <= ReceiveBuffer; i++ {
+		client.OnReceive(websocket.Message{MessageType: websocket.TextMessage, Data: []byte("1")})
+	}
+	if len(client.Receive()) != ReceiveBuffer || len(dropped) != 1 || !errors.Is(dropped[0], ErrBufferFull) {
+		t.Errorf("%d buffered, dropped %v", len(client.Receive()), dropped)
+	}
+}
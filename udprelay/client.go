@@ -0,0 +1,228 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package udprelay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// Client relays the datagrams of a local udp port over a websocket client.
+// Responses are only passed to senders with a flow, a sender without
+// datagrams for the idle timeout is forgotten.
+type Client struct {
+	inner websocket.Events
+	ws    *websocket.Client
+	conn  *net.UDPConn
+	wg    sync.WaitGroup
+
+	lock    sync.Mutex
+	flows   map[netip.AddrPort]*flow
+	idle    time.Duration
+	max     int
+	dropped atomic.Uint64
+}
+
+// Listen binds addr and relays its datagrams over ws. It wraps the event
+// handler of ws, datagrams are consumed and every other message is passed
+// on. Connect ws afterwards, datagrams are dropped while it is not
+// connected.
+func Listen(addr string, ws *websocket.Client) (*Client, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		inner: ws.EventHandler(),
+		ws:    ws,
+		conn:  conn,
+		flows: make(map[netip.AddrPort]*flow),
+		idle:  DefaultIdleTimeout,
+		max:   DefaultMaxDatagram,
+	}
+	ws.SetEventHandler(c)
+
+	c.wg.Add(1)
+	go c.readLoop()
+	return c, nil
+}
+
+// SetIdleTimeout sets the time after which a sender without datagrams in
+// either direction is forgotten.
+func (c *Client) SetIdleTimeout(timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.idle = timeout
+}
+
+// SetMaxDatagram sets the largest datagram relayed, larger ones are
+// dropped and reported by OnFailure.
+func (c *Client) SetMaxDatagram(size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.max = size
+}
+
+func (c *Client) Addr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Flows returns the number of senders with a flow.
+func (c *Client) Flows() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.flows)
+}
+
+// Dropped returns the number of datagrams not relayed.
+func (c *Client) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// Close stops relaying and releases the port, ws stays connected.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.wg.Wait()
+
+	c.lock.Lock()
+	flows := c.flows
+	c.flows = make(map[netip.AddrPort]*flow)
+	c.lock.Unlock()
+
+	// outside the lock, an expiring flow holds its own and waits for it
+	for _, f := range flows {
+		f.stop()
+	}
+	return err
+}
+
+func (c *Client) drop(err error) {
+	c.dropped.Add(1)
+	c.inner.OnFailure(false, err)
+}
+
+func (c *Client) readLoop() {
+	defer c.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.conn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		// the header carries unmapped ipv4, the flows must match it
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		c.lock.Lock()
+		maxSize, idle := c.max, c.idle
+		f, ok := c.flows[addr]
+		if !ok && n <= maxSize {
+			f = newFlow(idle, func(f *flow) { c.expire(addr, f) })
+			c.flows[addr] = f
+		}
+		c.lock.Unlock()
+
+		if n > maxSize {
+			c.drop(fmt.Errorf("datagram of %d bytes from %s: %w", n, addr, ErrOversized))
+			continue
+		}
+		f.touch()
+		err = c.ws.Send(websocket.Message{MessageType: websocket.BinaryMessage,
+			Data: encodeDatagram(addr, buf[:n])})
+		if err != nil {
+			c.drop(fmt.Errorf("relay datagram from %s: %w", addr, err))
+		}
+	}
+}
+
+func (c *Client) expire(addr netip.AddrPort, f *flow) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.flows[addr] == f {
+		delete(c.flows, addr)
+	}
+}
+
+// OnReceive passes a response to its sender.
+func (c *Client) OnReceive(msg websocket.Message) {
+	if msg.MessageType != websocket.BinaryMessage {
+		c.inner.OnReceive(msg)
+		return
+	}
+	addr, payload, err := decodeDatagram(msg.Data)
+	if err != nil {
+		c.inner.OnReceive(msg)
+		return
+	}
+
+	c.lock.Lock()
+	f, ok := c.flows[addr]
+	maxSize := c.max
+	c.lock.Unlock()
+
+	switch {
+	case !ok:
+		c.drop(fmt.Errorf("response to %s: %w", addr, ErrNoFlow))
+	case len(payload) > maxSize:
+		c.drop(fmt.Errorf("response of %d bytes to %s: %w", len(payload), addr, ErrOversized))
+	default:
+		f.touch()
+		if _, err = c.conn.WriteToUDPAddrPort(payload, addr); err != nil {
+			c.drop(fmt.Errorf("response to %s: %w", addr, err))
+		}
+	}
+}
+
+func (c *Client) OnConnect(id int) {
+	c.inner.OnConnect(id)
+}
+
+func (c *Client) OnDisconnect(id int) {
+	c.inner.OnDisconnect(id)
+}
+
+func (c *Client) OnFailure(exited bool, err error) {
+	c.inner.OnFailure(exited, err)
+}
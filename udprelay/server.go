@@ -0,0 +1,261 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package udprelay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+type flowKey struct {
+	clientId int
+	addr     netip.AddrPort
+}
+
+// serverFlow is the udp socket of one local sender of a client, like the
+// mapping of a nat.
+type serverFlow struct {
+	*flow
+	conn *net.UDPConn
+}
+
+// Server emits the datagrams of its clients towards a udp target, from
+// one socket per flow, and relays the responses back.
+type Server struct {
+	inner  websocket.Events
+	ws     *websocket.Server
+	target *net.UDPAddr
+	wg     sync.WaitGroup
+
+	lock    sync.Mutex
+	flows   map[flowKey]*serverFlow
+	idle    time.Duration
+	max     int
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// NewServer relays the datagrams received by ws to target. It wraps the
+// event handler of ws, datagrams are consumed and every other message is
+// passed on.
+func NewServer(ws *websocket.Server, target string) (*Server, error) {
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		inner:  ws.EventHandler(),
+		ws:     ws,
+		target: targetAddr,
+		flows:  make(map[flowKey]*serverFlow),
+		idle:   DefaultIdleTimeout,
+		max:    DefaultMaxDatagram,
+	}
+	ws.SetEventHandler(s)
+	return s, nil
+}
+
+// SetIdleTimeout sets the time after which a flow without datagrams in
+// either direction is closed.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.idle = timeout
+}
+
+// SetMaxDatagram sets the largest datagram relayed, larger ones are
+// dropped and reported by OnFailure.
+func (s *Server) SetMaxDatagram(size int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.max = size
+}
+
+// Flows returns the number of open flows.
+func (s *Server) Flows() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.flows)
+}
+
+// Dropped returns the number of datagrams not relayed.
+func (s *Server) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close closes all flows and stops opening new ones.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	flows := s.flows
+	s.flows = make(map[flowKey]*serverFlow)
+	s.lock.Unlock()
+
+	for _, f := range flows {
+		f.stop()
+		f.conn.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) drop(err error) {
+	s.dropped.Add(1)
+	s.inner.OnFailure(false, err)
+}
+
+// open returns the flow of key, opened if there is none.
+func (s *Server) open(key flowKey) (*serverFlow, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f, ok := s.flows[key]; ok {
+		return f, nil
+	}
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	conn, err := net.DialUDP("udp", nil, s.target)
+	if err != nil {
+		return nil, err
+	}
+	f := &serverFlow{conn: conn}
+	f.flow = newFlow(s.idle, func(*flow) { s.expire(key, f) })
+	s.flows[key] = f
+
+	s.wg.Add(1)
+	go s.readLoop(key, f, s.max)
+	return f, nil
+}
+
+func (s *Server) expire(key flowKey, f *serverFlow) {
+	s.lock.Lock()
+	if s.flows[key] == f {
+		delete(s.flows, key)
+	}
+	s.lock.Unlock()
+
+	f.conn.Close()
+}
+
+// readLoop relays the responses of a flow until it is closed.
+func (s *Server) readLoop(key flowKey, f *serverFlow, maxSize int) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := f.conn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		if n > maxSize {
+			s.drop(fmt.Errorf("response of %d bytes to %s: %w", n, key.addr, ErrOversized))
+			continue
+		}
+
+		f.touch()
+		err = s.ws.Send(key.clientId, &websocket.Message{
+			MessageType: websocket.BinaryMessage,
+			Data:        encodeDatagram(key.addr, buf[:n]),
+		})
+		if err != nil {
+			s.drop(fmt.Errorf("response to %s of client %d: %w", key.addr, key.clientId, err))
+		}
+	}
+}
+
+// OnReceive emits a datagram towards the target.
+func (s *Server) OnReceive(msg websocket.Message) {
+	if msg.MessageType != websocket.BinaryMessage {
+		s.inner.OnReceive(msg)
+		return
+	}
+	addr, payload, err := decodeDatagram(msg.Data)
+	if err != nil {
+		s.inner.OnReceive(msg)
+		return
+	}
+
+	s.lock.Lock()
+	maxSize := s.max
+	s.lock.Unlock()
+	if len(payload) > maxSize {
+		s.drop(fmt.Errorf("datagram of %d bytes from %s of client %d: %w",
+			len(payload), addr, msg.ClientId, ErrOversized))
+		return
+	}
+
+	f, err := s.open(flowKey{clientId: msg.ClientId, addr: addr})
+	if err != nil {
+		s.drop(fmt.Errorf("datagram from %s of client %d: %w", addr, msg.ClientId, err))
+		return
+	}
+	f.touch()
+	if _, err = f.conn.Write(payload); err != nil {
+		s.drop(fmt.Errorf("datagram from %s of client %d: %w", addr, msg.ClientId, err))
+	}
+}
+
+func (s *Server) OnConnect(id int) {
+	s.inner.OnConnect(id)
+}
+
+// OnDisconnect closes the flows of the client.
+func (s *Server) OnDisconnect(id int) {
+	var flows []*serverFlow
+	s.lock.Lock()
+	for key, f := range s.flows {
+		if key.clientId == id {
+			flows = append(flows, f)
+			delete(s.flows, key)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, f := range flows {
+		f.stop()
+		f.conn.Close()
+	}
+	s.inner.OnDisconnect(id)
+}
+
+func (s *Server) OnFailure(exited bool, err error) {
+	s.inner.OnFailure(exited, err)
+}
@@ -0,0 +1,134 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package udprelay carries udp datagrams over websocket connections. A
+// Client binds a local udp port and sends each datagram as one binary
+// message, a Server emits it towards its target and relays the responses
+// back to the local sender.
+package udprelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxDatagram is the largest datagram relayed by default, the
+// payload of an ethernet frame without ip and udp header.
+const DefaultMaxDatagram = 1472
+
+// DefaultIdleTimeout removes a flow without datagrams in either direction.
+const DefaultIdleTimeout = time.Minute
+
+var (
+	ErrOversized = errors.New("datagram too large")
+	ErrHeader    = errors.New("invalid datagram header")
+	ErrNoFlow    = errors.New("no flow of the address")
+)
+
+// Each message starts with the address of the local sender: the family,
+// the ip and the port in big endian.
+const (
+	headerIPv4 byte = 4
+	headerIPv6 byte = 6
+)
+
+func encodeDatagram(addr netip.AddrPort, payload []byte) []byte {
+	ip := addr.Addr().Unmap()
+	data := make([]byte, 0, 1+16+2+len(payload))
+	if ip.Is4() {
+		data = append(data, headerIPv4)
+	} else {
+		data = append(data, headerIPv6)
+	}
+	data = append(data, ip.AsSlice()...)
+	data = binary.BigEndian.AppendUint16(data, addr.Port())
+	return append(data, payload...)
+}
+
+func decodeDatagram(data []byte) (netip.AddrPort, []byte, error) {
+	if len(data) == 0 {
+		return netip.AddrPort{}, nil, ErrHeader
+	}
+
+	size := 4
+	switch data[0] {
+	case headerIPv4:
+	case headerIPv6:
+		size = 16
+	default:
+		return netip.AddrPort{}, nil, ErrHeader
+	}
+	if len(data) < 1+size+2 {
+		return netip.AddrPort{}, nil, ErrHeader
+	}
+	ip, _ := netip.AddrFromSlice(data[1 : 1+size])
+	port := binary.BigEndian.Uint16(data[1+size:])
+	return netip.AddrPortFrom(ip, port), data[1+size+2:], nil
+}
+
+// flow is an entry of a mapping table. expire is called once it was idle
+// for the timeout.
+type flow struct {
+	lastActive atomic.Int64
+
+	lock  sync.Mutex
+	timer *time.Timer
+}
+
+func newFlow(idle time.Duration, expire func(*flow)) *flow {
+	f := &flow{}
+	f.touch()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.timer = time.AfterFunc(idle, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		remaining := idle - time.Since(time.Unix(0, f.lastActive.Load()))
+		if remaining > 0 {
+			f.timer.Reset(remaining)
+			return
+		}
+		expire(f)
+	})
+	return f
+}
+
+func (f *flow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *flow) stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.timer.Stop()
+}
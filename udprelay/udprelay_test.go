@@ -0,0 +1,176 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package udprelay
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+func TestHeader(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:53", "[::1]:65535", "[::ffff:10.0.0.1]:1"} {
+		addrPort := netip.MustParseAddrPort(addr)
+		decoded, payload, err := decodeDatagram(encodeDatagram(addrPort, []byte("data")))
+		if err != nil || decoded != netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()) ||
+			string(payload) != "data" {
+			t.Errorf("%s decoded to %s %q: %v", addr, decoded, payload, err)
+		}
+	}
+	decoded, payload, err := decodeDatagram(encodeDatagram(netip.MustParseAddrPort("10.0.0.1:7"), nil))
+	if err != nil || decoded.Port() != 7 || len(payload) != 0 {
+		t.Error("empty datagram: ", decoded, payload, err)
+	}
+	for _, bad := range [][]byte{nil, {5, 1, 2, 3, 4, 0, 1}, {headerIPv4, 1, 2, 3}} {
+		if _, _, err = decodeDatagram(bad); !errors.Is(err, ErrHeader) {
+			t.Errorf("decoded %v: %v", bad, err)
+		}
+	}
+}
+
+// echo answers each datagram with the source address of the sender and
+// the datagram.
+func echo(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte(addr.String()+" "), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+func sender(t *testing.T, to net.Addr) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, to.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UDPConn) []byte {
+	t.Helper()
+	buf := make([]byte, 65536)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestRelay(t *testing.T) {
+	target := echo(t)
+	serverEvents := websockettest.NewRecorder()
+	ws := websockettest.NewServer(serverEvents)
+	defer ws.Close()
+	server, err := NewServer(ws.Server, target.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.SetIdleTimeout(200 * time.Millisecond)
+
+	clientEvents := websockettest.NewRecorder()
+	wsClient := websocket.NewClient(false, clientEvents)
+	client, err := Listen("127.0.0.1:0", wsClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetMaxDatagram(120)
+	ws.Connect(t, wsClient)
+	defer wsClient.Disconnect()
+
+	// each sender gets the responses to its datagrams, boundaries kept
+	alice, bob := sender(t, client.Addr()), sender(t, client.Addr())
+	var aliceSource, bobSource string
+	for _, data := range [][]byte{[]byte("a"), {}, bytes.Repeat([]byte("x"), 100)} {
+		_, _ = alice.Write(data)
+		source, echoed, _ := bytes.Cut(receive(t, alice), []byte(" "))
+		if !bytes.Equal(echoed, data) {
+			t.Errorf("alice sent %q, got %q", data, echoed)
+		}
+		aliceSource = string(source)
+
+		_, _ = bob.Write([]byte("bob"))
+		source, echoed, _ = bytes.Cut(receive(t, bob), []byte(" "))
+		if string(echoed) != "bob" {
+			t.Errorf("bob got %q", echoed)
+		}
+		bobSource = string(source)
+	}
+	if aliceSource == bobSource {
+		t.Error("senders share the flow ", aliceSource)
+	}
+	if client.Flows() != 2 || server.Flows() != 2 {
+		t.Errorf("flows: client %d, server %d", client.Flows(), server.Flows())
+	}
+
+	_, _ = alice.Write(make([]byte, 121))
+	for i := 0; i < 100 && client.Dropped() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.Dropped() != 1 {
+		t.Error("oversized datagram relayed")
+	}
+	if evnt := clientEvents.WaitForFailure(t, time.Second); !errors.Is(evnt.Err, ErrOversized) {
+		t.Error("oversized datagram not reported: ", evnt)
+	}
+
+	// other messages pass, idle flows are closed
+	_ = wsClient.SendTxt([]byte("hello"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "hello" {
+		t.Errorf("received %q", msg.Data)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if server.Flows() != 0 {
+		t.Error("idle flows left: ", server.Flows())
+	}
+
+	// a new flow gets a new mapping
+	_, _ = alice.Write([]byte("again"))
+	source, echoed, _ := bytes.Cut(receive(t, alice), []byte(" "))
+	if string(echoed) != "again" || string(source) == aliceSource {
+		t.Errorf("got %q from %s", echoed, source)
+	}
+}
@@ -0,0 +1,114 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultBackoffInitial    = 500 * time.Millisecond
+	DefaultBackoffMax        = 30 * time.Second
+	DefaultBackoffMultiplier = 2.0
+	DefaultBackoffJitter     = 0.2
+)
+
+// Backoff calculates exponentially growing delays. Jitter is the fraction
+// (0..1) by which each delay is randomly varied in both directions. A Backoff
+// is not safe for concurrent use.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+
+	current time.Duration
+}
+
+func NewBackoff() *Backoff {
+	return &Backoff{
+		Initial:    DefaultBackoffInitial,
+		Max:        DefaultBackoffMax,
+		Multiplier: DefaultBackoffMultiplier,
+		Jitter:     DefaultBackoffJitter,
+	}
+}
+
+// Next returns the delay to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	initial := b.Initial
+	if initial <= 0 {
+		initial = DefaultBackoffInitial
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultBackoffMultiplier
+	}
+
+	if b.current <= 0 {
+		b.current = initial
+	}
+	delay := b.current
+
+	b.current = time.Duration(float64(b.current) * multiplier)
+	if b.Max > 0 && b.current > b.Max {
+		b.current = b.Max
+	}
+
+	jitter := b.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		delay = time.Duration(float64(delay) *
+			(1 + jitter*(2*rand.Float64()-1)))
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+
+	return delay
+}
+
+func (b *Backoff) Reset() {
+	b.current = 0
+}
+
+// Wait sleeps for the next delay or until ctx is done, in which case the
+// context's error is returned.
+func (b *Backoff) Wait(ctx context.Context) error {
+	timer := time.NewTimer(b.Next())
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
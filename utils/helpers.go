@@ -26,11 +26,32 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 )
 
+var defaultPorts = map[string]string{
+	"ws":    "80",
+	"http":  "80",
+	"wss":   "443",
+	"https": "443",
+}
+
+// unixSchemes maps the schemes of websockets over unix sockets to the
+// scheme of the handshake.
+var unixSchemes = map[string]string{
+	"unix":     "ws",
+	"ws+unix":  "ws",
+	"wss+unix": "wss",
+}
+
+// UnixHost is the host of handshakes over unix sockets.
+const UnixHost = "localhost"
+
 func StringToUrl(sUrl string) (u url.URL, err error) {
 	var uPtr *url.URL
 
@@ -46,13 +67,101 @@ func StringToUrl(sUrl string) (u url.URL, err error) {
 	return
 }
 
+// ParseWsURL parses and validates a websocket url. The scheme must be one
+// of ws, wss, http or https. A missing port is set to the scheme's default
+// and an empty path is normalized to "/". Urls over unix sockets are
+// accepted too, see SplitUnixURL.
+func ParseWsURL(sUrl string) (u url.URL, err error) {
+	u, _, err = ParseWsAddress(sUrl)
+	return
+}
+
+// ParseWsAddress works like ParseWsURL but additionally accepts addresses
+// without scheme like "host:port" or "host:port/path", which default to ws.
+// schemeInferred reports whether the scheme was defaulted.
+func ParseWsAddress(sUrl string) (u url.URL, schemeInferred bool, err error) {
+	if sUrl != "" && !strings.Contains(sUrl, "://") {
+		sUrl = "ws://" + sUrl
+		schemeInferred = true
+	}
+
+	u, err = StringToUrl(sUrl)
+	if err != nil {
+		return
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	defaultPort, ok := defaultPorts[u.Scheme]
+	_, unix := unixSchemes[u.Scheme]
+	if !ok && !unix {
+		return u, schemeInferred, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Fragment != "" || strings.HasSuffix(sUrl, "#") {
+		return u, schemeInferred, fmt.Errorf("fragment %q not allowed", u.Fragment)
+	}
+	if unix {
+		if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+			return u, schemeInferred, errors.New("missing absolute socket path, like unix:///run/app.sock:/path")
+		}
+		return
+	}
+	if u.Hostname() == "" {
+		return u, schemeInferred, errors.New("missing host")
+	}
+
+	if u.Port() == "" {
+		if strings.HasSuffix(u.Host, ":") {
+			return u, schemeInferred, errors.New("empty port")
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return
+}
+
+// TlsScheme reports whether a scheme ("wss", "https") or the scheme of a
+// full url is a secure one. The comparison is case-insensitive.
 func TlsScheme(scheme string) bool {
-	if strings.Contains(scheme, "wss") ||
-		strings.Contains(scheme, "https") {
-		return true
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+	if idx := strings.Index(scheme, "://"); idx >= 0 {
+		scheme = scheme[:idx]
+	}
+
+	return scheme == "wss" || scheme == "https" || scheme == "wss+unix"
+}
+
+// SplitUnixURL splits a url over a unix socket, like
+// "unix:///run/app.sock:/path", into the socket file and the url of the
+// handshake, "ws://localhost/path". ok is false for other urls.
+func SplitUnixURL(u url.URL) (socket string, target url.URL, ok bool) {
+	scheme, ok := unixSchemes[strings.ToLower(u.Scheme)]
+	if !ok {
+		return "", u, false
 	}
 
-	return false
+	socket, path, _ := strings.Cut(u.Path, ":")
+	if path == "" {
+		path = "/"
+	}
+	target = u
+	target.Scheme = scheme
+	target.Host = UnixHost
+	target.Path = path
+	target.RawPath = ""
+	return socket, target, true
+}
+
+// IsSecureURL parses raw like ParseWsAddress and reports whether it uses
+// a secure scheme.
+func IsSecureURL(raw string) (bool, error) {
+	u, _, err := ParseWsAddress(raw)
+	if err != nil {
+		return false, err
+	}
+	return TlsScheme(u.Scheme), nil
 }
 
 func MapToHeader(headers map[string]string) (header http.Header) {
@@ -63,3 +172,62 @@ func MapToHeader(headers map[string]string) (header http.Header) {
 	}
 	return
 }
+
+// MultiMapToHeader adds every value of a key to the header. Keys are
+// canonicalized like http.Header.Add does.
+func MultiMapToHeader(headers map[string][]string) (header http.Header) {
+	header = make(http.Header)
+
+	for key, values := range headers {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return
+}
+
+// BuildURL joins the escaped path segments to the path of base and adds the
+// query parameters. The result is validated like ParseWsAddress does.
+func BuildURL(base string, pathSegments []string,
+	query map[string]string) (u url.URL, err error) {
+
+	u, _, err = ParseWsAddress(base)
+	if err != nil {
+		return
+	}
+
+	path := strings.TrimRight(u.EscapedPath(), "/")
+	for _, segment := range pathSegments {
+		segment = strings.Trim(segment, "/")
+		if segment == "" {
+			continue
+		}
+		path += "/" + url.PathEscape(segment)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	values := u.Query()
+	for key, value := range query {
+		values.Set(key, value)
+	}
+
+	raw := u.Scheme + "://" + u.Host + path
+	if len(values) > 0 {
+		raw += "?" + strings.ReplaceAll(values.Encode(), "+", "%20")
+	}
+
+	return ParseWsURL(raw)
+}
+
+// BuildWsURL is BuildURL returning the url as string.
+func BuildWsURL(base string, pathSegments []string,
+	query map[string]string) (string, error) {
+
+	u, err := BuildURL(base, pathSegments, query)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
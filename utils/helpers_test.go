@@ -0,0 +1,371 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package utils
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ccrypt "github.com/ChrIgiSta/go-utils/crypto"
+)
+
+func TestParseWsURL(t *testing.T) {
+	tests := []struct {
+		in      string
+		out     string
+		wantErr string
+	}{
+		{"ws://localhost:8080/path", "ws://localhost:8080/path", ""},
+		{"ws://localhost", "ws://localhost:80/", ""},
+		{"wss://example.com/x?y=1", "wss://example.com:443/x?y=1", ""},
+		{"HTTPS://example.com", "https://example.com:443/", ""},
+		{"http://[::1]", "http://[::1]:80/", ""},
+		{"ftp://host", "", `unsupported scheme "ftp"`},
+		{"ws://host/path#frag", "", `fragment "frag" not allowed`},
+		{"ws:///path", "", "missing host"},
+		{"ws://host:/path", "", "empty port"},
+		{"", "", `unsupported scheme ""`},
+		{"unix:///run/app.sock:/ws", "unix:///run/app.sock:/ws", ""},
+		{"WSS+UNIX:///run/app.sock", "wss+unix:///run/app.sock", ""},
+		{"unix://host/app.sock", "", "missing absolute socket path, like unix:///run/app.sock:/path"},
+	}
+
+	for _, test := range tests {
+		u, err := ParseWsURL(test.in)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%q: expected error %q, got %v", test.in, test.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.in, err)
+			continue
+		}
+		if u.String() != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, u.String())
+		}
+	}
+}
+
+func TestParseWsAddress(t *testing.T) {
+	tests := []struct {
+		in       string
+		out      string
+		inferred bool
+	}{
+		{"localhost:8080", "ws://localhost:8080/", true},
+		{"localhost:8080/path", "ws://localhost:8080/path", true},
+		{"[::1]:9000/p", "ws://[::1]:9000/p", true},
+		{"example.com", "ws://example.com:80/", true},
+		{"ws://localhost:8080", "ws://localhost:8080/", false},
+		{"wss://localhost:8443/x", "wss://localhost:8443/x", false},
+	}
+
+	for _, test := range tests {
+		u, inferred, err := ParseWsAddress(test.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.in, err)
+			continue
+		}
+		if u.String() != test.out || inferred != test.inferred {
+			t.Errorf("%q: expected %q (inferred %v), got %q (inferred %v)",
+				test.in, test.out, test.inferred, u.String(), inferred)
+		}
+	}
+}
+
+func TestMultiMapToHeader(t *testing.T) {
+	header := MultiMapToHeader(map[string][]string{
+		"sec-websocket-protocol": {"v1", "v2"},
+		"Cookie":                 {"a=1"},
+	})
+
+	protocols := header.Values("Sec-Websocket-Protocol")
+	if len(protocols) != 2 || protocols[0] != "v1" || protocols[1] != "v2" {
+		t.Error("unexpected protocols: ", protocols)
+	}
+	if header.Get("cookie") != "a=1" {
+		t.Error("unexpected cookie: ", header.Get("cookie"))
+	}
+}
+
+func TestTlsScheme(t *testing.T) {
+	tests := []struct {
+		in     string
+		secure bool
+	}{
+		{"wss", true},
+		{"WSS", true},
+		{"https", true},
+		{"HttpS", true},
+		{"ws", false},
+		{"http", false},
+		{"wss://host:443/path", true},
+		{"HTTPS://host", true},
+		{"ws://wss.example.com/https", false},
+		{"localhost:8080", false},
+		{"wss+unix:///run/app.sock", true},
+		{"unix:///run/app.sock", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if TlsScheme(test.in) != test.secure {
+			t.Errorf("TlsScheme(%q) != %v", test.in, test.secure)
+		}
+	}
+
+	if secure, err := IsSecureURL("WSS://host/path"); err != nil || !secure {
+		t.Error("expected secure url: ", err)
+	}
+	if secure, err := IsSecureURL("host:8080/path"); err != nil || secure {
+		t.Error("expected insecure url: ", err)
+	}
+	if _, err := IsSecureURL("ftp://host"); err == nil {
+		t.Error("expected error for ftp")
+	}
+}
+
+func TestBuildWsURL(t *testing.T) {
+	tests := []struct {
+		base     string
+		segments []string
+		query    map[string]string
+		out      string
+	}{
+		{"wss://host/base/", []string{"/path"},
+			map[string]string{"token": "abc", "room": "x y"},
+			"wss://host:443/base/path?room=x%20y&token=abc"},
+		{"ws://host:8080", []string{"a/b", "", "c d"}, nil,
+			"ws://host:8080/a%2Fb/c%20d"},
+		{"ws://host:8080/?keep=1", nil, map[string]string{"plus": "1+1"},
+			"ws://host:8080/?keep=1&plus=1%2B1"},
+		{"host:8080", []string{"x"}, nil, "ws://host:8080/x"},
+	}
+
+	for _, test := range tests {
+		out, err := BuildWsURL(test.base, test.segments, test.query)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.base, err)
+			continue
+		}
+		if out != test.out {
+			t.Errorf("%q: expected %q, got %q", test.base, test.out, out)
+		}
+	}
+
+	if _, err := BuildWsURL("ftp://host", nil, nil); err == nil {
+		t.Error("expected error for ftp")
+	}
+}
+
+func TestOriginMatcher(t *testing.T) {
+	matcher := NewOriginMatcher(
+		"https://example.com",
+		"https://*.example.com",
+		"http://localhost:3000",
+		".internal.net",
+		"http://[::1]:8080",
+		"https://[fe80::1]",
+		"[::2]",
+	)
+
+	tests := []struct {
+		origin string
+		allow  bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"https://example.com:443", true},
+		{"https://example.com:8443", false},
+		{"http://example.com", false},
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://evil-example.com", false},
+		{"https://example.com.evil.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://example.com@evil.com", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"http://localhost", false},
+		{"http://internal.net:9000", true},
+		{"wss://svc.internal.net", true},
+		{"https://notinternal.net", false},
+		{"null", false},
+		{"", false},
+		{"example.com", false},
+		{"http://[::1]:8080", true},
+		{"http://[::1]:8081", false},
+		{"https://[fe80::1]", true},
+		{"https://[FE80::1]:443", true},
+		{"http://[fe80::1]", false},
+		{"ws://[::2]:1234", true},
+		{"http://[::3]", false},
+	}
+
+	for _, test := range tests {
+		if matcher.Allow(test.origin) != test.allow {
+			t.Errorf("Allow(%q) != %v", test.origin, test.allow)
+		}
+	}
+
+	if !NewOriginMatcher("null").Allow("null") {
+		t.Error("explicit null pattern not matching")
+	}
+	if !NewOriginMatcher("*").Allow("https://anything.org") {
+		t.Error("catch-all not matching")
+	}
+}
+
+func TestLoadKeyPair(t *testing.T) {
+	subject := ccrypt.CertificateSubject{CommonName: "localhost"}
+	cert, key, err := ccrypt.CreateSelfsignedX509Certificate(big.NewInt(1),
+		1, ccrypt.KeyLength2048Bit, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ccrypt.CreateSelfsignedX509Certificate(big.NewInt(2),
+		1, ccrypt.KeyLength2048Bit, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	certPath := write("cert.pem", cert)
+	keyPath := write("key.pem", key)
+	otherKeyPath := write("other.pem", otherKey)
+
+	if _, _, err = LoadKeyPair(certPath, keyPath); err != nil {
+		t.Error("valid pair: ", err)
+	}
+	if _, _, err = LoadKeyPair(certPath, otherKeyPath); !errors.Is(err, ErrKeyMismatch) {
+		t.Error("expected mismatch, got ", err)
+	}
+	if _, _, err = LoadKeyPair(certPath, certPath); err == nil ||
+		!strings.Contains(err.Error(), "expected a private key") {
+		t.Error("expected wrong key type error, got ", err)
+	}
+	if _, _, err = LoadKeyPair(keyPath, keyPath); err == nil ||
+		!strings.Contains(err.Error(), "expected a certificate") {
+		t.Error("expected wrong certificate type error, got ", err)
+	}
+	if _, _, err = LoadKeyPair(filepath.Join(dir, "missing"), keyPath); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	t.Setenv("TEST_WS_CERT", string(cert))
+	t.Setenv("TEST_WS_KEY", keyPath)
+	if _, _, err = LoadKeyPairFromEnv("TEST_WS_CERT", "TEST_WS_KEY"); err != nil {
+		t.Error("pair from env: ", err)
+	}
+	if _, _, err = LoadKeyPairFromEnv("TEST_WS_CERT", "TEST_WS_UNSET"); err == nil {
+		t.Error("expected error for unset variable")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := &Backoff{
+		Initial:    100 * time.Millisecond,
+		Max:        time.Second,
+		Multiplier: 2,
+	}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for _, ms := range expected {
+		if next := backoff.Next(); next != ms*time.Millisecond {
+			t.Errorf("expected %v, got %v", ms*time.Millisecond, next)
+		}
+	}
+	backoff.Reset()
+	if next := backoff.Next(); next != 100*time.Millisecond {
+		t.Error("reset not applied: ", next)
+	}
+
+	jittered := &Backoff{Initial: time.Second, Max: time.Minute,
+		Multiplier: 1, Jitter: 0.25}
+	var below, above int
+	for i := 0; i < 1000; i++ {
+		next := jittered.Next()
+		if next < 750*time.Millisecond || next > 1250*time.Millisecond {
+			t.Fatal("jitter out of bounds: ", next)
+		}
+		if next < time.Second {
+			below++
+		} else {
+			above++
+		}
+	}
+	if below < 300 || above < 300 {
+		t.Errorf("jitter not spread: %d below, %d above", below, above)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (&Backoff{Initial: time.Hour}).Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Error("wait not cancelled: ", err)
+	}
+}
+
+func TestSplitUnixURL(t *testing.T) {
+	tests := []struct {
+		in     string
+		socket string
+		target string
+	}{
+		{"unix:///run/app.sock:/ws?x=1", "/run/app.sock", "ws://localhost/ws?x=1"},
+		{"ws+unix:///tmp/a.sock", "/tmp/a.sock", "ws://localhost/"},
+		{"wss+unix:///tmp/a.sock:/", "/tmp/a.sock", "wss://localhost/"},
+	}
+
+	for _, test := range tests {
+		u, err := ParseWsURL(test.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		socket, target, ok := SplitUnixURL(u)
+		if !ok || socket != test.socket || target.String() != test.target {
+			t.Errorf("%q: got %q %q %v", test.in, socket, target.String(), ok)
+		}
+	}
+
+	u, _ := ParseWsURL("ws://localhost/ws")
+	if _, _, ok := SplitUnixURL(u); ok {
+		t.Error("split a tcp url")
+	}
+}
@@ -0,0 +1,126 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrKeyMismatch = errors.New("key does not match certificate")
+
+// LoadKeyPair reads a PEM encoded certificate (chain) and private key from
+// disk and validates that they belong together.
+func LoadKeyPair(certPath, keyPath string) (certPEM, keyPEM []byte, err error) {
+	certPEM, err = os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read certificate: %w", err)
+	}
+	keyPEM, err = os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read private key: %w", err)
+	}
+
+	if err = ValidateKeyPair(certPEM, keyPEM); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// LoadKeyPairFromEnv reads certificate and key from environment variables.
+// A variable either holds the PEM content itself or a path to a PEM file.
+func LoadKeyPairFromEnv(certVar, keyVar string) (certPEM, keyPEM []byte, err error) {
+	certPEM, err = pemFromEnv(certVar)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = pemFromEnv(keyVar)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = ValidateKeyPair(certPEM, keyPEM); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func pemFromEnv(name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || strings.TrimSpace(value) == "" {
+		return nil, fmt.Errorf("environment variable %s not set", name)
+	}
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+
+	content, err := os.ReadFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return content, nil
+}
+
+// ValidateKeyPair checks the PEM structure of certificate and key and that
+// the key matches the certificate.
+func ValidateKeyPair(certPEM, keyPEM []byte) error {
+	certBlock, _ := pem.Decode(certPEM)
+	switch {
+	case certBlock == nil:
+		return errors.New("no PEM data found in certificate")
+	case strings.Contains(certBlock.Type, "PRIVATE KEY"):
+		return errors.New("file contains a private key, expected a certificate")
+	case certBlock.Type != "CERTIFICATE":
+		return fmt.Errorf("file contains %q, expected a certificate", certBlock.Type)
+	}
+	if _, err := x509.ParseCertificate(certBlock.Bytes); err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	switch {
+	case keyBlock == nil:
+		return errors.New("no PEM data found in private key")
+	case keyBlock.Type == "CERTIFICATE":
+		return errors.New("file contains a certificate, expected a private key")
+	case !strings.Contains(keyBlock.Type, "PRIVATE KEY"):
+		return fmt.Errorf("file contains %q, expected a private key", keyBlock.Type)
+	}
+
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		if strings.Contains(err.Error(), "does not match") {
+			return ErrKeyMismatch
+		}
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package utils
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+type originPattern struct {
+	scheme    string
+	host      string
+	port      string
+	subdomain bool // "*.example.com": only subdomains
+	domain    bool // ".example.com": the domain and its subdomains
+}
+
+// OriginMatcher matches Origin header values against a list of patterns:
+//
+//	"*"                      any origin
+//	"null"                   the opaque "null" origin
+//	"https://example.com"    exact origin (default port applies)
+//	"https://*.example.com"  any subdomain of example.com
+//	".example.com"           example.com and its subdomains
+//
+// Patterns without scheme match any scheme and port.
+type OriginMatcher struct {
+	any      bool
+	null     bool
+	patterns []originPattern
+}
+
+func NewOriginMatcher(patterns ...string) *OriginMatcher {
+	matcher := &OriginMatcher{}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		switch pattern {
+		case "":
+			continue
+		case "*":
+			matcher.any = true
+			continue
+		case "null":
+			matcher.null = true
+			continue
+		}
+
+		p := originPattern{}
+		if idx := strings.Index(pattern, "://"); idx >= 0 {
+			p.scheme = pattern[:idx]
+			pattern = pattern[idx+3:]
+		}
+		pattern = strings.TrimRight(pattern, "/")
+
+		// ipv6 hosts are matched without brackets, like url.Hostname
+		host, port, err := net.SplitHostPort(pattern)
+		if err == nil {
+			p.port = port
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")
+		}
+		if p.scheme != "" && p.port == "" {
+			p.port = defaultPorts[p.scheme]
+		}
+
+		switch {
+		case strings.HasPrefix(host, "*."):
+			p.subdomain = true
+			host = host[2:]
+		case strings.HasPrefix(host, "."):
+			p.domain = true
+			host = host[1:]
+		}
+		p.host = host
+
+		matcher.patterns = append(matcher.patterns, p)
+	}
+
+	return matcher
+}
+
+func (p originPattern) matchHost(host string) bool {
+	switch {
+	case p.subdomain:
+		return strings.HasSuffix(host, "."+p.host)
+	case p.domain:
+		return host == p.host || strings.HasSuffix(host, "."+p.host)
+	default:
+		return host == p.host
+	}
+}
+
+func (m *OriginMatcher) Allow(origin string) bool {
+	if m.any {
+		return true
+	}
+
+	origin = strings.ToLower(strings.TrimSpace(origin))
+	if origin == "null" {
+		return m.null
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Hostname() == "" ||
+		u.User != nil || (u.Path != "" && u.Path != "/") {
+		return false
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+	host := u.Hostname()
+
+	for _, p := range m.patterns {
+		if p.scheme != "" && (p.scheme != u.Scheme || p.port != port) {
+			continue
+		}
+		if p.matchHost(host) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,250 @@
+//go:build autobahn
+
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// The Autobahn TestSuite checks the server and the client against RFC 6455
+// in docker (host network, ports 9001 and 9002):
+//
+//	go test -tags autobahn -run Autobahn -v ./websocket
+//
+// Cases worse than NON-STRICT fail the test, the reports are kept in
+// -autobahn.reports.
+
+package websocket
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	autobahnImage   = flag.String("autobahn.image", "crossbario/autobahn-testsuite", "docker image of the Autobahn TestSuite")
+	autobahnCases   = flag.String("autobahn.cases", "*", "comma separated cases to run")
+	autobahnExclude = flag.String("autobahn.exclude", "12.*,13.*", "comma separated cases to skip, compression is not supported")
+	autobahnReports = flag.String("autobahn.reports", "", "directory for the reports, a temporary one if empty")
+)
+
+const autobahnAgent = "go-easy-websockets"
+
+// autobahnResult is a case in the index.json of a report.
+type autobahnResult struct {
+	Behavior      string `json:"behavior"`
+	BehaviorClose string `json:"behaviorClose"`
+}
+
+var autobahnPassing = map[string]bool{"OK": true, "NON-STRICT": true, "INFORMATIONAL": true}
+
+// autobahnEvents ignores the events, the fuzzer reports the results.
+type autobahnEvents struct{}
+
+func (autobahnEvents) OnConnect(id int)                 {}
+func (autobahnEvents) OnDisconnect(id int)              {}
+func (autobahnEvents) OnFailure(exited bool, err error) {}
+
+type echoServer struct {
+	autobahnEvents
+	server *Server
+}
+
+func (e *echoServer) OnReceive(msg Message) {
+	_ = e.server.Send(msg.ClientId, &msg)
+}
+
+type echoClient struct {
+	autobahnEvents
+	client   *Client
+	received chan Message
+}
+
+func (e *echoClient) OnReceive(msg Message) {
+	if e.received != nil {
+		e.received <- msg
+		return
+	}
+	_ = e.client.Send(msg)
+}
+
+func autobahnDirs(t *testing.T, mode string, config map[string]any) (configDir, reportDir string) {
+	t.Helper()
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not found")
+	}
+	reportDir = *autobahnReports
+	if reportDir == "" {
+		var err error
+		if reportDir, err = os.MkdirTemp("", "autobahn"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reportDir, err := filepath.Abs(reportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDir = filepath.Join(reportDir, "config")
+	if err = os.MkdirAll(configDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	config["cases"] = strings.Split(*autobahnCases, ",")
+	config["exclude-cases"] = []string{}
+	if *autobahnExclude != "" {
+		config["exclude-cases"] = strings.Split(*autobahnExclude, ",")
+	}
+	config["exclude-agent-cases"] = map[string]any{}
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(configDir, mode+".json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return configDir, reportDir
+}
+
+func autobahnDocker(configDir, reportDir string, args ...string) *exec.Cmd {
+	args = append([]string{"run", "--rm", "--network", "host",
+		"-v", configDir + ":/config", "-v", reportDir + ":/reports", *autobahnImage}, args...)
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// checkAutobahnReport fails t for each case worse than NON-STRICT.
+func checkAutobahnReport(t *testing.T, index string) {
+	t.Helper()
+
+	data, err := os.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report map[string]map[string]autobahnResult
+	if err = json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	results := report[autobahnAgent]
+	if len(results) == 0 {
+		t.Fatalf("no results for %s in %s", autobahnAgent, index)
+	}
+
+	cases := make([]string, 0, len(results))
+	for name := range results {
+		cases = append(cases, name)
+	}
+	sort.Strings(cases)
+	for _, name := range cases {
+		result := results[name]
+		if !autobahnPassing[result.Behavior] || !autobahnPassing[result.BehaviorClose] {
+			t.Errorf("case %s: %s, close %s", name, result.Behavior, result.BehaviorClose)
+		}
+	}
+	t.Logf("%d cases, report in %s", len(cases), filepath.Dir(index))
+}
+
+func TestAutobahnServer(t *testing.T) {
+	configDir, reportDir := autobahnDirs(t, "fuzzingclient", map[string]any{
+		"outdir":  "/reports/servers",
+		"servers": []map[string]string{{"agent": autobahnAgent, "url": "ws://127.0.0.1:9001/"}},
+	})
+
+	events := &echoServer{}
+	server := NewServer("ws://127.0.0.1:9001/", events)
+	events.server = server
+	go func() { _ = server.ListenAndServe() }()
+	defer server.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	if err := autobahnDocker(configDir, reportDir,
+		"wstest", "-m", "fuzzingclient", "-s", "/config/fuzzingclient.json").Run(); err != nil {
+		t.Fatal(err)
+	}
+	checkAutobahnReport(t, filepath.Join(reportDir, "servers", "index.json"))
+}
+
+func TestAutobahnClient(t *testing.T) {
+	const url = "ws://127.0.0.1:9002"
+
+	configDir, reportDir := autobahnDirs(t, "fuzzingserver", map[string]any{
+		"url":    url,
+		"outdir": "/reports/clients",
+	})
+
+	fuzzer := autobahnDocker(configDir, reportDir,
+		"wstest", "-m", "fuzzingserver", "-s", "/config/fuzzingserver.json")
+	if err := fuzzer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = fuzzer.Process.Signal(os.Interrupt)
+		_ = fuzzer.Wait()
+	}()
+	for start := time.Now(); ; time.Sleep(500 * time.Millisecond) {
+		conn, err := net.Dial("tcp", "127.0.0.1:9002")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Since(start) > time.Minute {
+			t.Fatalf("fuzzing server not up: %v", err)
+		}
+	}
+
+	counter := &echoClient{received: make(chan Message, 1)}
+	if err := NewClient(false, counter).ConnectAndServe(url+"/getCaseCount", nil); err != nil &&
+		KindOf(err) != KindNormalClosure {
+		t.Log(err)
+	}
+	var count int
+	select {
+	case msg := <-counter.received:
+		var err error
+		if count, err = strconv.Atoi(string(msg.Data)); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("no case count")
+	}
+
+	for i := 1; i <= count; i++ {
+		events := &echoClient{}
+		events.client = NewClient(false, events)
+		_ = events.client.ConnectAndServe(fmt.Sprintf("%s/runCase?case=%d&agent=%s", url, i, autobahnAgent), nil)
+	}
+	_ = NewClient(false, &echoClient{}).ConnectAndServe(url+"/updateReports?agent="+autobahnAgent, nil)
+
+	checkAutobahnReport(t, filepath.Join(reportDir, "clients", "index.json"))
+}
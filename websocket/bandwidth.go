@@ -0,0 +1,224 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ThrottleQueueSize is the number of writes queued for a bandwidth limited
+// client. Broadcasts to a client with a full queue fail.
+const ThrottleQueueSize = 256
+
+var ErrThrottleQueueFull = errors.New("throttled write queue full")
+
+// bandwidth is a token bucket over bytes with a burst of one second. A
+// message larger than the available tokens passes after the debt is paid
+// off, so no message size is refused.
+type bandwidth struct {
+	lock      sync.Mutex
+	rate      float64
+	tokens    float64
+	last      time.Time
+	throttled time.Duration
+}
+
+func newBandwidth(bytesPerSecond int) *bandwidth {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidth{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+func (b *bandwidth) refillLocked(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// reserve takes n bytes and returns how long to wait until they may pass.
+func (b *bandwidth) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refillLocked(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.throttled += wait
+	return wait
+}
+
+// wait blocks until n bytes may pass and returns the time waited.
+func (b *bandwidth) wait(ctx context.Context, n int) (time.Duration, error) {
+	wait := b.reserve(n)
+	if wait <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-ctx.Done():
+		return wait, ctx.Err()
+	}
+}
+
+func (b *bandwidth) limit() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.rate)
+}
+
+// utilization is the share of the limit used over about the last second,
+// 1 while throttling.
+func (b *bandwidth) utilization() float64 {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refillLocked(time.Now())
+	used := 1 - b.tokens/b.rate
+	if used < 0 {
+		return 0
+	}
+	if used > 1 {
+		return 1
+	}
+	return used
+}
+
+func (b *bandwidth) throttledFor() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.throttled
+}
+
+type queuedWrite struct {
+	message *Message
+	// result of Send, nil for broadcasts
+	result chan error
+}
+
+// enqueue queues a broadcast without blocking.
+func (c *serverClient) enqueue(message *Message) error {
+	select {
+	case c.queue <- queuedWrite{message: message}:
+		return nil
+	case <-c.done:
+		return ErrNoClient
+	default:
+		return ErrThrottleQueueFull
+	}
+}
+
+// sendThrottled queues the message and waits until it is written.
+func (c *serverClient) sendThrottled(message *Message) error {
+	write := queuedWrite{message: message, result: make(chan error, 1)}
+	select {
+	case c.queue <- write:
+	case <-c.done:
+		return ErrNoClient
+	}
+	select {
+	case err := <-write.result:
+		return err
+	case <-c.done:
+		return ErrNoClient
+	}
+}
+
+// runThrottled writes the queue of a bandwidth limited client at its rate
+// until ctx is done.
+func (c *serverClient) runThrottled(ctx context.Context, clientId int) {
+	hub := c.server.hub
+	for {
+		var write queuedWrite
+		select {
+		case <-ctx.Done():
+			return
+		case write = <-c.queue:
+		}
+
+		waited, err := c.writeBandwidth.wait(ctx, len(write.message.Data))
+		if err != nil {
+			return
+		}
+		if err = c.writeAfter(write.message, waited); err != nil {
+			if !errors.Is(err, ErrNoClient) {
+				hub.drop(clientId, c)
+			}
+			err = classifyError(err, dirWrite, nil)
+		} else {
+			hub.stats.sent(len(write.message.Data))
+		}
+
+		if write.result != nil {
+			write.result <- err
+		} else if err != nil && !errors.Is(err, ErrNoClient) {
+			hub.broadcastErrors.Add(1)
+			c.server.eventHandler.OnFailure(false,
+				&ClientError{ClientId: clientId, Err: fmt.Errorf("send: %w", err)})
+		}
+	}
+}
+
+// writeAfter writes a message which waited for the bandwidth limit. The
+// write deadline is moved by the time waited, throttling is no stall of
+// the peer.
+func (c *serverClient) writeAfter(message *Message, waited time.Duration) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if waited > 0 && !c.writeDeadline.IsZero() {
+		c.writeDeadline = c.writeDeadline.Add(waited)
+		if err := c.conn.SetWriteDeadline(c.writeDeadline); err != nil {
+			return err
+		}
+	}
+	return c.writeLocked(message)
+}
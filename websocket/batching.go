@@ -0,0 +1,125 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// BatchingEvents accumulates received messages and delivers them as slices,
+// either when maxBatch messages are pending or maxDelay has elapsed since
+// the first pending message.
+type BatchingEvents struct {
+	lock           sync.Mutex
+	messageChannel chan<- []Message
+	eventChannel   chan<- Event
+	maxBatch       int
+	maxDelay       time.Duration
+	pending        []Message
+	timer          *time.Timer
+}
+
+func NewBatchingEvents(messageChannel chan<- []Message, maxBatch int,
+	maxDelay time.Duration) *BatchingEvents {
+
+	if maxBatch < 1 {
+		maxBatch = 1
+	}
+	return &BatchingEvents{
+		lock:           sync.Mutex{},
+		messageChannel: messageChannel,
+		maxBatch:       maxBatch,
+		maxDelay:       maxDelay,
+		pending:        make([]Message, 0, maxBatch),
+	}
+}
+
+// SetEventChannel forwards connect, disconnect and failure events. Pending
+// messages are always flushed before an event is delivered.
+func (b *BatchingEvents) SetEventChannel(eventChannel chan<- Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.eventChannel = eventChannel
+}
+
+func (b *BatchingEvents) Flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.flush()
+}
+
+func (b *BatchingEvents) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	if b.messageChannel != nil {
+		b.messageChannel <- b.pending
+	} else {
+		logError("Batch2Channel", "message channel is nil")
+	}
+	b.pending = make([]Message, 0, b.maxBatch)
+}
+
+func (b *BatchingEvents) deliverEvent(evnt Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.flush()
+	if b.eventChannel != nil {
+		b.eventChannel <- evnt
+	}
+}
+
+func (b *BatchingEvents) OnReceive(msg Message) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.pending = append(b.pending, msg)
+	if len(b.pending) >= b.maxBatch {
+		b.flush()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.maxDelay, b.Flush)
+	}
+}
+
+func (b *BatchingEvents) OnDisconnect(id int) {
+	b.deliverEvent(Event{Type: Disconnect, Id: id})
+}
+
+func (b *BatchingEvents) OnConnect(id int) {
+	b.deliverEvent(Event{Type: Connect, Id: id})
+}
+
+func (b *BatchingEvents) OnFailure(exited bool, err error) {
+	b.deliverEvent(failureEvent(exited, err))
+}
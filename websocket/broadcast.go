@@ -0,0 +1,79 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// BroadcastBackend relays broadcasts between server instances, e.g. behind
+// a load balancer. Subscribers must also receive the messages published by
+// their own instance, the server drops them by Message.Origin.
+type BroadcastBackend interface {
+	Publish(channel string, msg Message) error
+	Subscribe(channel string, fn func(Message)) error
+}
+
+// MemoryBackend is a BroadcastBackend within one process, e.g. for tests.
+// Publish calls the subscribers synchronously.
+type MemoryBackend struct {
+	lock        sync.RWMutex
+	subscribers map[string][]func(Message)
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{subscribers: make(map[string][]func(Message))}
+}
+
+func (m *MemoryBackend) Publish(channel string, msg Message) error {
+	m.lock.RLock()
+	subscribers := m.subscribers[channel]
+	m.lock.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(msg)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Subscribe(channel string, fn func(Message)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// copy on write, Publish iterates without lock
+	subscribers := make([]func(Message), 0, len(m.subscribers[channel])+1)
+	subscribers = append(subscribers, m.subscribers[channel]...)
+	m.subscribers[channel] = append(subscribers, fn)
+	return nil
+}
+
+func newInstanceId() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
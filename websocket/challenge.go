@@ -0,0 +1,202 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseChallengeFailed is the close code sent to a client failing the
+// challenge authentication.
+const CloseChallengeFailed = 4401
+
+// DefaultChallengeTimeout is the time a client has for its response, and
+// the time it waits for the challenge and the verdict.
+const DefaultChallengeTimeout = 10 * time.Second
+
+const challengeNonceSize = 32
+
+// ChallengeError is a failed challenge authentication. It is reported
+// with KindAuthRejected, so errors.Is matches ErrAuthRejected.
+type ChallengeError struct {
+	KeyId  string
+	Reason string
+}
+
+func (e *ChallengeError) Error() string {
+	if e.KeyId == "" {
+		return "challenge authentication failed: " + e.Reason
+	}
+	return fmt.Sprintf("challenge authentication of key %q failed: %s", e.KeyId, e.Reason)
+}
+
+func challengeFailed(keyId string, reason string) error {
+	return &ClassifiedError{
+		Kind: KindAuthRejected,
+		Err:  &ChallengeError{KeyId: keyId, Reason: reason},
+	}
+}
+
+// challengeMessage is exchanged as json text message right after the
+// upgrade, unaffected by payload compression and text-only framing: the
+// server sends the challenge, the client its key id and response, and
+// the server the verdict.
+type challengeMessage struct {
+	Challenge     []byte `json:"challenge,omitempty"`
+	KeyId         string `json:"key_id,omitempty"`
+	Response      []byte `json:"response,omitempty"`
+	Authenticated bool   `json:"authenticated,omitempty"`
+}
+
+// challengeResponse proves the possession of secret, HMAC-SHA256 of the
+// nonce.
+func challengeResponse(secret []byte, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func writeChallenge(conn *websocket.Conn, msg challengeMessage, deadline time.Time) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(deadline)
+	defer conn.SetWriteDeadline(time.Time{})
+
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func readChallenge(conn *websocket.Conn, msg *challengeMessage, deadline time.Time) error {
+	_ = conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if messageType != websocket.TextMessage {
+		return errors.New("unexpected binary message")
+	}
+	return json.Unmarshal(data, msg)
+}
+
+type challengeAuth struct {
+	lookup  func(keyId string) ([]byte, bool)
+	timeout time.Duration
+}
+
+// admit challenges a client, an error of a failed authentication is a
+// ChallengeError.
+func (a *challengeAuth) admit(conn *websocket.Conn) error {
+	deadline := time.Now().Add(a.timeout)
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := writeChallenge(conn, challengeMessage{Challenge: nonce}, deadline); err != nil {
+		return classifyError(err, dirWrite, nil)
+	}
+
+	var answer challengeMessage
+	if err := readChallenge(conn, &answer, deadline); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return challengeFailed("", "no response in time")
+		}
+		return challengeFailed("", err.Error())
+	}
+	secret, ok := a.lookup(answer.KeyId)
+	if !ok {
+		return challengeFailed(answer.KeyId, "unknown key")
+	}
+	if !hmac.Equal(answer.Response, challengeResponse(secret, nonce)) {
+		return challengeFailed(answer.KeyId, "wrong response")
+	}
+
+	err := writeChallenge(conn, challengeMessage{Authenticated: true}, deadline)
+	return classifyError(err, dirWrite, nil)
+}
+
+// rejectChallenge closes the connection of a client failing the
+// challenge with CloseChallengeFailed.
+func rejectChallenge(client *serverClient, err error) {
+	reason := "authentication failed"
+	var challengeErr *ChallengeError
+	if errors.As(err, &challengeErr) {
+		reason = challengeErr.Reason
+	}
+	_ = client.closeWith(CloseChallengeFailed, reason)
+}
+
+type challengeCredentials struct {
+	keyId  string
+	secret []byte
+}
+
+// answer authenticates the client at the server, a rejection is a
+// ChallengeError.
+func (c *challengeCredentials) answer(conn *websocket.Conn) error {
+	deadline := time.Now().Add(DefaultChallengeTimeout)
+	var msg challengeMessage
+	if err := readChallenge(conn, &msg, deadline); err != nil {
+		return c.readFailed(err)
+	}
+	if len(msg.Challenge) == 0 {
+		return challengeFailed(c.keyId, "no challenge received")
+	}
+
+	answer := challengeMessage{KeyId: c.keyId, Response: challengeResponse(c.secret, msg.Challenge)}
+	if err := writeChallenge(conn, answer, deadline); err != nil {
+		return classifyError(err, dirWrite, nil)
+	}
+
+	msg = challengeMessage{}
+	if err := readChallenge(conn, &msg, time.Now().Add(DefaultChallengeTimeout)); err != nil {
+		return c.readFailed(err)
+	}
+	if !msg.Authenticated {
+		return challengeFailed(c.keyId, "not authenticated")
+	}
+	return nil
+}
+
+func (c *challengeCredentials) readFailed(err error) error {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) && closeErr.Code == CloseChallengeFailed {
+		return challengeFailed(c.keyId, closeErr.Text)
+	}
+	return classifyError(err, dirRead, nil)
+}
@@ -26,38 +26,100 @@
 package websocket
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ChrIgiSta/go-easy-websockets/utils"
 	ccrypt "github.com/ChrIgiSta/go-utils/crypto"
-	log "github.com/ChrIgiSta/go-utils/logger"
 	"github.com/gorilla/websocket"
 )
 
 const LogRegioWsClient = "websocket client"
 
+// maxHandshakeErrorBody caps how much of a rejected handshake's response
+// body is read for the log.
+const maxHandshakeErrorBody = 1024
+
+// ErrAlreadyConnected is returned by ConnectAndServe while another call
+// serves the client.
+var ErrAlreadyConnected = errors.New("client already connected")
+
+// NetDialFunc opens the connection to addr, e.g. an in-memory one for
+// tests.
+type NetDialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type ReconnectHook func(attempt int, delay time.Duration, lastErr error)
+
+// ReconnectedHook runs after the handshake of a reconnect. See
+// Client.SetOnReconnected.
+type ReconnectedHook func(attempt int) error
+
+// TLSHook receives the peer's certificates during the handshake together
+// with the result of verifying them, also if verification is skipped.
+type TLSHook func(state tls.ConnectionState, verifyErr error)
+
 type Client struct {
-	conn         *websocket.Conn
-	eventHandler Events
-	wg           sync.WaitGroup
-	tlsConfig    tls.Config
-	rootCAs      *x509.CertPool
-	checker      *ccrypt.CertChecker
+	conn           *websocket.Conn
+	eventHandler   Events
+	tlsConfig      tls.Config
+	rootCAs        *x509.CertPool
+	noCommonName   bool
+	lock           sync.Mutex
+	writeLock      sync.Mutex
+	stop           chan struct{}
+	serving        chan struct{} // closed when ConnectAndServe returns
+	reconnect      *utils.Backoff
+	reconnectMax   int
+	onReconnecting ReconnectHook
+	onReconnected  ReconnectedHook
+	// the reconnected hook running, nil if none
+	hook         *hookRun
+	keepalive    keepaliveConfig
+	heartbeat    *textHeartbeat
+	onTLS        TLSHook
+	tlsState     *tls.ConnectionState
+	subprotocols []string
+	subprotocol  string
+	stats        statsCounter
+	readLimit    int64
+	netDial      NetDialFunc
+	resolve      ResolverFunc
+	compression  *payloadCompression
+	// negotiated compression of the current connection, nil if off
+	payload     *payloadCompression
+	textFraming bool
+	// negotiated text-only framing of the current connection
+	textFramed bool
+	challenge  *challengeCredentials
+	token      *expiringTokenAuth
+	// start of the next dial in the resolved addresses
+	dialRotation atomic.Uint32
 }
 
 func NewClient(skipCertValidation bool, eventHandler Events) *Client {
 	return &Client{
 		eventHandler: eventHandler,
-		wg:           sync.WaitGroup{},
 		tlsConfig:    tls.Config{InsecureSkipVerify: skipCertValidation},
 	}
 }
 
+// AddRootCa trusts the pem certificate for verifying the server, in
+// addition to DisableCommonNameCheck.
 func (c *Client) AddRootCa(rootCA []byte) {
 	block, _ := pem.Decode(rootCA)
 	if block == nil {
@@ -65,66 +127,690 @@ func (c *Client) AddRootCa(rootCA []byte) {
 	}
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		_ = log.Warn(LogRegioWsClient, "error adding ca: %v", err)
+		logWarn(LogRegioWsClient, "error adding ca: %v", err)
 		return
 	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	if c.rootCAs == nil {
 		c.rootCAs = x509.NewCertPool()
 	}
 	c.rootCAs.AddCert(cert)
+	c.tlsConfig.RootCAs = c.rootCAs
+}
+
+// AddRootCaFile trusts all certificates of a pem file for verifying the
+// server. A file without any certificate is an error.
+func (c *Client) AddRootCaFile(path string) error {
+	rootCAs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.rootCAs == nil {
+		c.rootCAs = x509.NewCertPool()
+	}
+	if !c.rootCAs.AppendCertsFromPEM(rootCAs) {
+		return fmt.Errorf("no certificate found in %s", path)
+	}
+	c.tlsConfig.RootCAs = c.rootCAs
+
+	return nil
+}
+
+// SetClientCertificate presents the key pair to servers requiring mutual
+// tls.
+func (c *Client) SetClientCertificate(certificate []byte,
+	privateKey []byte) error {
+
+	if err := utils.ValidateKeyPair(certificate, privateKey); err != nil {
+		return err
+	}
+	clientCert, err := tls.X509KeyPair(certificate, privateKey)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.tlsConfig.Certificates = []tls.Certificate{clientCert}
+	return nil
 }
 
+// DisableCommonNameCheck verifies the server's certificate against the root
+// cas without checking its name. The cas are taken when dialing, so they may
+// also be added afterwards.
 func (c *Client) DisableCommonNameCheck() {
-	c.checker = ccrypt.NewCustomCertChecker(c.rootCAs)
-	c.tlsConfig.VerifyPeerCertificate = c.checker.X509CeckCertNoSAN
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.noCommonName = true
+}
+
+// SetReconnect makes ConnectAndServe reconnect with the given backoff after
+// the connection is lost or could not be established. maxAttempts limits
+// the consecutive failed attempts, 0 retries forever. A nil backoff disables
+// reconnecting.
+func (c *Client) SetReconnect(backoff *utils.Backoff, maxAttempts int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.reconnect = backoff
+	c.reconnectMax = maxAttempts
+}
+
+// SetOnReconnecting registers a hook called before waiting for the next
+// reconnect attempt.
+func (c *Client) SetOnReconnecting(hook ReconnectHook) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.onReconnecting = hook
+}
+
+// SetOnReconnected registers a hook run after the handshake of each
+// reconnect, not the initial connect, e.g. to send subscriptions again.
+// attempt counts the attempts since the connection was lost. It runs
+// before OnConnect and before any message is received. Its messages go
+// out first: Send in the hook writes to the new connection, Send of any
+// other goroutine waits until the hook returned. Disconnect is not legal
+// in it. An error closes the connection and continues with the next
+// reconnect attempt.
+func (c *Client) SetOnReconnected(hook ReconnectedHook) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.onReconnected = hook
+}
+
+// SetKeepalive sends a ping every interval. A connection without pong
+// within timeout is considered dead and closed. An interval of 0 disables it.
+func (c *Client) SetKeepalive(interval time.Duration, timeout time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.keepalive.interval = interval
+	c.keepalive.timeout = timeout
+}
+
+// EnableTextHeartbeat sends the ping text every interval and expects the
+// server to answer with the pong text, which does not reach OnReceive. A
+// connection without pong within timeout is considered dead and closed.
+func (c *Client) EnableTextHeartbeat(ping string, pong string, interval time.Duration,
+	timeout time.Duration) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.heartbeat = nil
+	if interval > 0 {
+		c.heartbeat = &textHeartbeat{ping: ping, pong: pong, interval: interval,
+			timeout: timeout}
+	}
+}
+
+// SetOnPong registers a hook receiving the round trip time of each pong.
+func (c *Client) SetOnPong(hook PongHook) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.keepalive.onPong = hook
+}
+
+// OnPong returns the registered pong hook, e.g. to chain it.
+func (c *Client) OnPong() PongHook {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.keepalive.onPong
+}
+
+// EventHandler returns the handler receiving messages and events.
+func (c *Client) EventHandler() Events {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.eventHandler
+}
+
+// SetEventHandler replaces the event handler, e.g. to wrap the current one
+// in a protocol layer. It takes effect immediately, also for a running
+// connection.
+func (c *Client) SetEventHandler(handler Events) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.eventHandler = handler
+}
+
+// SetReadLimit sets the maximum size in bytes of a received message. A
+// larger message closes the connection with KindMessageTooBig. 0 disables
+// the limit.
+func (c *Client) SetReadLimit(limit int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readLimit = limit
+}
+
+// SetSubprotocols sets the subprotocols offered in the handshake, in order
+// of preference.
+func (c *Client) SetSubprotocols(protocols ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.subprotocols = protocols
+}
+
+// SetPayloadCompression gzips outgoing messages of at least minSize bytes
+// with the given level and decompresses received ones, if the server
+// enables it too. Already compressed payloads are sent as they are.
+func (c *Client) SetPayloadCompression(minSize int, level int) error {
+	compression, err := newPayloadCompression(minSize, level)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.compression = compression
+	return nil
+}
+
+// SetChallengeAuth answers the challenge of a server requiring it, see
+// Server.RequireChallengeAuth, with the HMAC of secret. OnConnect follows
+// a successful authentication only, a rejection ends ConnectAndServe with
+// a ChallengeError.
+func (c *Client) SetChallengeAuth(keyId string, secret []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.challenge = &challengeCredentials{keyId: keyId, secret: secret}
+}
+
+// SetExpiringToken sends a fresh token of ExpiringToken signed with secret
+// in the header headerName on each dial, reconnects included, see
+// Server.SetExpiringTokenAuth. An empty headerName disables it.
+func (c *Client) SetExpiringToken(headerName string, secret []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.token = nil
+	if headerName != "" {
+		c.token = &expiringTokenAuth{header: headerName, secret: secret}
+	}
+}
+
+// EnableTextOnlyFraming sends binary messages base64 encoded in text
+// frames, if the server enables it too, for intermediaries passing text
+// frames only. Received ones are decoded, other text passes as is. See
+// TextFramingHeader for the overhead.
+func (c *Client) EnableTextOnlyFraming() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.textFraming = true
+}
+
+// SetNetDial replaces the dialing of the tcp connection, nil restores the
+// default. TLS is still set up on top of it for wss urls.
+func (c *Client) SetNetDial(dial NetDialFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.netDial = dial
+}
+
+// Subprotocol returns the protocol selected by the server for the current
+// connection, empty if none.
+func (c *Client) Subprotocol() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.subprotocol
+}
+
+// SetOnTLSHandshake registers a hook called on every tls handshake.
+func (c *Client) SetOnTLSHandshake(hook TLSHook) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.onTLS = hook
+}
+
+// TLSConnectionState returns the tls state of the current connection. ok
+// is false if not connected or not using tls.
+func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.tlsState == nil {
+		return state, false
+	}
+	return *c.tlsState, true
+}
+
+// dialTLSConfig returns the tls config for a dial to host. With a TLSHook
+// set the verification is done in VerifyConnection, so the hook also sees
+// chains which fail verification.
+func (c *Client) dialTLSConfig(host string) *tls.Config {
+	c.lock.Lock()
+	hook := c.onTLS
+	config := c.tlsConfig.Clone()
+	if c.rootCAs != nil {
+		// AddRootCa may add to the pool while dialing
+		config.RootCAs = c.rootCAs.Clone()
+	}
+	if c.noCommonName {
+		checker := ccrypt.NewCustomCertChecker(config.RootCAs)
+		config.VerifyPeerCertificate = checker.X509CeckCertNoSAN
+	}
+	c.lock.Unlock()
+
+	if hook == nil {
+		return config
+	}
+
+	skipVerify := config.InsecureSkipVerify
+	verifyPeer := config.VerifyPeerCertificate
+	roots := config.RootCAs
+	serverName := config.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = nil
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		verifyErr := verifyChain(state, serverName, roots, verifyPeer)
+		hook(state, verifyErr)
+		if skipVerify {
+			return nil
+		}
+		return verifyErr
+	}
+
+	return config
 }
 
+func verifyChain(state tls.ConnectionState, serverName string,
+	roots *x509.CertPool,
+	verifyPeer func([][]byte, [][]*x509.Certificate) error) error {
+
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+
+	if verifyPeer != nil {
+		rawCerts := make([][]byte, 0, len(state.PeerCertificates))
+		for _, cert := range state.PeerCertificates {
+			rawCerts = append(rawCerts, cert.Raw)
+		}
+		return verifyPeer(rawCerts, nil)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// ConnectAndServe connects to url and reads until the connection ends. A
+// normal closure by the server is no failure and returns nil.
 func (c *Client) ConnectAndServe(url string,
 	header map[string]string) (err error) {
 
-	c.wg.Add(1)
-	defer c.wg.Done()
+	return c.ConnectAndServeWithHeader(url, utils.MapToHeader(header))
+}
+
+// ConnectAndServeWithHeader works like ConnectAndServe but passes the
+// handshake header untouched, allowing multiple values per key.
+func (c *Client) ConnectAndServeWithHeader(url string,
+	header http.Header) (err error) {
+
+	u, schemeInferred, err := utils.ParseWsAddress(url)
+	if err != nil {
+		return err
+	}
+	if schemeInferred {
+		logWarn(LogRegioWsClient, "no scheme in %q, connecting unencrypted", url)
+	}
+
+	return c.ConnectAndServeURL(u, header)
+}
 
-	defer func() { _ = log.Debug(LogRegioWsServer, "serve exited") }()
+// ConnectAndServeURL works like ConnectAndServeWithHeader but takes an
+// already built url, e.g. from utils.BuildURL.
+func (c *Client) ConnectAndServeURL(target url.URL,
+	header http.Header) (err error) {
 
-	u, err := utils.StringToUrl(url)
+	u, err := utils.ParseWsURL(target.String())
 	if err != nil {
 		return err
 	}
 
-	_ = log.Debug(LogRegioWsClient, "connecting to %s", u.String())
+	stop := make(chan struct{})
+	served := make(chan struct{})
+	c.lock.Lock()
+	if c.serving != nil {
+		c.lock.Unlock()
+		return ErrAlreadyConnected
+	}
+	c.serving = served
+	c.stop = stop
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		c.serving = nil
+		c.lock.Unlock()
+		close(served)
+		logDebug(LogRegioWsClient, "serve exited")
+	}()
+
+	attempt := 0
+	reconnect := false
+	for {
+		var connected bool
+
+		reconnected := 0
+		if reconnect {
+			reconnected = attempt
+		}
+		connected, err = c.serve(u, header, reconnected)
+		reconnect = reconnect || connected
+
+		c.lock.Lock()
+		backoff, maxAttempts, hook := c.reconnect, c.reconnectMax, c.onReconnecting
+		c.lock.Unlock()
+
+		select {
+		case <-stop:
+			return err
+		default:
+		}
+		if backoff == nil {
+			return err
+		}
+
+		if connected {
+			attempt = 0
+			backoff.Reset()
+		}
+		attempt++
+		if maxAttempts > 0 && attempt > maxAttempts {
+			logWarn(LogRegioWsClient, "giving up after %d reconnect attempts",
+				maxAttempts)
+			return err
+		}
+
+		delay := backoff.Next()
+		if hook != nil {
+			hook(attempt, delay, err)
+		}
+		logKV(LogLevelInfo, LogRegioWsClient, "reconnecting",
+			LogKeyURL, u.String(), "delay", delay, "attempt", attempt)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-stop:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// serve dials once and runs the read loop until the connection ends.
+// connected reports whether the handshake succeeded, reconnected is the
+// attempt of a reconnect, 0 for the initial connect.
+func (c *Client) serve(u url.URL, header http.Header,
+	reconnected int) (connected bool, err error) {
+
+	logKV(LogLevelDebug, LogRegioWsClient, "connecting", LogKeyURL, u.String())
 
+	dialer := *websocket.DefaultDialer
+	c.lock.Lock()
+	dialer.Subprotocols = c.subprotocols
+	dialer.NetDialContext = c.netDial
+	resolve := c.resolve
+	compression, textFraming, token := c.compression, c.textFraming, c.token
+	stop := c.stop
+	c.lock.Unlock()
+	if stop == nil {
+		return false, net.ErrClosed
+	}
+	if compression != nil || textFraming || token != nil {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+	}
+	if compression != nil {
+		header.Set(PayloadCompressionHeader, payloadGzip)
+	}
+	if textFraming {
+		header.Set(TextFramingHeader, textFramingBase64)
+	}
+	if token != nil {
+		header.Set(token.header, ExpiringToken(token.secret, time.Now()))
+	}
+	target := u
+	if socket, unixTarget, ok := utils.SplitUnixURL(u); ok {
+		target = unixTarget
+		if dialer.NetDialContext == nil {
+			dialer.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			}
+		}
+	} else if resolve != nil || dialer.NetDialContext == nil {
+		// a NetDialFunc resolves itself unless a resolver is set
+		if resolve == nil {
+			resolve = lookupNetIP
+		}
+		dial := dialer.NetDialContext
+		if dial == nil {
+			var d net.Dialer
+			dial = d.DialContext
+		}
+		dialer.NetDialContext = c.rotatingDial(resolve, dial)
+	}
 	if utils.TlsScheme(u.Scheme) {
-		websocket.DefaultDialer.TLSClientConfig = &c.tlsConfig
+		dialer.TLSClientConfig = c.dialTLSConfig(target.Hostname())
 	}
 
-	var dailResp *http.Response
+	// Disconnect aborts a pending dial
+	dialCtx, cancelDial := context.WithCancel(context.Background())
+	defer cancelDial()
+	go func() {
+		select {
+		case <-stop:
+			cancelDial()
+		case <-dialCtx.Done():
+		}
+	}()
 
-	c.conn, dailResp, err = websocket.DefaultDialer.Dial(u.String(),
-		utils.MapToHeader(header))
+	conn, dailResp, err := dialer.DialContext(dialCtx, target.String(), header)
 	if err != nil {
 		var respBody []byte
+		if dailResp != nil && dailResp.Body != nil {
+			respBody, _ = io.ReadAll(io.LimitReader(dailResp.Body,
+				maxHandshakeErrorBody))
+			dailResp.Body.Close()
+		}
+		if dialCtx.Err() != nil {
+			logDebug(LogRegioWsClient, "dial aborted")
+			return false, net.ErrClosed
+		}
+		logKV(LogLevelError, LogRegioWsClient, "dial failed",
+			LogKeyURL, u.String(), LogKeyError, err, "response", string(respBody))
 		if dailResp != nil {
-			respBody, _ = io.ReadAll(dailResp.Body)
+			err = &HandshakeError{
+				StatusCode: dailResp.StatusCode,
+				Header:     dailResp.Header,
+				Body:       respBody,
+				Err:        err,
+			}
 		}
-		_ = log.Error(LogRegioWsClient, "dail<%v>: %v", err, string(respBody))
-		return err
+		return false, classifyError(err, dirRead, dailResp)
 	}
+	connected = true
 
-	defer dailResp.Body.Close()
-	defer c.conn.Close()
+	if dailResp.Body != nil {
+		dailResp.Body.Close()
+	}
+	defer conn.Close()
+
+	id := getIdFromConn(conn)
 
-	id := getIdFromConn(c.conn)
-	c.eventHandler.OnConnect(id)
-	defer c.eventHandler.OnDisconnect(id)
+	c.lock.Lock()
+	c.subprotocol = conn.Subprotocol()
+	conn.SetReadLimit(c.readLimit)
+	readLimit := c.readLimit
+	c.payload = nil
+	if compression != nil && acceptsPayloadCompression(dailResp.Header) {
+		c.payload = compression
+	}
+	payload := c.payload
+	c.textFramed = textFraming && acceptsTextFraming(dailResp.Header)
+	textFramed := c.textFramed
+	challenge := c.challenge
+	c.lock.Unlock()
+	replyToClose(conn)
+
+	if challenge != nil {
+		// Disconnect aborts the challenge too
+		answered := make(chan struct{})
+		go func() {
+			select {
+			case <-dialCtx.Done():
+				conn.Close()
+			case <-answered:
+			}
+		}()
+		err = challenge.answer(conn)
+		close(answered)
+		if err != nil {
+			logKV(LogLevelError, LogRegioWsClient, "challenge failed",
+				LogKeyURL, u.String(), LogKeyError, err)
+			return false, err
+		}
+	}
+
+	if tlsConn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		c.lock.Lock()
+		c.tlsState = &state
+		c.lock.Unlock()
+		defer func() {
+			c.lock.Lock()
+			c.tlsState = nil
+			c.lock.Unlock()
+		}()
+	}
+
+	c.lock.Lock()
+	onReconnected := c.onReconnected
+	c.lock.Unlock()
+	if reconnected > 0 && onReconnected != nil {
+		if err = c.runHook(conn, reconnected, onReconnected); err != nil {
+			err = fmt.Errorf("reconnected hook: %w", err)
+			logKV(LogLevelError, LogRegioWsClient, "reconnected hook failed",
+				LogKeyURL, u.String(), LogKeyError, err)
+			c.writeLock.Lock()
+			_ = conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			c.writeLock.Unlock()
+			c.EventHandler().OnFailure(false, err)
+			return false, err
+		}
+	}
+
+	// sends go to the connection from here on
+	c.lock.Lock()
+	if c.stop == nil {
+		// disconnected during the handshake
+		c.lock.Unlock()
+		return connected, net.ErrClosed
+	}
+	c.conn = conn
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.conn = nil
+		c.lock.Unlock()
+	}()
+	logKV(LogLevelDebug, LogRegioWsClient, "connected",
+		LogKeyURL, u.String(), LogKeyRemoteAddr, conn.RemoteAddr().String())
+
+	ctx, cancel := context.WithCancel(withRemoteAddr(
+		withClientId(context.Background(), id), conn.RemoteAddr()))
+	defer cancel()
+
+	c.stats.connected()
+
+	dispatchConnect(ctx, c.EventHandler(), id)
+	defer func() { c.EventHandler().OnDisconnect(id) }()
+
+	c.lock.Lock()
+	keepalive := c.keepalive
+	heartbeat := c.heartbeat
+	c.lock.Unlock()
+	dead := &deadPeer{close: conn.Close}
+	go runKeepalive(ctx, keepalive, conn, id, LogRegioWsClient, dead)
+	var lastPong atomic.Int64
+	if heartbeat != nil {
+		go runTextHeartbeat(ctx, *heartbeat, c.Send, &lastPong, dead)
+	}
 
 	for {
-		msgType, data, err := c.conn.ReadMessage()
+		msgType, data, err := conn.ReadMessage()
 		if err != nil {
-			c.eventHandler.OnFailure(true, err)
-			return err
+			c.stats.disconnected(err)
+			err = dead.err(classifyError(err, dirRead, nil))
+			if KindOf(err) == KindNormalClosure {
+				// the peer left politely
+				logKV(LogLevelInfo, LogRegioWsClient, "closed by peer",
+					LogKeyURL, u.String(), LogKeyError, err)
+				return connected, nil
+			}
+			c.EventHandler().OnFailure(true, err)
+			return connected, err
+		}
+		c.stats.received(len(data))
+		if textFramed {
+			msgType, data, err = decodeTextFrame(msgType, data)
+			if err != nil {
+				c.EventHandler().OnFailure(false, err)
+				continue
+			}
 		}
-		c.eventHandler.OnReceive(Message{
+		if payload != nil {
+			msgType, data, err = decodePayload(msgType, data, readLimit)
+			if err != nil {
+				c.EventHandler().OnFailure(false, err)
+				continue
+			}
+		}
+		if heartbeat != nil && isText(msgType, data, heartbeat.pong) {
+			lastPong.Store(time.Now().UnixNano())
+			continue
+		}
+		dispatchReceive(ctx, c.EventHandler(), Message{
 			MessageType: msgType,
 			Data:        data,
 			ClientId:    id,
@@ -132,24 +818,155 @@ func (c *Client) ConnectAndServe(url string,
 	}
 }
 
+// Disconnect closes the connection and waits for ConnectAndServe to
+// return, the client can connect again afterwards.
 func (c *Client) Disconnect() (err error) {
-	_ = log.Debug(LogRegioWsClient, "interrupted")
+	logDebug(LogRegioWsClient, "interrupted")
 
-	defer c.wg.Wait()
+	c.lock.Lock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	conn, served := c.conn, c.serving
+	// later sends fail with ErrNotConnected
+	c.conn = nil
+	c.lock.Unlock()
 
-	if c.conn != nil {
-		err = c.conn.WriteMessage(websocket.CloseMessage,
+	if conn != nil {
+		// heartbeats may be writing
+		c.writeLock.Lock()
+		err = conn.WriteMessage(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-		c.conn.Close()
+		c.writeLock.Unlock()
+		conn.Close()
+	}
+	if served != nil {
+		<-served
 	}
 
 	return
 }
 
 func (c *Client) SendTxt(message []byte) (err error) {
-	return c.conn.WriteMessage(websocket.TextMessage, message)
+	return c.Send(Message{MessageType: TextMessage, Data: message})
+}
+
+func (c *Client) connection() *websocket.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.conn
 }
 
+func (c *Client) setWriteDeadline(t time.Time) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	conn := c.connection()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+// hookRun is a reconnected hook running on goroutine, conn is the new
+// connection it sends to. done is closed when it returned.
+type hookRun struct {
+	conn      *websocket.Conn
+	goroutine uint64
+	done      chan struct{}
+}
+
+// runHook runs the reconnected hook with its sends going to conn.
+func (c *Client) runHook(conn *websocket.Conn, attempt int, hook ReconnectedHook) error {
+	run := &hookRun{conn: conn, goroutine: goroutineId(), done: make(chan struct{})}
+	c.lock.Lock()
+	c.hook = run
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		c.hook = nil
+		c.lock.Unlock()
+		close(run.done)
+	}()
+
+	return hook(attempt)
+}
+
+// hookConn returns the new connection if called by a running reconnected
+// hook, other callers wait until the hook returned.
+func (c *Client) hookConn() *websocket.Conn {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.hook == nil {
+		return nil
+	}
+	id := goroutineId()
+	for c.hook != nil {
+		if c.hook.goroutine == id {
+			return c.hook.conn
+		}
+		done := c.hook.done
+		c.lock.Unlock()
+		<-done
+		c.lock.Lock()
+	}
+	return nil
+}
+
+// goroutineId parses the id of the calling goroutine from the header of
+// its stack, "goroutine 42 [running]:".
+func goroutineId() uint64 {
+	var buf [64]byte
+	fields := bytes.Fields(buf[:runtime.Stack(buf[:], false)])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+// Send writes one message, safe for concurrent use.
 func (c *Client) Send(message Message) (err error) {
-	return c.conn.WriteMessage(message.MessageType, message.Data)
+	hookConn := c.hookConn()
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.lock.Lock()
+	conn, payload, textFramed := c.conn, c.payload, c.textFramed
+	c.lock.Unlock()
+	if hookConn != nil {
+		conn = hookConn
+	}
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return c.write(conn, payload, textFramed, message)
+}
+
+// write encodes message for conn and writes it, the caller holds
+// writeLock.
+func (c *Client) write(conn *websocket.Conn, payload *payloadCompression,
+	textFramed bool, message Message) error {
+
+	messageType, data := message.MessageType, message.Data
+	if payload != nil {
+		messageType, data = payload.encode(messageType, data)
+	}
+	if textFramed {
+		messageType, data = encodeTextFrame(messageType, data)
+	}
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		return classifyError(err, dirWrite, nil)
+	}
+	c.stats.sent(len(message.Data))
+	return nil
+}
+
+// Stats returns the counters of all connections of the client so far.
+func (c *Client) Stats() Stats {
+	return c.stats.snapshot()
 }
@@ -0,0 +1,152 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// PayloadCompressionHeader negotiates the payload compression in the
+// handshake. Payloads are only compressed if both ends enabled it.
+const PayloadCompressionHeader = "X-Payload-Compression"
+
+const payloadGzip = "gzip"
+
+// Each payload of a connection with payload compression starts with one
+// of these. Compressed text is sent in binary frames, so text frames stay
+// valid utf-8 for intermediaries.
+const (
+	prefixPlain byte = iota
+	prefixGzipBinary
+	prefixGzipText
+)
+
+var ErrPayloadPrefix = errors.New("invalid payload compression prefix")
+
+type payloadCompression struct {
+	minSize int
+	level   int
+}
+
+func newPayloadCompression(minSize int, level int) (*payloadCompression, error) {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid gzip level %d", level)
+	}
+	return &payloadCompression{minSize: minSize, level: level}, nil
+}
+
+// compressedMagics start formats compressing again does not help.
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},               // gzip
+	{'P', 'K', 0x03, 0x04},     // zip
+	{0x28, 0xb5, 0x2f, 0xfd},   // zstd
+	{'B', 'Z', 'h'},            // bzip2
+	{0xfd, '7', 'z', 'X', 'Z'}, // xz
+	{0x89, 'P', 'N', 'G'},      // png
+	{0xff, 0xd8, 0xff},         // jpeg
+}
+
+func alreadyCompressed(data []byte) bool {
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// encode returns the frame type and payload of a message, compressed if
+// it is at least minSize and gets smaller.
+func (p *payloadCompression) encode(messageType int, data []byte) (int, []byte) {
+	if len(data) >= p.minSize && !alreadyCompressed(data) &&
+		(messageType == websocket.TextMessage || messageType == websocket.BinaryMessage) {
+
+		var buf bytes.Buffer
+		prefix := prefixGzipBinary
+		if messageType == websocket.TextMessage {
+			prefix = prefixGzipText
+		}
+		buf.WriteByte(prefix)
+		w, _ := gzip.NewWriterLevel(&buf, p.level)
+		_, _ = w.Write(data)
+		if w.Close() == nil && buf.Len() < len(data)+1 {
+			return websocket.BinaryMessage, buf.Bytes()
+		}
+	}
+
+	payload := make([]byte, 1+len(data))
+	payload[0] = prefixPlain
+	copy(payload[1:], data)
+	return messageType, payload
+}
+
+// decodePayload reverses encode. limit caps the decompressed size, 0 does
+// not.
+func decodePayload(messageType int, data []byte, limit int64) (int, []byte, error) {
+	if len(data) == 0 {
+		return messageType, nil, ErrPayloadPrefix
+	}
+
+	switch data[0] {
+	case prefixPlain:
+		return messageType, data[1:], nil
+	case prefixGzipBinary, prefixGzipText:
+		if data[0] == prefixGzipText {
+			messageType = websocket.TextMessage
+		}
+		r, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return messageType, nil, fmt.Errorf("decompress payload: %w", err)
+		}
+		var reader io.Reader = r
+		if limit > 0 {
+			reader = io.LimitReader(r, limit+1)
+		}
+		plain, err := io.ReadAll(reader)
+		if err != nil {
+			return messageType, nil, fmt.Errorf("decompress payload: %w", err)
+		}
+		if limit > 0 && int64(len(plain)) > limit {
+			return messageType, nil, fmt.Errorf("decompressed payload: %w", ErrMessageTooBig)
+		}
+		return messageType, plain, nil
+	default:
+		return messageType, nil, ErrPayloadPrefix
+	}
+}
+
+// acceptsPayloadCompression reports whether the handshake header enables
+// payload compression.
+func acceptsPayloadCompression(header http.Header) bool {
+	return header.Get(PayloadCompressionHeader) == payloadGzip
+}
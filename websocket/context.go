@@ -0,0 +1,90 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"net"
+)
+
+type contextKey int
+
+const (
+	clientIdKey contextKey = iota
+	remoteAddrKey
+)
+
+// CtxEvents is an optional extension of Events. If the handler implements
+// it, OnReceiveCtx is called instead of OnReceive with a context bound to
+// the lifetime of the connection.
+type CtxEvents interface {
+	Events
+	OnReceiveCtx(ctx context.Context, msg Message)
+}
+
+// ConnectCtxEvents is an optional extension of Events. If the handler
+// implements it, OnConnectCtx is called instead of OnConnect with the
+// context of the connection, see RemoteAddrFromContext.
+type ConnectCtxEvents interface {
+	Events
+	OnConnectCtx(ctx context.Context, id int)
+}
+
+func withClientId(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, clientIdKey, id)
+}
+
+func ClientIdFromContext(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(clientIdKey).(int)
+	return id, ok
+}
+
+func withRemoteAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, remoteAddrKey, addr)
+}
+
+// RemoteAddrFromContext returns the address of the peer of a connection,
+// for a client the one dialed of the resolved addresses.
+func RemoteAddrFromContext(ctx context.Context) (net.Addr, bool) {
+	addr, ok := ctx.Value(remoteAddrKey).(net.Addr)
+	return addr, ok
+}
+
+func dispatchConnect(ctx context.Context, handler Events, id int) {
+	if ctxHandler, ok := handler.(ConnectCtxEvents); ok {
+		ctxHandler.OnConnectCtx(ctx, id)
+		return
+	}
+	handler.OnConnect(id)
+}
+
+func dispatchReceive(ctx context.Context, handler Events, msg Message) {
+	if ctxHandler, ok := handler.(CtxEvents); ok {
+		ctxHandler.OnReceiveCtx(ctx, msg)
+		return
+	}
+	handler.OnReceive(msg)
+}
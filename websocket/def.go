@@ -28,14 +28,24 @@ package websocket
 import (
 	"unsafe"
 
-	log "github.com/ChrIgiSta/go-utils/logger"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	TextMessage   = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+	CloseMessage  = websocket.CloseMessage
+	PingMessage   = websocket.PingMessage
+	PongMessage   = websocket.PongMessage
+)
+
 type Message struct {
 	MessageType int
 	Data        []byte
 	ClientId    int
+	// Origin is the instance id of the server which broadcast a message
+	// relayed by a BroadcastBackend, empty otherwise.
+	Origin string
 }
 
 type Events interface {
@@ -60,10 +70,25 @@ const (
 
 type Event struct {
 	Err  error
+	Kind ErrorKind
 	Type EventType
 	Id   int
 }
 
+func failureEvent(exited bool, err error) Event {
+	fType := Failure
+	if exited {
+		fType = FailureWithExit
+	}
+
+	return Event{
+		Err:  err,
+		Kind: KindOf(err),
+		Type: fType,
+		Id:   ClientIdOf(err),
+	}
+}
+
 type EventsToChannel struct {
 	messageChannel chan<- Message
 	eventChannel   chan<- Event
@@ -78,15 +103,15 @@ func NewEventsToChannel(messageChannel chan<- Message,
 }
 
 func (t *EventsToChannel) OnReceive(msg Message) {
-	_ = log.Debug("Evnt2Channel", "onReceive: %v", msg)
+	logDebug("Evnt2Channel", "onReceive: %v", msg)
 	if t.messageChannel != nil {
 		t.messageChannel <- msg
 	} else {
-		_ = log.Error("Evnt2Channel", "message channel is nil")
+		logError("Evnt2Channel", "message channel is nil")
 	}
 }
 func (t *EventsToChannel) OnDisconnect(id int) {
-	_ = log.Debug("Evnt2Channel", "onDisconnect: %v", id)
+	logDebug("Evnt2Channel", "onDisconnect: %v", id)
 	if t.eventChannel != nil {
 		t.eventChannel <- Event{
 			Err:  nil,
@@ -94,11 +119,11 @@ func (t *EventsToChannel) OnDisconnect(id int) {
 			Id:   id,
 		}
 	} else {
-		_ = log.Error("Evnt2Channel", "event channel is nil")
+		logError("Evnt2Channel", "event channel is nil")
 	}
 }
 func (t *EventsToChannel) OnConnect(id int) {
-	_ = log.Debug("Evnt2Channel", "onConnect: %v", id)
+	logDebug("Evnt2Channel", "onConnect: %v", id)
 	if t.eventChannel != nil {
 		t.eventChannel <- Event{
 			Err:  nil,
@@ -106,24 +131,15 @@ func (t *EventsToChannel) OnConnect(id int) {
 			Id:   id,
 		}
 	} else {
-		_ = log.Error("Evnt2Channel", "event channel is nil")
+		logError("Evnt2Channel", "event channel is nil")
 	}
 }
 func (t *EventsToChannel) OnFailure(exited bool, err error) {
-	_ = log.Debug("Evnt2Channel", "onFailure: %v", err)
-
-	fType := Failure
-	if exited {
-		fType = FailureWithExit
-	}
+	logDebug("Evnt2Channel", "onFailure: %v", err)
 
 	if t.eventChannel != nil {
-		t.eventChannel <- Event{
-			Err:  err,
-			Type: fType,
-			Id:   -1,
-		}
+		t.eventChannel <- failureEvent(exited, err)
 	} else {
-		_ = log.Error("Evnt2Channel", "event channel is nil")
+		logError("Evnt2Channel", "event channel is nil")
 	}
 }
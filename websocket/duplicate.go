@@ -0,0 +1,106 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"net/http"
+)
+
+// CloseDuplicateConnection is the close code sent to a client replaced by
+// a new connection of the same identity with DuplicateKickOld.
+const CloseDuplicateConnection = 4409
+
+// DuplicatePolicy tells what happens to a client connecting with the
+// identity of a connected one, see Server.SetDuplicatePolicy.
+type DuplicatePolicy int
+
+const (
+	DuplicateAllowAll DuplicatePolicy = iota
+	DuplicateKickOld
+	DuplicateRejectNew
+)
+
+// SetIdentity sets the function telling the identity of a client from its
+// upgrade request, e.g. the user of its auth header. Clients with an
+// empty identity are not subject to the duplicate policy.
+func (s *Server) SetIdentity(identify func(r *http.Request) string) {
+	s.identify = identify
+}
+
+// SetDuplicatePolicy sets the handling of a second connection of the same
+// identity, see SetIdentity: DuplicateKickOld closes the connected client
+// with CloseDuplicateConnection before the new one is admitted,
+// DuplicateRejectNew answers 409 to the new one before upgrading it.
+// Identities are shared by the servers of a hub.
+func (s *Server) SetDuplicatePolicy(policy DuplicatePolicy) {
+	s.duplicates = policy
+}
+
+// identity returns the identity of a request subject to the duplicate
+// policy, empty if none.
+func (s *Server) identity(r *http.Request) string {
+	if s.identify == nil || s.duplicates == DuplicateAllowAll {
+		return ""
+	}
+	return s.identify(r)
+}
+
+// reserveIdentity claims an identity not connected yet for a client about
+// to be upgraded.
+func (h *Hub) reserveIdentity(identity string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, taken := h.identities[identity]; taken {
+		return false
+	}
+	h.identities[identity] = nil
+	return true
+}
+
+// bindIdentity makes client the one of identity and adds it to the pool
+// in the same step, an identity is never bound to a client missing in the
+// pool. It returns the client bound before, nil if none.
+func (h *Hub) bindIdentity(identity string, clientId int, client *serverClient) *serverClient {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	previous := h.identities[identity]
+	h.identities[identity] = client
+	h.add(clientId, client)
+	return previous
+}
+
+// releaseIdentity frees identity if still bound to client, a nil client
+// being a reservation.
+func (h *Hub) releaseIdentity(identity string, client *serverClient) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if bound, ok := h.identities[identity]; ok && bound == client {
+		delete(h.identities, identity)
+	}
+}
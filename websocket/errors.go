@@ -0,0 +1,210 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+type ErrorKind int
+
+const (
+	KindUnknown ErrorKind = iota
+	KindAuthRejected
+	KindTLSHandshake
+	KindReadTimeout
+	KindWriteTimeout
+	KindMessageTooBig
+	KindNormalClosure
+)
+
+var (
+	ErrAuthRejected  = errors.New("authentication rejected")
+	ErrTLSHandshake  = errors.New("tls handshake failed")
+	ErrReadTimeout   = errors.New("read timeout")
+	ErrWriteTimeout  = errors.New("write timeout")
+	ErrMessageTooBig = errors.New("message too big")
+	ErrNormalClosure = errors.New("normal closure")
+)
+
+var kindToError = map[ErrorKind]error{
+	KindAuthRejected:  ErrAuthRejected,
+	KindTLSHandshake:  ErrTLSHandshake,
+	KindReadTimeout:   ErrReadTimeout,
+	KindWriteTimeout:  ErrWriteTimeout,
+	KindMessageTooBig: ErrMessageTooBig,
+	KindNormalClosure: ErrNormalClosure,
+}
+
+func (k ErrorKind) String() string {
+	if err, ok := kindToError[k]; ok {
+		return err.Error()
+	}
+	return "unknown"
+}
+
+// ClassifiedError wraps an underlying error together with its kind, so
+// errors.Is matches both the Err* sentinel of the kind and the original
+// error chain.
+type ClassifiedError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ClassifiedError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *ClassifiedError) Unwrap() []error {
+	if sentinel, ok := kindToError[e.Kind]; ok {
+		return []error{sentinel, e.Err}
+	}
+	return []error{e.Err}
+}
+
+// HandshakeError is returned by a client when the server answers the
+// upgrade with another status than 101, e.g. to refresh a token on 401
+// but back off on 503. Body holds the start of the response body.
+type HandshakeError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Err        error
+}
+
+func (e *HandshakeError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("%v: status %d", e.Err, e.StatusCode)
+	}
+	return fmt.Sprintf("%v: status %d: %s", e.Err, e.StatusCode, e.Body)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// ClientError ties a failure reported by OnFailure to the client it
+// occurred with, the Id of its failure Event.
+type ClientError struct {
+	ClientId int
+	// RemoteAddr is the address of the client if the failure happened
+	// before its OnConnect, e.g. in the challenge, empty otherwise.
+	RemoteAddr string
+	Err        error
+}
+
+func (e *ClientError) Error() string {
+	if e.RemoteAddr != "" {
+		return fmt.Sprintf("client <%v> %s: %v", e.ClientId, e.RemoteAddr, e.Err)
+	}
+	return fmt.Sprintf("client <%v>: %v", e.ClientId, e.Err)
+}
+
+func (e *ClientError) Unwrap() error {
+	return e.Err
+}
+
+// ClientIdOf returns the id of a ClientError anywhere in err's chain, -1 if
+// the failure is not tied to a client.
+func ClientIdOf(err error) int {
+	var clientErr *ClientError
+	if errors.As(err, &clientErr) {
+		return clientErr.ClientId
+	}
+	return -1
+}
+
+// KindOf returns the kind of a classified error anywhere in err's chain.
+func KindOf(err error) ErrorKind {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified.Kind
+	}
+	return KindUnknown
+}
+
+type ioDirection int
+
+const (
+	dirRead ioDirection = iota
+	dirWrite
+)
+
+func classifyError(err error, dir ioDirection, resp *http.Response) error {
+	if err == nil {
+		return nil
+	}
+	if KindOf(err) != KindUnknown {
+		return err
+	}
+
+	kind := KindUnknown
+
+	var (
+		netErr        net.Error
+		recordErr     tls.RecordHeaderError
+		alertErr      tls.AlertError
+		verifyErr     *tls.CertificateVerificationError
+		authorityErr  x509.UnknownAuthorityError
+		hostnameErr   x509.HostnameError
+		certInvalidEr x509.CertificateInvalidError
+	)
+
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure,
+		websocket.CloseGoingAway):
+		kind = KindNormalClosure
+	case errors.Is(err, websocket.ErrReadLimit),
+		websocket.IsCloseError(err, websocket.CloseMessageTooBig):
+		kind = KindMessageTooBig
+	case errors.Is(err, websocket.ErrBadHandshake) && resp != nil &&
+		(resp.StatusCode == http.StatusUnauthorized ||
+			resp.StatusCode == http.StatusForbidden):
+		kind = KindAuthRejected
+	case errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &verifyErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &certInvalidEr):
+		kind = KindTLSHandshake
+	case errors.As(err, &netErr) && netErr.Timeout():
+		if dir == dirWrite {
+			kind = KindWriteTimeout
+		} else {
+			kind = KindReadTimeout
+		}
+	}
+
+	if kind == KindUnknown {
+		return err
+	}
+	return &ClassifiedError{Kind: kind, Err: err}
+}
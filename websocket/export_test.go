@@ -0,0 +1,68 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TextFramingBase64 exposes the text framing header value to the tests.
+const TextFramingBase64 = textFramingBase64
+
+// DialTLSConfig returns the tls config the client dials host with.
+func (c *Client) DialTLSConfig(host string) *tls.Config {
+	return c.dialTLSConfig(host)
+}
+
+// SetDefaultResolver replaces the system resolver of the clients until
+// the returned restore is called.
+func SetDefaultResolver(resolve ResolverFunc) (restore func()) {
+	saved := lookupNetIP
+	lookupNetIP = resolve
+	return func() { lookupNetIP = saved }
+}
+
+// Identities returns how many identities the server's hub holds.
+func (s *Server) Identities() int {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	return len(s.hub.identities)
+}
+
+// WriteClose sends a close frame to the client without closing the
+// connection, the close handshake is left to the peer.
+func (s *Server) WriteClose(clientId int, code int, text string) error {
+	client := s.hub.client(clientId)
+	if client == nil {
+		return ErrNoClient
+	}
+	return client.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+}
@@ -0,0 +1,122 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"expvar"
+	"sync"
+)
+
+var (
+	expvarLock    sync.Mutex
+	expvarSources = make(map[string]*expvarSource)
+)
+
+// expvarSource serves the values of a published map. Publishing the prefix
+// again swaps the source instead of registering twice, which would make
+// expvar panic.
+type expvarSource struct {
+	lock   sync.Mutex
+	values func() map[string]uint64
+}
+
+func (e *expvarSource) value(key string) any {
+	e.lock.Lock()
+	values := e.values
+	e.lock.Unlock()
+
+	return values()[key]
+}
+
+// publishExpvar publishes an expvar.Map named prefix with an entry per
+// key of values, read on each access.
+func publishExpvar(prefix string, values func() map[string]uint64) {
+	expvarLock.Lock()
+	defer expvarLock.Unlock()
+
+	source, ok := expvarSources[prefix]
+	if ok {
+		source.lock.Lock()
+		source.values = values
+		source.lock.Unlock()
+	} else {
+		if expvar.Get(prefix) != nil {
+			logWarn(LogRegioWsServer, "expvar %q is used elsewhere", prefix)
+			return
+		}
+		source = &expvarSource{values: values}
+		expvarSources[prefix] = source
+		expvar.Publish(prefix, new(expvar.Map).Init())
+	}
+
+	vars := expvar.Get(prefix).(*expvar.Map)
+	for key := range values() {
+		if vars.Get(key) == nil {
+			key := key
+			vars.Set(key, expvar.Func(func() any { return source.value(key) }))
+		}
+	}
+}
+
+// PublishExpvar publishes the counters of Stats as expvar.Map named
+// prefix. Publishing the prefix again switches it to this server.
+func (s *Server) PublishExpvar(prefix string) {
+	publishExpvar(prefix, func() map[string]uint64 {
+		stats := s.Stats()
+		return map[string]uint64{
+			"connections":       uint64(stats.Clients),
+			"connections_total": uint64(stats.Connects),
+			"messages_in":       stats.MessagesReceived,
+			"messages_out":      stats.MessagesSent,
+			"bytes_in":          stats.BytesReceived,
+			"bytes_out":         stats.BytesSent,
+			"broadcast_errors":  stats.BroadcastErrors,
+			"rejected_upgrades": stats.RejectedUpgrades,
+			"shed_upgrades":     stats.ShedUpgrades,
+		}
+	})
+}
+
+// PublishExpvar publishes the counters of Stats as expvar.Map named
+// prefix. Publishing the prefix again switches it to this client.
+func (c *Client) PublishExpvar(prefix string) {
+	publishExpvar(prefix, func() map[string]uint64 {
+		stats := c.Stats()
+		connected := uint64(0)
+		if stats.Connected {
+			connected = 1
+		}
+		return map[string]uint64{
+			"connections":       connected,
+			"connections_total": uint64(stats.Connects),
+			"reconnects":        uint64(stats.Reconnects),
+			"messages_in":       stats.MessagesReceived,
+			"messages_out":      stats.MessagesSent,
+			"bytes_in":          stats.BytesReceived,
+			"bytes_out":         stats.BytesSent,
+		}
+	})
+}
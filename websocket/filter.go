@@ -0,0 +1,113 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type FilterOptions struct {
+	SuppressMessages bool
+	SuppressTypes    []EventType
+	// MessagePredicate, if set, forwards only messages it returns true for.
+	MessagePredicate func(msg Message) bool
+}
+
+type FilterCounts struct {
+	Messages uint64
+	Events   uint64
+}
+
+type FilteredEvents struct {
+	inner            Events
+	opts             FilterOptions
+	filteredMessages atomic.Uint64
+	filteredEvents   atomic.Uint64
+}
+
+func NewFilteredEvents(inner Events, opts FilterOptions) *FilteredEvents {
+	return &FilteredEvents{
+		inner: inner,
+		opts:  opts,
+	}
+}
+
+func (f *FilteredEvents) Filtered() FilterCounts {
+	return FilterCounts{
+		Messages: f.filteredMessages.Load(),
+		Events:   f.filteredEvents.Load(),
+	}
+}
+
+func (f *FilteredEvents) suppressed(eventType EventType) bool {
+	for _, t := range f.opts.SuppressTypes {
+		if t == eventType {
+			f.filteredEvents.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FilteredEvents) OnReceive(msg Message) {
+	f.OnReceiveCtx(context.Background(), msg)
+}
+
+func (f *FilteredEvents) OnReceiveCtx(ctx context.Context, msg Message) {
+	if f.opts.SuppressMessages ||
+		(f.opts.MessagePredicate != nil && !f.opts.MessagePredicate(msg)) {
+		f.filteredMessages.Add(1)
+		return
+	}
+	dispatchReceive(ctx, f.inner, msg)
+}
+
+func (f *FilteredEvents) OnDisconnect(id int) {
+	if !f.suppressed(Disconnect) {
+		f.inner.OnDisconnect(id)
+	}
+}
+
+func (f *FilteredEvents) OnConnect(id int) {
+	f.OnConnectCtx(context.Background(), id)
+}
+
+func (f *FilteredEvents) OnConnectCtx(ctx context.Context, id int) {
+	if !f.suppressed(Connect) {
+		dispatchConnect(ctx, f.inner, id)
+	}
+}
+
+func (f *FilteredEvents) OnFailure(exited bool, err error) {
+	fType := Failure
+	if exited {
+		fType = FailureWithExit
+	}
+	if !f.suppressed(fType) {
+		f.inner.OnFailure(exited, err)
+	}
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var errHeartbeatTimeout = errors.New("no text heartbeat received")
+
+// textHeartbeat is the keepalive of browser clients, which cannot send
+// ping frames: the client sends the ping text, the server answers with the
+// pong text. Neither is delivered to OnReceive.
+type textHeartbeat struct {
+	ping     string
+	pong     string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func isText(messageType int, data []byte, text string) bool {
+	return messageType == TextMessage && string(data) == text
+}
+
+// heartbeatTimeout closes a dead connection like a missing pong of
+// runKeepalive, the read loop reports it.
+func heartbeatTimeout(dead *deadPeer) {
+	dead.fail(&ClassifiedError{
+		Kind: KindReadTimeout,
+		Err:  errHeartbeatTimeout,
+	})
+}
+
+// watchHeartbeat fails the connection if alive is not called within
+// timeout, until the returned stop is called.
+func watchHeartbeat(timeout time.Duration, dead *deadPeer) (alive func(), stop func()) {
+	timer := time.AfterFunc(timeout, func() { heartbeatTimeout(dead) })
+	return func() { timer.Reset(timeout) }, func() { timer.Stop() }
+}
+
+// runTextHeartbeat sends the ping text every interval until ctx is done.
+// It fails the connection if the pong, recorded by the read loop in
+// lastPong, does not arrive within timeout.
+func runTextHeartbeat(ctx context.Context, cfg textHeartbeat, send func(Message) error,
+	lastPong *atomic.Int64, dead *deadPeer) {
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sent := time.Now()
+		if err := send(Message{MessageType: TextMessage, Data: []byte(cfg.ping)}); err != nil {
+			logKV(LogLevelDebug, LogRegioWsClient, "heartbeat failed",
+				LogKeyError, err)
+			continue
+		}
+
+		if cfg.timeout > 0 {
+			time.AfterFunc(cfg.timeout, func() {
+				if lastPong.Load() < sent.UnixNano() && ctx.Err() == nil {
+					heartbeatTimeout(dead)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,419 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ChrIgiSta/go-utils/containers"
+	"github.com/gorilla/websocket"
+)
+
+var ErrNoClient = errors.New("no valid client")
+
+// serverClient is the hub entry of a connected client.
+type serverClient struct {
+	conn        *websocket.Conn
+	connectedAt time.Time
+	cancel      context.CancelFunc
+	writeLock   sync.Mutex
+	// negotiated payload compression, nil if off
+	payload *payloadCompression
+	// negotiated text-only framing
+	textFramed bool
+	// server accepted the client, its event handler gets the failures
+	server *Server
+	// bandwidth limits, nil if unlimited. Writes of a limited client go
+	// through queue, done is closed with the connection.
+	writeBandwidth *bandwidth
+	readBandwidth  *bandwidth
+	queue          chan queuedWrite
+	done           <-chan struct{}
+	writeDeadline  time.Time
+	// closing is set before the connection is closed and the client
+	// removed, writers skip it from then on
+	closing atomic.Bool
+}
+
+// close marks the client closing and closes its connection.
+func (c *serverClient) close() error {
+	c.closing.Store(true)
+	return c.conn.Close()
+}
+
+// closeWith sends a close frame with code and text before closing the
+// connection, unless the client is closing already.
+func (c *serverClient) closeWith(code int, text string) error {
+	if !c.closing.Swap(true) {
+		_ = c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, text),
+			time.Now().Add(closeHandshakeTimeout))
+	}
+	return c.conn.Close()
+}
+
+// closePolicy closes a client which missed its heartbeat or pong.
+func (c *serverClient) closePolicy() error {
+	return c.closeWith(websocket.ClosePolicyViolation, "heartbeat timeout")
+}
+
+// write serializes writes of Send and Broadcast to the connection.
+func (c *serverClient) write(message *Message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.writeLocked(message)
+}
+
+// writeLocked returns ErrNoClient for a closing client, also when the
+// close interrupted the write.
+func (c *serverClient) writeLocked(message *Message) error {
+	if c.closing.Load() {
+		return ErrNoClient
+	}
+	messageType, data := message.MessageType, message.Data
+	if c.payload != nil {
+		messageType, data = c.payload.encode(messageType, data)
+	}
+	if c.textFramed {
+		messageType, data = encodeTextFrame(messageType, data)
+	}
+	err := c.conn.WriteMessage(messageType, data)
+	if err != nil && c.closing.Load() {
+		return ErrNoClient
+	}
+	return err
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	Id          int
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Subprotocol string
+	// WriteLimit and ReadLimit are the bandwidth limits in bytes per
+	// second, 0 if unlimited. The utilizations are the shares of the
+	// limits used over about the last second, Throttled is the time
+	// writes waited for the limit.
+	WriteLimit       int
+	WriteUtilization float64
+	ReadLimit        int
+	ReadUtilization  float64
+	Throttled        time.Duration
+}
+
+// Hub holds the clients of one or more servers, with their rooms and
+// metadata, so one Broadcast reaches all of them. Each server has an own
+// hub unless attached to a shared one by Server.SetHub.
+type Hub struct {
+	clientPool       *containers.List
+	stats            statsCounter
+	broadcastErrors  atomic.Uint64
+	rejectedUpgrades atomic.Uint64
+	shedUpgrades     atomic.Uint64
+
+	lock     sync.Mutex
+	rooms    map[string]map[int]struct{}
+	metadata map[int]map[string]any
+	presence map[string]map[string]*presenceMember
+	debounce time.Duration
+	// identities maps an identity to its client, nil while reserved
+	identities map[string]*serverClient
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clientPool: containers.NewList(),
+		rooms:      make(map[string]map[int]struct{}),
+		metadata:   make(map[int]map[string]any),
+		presence:   make(map[string]map[string]*presenceMember),
+		debounce:   DefaultPresenceDebounce,
+		identities: make(map[string]*serverClient),
+	}
+}
+
+func (h *Hub) add(clientId int, client *serverClient) {
+	h.clientPool.AddOrUpdate(clientId, client)
+	h.stats.connected()
+}
+
+// remove drops the client from the pool, its rooms, presence and
+// metadata.
+func (h *Hub) remove(clientId int) {
+	if client := h.client(clientId); client != nil {
+		client.closing.Store(true)
+	}
+	h.clientPool.Delete(clientId)
+
+	h.lock.Lock()
+	var left []PresenceEvent
+	for room, members := range h.rooms {
+		delete(members, clientId)
+		if len(members) == 0 {
+			delete(h.rooms, room)
+		}
+	}
+	for room := range h.presence {
+		left = append(left, h.leavePresenceLocked(clientId, room)...)
+	}
+	delete(h.metadata, clientId)
+	h.lock.Unlock()
+
+	h.announceLeaves(left)
+}
+
+// drop closes a client after a failed write, writes to it can't succeed
+// anymore, and removes it. Its read loop unwinds and reports OnDisconnect.
+func (h *Hub) drop(clientId int, client *serverClient) {
+	_ = client.close()
+	if h.client(clientId) == client {
+		h.remove(clientId)
+	}
+}
+
+func (h *Hub) client(clientId int) *serverClient {
+	_, item := h.clientPool.Get(clientId)
+	client, _ := item.(*serverClient)
+	return client
+}
+
+// Broadcast sends the message to all clients of the hub.
+func (h *Hub) Broadcast(message *Message) {
+	clientIds := h.clientPool.GetIds()
+	if len(clientIds) < 1 {
+		logDebug(LogRegioWsServer, "no clients connected")
+	}
+	h.sendAll(clientIds, message)
+}
+
+func (h *Hub) sendAll(clientIds []int, message *Message) {
+	for _, id := range clientIds {
+		client := h.client(id)
+		if client == nil || client.closing.Load() {
+			// left since the snapshot
+			continue
+		}
+		if client.queue != nil {
+			// throttled clients must not hold up the others
+			if err := client.enqueue(message); err != nil && !errors.Is(err, ErrNoClient) {
+				h.broadcastErrors.Add(1)
+				client.server.eventHandler.OnFailure(false,
+					&ClientError{ClientId: id, Err: fmt.Errorf("send: %w", err)})
+			}
+			continue
+		}
+		err := client.write(message)
+		if errors.Is(err, ErrNoClient) {
+			continue
+		}
+		if err != nil {
+			h.broadcastErrors.Add(1)
+			client.server.eventHandler.OnFailure(false,
+				&ClientError{ClientId: id, Err: fmt.Errorf("send: %w",
+					classifyError(err, dirWrite, nil))})
+
+			logKV(LogLevelError, LogRegioWsServer, "send failed",
+				LogKeyClientId, id, LogKeyError, err)
+			h.drop(id, client)
+			continue
+		}
+		h.stats.sent(len(message.Data))
+	}
+}
+
+func (h *Hub) Send(clientId int, message *Message) error {
+	client := h.client(clientId)
+	if client == nil || client.closing.Load() {
+		return ErrNoClient
+	}
+	if client.queue != nil {
+		return client.sendThrottled(message)
+	}
+	if err := client.write(message); err != nil {
+		if !errors.Is(err, ErrNoClient) {
+			h.drop(clientId, client)
+		}
+		return classifyError(err, dirWrite, nil)
+	}
+	h.stats.sent(len(message.Data))
+	return nil
+}
+
+// Kick sends a normal close frame to a client and drops its connection.
+func (h *Hub) Kick(clientId int) error {
+	client := h.client(clientId)
+	if client == nil || client.closing.Load() {
+		return ErrNoClient
+	}
+	_ = client.closeWith(websocket.CloseNormalClosure, "")
+	client.cancel()
+	return nil
+}
+
+// Clients lists the connected clients, longest connected first.
+func (h *Hub) Clients() []ClientInfo {
+	var clients []ClientInfo
+
+	for _, id := range h.clientPool.GetIds() {
+		client := h.client(id)
+		if client == nil {
+			continue
+		}
+		clients = append(clients, ClientInfo{
+			Id:          id,
+			RemoteAddr:  client.conn.RemoteAddr().String(),
+			ConnectedAt: client.connectedAt,
+			Subprotocol: client.conn.Subprotocol(),
+
+			WriteLimit:       client.writeBandwidth.limit(),
+			WriteUtilization: client.writeBandwidth.utilization(),
+			ReadLimit:        client.readBandwidth.limit(),
+			ReadUtilization:  client.readBandwidth.utilization(),
+			Throttled:        client.writeBandwidth.throttledFor(),
+		})
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ConnectedAt.Before(clients[j].ConnectedAt)
+	})
+
+	return clients
+}
+
+// Stats returns the counters over all clients.
+func (h *Hub) Stats() ServerStats {
+	stats := h.stats.snapshot()
+	return ServerStats{
+		Clients:          len(h.clientPool.GetIds()),
+		Connects:         stats.Connects,
+		MessagesSent:     stats.MessagesSent,
+		MessagesReceived: stats.MessagesReceived,
+		BytesSent:        stats.BytesSent,
+		BytesReceived:    stats.BytesReceived,
+		BroadcastErrors:  h.broadcastErrors.Load(),
+		RejectedUpgrades: h.rejectedUpgrades.Load(),
+		ShedUpgrades:     h.shedUpgrades.Load(),
+	}
+}
+
+// Join adds a connected client to room. Clients leave all rooms when they
+// disconnect.
+func (h *Hub) Join(clientId int, room string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.joinLocked(clientId, room)
+}
+
+func (h *Hub) joinLocked(clientId int, room string) error {
+	if h.client(clientId) == nil {
+		return ErrNoClient
+	}
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[int]struct{})
+	}
+	h.rooms[room][clientId] = struct{}{}
+	return nil
+}
+
+// Leave removes a client from room and its presence there.
+func (h *Hub) Leave(clientId int, room string) {
+	h.lock.Lock()
+	delete(h.rooms[room], clientId)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+	left := h.leavePresenceLocked(clientId, room)
+	h.lock.Unlock()
+
+	h.announceLeaves(left)
+}
+
+// Members returns the ids of the clients in room, in ascending order.
+func (h *Hub) Members(room string) []int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.membersLocked(room)
+}
+
+func (h *Hub) membersLocked(room string) []int {
+	members := make([]int, 0, len(h.rooms[room]))
+	for id := range h.rooms[room] {
+		members = append(members, id)
+	}
+	sort.Ints(members)
+	return members
+}
+
+// Rooms returns the rooms of a client, sorted.
+func (h *Hub) Rooms(clientId int) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var rooms []string
+	for room, members := range h.rooms {
+		if _, ok := members[clientId]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// BroadcastRoom sends the message to the clients in room.
+func (h *Hub) BroadcastRoom(room string, message *Message) {
+	h.sendAll(h.Members(room), message)
+}
+
+// SetMetadata stores a value with a connected client until it
+// disconnects.
+func (h *Hub) SetMetadata(clientId int, key string, value any) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.client(clientId) == nil {
+		return ErrNoClient
+	}
+	if h.metadata[clientId] == nil {
+		h.metadata[clientId] = make(map[string]any)
+	}
+	h.metadata[clientId][key] = value
+	return nil
+}
+
+func (h *Hub) Metadata(clientId int, key string) (value any, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	value, ok = h.metadata[clientId][key]
+	return
+}
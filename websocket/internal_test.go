@@ -0,0 +1,214 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		dir      ioDirection
+		resp     *http.Response
+		kind     ErrorKind
+		sentinel error
+	}{
+		{"normal close", &websocket.CloseError{Code: websocket.CloseNormalClosure},
+			dirRead, nil, KindNormalClosure, ErrNormalClosure},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway},
+			dirRead, nil, KindNormalClosure, ErrNormalClosure},
+		{"read limit", websocket.ErrReadLimit,
+			dirRead, nil, KindMessageTooBig, ErrMessageTooBig},
+		{"auth", websocket.ErrBadHandshake,
+			dirRead, &http.Response{StatusCode: http.StatusUnauthorized},
+			KindAuthRejected, ErrAuthRejected},
+		{"bad handshake", websocket.ErrBadHandshake,
+			dirRead, &http.Response{StatusCode: http.StatusNotFound},
+			KindUnknown, nil},
+		{"read timeout", os.ErrDeadlineExceeded,
+			dirRead, nil, KindReadTimeout, ErrReadTimeout},
+		{"write timeout", os.ErrDeadlineExceeded,
+			dirWrite, nil, KindWriteTimeout, ErrWriteTimeout},
+	}
+
+	for _, test := range tests {
+		err := classifyError(test.err, test.dir, test.resp)
+		if KindOf(err) != test.kind {
+			t.Errorf("%s: kind %v, expected %v", test.name, KindOf(err), test.kind)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: original error lost", test.name)
+		}
+		if test.sentinel != nil && !errors.Is(err, test.sentinel) {
+			t.Errorf("%s: not matching sentinel %v", test.name, test.sentinel)
+		}
+	}
+}
+
+// ctxRecorder records the client id found in the context of each call.
+type ctxRecorder struct {
+	*RingBufferEvents
+	ids []int
+}
+
+func (c *ctxRecorder) OnReceiveCtx(ctx context.Context, msg Message) {
+	id, _ := ClientIdFromContext(ctx)
+	c.ids = append(c.ids, id)
+	c.OnReceive(msg)
+}
+
+func (c *ctxRecorder) OnConnectCtx(ctx context.Context, id int) {
+	ctxId, _ := ClientIdFromContext(ctx)
+	c.ids = append(c.ids, ctxId)
+	c.OnConnect(id)
+}
+
+func TestWrappersForwardCtx(t *testing.T) {
+	wrappers := map[string]func(inner Events) Events{
+		"recovering": func(inner Events) Events { return NewRecoveringEvents(inner, nil) },
+		"ringbuffer": func(inner Events) Events { return NewRingBufferEvents(inner, 4) },
+		"filtered": func(inner Events) Events {
+			return NewFilteredEvents(inner, FilterOptions{})
+		},
+	}
+	ctx := withClientId(context.Background(), 7)
+
+	for name, wrap := range wrappers {
+		inner := &ctxRecorder{RingBufferEvents: NewRingBufferEvents(nil, 4)}
+		handler := wrap(inner)
+		dispatchConnect(ctx, handler, 7)
+		dispatchReceive(ctx, handler, Message{ClientId: 7, Data: []byte("hi")})
+
+		if len(inner.ids) != 2 || inner.ids[0] != 7 || inner.ids[1] != 7 {
+			t.Errorf("%s: context not passed on: %v", name, inner.ids)
+		}
+		if len(inner.Snapshot()) != 1 || len(inner.SnapshotEvents()) != 1 {
+			t.Errorf("%s: calls not passed on", name)
+		}
+	}
+
+	// plain handlers still get the plain calls
+	messages := make(chan Message, 1)
+	plain := NewEventsToChannel(messages, nil)
+	dispatchReceive(ctx, NewRecoveringEvents(plain, nil), Message{Data: []byte("hi")})
+	if len(messages) != 1 {
+		t.Error("message not passed to a plain handler")
+	}
+}
+
+type captureLogger struct {
+	lines []string
+}
+
+func (c *captureLogger) Debug(module string, message string) {
+	c.lines = append(c.lines, "debug "+module+": "+message)
+}
+func (c *captureLogger) Info(module string, message string) {
+	c.lines = append(c.lines, "info "+module+": "+message)
+}
+func (c *captureLogger) Warn(module string, message string) {
+	c.lines = append(c.lines, "warn "+module+": "+message)
+}
+func (c *captureLogger) Error(module string, message string) {
+	c.lines = append(c.lines, "error "+module+": "+message)
+}
+
+func TestLogger(t *testing.T) {
+	capture := &captureLogger{}
+	SetLogger(capture)
+	SetLogLevel(LogLevelWarn)
+	defer SetLogger(nil)
+	defer SetLogLevel(LogLevelDebug)
+
+	logDebug(LogRegioWsClient, "hidden %d", 1)
+	logInfo(LogRegioWsClient, "hidden %d", 2)
+	logWarn(LogRegioWsClient, "shown %d", 3)
+	logError(LogRegioWsServer, "shown %d", 4)
+
+	want := []string{"warn websocket client: shown 3", "error ws server: shown 4"}
+	if len(capture.lines) != len(want) {
+		t.Fatal("unexpected log lines: ", capture.lines)
+	}
+	for i := range want {
+		if capture.lines[i] != want[i] {
+			t.Errorf("line %d: %q, want %q", i, capture.lines[i], want[i])
+		}
+	}
+}
+
+func TestProxyBackendHeader(t *testing.T) {
+	r := &http.Request{
+		RemoteAddr: "10.0.0.2:1234",
+		Header: http.Header{
+			"X-Forwarded-For": {"10.0.0.1"},
+			"Cookie":          {"a=b"},
+			"Origin":          {"https://example.com"},
+		},
+	}
+	header := backendHeader(r, DefaultForwardHeaders)
+	if got := header.Get("X-Forwarded-For"); got != "10.0.0.1, 10.0.0.2" {
+		t.Errorf("X-Forwarded-For %q", got)
+	}
+	if header.Get("Cookie") != "a=b" || header.Get("Origin") != "" {
+		t.Errorf("unexpected header %v", header)
+	}
+}
+
+func TestTextFrame(t *testing.T) {
+	binary := []byte{0x00, 0xff, 0x01, 'b', 0x80}
+	for _, data := range [][]byte{nil, binary, bytes.Repeat(binary, 100)} {
+		messageType, frame := encodeTextFrame(BinaryMessage, data)
+		if messageType != TextMessage || !utf8.Valid(frame) ||
+			len(frame) != 2+(len(data)+2)/3*4 {
+			t.Errorf("%d bytes framed as %d %q", len(data), messageType, frame)
+		}
+		messageType, decoded, err := decodeTextFrame(messageType, frame)
+		if err != nil || messageType != BinaryMessage || !bytes.Equal(decoded, data) {
+			t.Error("round trip failed: ", decoded, err)
+		}
+	}
+	for _, text := range []string{"", "plain", "\x01tagged", "\x01"} {
+		messageType, frame := encodeTextFrame(TextMessage, []byte(text))
+		if (text == "" || text[0] != 0x01) && string(frame) != text {
+			t.Errorf("untagged text changed to %q", frame)
+		}
+		_, decoded, err := decodeTextFrame(messageType, frame)
+		if err != nil || string(decoded) != text {
+			t.Errorf("text %q decoded to %q: %v", text, decoded, err)
+		}
+	}
+
+}
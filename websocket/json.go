@@ -0,0 +1,231 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	EncodingBase64 = "base64"
+	EncodingText   = "text"
+)
+
+var messageTypeToString = map[int]string{
+	websocket.TextMessage:   "text",
+	websocket.BinaryMessage: "binary",
+	websocket.CloseMessage:  "close",
+	websocket.PingMessage:   "ping",
+	websocket.PongMessage:   "pong",
+}
+
+var eventTypeToString = map[EventType]string{
+	Connect:         "connect",
+	Disconnect:      "disconnect",
+	Failure:         "failure",
+	FailureWithExit: "failure_with_exit",
+}
+
+func MessageTypeString(messageType int) string {
+	if name, ok := messageTypeToString[messageType]; ok {
+		return name
+	}
+	return strconv.Itoa(messageType)
+}
+
+func parseMessageType(name string) (int, error) {
+	for messageType, n := range messageTypeToString {
+		if n == name {
+			return messageType, nil
+		}
+	}
+	messageType, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown message type %q", name)
+	}
+	return messageType, nil
+}
+
+func (e EventType) String() string {
+	if name, ok := eventTypeToString[e]; ok {
+		return name
+	}
+	return strconv.Itoa(int(e))
+}
+
+type jsonMessage struct {
+	Type     string `json:"type"`
+	ClientId int    `json:"client"`
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+	Origin   string `json:"origin,omitempty"`
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonMessage{
+		Type:     MessageTypeString(m.MessageType),
+		ClientId: m.ClientId,
+		Encoding: EncodingBase64,
+		Data:     base64.StdEncoding.EncodeToString(m.Data),
+		Origin:   m.Origin,
+	})
+}
+
+func (m *Message) UnmarshalJSON(data []byte) (err error) {
+	var raw jsonMessage
+
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if m.MessageType, err = parseMessageType(raw.Type); err != nil {
+		return err
+	}
+	m.ClientId = raw.ClientId
+	m.Origin = raw.Origin
+
+	switch raw.Encoding {
+	case EncodingBase64:
+		m.Data, err = base64.StdEncoding.DecodeString(raw.Data)
+	case EncodingText:
+		m.Data = []byte(raw.Data)
+	default:
+		err = fmt.Errorf("unknown encoding %q", raw.Encoding)
+	}
+	return err
+}
+
+type jsonEvent struct {
+	Type  string `json:"type"`
+	Id    int    `json:"id"`
+	Kind  string `json:"kind,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	raw := jsonEvent{
+		Type: e.Type.String(),
+		Id:   e.Id,
+	}
+	if e.Err != nil {
+		raw.Error = e.Err.Error()
+		raw.Kind = e.Kind.String()
+	}
+	return json.Marshal(raw)
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var raw jsonEvent
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	e.Type = 0
+	found := false
+	for eventType, name := range eventTypeToString {
+		if name == raw.Type {
+			e.Type = eventType
+			found = true
+		}
+	}
+	if !found {
+		eventType, err := strconv.Atoi(raw.Type)
+		if err != nil {
+			return fmt.Errorf("unknown event type %q", raw.Type)
+		}
+		e.Type = EventType(eventType)
+	}
+
+	e.Id = raw.Id
+	e.Err = nil
+	e.Kind = KindUnknown
+	if raw.Error != "" {
+		e.Err = errors.New(raw.Error)
+	}
+	for kind, sentinel := range kindToError {
+		if sentinel.Error() == raw.Kind {
+			e.Kind = kind
+		}
+	}
+
+	return nil
+}
+
+// JSONLRecord is one line written by JSONLWriterEvents. Exactly one of
+// Message and Event is set.
+type JSONLRecord struct {
+	Time    time.Time `json:"ts"`
+	Message *Message  `json:"message,omitempty"`
+	Event   *Event    `json:"event,omitempty"`
+}
+
+type JSONLWriterEvents struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONLWriterEvents(w io.Writer) *JSONLWriterEvents {
+	return &JSONLWriterEvents{
+		lock:    sync.Mutex{},
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func (j *JSONLWriterEvents) write(record JSONLRecord) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	record.Time = time.Now()
+	if err := j.encoder.Encode(record); err != nil {
+		logError("JSONLWriter", "write record: %v", err)
+	}
+}
+
+func (j *JSONLWriterEvents) OnReceive(msg Message) {
+	j.write(JSONLRecord{Message: &msg})
+}
+
+func (j *JSONLWriterEvents) OnDisconnect(id int) {
+	j.write(JSONLRecord{Event: &Event{Type: Disconnect, Id: id}})
+}
+
+func (j *JSONLWriterEvents) OnConnect(id int) {
+	j.write(JSONLRecord{Event: &Event{Type: Connect, Id: id}})
+}
+
+func (j *JSONLWriterEvents) OnFailure(exited bool, err error) {
+	evnt := failureEvent(exited, err)
+	j.write(JSONLRecord{Event: &evnt})
+}
@@ -0,0 +1,146 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const keepaliveWriteWait = 5 * time.Second
+
+var errPongTimeout = errors.New("no pong received")
+
+type PongHook func(id int, rtt time.Duration)
+
+type keepaliveConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+	onPong   PongHook
+}
+
+// deadPeer closes a connection which missed its pong or heartbeat. The
+// read loop ends on the closed connection and reports the recorded cause
+// instead of its read error, so the failure is reported once.
+type deadPeer struct {
+	cause atomic.Pointer[ClassifiedError]
+	close func() error
+}
+
+func (d *deadPeer) fail(err *ClassifiedError) {
+	if d.cause.CompareAndSwap(nil, err) {
+		_ = d.close()
+	}
+}
+
+func (d *deadPeer) failed() bool {
+	return d.cause.Load() != nil
+}
+
+// err returns the cause if the connection was closed as dead, else readErr.
+func (d *deadPeer) err(readErr error) error {
+	if cause := d.cause.Load(); cause != nil {
+		return cause
+	}
+	return readErr
+}
+
+// runKeepalive sends a ping every interval until ctx is done. If no pong
+// arrives within timeout, dead closes the connection, which ends the read
+// loop. Ping failures are logged under module.
+func runKeepalive(ctx context.Context, cfg keepaliveConfig, conn *websocket.Conn,
+	id int, module string, dead *deadPeer) {
+
+	if cfg.interval <= 0 {
+		return
+	}
+
+	var (
+		lock    sync.Mutex
+		pending = make(map[string]time.Time)
+	)
+
+	conn.SetPongHandler(func(appData string) error {
+		lock.Lock()
+		sent, ok := pending[appData]
+		for key := range pending {
+			delete(pending, key)
+		}
+		lock.Unlock()
+
+		if ok && cfg.onPong != nil {
+			cfg.onPong(id, time.Since(sent))
+		}
+		return nil
+	})
+
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		payload := strconv.FormatInt(now.UnixNano(), 10)
+
+		lock.Lock()
+		pending[payload] = now
+		lock.Unlock()
+
+		err := conn.WriteControl(websocket.PingMessage, []byte(payload),
+			now.Add(keepaliveWriteWait))
+		if err != nil {
+			logKV(LogLevelDebug, module, "ping failed",
+				LogKeyClientId, id, LogKeyError, err)
+			continue
+		}
+
+		if cfg.timeout > 0 {
+			time.AfterFunc(cfg.timeout, func() {
+				lock.Lock()
+				_, missing := pending[payload]
+				lock.Unlock()
+
+				if missing && ctx.Err() == nil {
+					dead.fail(&ClassifiedError{
+						Kind: KindReadTimeout,
+						Err:  errPongTimeout,
+					})
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/ChrIgiSta/go-utils/logger"
+)
+
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelNone
+)
+
+// Logger receives the log output of the client and server. module is one
+// of the LogRegio* constants.
+type Logger interface {
+	Debug(module string, message string)
+	Info(module string, message string)
+	Warn(module string, message string)
+	Error(module string, message string)
+}
+
+// StructuredLogger is a Logger which also takes the context of a log call
+// as key/value pairs, see the LogKey* constants. Other loggers get the
+// pairs appended to the message.
+type StructuredLogger interface {
+	Logger
+	LogAttrs(level LogLevel, module string, message string, keysAndValues ...any)
+}
+
+// Keys of the context passed with log calls.
+const (
+	LogKeyClientId   = "client_id"
+	LogKeyRemoteAddr = "remote_addr"
+	LogKeyPath       = "path"
+	LogKeyURL        = "url"
+	LogKeyError      = "error"
+)
+
+// utilsLogger is the default Logger writing to the go-utils logger, which
+// applies its own level from LOG_LEVEL on top. The go-utils logger isn't
+// safe for concurrent use, utilsLock serializes the calls.
+type utilsLogger struct{}
+
+var utilsLock sync.Mutex
+
+func (utilsLogger) Debug(module string, message string) {
+	utilsLock.Lock()
+	defer utilsLock.Unlock()
+	_ = log.Debug(module, "%s", message)
+}
+
+func (utilsLogger) Info(module string, message string) {
+	utilsLock.Lock()
+	defer utilsLock.Unlock()
+	_ = log.Info(module, "%s", message)
+}
+
+func (utilsLogger) Warn(module string, message string) {
+	utilsLock.Lock()
+	defer utilsLock.Unlock()
+	_ = log.Warn(module, "%s", message)
+}
+
+func (utilsLogger) Error(module string, message string) {
+	utilsLock.Lock()
+	defer utilsLock.Unlock()
+	_ = log.Error(module, "%s", message)
+}
+
+var (
+	logLock   sync.RWMutex
+	logger    Logger = utilsLogger{}
+	logFilter        = LogLevelDebug
+)
+
+// SetLogger replaces the logger of the package, nil restores the default.
+func SetLogger(l Logger) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if l == nil {
+		l = utilsLogger{}
+	}
+	logger = l
+}
+
+// SetLogLevel drops log output below level before it reaches the logger.
+func SetLogLevel(level LogLevel) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logFilter = level
+}
+
+func logf(level LogLevel, module string, format string, args ...any) {
+	logLock.RLock()
+	l, filter := logger, logFilter
+	logLock.RUnlock()
+
+	if level < filter {
+		return
+	}
+
+	write(l, level, module, fmt.Sprintf(format, args...))
+}
+
+// logKV logs message with key/value context, structured if the logger
+// supports it.
+func logKV(level LogLevel, module string, message string, keysAndValues ...any) {
+	logLock.RLock()
+	l, filter := logger, logFilter
+	logLock.RUnlock()
+
+	if level < filter {
+		return
+	}
+
+	if structured, ok := l.(StructuredLogger); ok {
+		structured.LogAttrs(level, module, message, keysAndValues...)
+		return
+	}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		message += fmt.Sprintf(" %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	write(l, level, module, message)
+}
+
+func write(l Logger, level LogLevel, module string, message string) {
+	switch level {
+	case LogLevelDebug:
+		l.Debug(module, message)
+	case LogLevelInfo:
+		l.Info(module, message)
+	case LogLevelWarn:
+		l.Warn(module, message)
+	default:
+		l.Error(module, message)
+	}
+}
+
+func logDebug(module string, format string, args ...any) {
+	logf(LogLevelDebug, module, format, args...)
+}
+
+func logInfo(module string, format string, args ...any) {
+	logf(LogLevelInfo, module, format, args...)
+}
+
+func logWarn(module string, format string, args ...any) {
+	logf(LogLevelWarn, module, format, args...)
+}
+
+func logError(module string, format string, args ...any) {
+	logf(LogLevelError, module, format, args...)
+}
@@ -0,0 +1,451 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeHandshakeTimeout is how long Close waits for the peer to answer the
+// close frame before the connection is dropped.
+const closeHandshakeTimeout = time.Second
+
+// wsAddr is the net.Addr of a connection that is not established yet.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// netConn adapts a websocket connection to a byte stream. Binary messages
+// are read as successive chunks of the stream, each Write is sent as one
+// binary message.
+type netConn struct {
+	incoming  chan []byte
+	done      chan struct{} // connection ended
+	closed    chan struct{} // Close called
+	doneOnce  sync.Once
+	closeOnce sync.Once
+
+	readLock sync.Mutex
+	pending  []byte
+
+	lock            sync.Mutex
+	readDeadline    time.Time
+	deadlineChanged chan struct{}
+	local, remote   net.Addr
+
+	write            func(data []byte) error
+	setWriteDeadline func(t time.Time) error
+	sendClose        func() error
+	drop             func() error
+}
+
+func newNetConn() *netConn {
+	return &netConn{
+		incoming:        make(chan []byte, 16),
+		done:            make(chan struct{}),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+		local:           wsAddr(""),
+		remote:          wsAddr(""),
+	}
+}
+
+// deliver blocks until the message is read, which throttles the peer if
+// the reader is slow.
+func (n *netConn) deliver(data []byte) {
+	select {
+	case n.incoming <- data:
+	case <-n.closed:
+	}
+}
+
+func (n *netConn) ended() {
+	n.doneOnce.Do(func() { close(n.done) })
+}
+
+func (n *netConn) setAddrs(local, remote net.Addr) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.local, n.remote = local, remote
+}
+
+// Read returns io.EOF once the connection ended and all received data is
+// read.
+func (n *netConn) Read(p []byte) (int, error) {
+	n.readLock.Lock()
+	defer n.readLock.Unlock()
+
+	for len(n.pending) == 0 {
+		data, err := n.next()
+		if err != nil {
+			return 0, err
+		}
+		n.pending = data
+	}
+
+	count := copy(p, n.pending)
+	n.pending = n.pending[count:]
+	return count, nil
+}
+
+func (n *netConn) next() ([]byte, error) {
+	for {
+		data, retry, err := n.receive()
+		if !retry {
+			return data, err
+		}
+	}
+}
+
+// receive waits for the next data until the read deadline. retry is set if
+// the deadline changed while waiting.
+func (n *netConn) receive() (data []byte, retry bool, err error) {
+	n.lock.Lock()
+	deadline, changed := n.readDeadline, n.deadlineChanged
+	n.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, false, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case data = <-n.incoming:
+		return data, false, nil
+	case <-n.closed:
+		return nil, false, net.ErrClosed
+	case <-n.done:
+		select {
+		case data = <-n.incoming:
+			return data, false, nil
+		default:
+			return nil, false, io.EOF
+		}
+	case <-timeout:
+		return nil, false, os.ErrDeadlineExceeded
+	case <-changed:
+		return nil, true, nil
+	}
+}
+
+func (n *netConn) Write(p []byte) (int, error) {
+	select {
+	case <-n.closed:
+		return 0, net.ErrClosed
+	case <-n.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if err := n.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame, waits up to closeHandshakeTimeout for the
+// peer to answer it and drops the connection.
+func (n *netConn) Close() (err error) {
+	err = net.ErrClosed
+	n.closeOnce.Do(func() {
+		close(n.closed)
+
+		err = nil
+		select {
+		case <-n.done:
+		default:
+			_ = n.sendClose()
+			timer := time.NewTimer(closeHandshakeTimeout)
+			select {
+			case <-n.done:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+		_ = n.drop()
+	})
+	return err
+}
+
+func (n *netConn) LocalAddr() net.Addr {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.local
+}
+
+func (n *netConn) RemoteAddr() net.Addr {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.remote
+}
+
+func (n *netConn) SetDeadline(t time.Time) error {
+	if err := n.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return n.SetWriteDeadline(t)
+}
+
+// SetReadDeadline applies to the stream only, a timed out Read leaves the
+// connection intact.
+func (n *netConn) SetReadDeadline(t time.Time) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.readDeadline = t
+	close(n.deadlineChanged)
+	n.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the websocket connection. A
+// timed out write breaks the connection.
+func (n *netConn) SetWriteDeadline(t time.Time) error {
+	return n.setWriteDeadline(t)
+}
+
+func closeFrame(conn *websocket.Conn) error {
+	return conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeHandshakeTimeout))
+}
+
+// replyToClose answers a close frame of the peer. Unlike the default
+// handler it also ends the read with the peer's *websocket.CloseError if
+// we started the close handshake.
+func replyToClose(conn *websocket.Conn) {
+	conn.SetCloseHandler(func(code int, text string) error {
+		err := conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, ""),
+			time.Now().Add(closeHandshakeTimeout))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			return err
+		}
+		return nil
+	})
+}
+
+// clientNetConn wraps the event handler of a Client to feed its netConn.
+type clientNetConn struct {
+	*netConn
+	inner  Events
+	client *Client
+}
+
+// NewNetConn returns a net.Conn streaming over binary messages of c. It
+// wraps the client's event handler, other messages and all events are
+// passed on. Create it before connecting, the stream ends with the first
+// connection, so don't combine it with SetReconnect.
+func NewNetConn(c *Client) net.Conn {
+	n := &clientNetConn{
+		netConn: newNetConn(),
+		inner:   c.EventHandler(),
+		client:  c,
+	}
+	n.write = func(data []byte) error {
+		return c.Send(Message{MessageType: BinaryMessage, Data: data})
+	}
+	n.setWriteDeadline = c.setWriteDeadline
+	n.sendClose = func() error {
+		conn := c.connection()
+		if conn == nil {
+			return nil
+		}
+		return closeFrame(conn)
+	}
+	n.drop = c.Disconnect
+	c.SetEventHandler(n)
+	return n
+}
+
+func (n *clientNetConn) OnReceive(msg Message) {
+	n.OnReceiveCtx(context.Background(), msg)
+}
+
+func (n *clientNetConn) OnReceiveCtx(ctx context.Context, msg Message) {
+	if msg.MessageType == BinaryMessage {
+		n.deliver(msg.Data)
+		return
+	}
+	dispatchReceive(ctx, n.inner, msg)
+}
+
+func (n *clientNetConn) OnConnect(id int) {
+	if conn := n.client.connection(); conn != nil {
+		n.setAddrs(conn.LocalAddr(), conn.RemoteAddr())
+	}
+	n.inner.OnConnect(id)
+}
+
+func (n *clientNetConn) OnDisconnect(id int) {
+	n.ended()
+	n.inner.OnDisconnect(id)
+}
+
+func (n *clientNetConn) OnFailure(exited bool, err error) {
+	n.inner.OnFailure(exited, err)
+}
+
+// netListener wraps the event handler of a Server and hands out a netConn
+// per client.
+type netListener struct {
+	inner  Events
+	server *Server
+
+	lock  sync.Mutex
+	conns map[int]*netConn
+
+	accept chan *netConn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewNetListener returns a net.Listener accepting a net.Conn per client of
+// s, streaming over binary messages like NewNetConn. It wraps the server's
+// event handler, other messages and all events are passed on. Clients
+// connecting while 16 connections wait for Accept, or after Close, are
+// disconnected. Create it before ListenAndServe.
+func NewNetListener(s *Server) net.Listener {
+	l := &netListener{
+		inner:  s.EventHandler(),
+		server: s,
+		conns:  make(map[int]*netConn),
+		accept: make(chan *netConn, 16),
+		closed: make(chan struct{}),
+	}
+	s.SetEventHandler(l)
+	return l
+}
+
+func (l *netListener) Accept() (net.Conn, error) {
+	select {
+	case n := <-l.accept:
+		return n, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, connections already accepted stay open.
+func (l *netListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *netListener) Addr() net.Addr {
+	return wsAddr(l.server.address)
+}
+
+func (l *netListener) OnConnect(id int) {
+	client := l.server.client(id)
+	if client == nil {
+		return
+	}
+
+	n := newNetConn()
+	n.setAddrs(client.conn.LocalAddr(), client.conn.RemoteAddr())
+	n.write = func(data []byte) error {
+		return l.server.Send(id, &Message{MessageType: BinaryMessage, Data: data})
+	}
+	n.setWriteDeadline = func(t time.Time) error {
+		return l.server.setWriteDeadline(id, t)
+	}
+	n.sendClose = func() error { return closeFrame(client.conn) }
+	n.drop = func() error {
+		client.cancel()
+		return nil
+	}
+
+	select {
+	case <-l.closed:
+	default:
+		l.lock.Lock()
+		l.conns[id] = n
+		l.lock.Unlock()
+
+		select {
+		case l.accept <- n:
+			l.inner.OnConnect(id)
+			return
+		default:
+			l.lock.Lock()
+			delete(l.conns, id)
+			l.lock.Unlock()
+		}
+	}
+	logWarn(LogRegioWsServer, "net listener: client <%d> not accepted", id)
+	_ = l.server.Disconnect(id)
+}
+
+func (l *netListener) OnReceive(msg Message) {
+	l.OnReceiveCtx(context.Background(), msg)
+}
+
+func (l *netListener) OnReceiveCtx(ctx context.Context, msg Message) {
+	l.lock.Lock()
+	n := l.conns[msg.ClientId]
+	l.lock.Unlock()
+
+	if n != nil && msg.MessageType == BinaryMessage {
+		n.deliver(msg.Data)
+		return
+	}
+	dispatchReceive(ctx, l.inner, msg)
+}
+
+func (l *netListener) OnDisconnect(id int) {
+	l.lock.Lock()
+	n := l.conns[id]
+	delete(l.conns, id)
+	l.lock.Unlock()
+
+	if n == nil {
+		return
+	}
+	n.ended()
+	l.inner.OnDisconnect(id)
+}
+
+func (l *netListener) OnFailure(exited bool, err error) {
+	l.inner.OnFailure(exited, err)
+}
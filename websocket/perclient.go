@@ -0,0 +1,166 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"sync"
+)
+
+type clientChannel struct {
+	lock    sync.Mutex
+	channel chan Message
+	closed  bool
+	// done is closed by the disconnect to release a blocked receive
+	done chan struct{}
+}
+
+// PerClientChannels demultiplexes received messages into one channel per
+// connected client.
+type PerClientChannels struct {
+	lock       sync.RWMutex
+	bufferSize int
+	clients    map[int]*clientChannel
+	newClients chan int
+	// pending queues the notifications the new clients channel had no
+	// room for, a pump goroutine delivers them while it is not empty
+	pending []int
+	pumping bool
+}
+
+func NewPerClientChannels(bufferSize int) *PerClientChannels {
+	return &PerClientChannels{
+		lock:       sync.RWMutex{},
+		bufferSize: bufferSize,
+		clients:    make(map[int]*clientChannel),
+		newClients: make(chan int, bufferSize),
+	}
+}
+
+// NewClients delivers the id of every newly connected client in connect
+// order. Ids the channel has no room for are queued, so a connect never
+// waits for the channel to be drained.
+func (p *PerClientChannels) NewClients() <-chan int {
+	return p.newClients
+}
+
+// Client returns the message channel of a connected client. The channel is
+// closed when the client disconnects.
+func (p *PerClientChannels) Client(id int) (<-chan Message, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	client, ok := p.clients[id]
+	if !ok {
+		return nil, false
+	}
+	return client.channel, true
+}
+
+func (p *PerClientChannels) OnReceive(msg Message) {
+	p.lock.RLock()
+	client, ok := p.clients[msg.ClientId]
+	p.lock.RUnlock()
+
+	if !ok {
+		logDebug("PerClient2Channel", "drop message of unknown client %d",
+			msg.ClientId)
+		return
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.closed {
+		return
+	}
+	select {
+	case client.channel <- msg:
+	case <-client.done:
+	}
+}
+
+func (p *PerClientChannels) OnDisconnect(id int) {
+	p.lock.Lock()
+	client, ok := p.clients[id]
+	delete(p.clients, id)
+	p.lock.Unlock()
+
+	if !ok {
+		return
+	}
+	close(client.done)
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.closed = true
+	close(client.channel)
+}
+
+func (p *PerClientChannels) OnConnect(id int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, exists := p.clients[id]; !exists {
+		p.clients[id] = &clientChannel{
+			channel: make(chan Message, p.bufferSize),
+			done:    make(chan struct{}),
+		}
+	}
+
+	// never block the connect of the client
+	if !p.pumping {
+		select {
+		case p.newClients <- id:
+			return
+		default:
+		}
+		p.pumping = true
+		go p.pump()
+	}
+	p.pending = append(p.pending, id)
+}
+
+// pump delivers the queued new client notifications.
+func (p *PerClientChannels) pump() {
+	for {
+		p.lock.Lock()
+		if len(p.pending) == 0 {
+			p.pumping = false
+			p.lock.Unlock()
+			return
+		}
+		id := p.pending[0]
+		p.pending = p.pending[1:]
+		p.lock.Unlock()
+
+		p.newClients <- id
+	}
+}
+
+func (p *PerClientChannels) OnFailure(exited bool, err error) {
+	logDebug("PerClient2Channel", "onFailure (exited: %v): %v", exited, err)
+}
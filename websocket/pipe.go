@@ -0,0 +1,222 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+type Framing int
+
+const (
+	// FramingLine sends each line as one message without the line break.
+	// Received messages are written with a trailing newline.
+	FramingLine Framing = iota
+	// FramingChunk sends each read of up to ChunkSize bytes as one message.
+	FramingChunk
+	// FramingStream sends everything up to EOF as one message.
+	FramingStream
+)
+
+const defaultPipeChunkSize = 32 * 1024
+
+type PipeOptions struct {
+	Framing Framing
+	// ChunkSize limits the messages of FramingChunk, default 32 KiB.
+	ChunkSize int
+	// MessageType of sent messages, default TextMessage for FramingLine
+	// and BinaryMessage otherwise.
+	MessageType int
+}
+
+// pipeEvents writes received messages to the pipe's writer and passes all
+// events on.
+type pipeEvents struct {
+	inner   Events
+	w       io.Writer
+	newline bool
+
+	lock      sync.Mutex
+	failed    bool
+	connected chan struct{}
+	connOnce  sync.Once
+	ended     chan error
+}
+
+func (p *pipeEvents) end(err error) {
+	select {
+	case p.ended <- err:
+	default:
+	}
+}
+
+func (p *pipeEvents) OnReceive(msg Message) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.failed {
+		return
+	}
+	data := msg.Data
+	if p.newline && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
+	}
+	if _, err := p.w.Write(data); err != nil {
+		p.failed = true
+		p.end(err)
+	}
+}
+
+func (p *pipeEvents) OnConnect(id int) {
+	p.OnConnectCtx(context.Background(), id)
+}
+
+func (p *pipeEvents) OnConnectCtx(ctx context.Context, id int) {
+	p.connOnce.Do(func() { close(p.connected) })
+	dispatchConnect(ctx, p.inner, id)
+}
+
+func (p *pipeEvents) OnDisconnect(id int) {
+	p.end(nil)
+	p.inner.OnDisconnect(id)
+}
+
+func (p *pipeEvents) OnFailure(exited bool, err error) {
+	if exited && KindOf(err) != KindNormalClosure {
+		p.end(err)
+	}
+	p.inner.OnFailure(exited, err)
+}
+
+// Pipe copies r to c as messages framed as configured and received
+// messages of c to w, until r reaches EOF, the connection ends, an error
+// occurs on either side or ctx is done. If c is not connected yet, Pipe
+// waits for the connection. A normal closure by the peer and EOF of r
+// return nil. The event handler of c is wrapped while the pipe runs, its
+// messages go to w. Pipe does not disconnect c and can't interrupt a
+// blocked Read of r on return.
+func Pipe(ctx context.Context, c *Client, r io.Reader, w io.Writer,
+	opts PipeOptions) error {
+
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultPipeChunkSize
+	}
+	if opts.MessageType == 0 {
+		opts.MessageType = BinaryMessage
+		if opts.Framing == FramingLine {
+			opts.MessageType = TextMessage
+		}
+	}
+
+	events := &pipeEvents{
+		inner:     c.EventHandler(),
+		w:         w,
+		newline:   opts.Framing == FramingLine,
+		connected: make(chan struct{}),
+		ended:     make(chan error, 1),
+	}
+	c.SetEventHandler(events)
+	defer c.SetEventHandler(events.inner)
+
+	if c.connection() != nil {
+		events.connOnce.Do(func() { close(events.connected) })
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-events.ended:
+		return err
+	case <-events.connected:
+	}
+
+	sendDone := make(chan error, 1)
+	go func() {
+		sendDone <- pipeSend(c, r, opts)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-events.ended:
+		return err
+	case err := <-sendDone:
+		return err
+	}
+}
+
+func pipeSend(c *Client, r io.Reader, opts PipeOptions) error {
+	send := func(data []byte) error {
+		return c.Send(Message{MessageType: opts.MessageType, Data: data})
+	}
+
+	switch opts.Framing {
+	case FramingLine:
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+				if sendErr := send(line); sendErr != nil {
+					return sendErr
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case FramingChunk:
+		buf := make([]byte, opts.ChunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				// Send does not keep the data, buf can be reused
+				if sendErr := send(buf[:n]); sendErr != nil {
+					return sendErr
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return send(data)
+	}
+}
@@ -0,0 +1,252 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultPresenceDebounce is how long a member who lost all connections
+// stays present, so a reconnect does not announce a leave and a join.
+const DefaultPresenceDebounce = 2 * time.Second
+
+// Types of PresenceEvent.
+const (
+	PresenceSnapshot = "snapshot"
+	PresenceJoin     = "join"
+	PresenceLeave    = "leave"
+)
+
+// Member describes who joined a room with presence. Key identifies the
+// member across connections, e.g. the user id, it defaults to the client
+// id.
+type Member struct {
+	Key      string         `json:"key"`
+	Name     string         `json:"name,omitempty"`
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+type PresenceEntry struct {
+	Member
+	// ClientIds are the connections of the member, empty when it left
+	// or is about to.
+	ClientIds []int     `json:"clients"`
+	Since     time.Time `json:"since"`
+}
+
+// PresenceEvent is sent to the clients of a room as json text message
+// {"presence": {...}}. A joining client gets a snapshot of all members,
+// the others get joins and leaves.
+type PresenceEvent struct {
+	Room    string          `json:"room"`
+	Type    string          `json:"type"`
+	Members []PresenceEntry `json:"members"`
+}
+
+type presenceMessage struct {
+	Presence *PresenceEvent `json:"presence"`
+}
+
+// ParsePresence decodes a presence event received by a client, ok is
+// false for other messages.
+func ParsePresence(msg Message) (evnt *PresenceEvent, ok bool) {
+	if msg.MessageType != TextMessage {
+		return nil, false
+	}
+	var envelope presenceMessage
+	if json.Unmarshal(msg.Data, &envelope) != nil || envelope.Presence == nil {
+		return nil, false
+	}
+	return envelope.Presence, true
+}
+
+type presenceMember struct {
+	member  Member
+	since   time.Time
+	clients map[int]struct{}
+	leaving *time.Timer
+}
+
+func (p *presenceMember) entry() PresenceEntry {
+	ids := make([]int, 0, len(p.clients))
+	for id := range p.clients {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return PresenceEntry{Member: p.member, ClientIds: ids, Since: p.since}
+}
+
+// SetPresenceDebounce sets how long members stay present after their
+// last connection left, 0 announces leaves at once.
+func (h *Hub) SetPresenceDebounce(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.debounce = d
+}
+
+// JoinPresence joins a client to room like Join and makes it present
+// there as member. The client gets a snapshot of the room's presence, the
+// other clients in the room a join unless the member was present already.
+func (h *Hub) JoinPresence(clientId int, room string, member Member) error {
+	if member.Key == "" {
+		member.Key = strconv.Itoa(clientId)
+	}
+
+	h.lock.Lock()
+	if err := h.joinLocked(clientId, room); err != nil {
+		h.lock.Unlock()
+		return err
+	}
+	if h.presence[room] == nil {
+		h.presence[room] = make(map[string]*presenceMember)
+	}
+	p := h.presence[room][member.Key]
+	joined := p == nil
+	if joined {
+		p = &presenceMember{since: time.Now(), clients: make(map[int]struct{})}
+		h.presence[room][member.Key] = p
+	}
+	if p.leaving != nil {
+		p.leaving.Stop()
+		p.leaving = nil
+	}
+	p.member = member
+	p.clients[clientId] = struct{}{}
+
+	var others []int
+	for _, id := range h.membersLocked(room) {
+		if id != clientId {
+			others = append(others, id)
+		}
+	}
+	join := p.entry()
+	snapshot := h.presenceLocked(room)
+	h.lock.Unlock()
+
+	if joined {
+		h.sendPresence(others, &PresenceEvent{
+			Room: room, Type: PresenceJoin, Members: []PresenceEntry{join}})
+	}
+	h.sendPresence([]int{clientId}, &PresenceEvent{
+		Room: room, Type: PresenceSnapshot, Members: snapshot})
+	return nil
+}
+
+// Presence returns the members present in room, longest present first.
+func (h *Hub) Presence(room string) []PresenceEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.presenceLocked(room)
+}
+
+func (h *Hub) presenceLocked(room string) []PresenceEntry {
+	entries := make([]PresenceEntry, 0, len(h.presence[room]))
+	for _, p := range h.presence[room] {
+		entries = append(entries, p.entry())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Since.Equal(entries[j].Since) {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Since.Before(entries[j].Since)
+	})
+	return entries
+}
+
+// leavePresenceLocked removes a client from the presence in room. It
+// returns the leave to announce if it was the member's last connection,
+// or schedules it after the debounce.
+func (h *Hub) leavePresenceLocked(clientId int, room string) (left []PresenceEvent) {
+	for key, p := range h.presence[room] {
+		if _, ok := p.clients[clientId]; !ok {
+			continue
+		}
+		delete(p.clients, clientId)
+		if len(p.clients) > 0 {
+			continue
+		}
+		if h.debounce > 0 {
+			key, p := key, p
+			p.leaving = time.AfterFunc(h.debounce, func() {
+				h.expirePresence(room, key, p)
+			})
+			continue
+		}
+		left = append(left, h.dropPresenceLocked(room, key, p))
+	}
+	return left
+}
+
+func (h *Hub) dropPresenceLocked(room string, key string, p *presenceMember) PresenceEvent {
+	delete(h.presence[room], key)
+	if len(h.presence[room]) == 0 {
+		delete(h.presence, room)
+	}
+	return PresenceEvent{Room: room, Type: PresenceLeave, Members: []PresenceEntry{p.entry()}}
+}
+
+// expirePresence announces the leave of a member after the debounce,
+// unless it reconnected in the meantime.
+func (h *Hub) expirePresence(room string, key string, p *presenceMember) {
+	h.lock.Lock()
+	if h.presence[room][key] != p || len(p.clients) > 0 {
+		h.lock.Unlock()
+		return
+	}
+	left := h.dropPresenceLocked(room, key, p)
+	h.lock.Unlock()
+
+	h.announceLeaves([]PresenceEvent{left})
+}
+
+func (h *Hub) announceLeaves(left []PresenceEvent) {
+	for i := range left {
+		h.sendPresence(h.Members(left[i].Room), &left[i])
+	}
+}
+
+func (h *Hub) sendPresence(clientIds []int, evnt *PresenceEvent) {
+	if len(clientIds) == 0 {
+		return
+	}
+	data, err := json.Marshal(presenceMessage{Presence: evnt})
+	if err != nil {
+		logKV(LogLevelError, LogRegioWsServer, "encode presence failed",
+			LogKeyError, err)
+		return
+	}
+	h.sendAll(clientIds, &Message{MessageType: TextMessage, Data: data})
+}
+
+// Presence returns the members present in room of the server's hub.
+func (s *Server) Presence(room string) []PresenceEntry {
+	return s.hub.Presence(room)
+}
@@ -0,0 +1,292 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const LogRegioProxy = "ws proxy"
+
+// closeBadGateway is sent to the client when the backend connection breaks
+// without a close frame.
+const closeBadGateway = 1014
+
+// DefaultForwardHeaders are copied from the inbound request to the backend
+// handshake.
+var DefaultForwardHeaders = []string{"Authorization", "Cookie", "User-Agent"}
+
+// ReverseProxy relays websocket sessions to backend servers, a backend
+// connection per inbound one. Messages keep their type, close codes are
+// passed on in both directions.
+type ReverseProxy struct {
+	backendURL func(r *http.Request) string
+
+	lock           sync.Mutex
+	checkOrigin    func(r *http.Request) bool
+	forwardHeaders []string
+	factory        func(events Events) *Client
+	stats          ProxyStats
+}
+
+// NewReverseProxy returns a proxy dialing the url returned by backendURL
+// for each inbound request. Use it as http.Handler or with
+// Server.SetHandler.
+func NewReverseProxy(backendURL func(r *http.Request) string) *ReverseProxy {
+	return &ReverseProxy{
+		backendURL:     backendURL,
+		forwardHeaders: DefaultForwardHeaders,
+		factory: func(events Events) *Client {
+			return NewClient(false, events)
+		},
+	}
+}
+
+// SetCheckOrigin overrides the default same-origin check of the upgrade.
+func (p *ReverseProxy) SetCheckOrigin(checkOrigin func(r *http.Request) bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.checkOrigin = checkOrigin
+}
+
+// SetForwardHeaders sets the headers copied to the backend handshake.
+// X-Forwarded-For is always added.
+func (p *ReverseProxy) SetForwardHeaders(names ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.forwardHeaders = names
+}
+
+// SetClientFactory replaces the backend client, e.g. to configure tls.
+// events must be passed to the client.
+func (p *ReverseProxy) SetClientFactory(factory func(events Events) *Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.factory = factory
+}
+
+func (p *ReverseProxy) Stats() ProxyStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.stats
+}
+
+func (p *ReverseProxy) count(update func(stats *ProxyStats)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	update(&p.stats)
+}
+
+// backendHeader copies the forwarded headers of r and appends the client
+// address to X-Forwarded-For.
+func backendHeader(r *http.Request, names []string) http.Header {
+	header := http.Header{}
+	for _, name := range names {
+		for _, value := range r.Header.Values(name) {
+			header.Add(name, value)
+		}
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	header.Set("X-Forwarded-For", clientIP)
+
+	return header
+}
+
+// closeMessage builds the close frame passing on the close of err to the
+// other side. Connections ending without a sendable code get fallback.
+func closeMessage(err error, fallback int) []byte {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		default:
+			return websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+		}
+	}
+	return websocket.FormatCloseMessage(fallback, "")
+}
+
+// proxySession is the event handler of a backend client, writing the
+// backend's messages and its close to the inbound connection.
+type proxySession struct {
+	client    *Client
+	connected chan struct{}
+	connOnce  sync.Once
+	// ready is closed once the inbound connection is upgraded, inbound
+	// stays nil if the upgrade failed.
+	ready   chan struct{}
+	inbound *websocket.Conn
+}
+
+func (s *proxySession) OnConnect(id int) {
+	s.connOnce.Do(func() { close(s.connected) })
+}
+
+// OnDisconnect passes the close code and reason of the backend on, also of
+// a normal closure, which is no failure.
+func (s *proxySession) OnDisconnect(id int) {
+	<-s.ready
+	if s.inbound == nil {
+		return
+	}
+	var closeErr error
+	if stats := s.client.Stats(); stats.CloseCode != 0 {
+		closeErr = &websocket.CloseError{Code: stats.CloseCode, Text: stats.CloseText}
+	}
+	deadline := time.Now().Add(closeHandshakeTimeout)
+	_ = s.inbound.WriteControl(websocket.CloseMessage,
+		closeMessage(closeErr, closeBadGateway), deadline)
+	// the client's answer ends the read loop
+	_ = s.inbound.SetReadDeadline(deadline)
+}
+
+func (s *proxySession) OnReceive(msg Message) {
+	<-s.ready
+	if s.inbound == nil {
+		return
+	}
+	// a failing inbound connection ends the inbound read loop
+	_ = s.inbound.WriteMessage(msg.MessageType, msg.Data)
+}
+
+func (s *proxySession) OnFailure(exited bool, err error) {}
+
+// ServeHTTP dials the backend, upgrades the request and relays the session
+// until either side closes. A failing dial is answered with 502 Bad
+// Gateway.
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+
+	p.lock.Lock()
+	checkOrigin, forward, factory := p.checkOrigin, p.forwardHeaders, p.factory
+	p.lock.Unlock()
+
+	if checkOrigin != nil && !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	target := p.backendURL(r)
+	if target == "" {
+		http.Error(w, "no backend", http.StatusBadGateway)
+		return
+	}
+
+	session := &proxySession{
+		connected: make(chan struct{}),
+		ready:     make(chan struct{}),
+	}
+	client := factory(session)
+	session.client = client
+	client.SetSubprotocols(websocket.Subprotocols(r)...)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- client.ConnectAndServeWithHeader(target, backendHeader(r, forward))
+	}()
+
+	select {
+	case err := <-served:
+		logKV(LogLevelInfo, LogRegioProxy, "dial backend failed",
+			LogKeyRemoteAddr, r.RemoteAddr, LogKeyURL, target, LogKeyError, err)
+		p.count(func(stats *ProxyStats) { stats.DialFailures++ })
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	case <-session.connected:
+	}
+
+	responseHeader := http.Header{}
+	if protocol := client.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: checkOrigin}
+	inbound, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		logKV(LogLevelInfo, LogRegioProxy, "upgrade failed",
+			LogKeyRemoteAddr, r.RemoteAddr, LogKeyError, err)
+		close(session.ready)
+		_ = client.Disconnect()
+		return
+	}
+	defer inbound.Close()
+	replyToClose(inbound)
+	session.inbound = inbound
+	close(session.ready)
+
+	p.count(func(stats *ProxyStats) {
+		stats.Active++
+		stats.Sessions++
+	})
+	defer p.count(func(stats *ProxyStats) { stats.Active-- })
+
+	logKV(LogLevelDebug, LogRegioProxy, "relaying",
+		LogKeyRemoteAddr, inbound.RemoteAddr().String(), LogKeyURL, target)
+
+	for {
+		messageType, data, err := inbound.ReadMessage()
+		if err != nil {
+			if conn := client.connection(); conn != nil {
+				_ = conn.WriteControl(websocket.CloseMessage,
+					closeMessage(err, websocket.CloseGoingAway),
+					time.Now().Add(closeHandshakeTimeout))
+			}
+			break
+		}
+		if err = client.Send(Message{MessageType: messageType, Data: data}); err != nil {
+			break
+		}
+	}
+
+	timer := time.NewTimer(closeHandshakeTimeout)
+	defer timer.Stop()
+	select {
+	case <-served:
+	case <-timer.C:
+		_ = client.Disconnect()
+	}
+}
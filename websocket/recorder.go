@@ -0,0 +1,225 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Recorder is an Events implementation for tests. It records everything
+// it receives and lets a test wait for connects, disconnects, failures and
+// messages.
+type Recorder struct {
+	lock      sync.Mutex
+	changed   chan struct{}
+	messages  []Message
+	events    []Event
+	msgRead   int
+	connRead  int
+	discoRead int
+	failRead  int
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		lock:    sync.Mutex{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (r *Recorder) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *Recorder) Messages() []Message {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]Message{}, r.messages...)
+}
+
+func (r *Recorder) EventsSeen() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]Event{}, r.events...)
+}
+
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.messages = nil
+	r.events = nil
+	r.msgRead = 0
+	r.connRead = 0
+	r.discoRead = 0
+	r.failRead = 0
+	r.notify()
+}
+
+// wait calls check under the lock until it reports success or the timeout
+// expires.
+func (r *Recorder) wait(timeout time.Duration, check func() bool) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		r.lock.Lock()
+		ok := check()
+		changed := r.changed
+		r.lock.Unlock()
+
+		if ok {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+func (r *Recorder) nextEvent(eventType EventType, cursor *int, found *Event) bool {
+	for ; *cursor < len(r.events); *cursor++ {
+		if r.events[*cursor].Type == eventType {
+			*found = r.events[*cursor]
+			*cursor++
+			return true
+		}
+	}
+	return false
+}
+
+// WaitForConnect waits for the next not yet consumed connect event and
+// returns the id of the connection.
+func (r *Recorder) WaitForConnect(t testing.TB, timeout time.Duration) int {
+	t.Helper()
+
+	var evnt Event
+	if !r.wait(timeout, func() bool {
+		return r.nextEvent(Connect, &r.connRead, &evnt)
+	}) {
+		t.Fatalf("no connect within %v", timeout)
+	}
+	return evnt.Id
+}
+
+// WaitForDisconnect waits for the next not yet consumed disconnect event
+// and returns the id of the connection.
+func (r *Recorder) WaitForDisconnect(t testing.TB, timeout time.Duration) int {
+	t.Helper()
+
+	var evnt Event
+	if !r.wait(timeout, func() bool {
+		return r.nextEvent(Disconnect, &r.discoRead, &evnt)
+	}) {
+		t.Fatalf("no disconnect within %v", timeout)
+	}
+	return evnt.Id
+}
+
+// WaitForFailure waits for the next not yet consumed failure, with or
+// without exit, and returns its event.
+func (r *Recorder) WaitForFailure(t testing.TB, timeout time.Duration) Event {
+	t.Helper()
+
+	var evnt Event
+	if !r.wait(timeout, func() bool {
+		for ; r.failRead < len(r.events); r.failRead++ {
+			if t := r.events[r.failRead].Type; t == Failure || t == FailureWithExit {
+				evnt = r.events[r.failRead]
+				r.failRead++
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatalf("no failure within %v", timeout)
+	}
+	return evnt
+}
+
+// WaitForMessage waits for the next not yet consumed message.
+func (r *Recorder) WaitForMessage(t testing.TB, timeout time.Duration) Message {
+	t.Helper()
+
+	var msg Message
+	if !r.wait(timeout, func() bool {
+		if r.msgRead < len(r.messages) {
+			msg = r.messages[r.msgRead]
+			r.msgRead++
+			return true
+		}
+		return false
+	}) {
+		t.Fatalf("no message within %v", timeout)
+	}
+	return msg
+}
+
+func (r *Recorder) record(msg *Message, evnt *Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if msg != nil {
+		r.messages = append(r.messages, *msg)
+	}
+	if evnt != nil {
+		r.events = append(r.events, *evnt)
+	}
+	r.notify()
+}
+
+func (r *Recorder) OnReceive(msg Message) {
+	r.record(&msg, nil)
+}
+
+func (r *Recorder) OnDisconnect(id int) {
+	r.record(nil, &Event{Type: Disconnect, Id: id})
+}
+
+func (r *Recorder) OnConnect(id int) {
+	r.record(nil, &Event{Type: Connect, Id: id})
+}
+
+func (r *Recorder) OnFailure(exited bool, err error) {
+	evnt := Event{
+		Err:  err,
+		Kind: KindOf(err),
+		Type: Failure,
+		Id:   ClientIdOf(err),
+	}
+	if exited {
+		evnt.Type = FailureWithExit
+	}
+	r.record(nil, &evnt)
+}
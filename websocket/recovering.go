@@ -0,0 +1,107 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+const LogRegioRecovering = "recovering events"
+
+type PanicHook func(callback string, recovered any, stack []byte)
+
+// RecoveringEvents contains panics raised by the wrapped handler. A panic is
+// reported to the hook (or logged with its stack if there is none) and, if it
+// did not happen in OnFailure itself, as a failure to the wrapped handler.
+type RecoveringEvents struct {
+	inner   Events
+	onPanic PanicHook
+}
+
+func NewRecoveringEvents(inner Events, onPanic PanicHook) *RecoveringEvents {
+	return &RecoveringEvents{
+		inner:   inner,
+		onPanic: onPanic,
+	}
+}
+
+func (r *RecoveringEvents) handlePanic(callback string) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	stack := debug.Stack()
+
+	if r.onPanic != nil {
+		r.onPanic(callback, recovered, stack)
+	} else {
+		logError(LogRegioRecovering, "panic in %s: %v\n%s",
+			callback, recovered, stack)
+	}
+
+	if callback != "OnFailure" {
+		func() {
+			defer func() {
+				if again := recover(); again != nil {
+					logError(LogRegioRecovering,
+						"panic reporting failure: %v", again)
+				}
+			}()
+			r.inner.OnFailure(false,
+				fmt.Errorf("panic in %s: %v", callback, recovered))
+		}()
+	}
+}
+
+func (r *RecoveringEvents) OnReceive(msg Message) {
+	r.OnReceiveCtx(context.Background(), msg)
+}
+
+func (r *RecoveringEvents) OnReceiveCtx(ctx context.Context, msg Message) {
+	defer r.handlePanic("OnReceive")
+	dispatchReceive(ctx, r.inner, msg)
+}
+
+func (r *RecoveringEvents) OnDisconnect(id int) {
+	defer r.handlePanic("OnDisconnect")
+	r.inner.OnDisconnect(id)
+}
+
+func (r *RecoveringEvents) OnConnect(id int) {
+	r.OnConnectCtx(context.Background(), id)
+}
+
+func (r *RecoveringEvents) OnConnectCtx(ctx context.Context, id int) {
+	defer r.handlePanic("OnConnect")
+	dispatchConnect(ctx, r.inner, id)
+}
+
+func (r *RecoveringEvents) OnFailure(exited bool, err error) {
+	defer r.handlePanic("OnFailure")
+	r.inner.OnFailure(exited, err)
+}
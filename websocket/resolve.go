@@ -0,0 +1,105 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// ResolverFunc looks up the addresses of host, e.g. from a service
+// discovery.
+type ResolverFunc func(ctx context.Context, host string) ([]netip.Addr, error)
+
+// SetResolver looks up the server's host with resolve on each dial,
+// reconnects included, and tries its addresses in turn, starting at the
+// next one each dial. The dial of each address is done by the NetDialFunc
+// if set. nil restores the default: the system resolver is used the same
+// way, unless a NetDialFunc is set, which then resolves on its own.
+func (c *Client) SetResolver(resolve ResolverFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.resolve = resolve
+}
+
+// RemoteAddr returns the address dialed for the current connection, one of
+// the resolved ones, nil if not connected. OnConnectCtx gets it by
+// RemoteAddrFromContext.
+func (c *Client) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// lookupNetIP is the resolver without SetResolver and NetDialFunc.
+var lookupNetIP ResolverFunc = func(ctx context.Context, host string) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// rotatingDial resolves the host of each dial and tries its addresses in
+// turn until one connects. Each dial starts at the next address, so
+// reconnects spread over all of them.
+func (c *Client) rotatingDial(resolve ResolverFunc, dial NetDialFunc) NetDialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := netip.ParseAddr(host); err == nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+		}
+
+		start := int(c.dialRotation.Add(1)-1) % len(addrs)
+		var errs []error
+		for i := range addrs {
+			ip := addrs[(start+i)%len(addrs)].Unmap()
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, errors.Join(errs...)
+	}
+}
@@ -0,0 +1,159 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"sync"
+)
+
+const DefaultRingBufferPayloadPrefix = 256
+
+// RingBufferEvents keeps the most recent messages and events handled by
+// the wrapped handler, e.g. to dump them when debugging an incident.
+type RingBufferEvents struct {
+	inner         Events
+	lock          sync.Mutex
+	messages      []Message
+	msgNext       int
+	msgFull       bool
+	events        []Event
+	evntNext      int
+	evntFull      bool
+	payloadPrefix int
+}
+
+func NewRingBufferEvents(inner Events, n int) *RingBufferEvents {
+	if n < 1 {
+		n = 1
+	}
+	return &RingBufferEvents{
+		inner:         inner,
+		lock:          sync.Mutex{},
+		messages:      make([]Message, n),
+		events:        make([]Event, n),
+		payloadPrefix: DefaultRingBufferPayloadPrefix,
+	}
+}
+
+// SetPayloadPrefix limits how many bytes of each payload are kept.
+// A value < 0 keeps the whole payload.
+func (r *RingBufferEvents) SetPayloadPrefix(bytes int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.payloadPrefix = bytes
+}
+
+func (r *RingBufferEvents) recordMessage(msg Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	length := len(msg.Data)
+	if r.payloadPrefix >= 0 && length > r.payloadPrefix {
+		length = r.payloadPrefix
+	}
+	data := make([]byte, length)
+	copy(data, msg.Data)
+	msg.Data = data
+
+	r.messages[r.msgNext] = msg
+	r.msgNext = (r.msgNext + 1) % len(r.messages)
+	if r.msgNext == 0 {
+		r.msgFull = true
+	}
+}
+
+func (r *RingBufferEvents) recordEvent(evnt Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.events[r.evntNext] = evnt
+	r.evntNext = (r.evntNext + 1) % len(r.events)
+	if r.evntNext == 0 {
+		r.evntFull = true
+	}
+}
+
+// Snapshot returns the recorded messages, oldest first.
+func (r *RingBufferEvents) Snapshot() []Message {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.msgFull {
+		return append([]Message{}, r.messages[:r.msgNext]...)
+	}
+	return append(append([]Message{}, r.messages[r.msgNext:]...),
+		r.messages[:r.msgNext]...)
+}
+
+// SnapshotEvents returns the recorded events, oldest first.
+func (r *RingBufferEvents) SnapshotEvents() []Event {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.evntFull {
+		return append([]Event{}, r.events[:r.evntNext]...)
+	}
+	return append(append([]Event{}, r.events[r.evntNext:]...),
+		r.events[:r.evntNext]...)
+}
+
+func (r *RingBufferEvents) OnReceive(msg Message) {
+	r.OnReceiveCtx(context.Background(), msg)
+}
+
+func (r *RingBufferEvents) OnReceiveCtx(ctx context.Context, msg Message) {
+	r.recordMessage(msg)
+	if r.inner != nil {
+		dispatchReceive(ctx, r.inner, msg)
+	}
+}
+
+func (r *RingBufferEvents) OnDisconnect(id int) {
+	r.recordEvent(Event{Type: Disconnect, Id: id})
+	if r.inner != nil {
+		r.inner.OnDisconnect(id)
+	}
+}
+
+func (r *RingBufferEvents) OnConnect(id int) {
+	r.OnConnectCtx(context.Background(), id)
+}
+
+func (r *RingBufferEvents) OnConnectCtx(ctx context.Context, id int) {
+	r.recordEvent(Event{Type: Connect, Id: id})
+	if r.inner != nil {
+		dispatchConnect(ctx, r.inner, id)
+	}
+}
+
+func (r *RingBufferEvents) OnFailure(exited bool, err error) {
+	r.recordEvent(failureEvent(exited, err))
+	if r.inner != nil {
+		r.inner.OnFailure(exited, err)
+	}
+}
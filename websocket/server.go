@@ -26,23 +26,35 @@
 package websocket
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ChrIgiSta/go-easy-websockets/utils"
-	"github.com/ChrIgiSta/go-utils/containers"
-	log "github.com/ChrIgiSta/go-utils/logger"
 	"github.com/gorilla/websocket"
 )
 
 const LogRegioWsServer = "ws server"
 
+// ErrServerStarted is returned by setters which can't take effect once the
+// server listens.
+var ErrServerStarted = errors.New("server already started")
+
 type HashAlgo int
 
 const (
@@ -51,9 +63,102 @@ const (
 	HashAlgoSHA256 = 2
 )
 
+// AuthMode tells whether all headers of an AuthHeader must match or one
+// is enough.
+type AuthMode int
+
+const (
+	AuthRequireAll AuthMode = iota
+	AuthRequireAny
+)
+
+// AuthHeader lists headers a client must send. With a hash algo other than
+// HashAlgoNone the client sends the hex digest of the value instead of the
+// value itself, see HashAuthValue. HeaderAccepted adds values accepted for
+// a header as well, e.g. the old and the new token during a rotation, the
+// algo applies to each of them.
 type AuthHeader struct {
 	HeaderRequired map[string]string
+	HeaderAccepted map[string][]string
 	ValueHashAlgo  HashAlgo
+	Mode           AuthMode
+}
+
+// NewAuthHeaderValues accepts any of the values of each header, with all or
+// any of the headers required depending on mode.
+func NewAuthHeaderValues(accepted map[string][]string, valueHashAlgo HashAlgo,
+	mode AuthMode) *AuthHeader {
+
+	return &AuthHeader{
+		HeaderAccepted: accepted,
+		ValueHashAlgo:  valueHashAlgo,
+		Mode:           mode,
+	}
+}
+
+// values returns the accepted values of each header.
+func (a *AuthHeader) values() map[string][]string {
+	values := make(map[string][]string, len(a.HeaderRequired)+len(a.HeaderAccepted))
+	for key, value := range a.HeaderRequired {
+		key = http.CanonicalHeaderKey(key)
+		values[key] = append(values[key], value)
+	}
+	for key, accepted := range a.HeaderAccepted {
+		key = http.CanonicalHeaderKey(key)
+		values[key] = append(values[key], accepted...)
+	}
+	return values
+}
+
+// AuthRejection is the response to an upgrade failing the auth header,
+// e.g. with a WWW-Authenticate header or a body telling what to fix. A
+// zero StatusCode answers 401.
+type AuthRejection struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	Header      http.Header
+}
+
+func (r *AuthRejection) write(w http.ResponseWriter) {
+	if r == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	for key, values := range r.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	if r.ContentType != "" {
+		w.Header().Set("Content-Type", r.ContentType)
+	}
+	status := r.StatusCode
+	if status == 0 {
+		status = http.StatusUnauthorized
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(r.Body)
+}
+
+// HashAuthValue returns the header value a client sends for an AuthHeader
+// value hashed with algo.
+func HashAuthValue(value string, algo HashAlgo) (string, error) {
+	var hasher hash.Hash
+
+	switch algo {
+	case HashAlgoNone:
+		return value, nil
+	case HashAlgoMD5:
+		hasher = md5.New()
+	case HashAlgoSHA256:
+		hasher = sha256.New()
+	default:
+		return "", fmt.Errorf("unknown hash algo %d", algo)
+	}
+	hasher.Write([]byte(value))
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 func NewAuthHeader(headerKey string, headerValue string, valueHashAlgo HashAlgo) *AuthHeader {
@@ -66,113 +171,637 @@ func NewAuthHeader(headerKey string, headerValue string, valueHashAlgo HashAlgo)
 }
 
 type Server struct {
-	wg           sync.WaitGroup
-	address      string
-	path         string
-	clientPool   *containers.List
+	wg       sync.WaitGroup
+	handlers sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	address  string
+	path     string
+	hub      *Hub
+	// setup guards the tls settings, fixed once started, and server
+	setup        sync.Mutex
+	started      bool
 	tls          bool
+	secureUrl    bool
 	certificate  []byte
 	privateKey   []byte
 	server       *http.Server
 	eventHandler Events
-	authHeader   *AuthHeader
+	authHeader   atomic.Pointer[AuthHeader]
+	rejection    atomic.Pointer[AuthRejection]
+	token        atomic.Pointer[expiringTokenAuth]
+	checkOrigin  func(r *http.Request) bool
+	keepalive    keepaliveConfig
+	subprotocols []string
+	clientCAs    *x509.CertPool
+	readLimit    int64
+	handler      http.Handler
+	routes       map[string]http.Handler
+	instanceId   string
+	backend      BroadcastBackend
+	channel      string
+	unixSocket   bool
+	socketMode   os.FileMode
+	compression  *payloadCompression
+	textFraming  bool
+	challenge    *challengeAuth
+	heartbeat    *textHeartbeat
+	shedding     atomic.Pointer[loadShedding]
+	identify     func(r *http.Request) string
+	duplicates   DuplicatePolicy
+	// bandwidth limits of each client in bytes per second
+	writeBandwidth int
+	readBandwidth  int
 }
 
 func NewServer(url string,
 	eventHander Events) *Server {
 
-	u, err := utils.StringToUrl(url)
+	u, schemeInferred, err := utils.ParseWsAddress(url)
 	if err != nil {
-		_ = log.Error(LogRegioWsServer, "invalid url: %v", err)
+		logError(LogRegioWsServer, "invalid url: %v", err)
 		return nil
 	}
+	if schemeInferred {
+		logWarn(LogRegioWsServer, "no scheme in %q, serving unencrypted ws", url)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	server := Server{
 		wg:           sync.WaitGroup{},
+		handlers:     sync.WaitGroup{},
+		ctx:          ctx,
+		cancel:       cancel,
 		address:      u.Host,
 		path:         u.Path,
 		eventHandler: eventHander,
-		clientPool:   containers.NewList(),
+		hub:          NewHub(),
 		tls:          false,
+		secureUrl:    utils.TlsScheme(u.Scheme),
+		instanceId:   newInstanceId(),
+	}
+	if socket, target, ok := utils.SplitUnixURL(u); ok {
+		server.address = socket
+		server.path = target.Path
+		server.unixSocket = true
 	}
 
 	return &server
 }
 
-func (s *Server) SetupTls(certificate []byte, privateKey []byte) {
+// SetupTls serves wss with the pem encoded certificate and key. Call it
+// before ListenAndServe, afterwards it returns ErrServerStarted.
+func (s *Server) SetupTls(certificate []byte, privateKey []byte) error {
+	s.setup.Lock()
+	defer s.setup.Unlock()
+
+	if s.started {
+		return ErrServerStarted
+	}
 	s.certificate = certificate
 	s.privateKey = privateKey
 	s.tls = true
+	return nil
+}
+
+// RequireClientCert makes the tls handshake require a client certificate
+// signed by one of the cas in caCertificates (pem, one or more).
+func (s *Server) RequireClientCert(caCertificates []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCertificates) {
+		return errors.New("no client ca certificate found")
+	}
+
+	s.setup.Lock()
+	defer s.setup.Unlock()
+
+	if s.started {
+		return ErrServerStarted
+	}
+	s.clientCAs = pool
+	return nil
 }
 
+// SetAuthHeader sets the headers required for the upgrade, nil accepts
+// any client. It may be changed while serving and applies to the
+// following handshakes.
 func (s *Server) SetAuthHeader(authHeader *AuthHeader) {
-	s.authHeader = authHeader
+	s.authHeader.Store(authHeader)
 }
 
-func (s *Server) validateHash(value string, hashValue string, algo HashAlgo) bool {
+// SetExpiringTokenAuth requires a token of ExpiringToken signed with
+// secret in the header headerName, see Client.SetExpiringToken. A token is
+// valid from maxSkew before until maxSkew after the time it was issued, so
+// the clocks of client and server may differ by up to maxSkew. Tokens are
+// not tracked: a captured token can be replayed until it expires, use it
+// over tls only. An empty headerName disables it. Combined with an auth
+// header, both must match.
+func (s *Server) SetExpiringTokenAuth(headerName string, secret []byte, maxSkew time.Duration) {
+	if headerName == "" {
+		s.token.Store(nil)
+		return
+	}
+	s.token.Store(&expiringTokenAuth{header: headerName, secret: secret, maxSkew: maxSkew})
+}
 
-	var hasher hash.Hash
+// SetAuthRejectionResponse sets the response to clients failing the auth
+// header, the client sees it as HandshakeError. nil answers a bare 401.
+func (s *Server) SetAuthRejectionResponse(rejection *AuthRejection) {
+	s.rejection.Store(rejection)
+}
 
-	switch algo {
-	case HashAlgoNone:
-		return value == hashValue
-	case HashAlgoMD5:
-		hasher = md5.New()
-	case HashAlgoSHA256:
-		hasher = sha256.New()
-	default:
+// EventHandler returns the handler receiving messages and events.
+func (s *Server) EventHandler() Events {
+	return s.eventHandler
+}
+
+// SetEventHandler replaces the event handler, e.g. to wrap the current one
+// in a protocol layer. Call it before ListenAndServe.
+func (s *Server) SetEventHandler(handler Events) {
+	s.eventHandler = handler
+}
+
+// SetHandler serves the server's path with handler, e.g. a ReverseProxy,
+// instead of accepting the clients itself. The auth header is still
+// checked. Call it before ListenAndServe.
+func (s *Server) SetHandler(handler http.Handler) {
+	s.handler = handler
+}
+
+// Handle serves another path on the server's listener, e.g. metrics. The
+// auth header is not checked for it. Call it before ListenAndServe.
+func (s *Server) Handle(path string, handler http.Handler) {
+	if s.routes == nil {
+		s.routes = make(map[string]http.Handler)
+	}
+	s.routes[path] = handler
+}
+
+// Address returns the listen address, the socket file on a unix socket,
+// Path the path clients connect to.
+func (s *Server) Address() string {
+	return s.address
+}
+
+func (s *Server) Path() string {
+	return s.path
+}
+
+// DefaultShedRetryAfter is the Retry-After sent to clients refused by load
+// shedding unless set otherwise.
+const DefaultShedRetryAfter = 5 * time.Second
+
+type loadShedding struct {
+	shed       func() bool
+	retryAfter string
+}
+
+// SetLoadShedding consults shed before each upgrade. While it returns true
+// new clients are answered 503 with a Retry-After of retryAfter (0 for
+// DefaultShedRetryAfter), e.g. while event handlers fall behind, connected
+// ones are unaffected. A nil shed disables it. It may be set while serving.
+func (s *Server) SetLoadShedding(shed func() bool, retryAfter time.Duration) {
+	if shed == nil {
+		s.shedding.Store(nil)
+		return
+	}
+	if retryAfter <= 0 {
+		retryAfter = DefaultShedRetryAfter
+	}
+	seconds := (retryAfter + time.Second - 1) / time.Second
+	s.shedding.Store(&loadShedding{shed: shed, retryAfter: strconv.Itoa(int(seconds))})
+}
+
+// SetCheckOrigin overrides the default same-origin check of the upgrade.
+func (s *Server) SetCheckOrigin(checkOrigin func(r *http.Request) bool) {
+	s.checkOrigin = checkOrigin
+}
+
+// AllowOrigins only accepts upgrades with an Origin matching one of the
+// patterns (see utils.OriginMatcher). Requests without Origin header, as sent
+// by non-browser clients, are accepted.
+func (s *Server) AllowOrigins(patterns ...string) {
+	matcher := utils.NewOriginMatcher(patterns...)
+
+	s.SetCheckOrigin(func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		return matcher.Allow(origin)
+	})
+}
+
+// SetKeepalive pings every client each interval. Clients without pong
+// within timeout are considered dead and disconnected.
+func (s *Server) SetKeepalive(interval time.Duration, timeout time.Duration) {
+	s.keepalive.interval = interval
+	s.keepalive.timeout = timeout
+}
+
+// EnableTextHeartbeat answers the text ping of a client with the text pong,
+// for browser clients which cannot send ping frames. Neither reaches
+// OnReceive. A client without ping within timeout is considered dead and
+// disconnected, 0 only answers.
+func (s *Server) EnableTextHeartbeat(ping string, pong string, timeout time.Duration) {
+	s.heartbeat = &textHeartbeat{ping: ping, pong: pong, timeout: timeout}
+}
+
+// RequireChallengeAuth admits a client only after it proved the secret of
+// its key: the server sends a random nonce as first message, the client
+// must answer with the HMAC-SHA256 of it within timeout (0 for
+// DefaultChallengeTimeout), see Client.SetChallengeAuth. Until then no
+// OnConnect is emitted and no message delivered, a failing client is
+// closed with CloseChallengeFailed and reported by OnFailure with a
+// ChallengeError, wrapped in a ClientError with its remote address.
+func (s *Server) RequireChallengeAuth(lookupSecret func(keyId string) ([]byte, bool),
+	timeout time.Duration) {
+
+	if timeout <= 0 {
+		timeout = DefaultChallengeTimeout
+	}
+	s.challenge = &challengeAuth{lookup: lookupSecret, timeout: timeout}
+}
+
+// EnableTextOnlyFraming sends binary messages base64 encoded in text
+// frames to clients enabling it too, see Client.EnableTextOnlyFraming.
+func (s *Server) EnableTextOnlyFraming() {
+	s.textFraming = true
+}
+
+// SetClientBandwidthLimit limits the bytes per second written to each
+// client, with bursts up to one second. Writes to a limited client are
+// queued and paced: Send waits for its turn, Broadcast does not wait for
+// limited clients. 0 disables the limit, it applies to clients connecting
+// afterwards.
+func (s *Server) SetClientBandwidthLimit(bytesPerSecond int) {
+	s.writeBandwidth = bytesPerSecond
+}
+
+// SetClientReadBandwidthLimit limits the bytes per second read from each
+// client by pausing its read loop.
+func (s *Server) SetClientReadBandwidthLimit(bytesPerSecond int) {
+	s.readBandwidth = bytesPerSecond
+}
+
+// SetOnPong registers a hook receiving the round trip time of each pong.
+func (s *Server) SetOnPong(hook PongHook) {
+	s.keepalive.onPong = hook
+}
+
+// OnPong returns the registered pong hook, e.g. to chain it.
+func (s *Server) OnPong() PongHook {
+	return s.keepalive.onPong
+}
+
+// SetReadLimit sets the maximum size in bytes of a message received from a
+// client. A client sending more is disconnected and reported by OnFailure
+// with KindMessageTooBig. 0 disables the limit.
+func (s *Server) SetReadLimit(limit int64) {
+	s.readLimit = limit
+}
+
+// SetPayloadCompression gzips messages of at least minSize bytes to
+// clients enabling it too, see Client.SetPayloadCompression. Call it
+// before ListenAndServe.
+func (s *Server) SetPayloadCompression(minSize int, level int) error {
+	compression, err := newPayloadCompression(minSize, level)
+	if err != nil {
+		return err
+	}
+	s.compression = compression
+	return nil
+}
+
+// SetSocketMode sets the permissions of the socket file of a server on a
+// unix socket, e.g. 0660 to allow the group. Call it before
+// ListenAndServe.
+func (s *Server) SetSocketMode(mode os.FileMode) {
+	s.socketMode = mode
+}
+
+// SetSubprotocols sets the subprotocols the server accepts, in order of
+// preference. Clients offering only other protocols are rejected, clients
+// offering none are accepted without protocol.
+func (s *Server) SetSubprotocols(protocols ...string) {
+	s.subprotocols = protocols
+}
+
+// Subprotocol returns the protocol negotiated with a client.
+func (s *Server) Subprotocol(clientId int) string {
+	client := s.client(clientId)
+	if client == nil {
+		return ""
+	}
+	return client.conn.Subprotocol()
+}
+
+func (s *Server) client(clientId int) *serverClient {
+	return s.hub.client(clientId)
+}
+
+// SetHub attaches the server to a hub shared with other servers. Call it
+// before accepting clients.
+func (s *Server) SetHub(hub *Hub) {
+	s.hub = hub
+}
+
+// Hub returns the hub holding the server's clients.
+func (s *Server) Hub() *Hub {
+	return s.hub
+}
+
+func (s *Server) acceptsSubprotocol(r *http.Request) bool {
+	offered := websocket.Subprotocols(r)
+	if len(s.subprotocols) == 0 || len(offered) == 0 {
+		return true
+	}
+	for _, protocol := range offered {
+		for _, accepted := range s.subprotocols {
+			if protocol == accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateHash checks a received header value against the configured one.
+func (s *Server) validateHash(value string, configured string, algo HashAlgo) bool {
+	expected, err := HashAuthValue(configured, algo)
+	if err != nil {
 		return false
 	}
-	hashedValue := hasher.Sum([]byte(value))
+	if algo != HashAlgoNone {
+		value = strings.ToLower(value)
+	}
 
-	return string(hashedValue) == hashValue
+	return subtle.ConstantTimeCompare([]byte(value), []byte(expected)) == 1
 }
 
-func (s *Server) clientHandler(w http.ResponseWriter, r *http.Request) {
+// clientFailures reports the failures of one client as ClientError.
+type clientFailures struct {
+	Events
+	id int
+}
 
-	if s.authHeader != nil {
-		for key, value := range s.authHeader.HeaderRequired {
-			valueGot := r.Header.Get(key)
-			if !s.validateHash(valueGot, value, s.authHeader.ValueHashAlgo) {
-				_ = log.Debug(LogRegioWsServer, "not authorized")
-				w.WriteHeader(http.StatusUnauthorized)
-				// not authorized
-				return
+func (c clientFailures) OnFailure(exited bool, err error) {
+	c.Events.OnFailure(exited, &ClientError{ClientId: c.id, Err: err})
+}
+
+// authorized checks the request headers against the auth header. All
+// values are compared, the time taken tells nothing about which one was
+// wrong.
+func (s *Server) authorized(authHeader *AuthHeader, header http.Header) bool {
+	values := authHeader.values()
+	matched := 0
+	for key, accepted := range values {
+		valueGot := header.Get(key)
+		ok := false
+		for _, value := range accepted {
+			if s.validateHash(valueGot, value, authHeader.ValueHashAlgo) {
+				ok = true
 			}
 		}
+		if ok {
+			matched++
+		}
+	}
+
+	if authHeader.Mode == AuthRequireAny {
+		return matched > 0
 	}
+	return matched == len(values)
+}
 
-	upgrader := websocket.Upgrader{}
-	conn, err := upgrader.Upgrade(w, r, nil)
+func (s *Server) clientHandler(w http.ResponseWriter, r *http.Request) {
+
+	if shedding := s.shedding.Load(); shedding != nil && shedding.shed() {
+		logKV(LogLevelDebug, LogRegioWsServer, "shedding load",
+			LogKeyRemoteAddr, r.RemoteAddr, LogKeyPath, r.URL.Path)
+		s.hub.rejectedUpgrades.Add(1)
+		s.hub.shedUpgrades.Add(1)
+		w.Header().Set("Retry-After", shedding.retryAfter)
+		http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	authHeader, token := s.authHeader.Load(), s.token.Load()
+	if (authHeader != nil && !s.authorized(authHeader, r.Header)) ||
+		(token != nil && !token.valid(r.Header, time.Now())) {
+
+		logKV(LogLevelDebug, LogRegioWsServer, "not authorized",
+			LogKeyRemoteAddr, r.RemoteAddr, LogKeyPath, r.URL.Path)
+		s.hub.rejectedUpgrades.Add(1)
+		s.rejection.Load().write(w)
+		return
+	}
+
+	if s.handler != nil {
+		s.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if !s.acceptsSubprotocol(r) {
+		logKV(LogLevelInfo, LogRegioWsServer, "no supported subprotocol",
+			LogKeyRemoteAddr, r.RemoteAddr, LogKeyPath, r.URL.Path,
+			"offered", websocket.Subprotocols(r))
+		s.hub.rejectedUpgrades.Add(1)
+		http.Error(w, "no supported subprotocol", http.StatusBadRequest)
+		return
+	}
+
+	identity := s.identity(r)
+	if identity != "" && s.duplicates == DuplicateRejectNew {
+		if !s.hub.reserveIdentity(identity) {
+			logKV(LogLevelInfo, LogRegioWsServer, "identity already connected",
+				LogKeyRemoteAddr, r.RemoteAddr, LogKeyPath, r.URL.Path)
+			s.hub.rejectedUpgrades.Add(1)
+			http.Error(w, "already connected", http.StatusConflict)
+			return
+		}
+		// unless bound to the client meanwhile
+		defer s.hub.releaseIdentity(identity, nil)
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin:  s.checkOrigin,
+		Subprotocols: s.subprotocols,
+	}
+	var responseHeader http.Header
+	var compression *payloadCompression
+	if s.compression != nil && acceptsPayloadCompression(r.Header) {
+		compression = s.compression
+		responseHeader = http.Header{PayloadCompressionHeader: {payloadGzip}}
+	}
+	textFramed := s.textFraming && acceptsTextFraming(r.Header)
+	if textFramed {
+		if responseHeader == nil {
+			responseHeader = http.Header{}
+		}
+		responseHeader.Set(TextFramingHeader, textFramingBase64)
+	}
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
-		_ = log.Info(LogRegioWsServer, "upgrade conn: %v", err)
+		logKV(LogLevelInfo, LogRegioWsServer, "upgrade failed",
+			LogKeyRemoteAddr, r.RemoteAddr, LogKeyPath, r.URL.Path,
+			LogKeyError, err)
+		s.hub.rejectedUpgrades.Add(1)
 		return
 	}
+	conn.SetReadLimit(s.readLimit)
+	replyToClose(conn)
+
+	s.handlers.Add(1)
+	defer s.handlers.Done()
 
 	clientId := getIdFromConn(conn)
-	s.clientPool.AddOrUpdate(clientId, conn)
+	ctx, cancel := context.WithCancel(withRemoteAddr(
+		withClientId(s.ctx, clientId), conn.RemoteAddr()))
+	defer cancel()
+	client := &serverClient{
+		conn:        conn,
+		connectedAt: time.Now(),
+		cancel:      cancel,
+		payload:     compression,
+		textFramed:  textFramed,
+		server:      s,
+
+		writeBandwidth: newBandwidth(s.writeBandwidth),
+		readBandwidth:  newBandwidth(s.readBandwidth),
+		done:           ctx.Done(),
+	}
+	if client.writeBandwidth != nil {
+		client.queue = make(chan queuedWrite, ThrottleQueueSize)
+		go client.runThrottled(ctx, clientId)
+	}
+	go func() {
+		<-ctx.Done()
+		if s.ctx.Err() != nil {
+			_ = client.closeWith(websocket.CloseGoingAway, "server shutting down")
+			return
+		}
+		_ = client.close()
+	}()
+	if s.challenge != nil {
+		if err = s.challenge.admit(conn); err != nil {
+			logKV(LogLevelInfo, LogRegioWsServer, "challenge failed",
+				LogKeyRemoteAddr, r.RemoteAddr, LogKeyError, err)
+			rejectChallenge(client, err)
+			s.hub.rejectedUpgrades.Add(1)
+			s.eventHandler.OnFailure(false, &ClientError{ClientId: clientId,
+				RemoteAddr: r.RemoteAddr, Err: err})
+			return
+		}
+	}
+	if identity != "" {
+		if previous := s.hub.bindIdentity(identity, clientId, client); previous != nil {
+			logKV(LogLevelInfo, LogRegioWsServer, "replacing duplicate connection",
+				LogKeyClientId, clientId, LogKeyRemoteAddr, r.RemoteAddr)
+			_ = previous.closeWith(CloseDuplicateConnection, "replaced by a new connection")
+			previous.cancel()
+		}
+		defer s.hub.releaseIdentity(identity, client)
+	} else {
+		s.hub.add(clientId, client)
+	}
 
-	_ = log.Debug(LogRegioWsServer, "new client<%d> connected: %s",
-		clientId, conn.RemoteAddr().String())
-	defer func() { _ = log.Debug(LogRegioWsServer, "client <%d> disconnected", clientId) }()
+	remoteAddr := conn.RemoteAddr().String()
+	logKV(LogLevelDebug, LogRegioWsServer, "client connected",
+		LogKeyClientId, clientId, LogKeyRemoteAddr, remoteAddr,
+		LogKeyPath, r.URL.Path)
+	defer logKV(LogLevelDebug, LogRegioWsServer, "client disconnected",
+		LogKeyClientId, clientId, LogKeyRemoteAddr, remoteAddr)
 
-	defer s.clientPool.Delete(clientId)
 	defer s.eventHandler.OnDisconnect(clientId)
-	s.eventHandler.OnConnect(clientId)
+	// gone from Clients before OnDisconnect
+	defer s.hub.remove(clientId)
+	dispatchConnect(ctx, s.eventHandler, clientId)
+
+	failures := clientFailures{Events: s.eventHandler, id: clientId}
+	dead := &deadPeer{close: client.closePolicy}
+	go runKeepalive(ctx, s.keepalive, conn, clientId, LogRegioWsServer, dead)
+	heartbeat := s.heartbeat
+	alive := func() {}
+	if heartbeat != nil && heartbeat.timeout > 0 {
+		var stop func()
+		alive, stop = watchHeartbeat(heartbeat.timeout, dead)
+		defer stop()
+	}
 
 	for {
 		messageType, payload, err := conn.ReadMessage()
 
 		if err != nil {
-			_ = log.Info(LogRegioWsServer,
-				"read from client: %v. exit client handler", err)
+			err = dead.err(classifyError(err, dirRead, nil))
+			var closeErr *websocket.CloseError
+			switch {
+			case dead.failed():
+				logKV(LogLevelInfo, LogRegioWsServer, "client timed out",
+					LogKeyClientId, clientId, LogKeyError, err)
+				failures.OnFailure(false, err)
+			case KindOf(err) == KindNormalClosure:
+				logKV(LogLevelDebug, LogRegioWsServer, "client left",
+					LogKeyClientId, clientId, LogKeyError, err)
+			case KindOf(err) == KindMessageTooBig:
+				logKV(LogLevelInfo, LogRegioWsServer, "read from client failed",
+					LogKeyClientId, clientId, LogKeyError, err)
+				failures.OnFailure(false, err)
+			default:
+				logKV(LogLevelInfo, LogRegioWsServer, "read from client failed",
+					LogKeyClientId, clientId, LogKeyError, err)
+			}
+			switch {
+			case dead.failed():
+				// closed by closePolicy
+			case errors.As(err, &closeErr):
+				// answered by the close handler
+				_ = client.close()
+			case KindOf(err) == KindMessageTooBig:
+				_ = client.closeWith(websocket.CloseMessageTooBig, "")
+			case s.ctx.Err() != nil:
+				_ = client.closeWith(websocket.CloseGoingAway, "server shutting down")
+			default:
+				_ = client.closeWith(websocket.CloseInternalServerErr, "")
+			}
 			return
 		}
 
-		_ = log.Debug(LogRegioWsServer, "rx type <%d>: %s",
-			messageType, payload)
+		logKV(LogLevelDebug, LogRegioWsServer, "message received",
+			LogKeyClientId, clientId, "type", messageType,
+			"size", len(payload))
+		s.hub.stats.received(len(payload))
+		if client.readBandwidth != nil {
+			if _, err = client.readBandwidth.wait(ctx, len(payload)); err != nil {
+				return
+			}
+		}
+		if textFramed {
+			messageType, payload, err = decodeTextFrame(messageType, payload)
+			if err != nil {
+				failures.OnFailure(false, err)
+				continue
+			}
+		}
+		if compression != nil {
+			messageType, payload, err = decodePayload(messageType, payload, s.readLimit)
+			if err != nil {
+				failures.OnFailure(false, err)
+				continue
+			}
+		}
+		if heartbeat != nil && isText(messageType, payload, heartbeat.ping) {
+			alive()
+			pong := &Message{MessageType: TextMessage, Data: []byte(heartbeat.pong)}
+			if err = client.write(pong); err != nil {
+				logKV(LogLevelDebug, LogRegioWsServer, "heartbeat failed",
+					LogKeyClientId, clientId, LogKeyError, err)
+			}
+			continue
+		}
 
-		s.eventHandler.OnReceive(Message{
+		dispatchReceive(ctx, s.eventHandler, Message{
 			MessageType: messageType,
 			Data:        payload,
 			ClientId:    clientId,
@@ -180,89 +809,219 @@ func (s *Server) clientHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ServeHTTP accepts clients on an own http server or mux, instead of or
+// next to ListenAndServe. The auth header and subprotocols are checked as
+// configured.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.clientHandler(w, r)
+}
+
 func (s *Server) ListenAndServe() (err error) {
+	return s.serve(nil)
+}
+
+// Serve works like ListenAndServe but accepts the clients on l, the
+// address of the url is not used.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l)
+}
+
+func (s *Server) serve(l net.Listener) (err error) {
 
 	var serverCert tls.Certificate
 
 	s.wg.Add(1)
-	defer func() { _ = log.Debug(LogRegioWsServer, "listener exited") }()
+	defer func() { logDebug(LogRegioWsServer, "listener exited") }()
 	defer s.wg.Done()
 
 	mux := http.ServeMux{}
 	mux.HandleFunc(s.path, s.clientHandler)
+	for path, handler := range s.routes {
+		mux.Handle(path, handler)
+	}
 
-	s.server = &http.Server{
+	server := &http.Server{
 		Addr:    s.address,
 		Handler: &mux,
 	}
 
-	if s.tls {
-		serverCert, err = tls.X509KeyPair(
-			s.certificate,
-			s.privateKey)
+	if l == nil && s.unixSocket {
+		if l, err = s.listenUnix(); err != nil {
+			err = fmt.Errorf("listen on %s: %w", s.address, err)
+			s.eventHandler.OnFailure(true, err)
+			return
+		}
+	}
+
+	s.setup.Lock()
+	s.started = true
+	useTls, clientCAs := s.tls, s.clientCAs
+	certificate, privateKey := s.certificate, s.privateKey
+	s.setup.Unlock()
+
+	if useTls {
+		serverCert, err = tls.X509KeyPair(certificate, privateKey)
 		if err != nil {
-			err = fmt.Errorf("load x509 keypair: %v", err)
+			err = fmt.Errorf("load x509 keypair: %w", err)
 			s.eventHandler.OnFailure(true, err)
 			return
 		}
 		tlsConfig := tls.Config{
 			Certificates: []tls.Certificate{serverCert},
 		}
-		s.server.TLSConfig = &tlsConfig
+		if clientCAs != nil {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			tlsConfig.ClientCAs = clientCAs
+		}
+		server.TLSConfig = &tlsConfig
 	}
 
-	_ = log.Info(LogRegioWsServer, "ws server start listening @ %v%v",
-		s.address, s.path)
+	if s.secureUrl && !useTls {
+		logWarn(LogRegioWsServer, "secure url without tls setup, serving unencrypted")
+	}
 
-	if !s.tls {
-		err = s.server.ListenAndServe()
-	} else {
-		err = s.server.ListenAndServeTLS("", "")
+	logKV(LogLevelInfo, LogRegioWsServer, "listening",
+		"address", s.address, LogKeyPath, s.path)
+
+	s.setup.Lock()
+	if s.ctx.Err() != nil {
+		// closed while starting
+		s.setup.Unlock()
+		if l != nil {
+			l.Close()
+		}
+		return http.ErrServerClosed
 	}
+	s.server = server
+	s.setup.Unlock()
 
-	s.eventHandler.OnFailure(true, fmt.Errorf("exited: %v", err))
+	switch {
+	case l == nil && !useTls:
+		err = server.ListenAndServe()
+	case l == nil:
+		err = server.ListenAndServeTLS("", "")
+	case !useTls:
+		err = server.Serve(l)
+	default:
+		err = server.ServeTLS(l, "", "")
+	}
+
+	s.eventHandler.OnFailure(true, fmt.Errorf("exited: %w", err))
 
 	return err
 }
 
-func (s *Server) Broadcast(message *Message) {
-	var err error
-
-	clientIds := s.clientPool.GetIds()
-	for _, id := range clientIds {
-		_, conn := s.clientPool.Get(id)
-		if conn == nil {
-			_ = log.Warn(LogRegioWsServer, "no connection for id %v", id)
-			s.clientPool.Delete(id)
-			continue
+// listenUnix listens on the socket file, replacing a stale one. The file
+// is removed when the listener is closed.
+func (s *Server) listenUnix() (net.Listener, error) {
+	if info, err := os.Lstat(s.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", s.address)
+		if err == nil {
+			conn.Close()
+			return nil, errors.New("socket in use")
 		}
-		client := conn.(*websocket.Conn)
-		err = client.WriteMessage(message.MessageType,
-			message.Data)
-		if err != nil {
-			s.eventHandler.OnFailure(false,
-				fmt.Errorf("send to client <%v>: %v", id, err))
+		if err = os.Remove(s.address); err != nil {
+			return nil, err
+		}
+	}
 
-			_ = log.Error(LogRegioWsServer, "send<%v>: %v", id, err)
+	l, err := net.Listen("unix", s.address)
+	if err != nil {
+		return nil, err
+	}
+	if s.socketMode != 0 {
+		if err = os.Chmod(s.address, s.socketMode); err != nil {
+			l.Close()
+			return nil, err
 		}
 	}
-	if len(clientIds) < 1 {
-		_ = log.Debug(LogRegioWsServer, "no clients connected")
+	return l, nil
+}
+
+// SetBroadcastBackend wires the server to the other instances subscribed
+// to channel of backend: Broadcast also publishes there, broadcasts of the
+// other instances are sent to the local clients. Call it before
+// ListenAndServe.
+func (s *Server) SetBroadcastBackend(backend BroadcastBackend,
+	channel string) error {
+
+	s.backend, s.channel = backend, channel
+
+	return backend.Subscribe(channel, func(msg Message) {
+		if msg.Origin == s.instanceId {
+			return
+		}
+		s.hub.Broadcast(&msg)
+	})
+}
+
+// InstanceId identifies the server as Origin of the messages published to
+// the broadcast backend.
+func (s *Server) InstanceId() string {
+	return s.instanceId
+}
+
+// Broadcast sends the message to all clients of the hub, including those
+// of other instances if a broadcast backend is set.
+func (s *Server) Broadcast(message *Message) {
+	s.hub.Broadcast(message)
+
+	if s.backend == nil {
+		return
+	}
+	relayed := *message
+	relayed.Origin = s.instanceId
+	if err := s.backend.Publish(s.channel, relayed); err != nil {
+		logError(LogRegioWsServer, "publish broadcast: %v", err)
+		s.eventHandler.OnFailure(false,
+			fmt.Errorf("publish broadcast: %w", err))
 	}
 }
 
 func (s *Server) Send(clientId int, message *Message) error {
-	_, conn := s.clientPool.Get(clientId)
-	if conn == nil {
-		return errors.New("no valid client")
+	return s.hub.Send(clientId, message)
+}
+
+func (s *Server) setWriteDeadline(clientId int, t time.Time) error {
+	client := s.client(clientId)
+	if client == nil {
+		return ErrNoClient
 	}
-	client := conn.(*websocket.Conn)
-	return client.WriteMessage(message.MessageType,
-		message.Data)
+	client.writeLock.Lock()
+	defer client.writeLock.Unlock()
+
+	client.writeDeadline = t
+	return client.conn.SetWriteDeadline(t)
+}
+
+// Clients lists the connected clients of the hub, longest connected first.
+func (s *Server) Clients() []ClientInfo {
+	return s.hub.Clients()
+}
+
+// Disconnect sends a normal close frame to a client and drops its
+// connection.
+func (s *Server) Disconnect(clientId int) error {
+	return s.hub.Kick(clientId)
+}
+
+// Stats returns the counters over all clients of the hub.
+func (s *Server) Stats() ServerStats {
+	stats := s.hub.Stats()
+	shedding := s.shedding.Load()
+	stats.Shedding = shedding != nil && shedding.shed()
+	return stats
 }
 
 func (s *Server) Close() (err error) {
 	defer s.wg.Wait()
-	err = s.server.Close()
+	s.cancel()
+	s.setup.Lock()
+	server := s.server
+	s.setup.Unlock()
+	if server != nil {
+		err = server.Close()
+	}
+	s.handlers.Wait()
 	return
 }
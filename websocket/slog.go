@@ -0,0 +1,78 @@
+//go:build go1.21
+
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger writes to a slog.Logger, with the module as "component" and
+// the context of the log calls as attributes.
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger for SetLogger writing to l. The level set
+// by SetLogLevel applies before the one of l's handler.
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	return slogLogger{logger: l}
+}
+
+func (s slogLogger) Debug(module string, message string) {
+	s.LogAttrs(LogLevelDebug, module, message)
+}
+
+func (s slogLogger) Info(module string, message string) {
+	s.LogAttrs(LogLevelInfo, module, message)
+}
+
+func (s slogLogger) Warn(module string, message string) {
+	s.LogAttrs(LogLevelWarn, module, message)
+}
+
+func (s slogLogger) Error(module string, message string) {
+	s.LogAttrs(LogLevelError, module, message)
+}
+
+func (s slogLogger) LogAttrs(level LogLevel, module string, message string,
+	keysAndValues ...any) {
+
+	slogLevel := slog.LevelError
+	switch level {
+	case LogLevelDebug:
+		slogLevel = slog.LevelDebug
+	case LogLevelInfo:
+		slogLevel = slog.LevelInfo
+	case LogLevelWarn:
+		slogLevel = slog.LevelWarn
+	}
+
+	args := append([]any{"component", module}, keysAndValues...)
+	s.logger.Log(context.Background(), slogLevel, message, args...)
+}
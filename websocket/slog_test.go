@@ -0,0 +1,112 @@
+//go:build go1.21
+
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
+)
+
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// lineLogger is a plain Logger collecting the messages.
+type lineLogger struct {
+	lockedBuffer
+}
+
+func (l *lineLogger) Debug(module string, message string) { _, _ = l.Write([]byte(message + "\n")) }
+func (l *lineLogger) Info(module string, message string)  { _, _ = l.Write([]byte(message + "\n")) }
+func (l *lineLogger) Warn(module string, message string)  { _, _ = l.Write([]byte(message + "\n")) }
+func (l *lineLogger) Error(module string, message string) { _, _ = l.Write([]byte(message + "\n")) }
+
+func TestSlogLogger(t *testing.T) {
+	var output lockedBuffer
+	websocket.SetLogger(websocket.NewSlogLogger(slog.New(slog.NewJSONHandler(&output,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))))
+	defer websocket.SetLogger(nil)
+
+	// connected once both ends reported it, the server logged it before
+	server, client := websockettest.NewPair(t, websocket.NewRecorder(),
+		websocket.NewRecorder())
+	defer server.Close()
+	defer client.Disconnect()
+
+	var connected map[string]any
+	lines := bufio.NewScanner(strings.NewReader(output.String()))
+	for lines.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(lines.Bytes(), &record); err != nil {
+			t.Fatalf("no json: %s", lines.Text())
+		}
+		if record["msg"] == "client connected" {
+			connected = record
+		}
+	}
+	if connected == nil {
+		t.Fatalf("no connect record in\n%s", output.String())
+	}
+	if connected["component"] != websocket.LogRegioWsServer || connected["path"] != "/" ||
+		connected["level"] != "DEBUG" || connected[websocket.LogKeyClientId] == nil ||
+		connected[websocket.LogKeyRemoteAddr] == nil {
+		t.Errorf("unexpected record %v", connected)
+	}
+
+	// plain loggers get the context appended
+	plain := &lineLogger{}
+	websocket.SetLogger(plain)
+	other := server.NewClient(t, websocket.NewRecorder())
+	defer other.Disconnect()
+	want := fmt.Sprintf("client connected %s=%d ", websocket.LogKeyClientId, other.ClientId)
+	if got := plain.String(); !strings.Contains(got, want) {
+		t.Errorf("%q not in %q", want, got)
+	}
+}
@@ -0,0 +1,146 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stats are the counters of a client over all its connections.
+type Stats struct {
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+	Connects         int
+	Reconnects       int
+	// Connected reports whether a connection is up.
+	Connected bool
+	// ConnectedFor sums up the time connected, including the current
+	// connection.
+	ConnectedFor time.Duration
+	// CloseCode and CloseText are from the last close frame of the peer,
+	// 0 if the peer never closed.
+	CloseCode int
+	CloseText string
+}
+
+// ServerStats are the counters of a server over all its clients.
+type ServerStats struct {
+	// Clients is the number of currently connected clients, Connects the
+	// number of clients accepted so far.
+	Clients          int
+	Connects         int
+	MessagesSent     uint64
+	MessagesReceived uint64
+	BytesSent        uint64
+	BytesReceived    uint64
+	// BroadcastErrors counts failed sends of Broadcast, RejectedUpgrades
+	// the requests refused by load shedding, auth, subprotocol or upgrade
+	// checks, ShedUpgrades those refused by load shedding alone.
+	BroadcastErrors  uint64
+	RejectedUpgrades uint64
+	ShedUpgrades     uint64
+	// Shedding tells whether the server currently refuses new clients, see
+	// Server.SetLoadShedding.
+	Shedding bool
+}
+
+// ProxyStats are the counters of a ReverseProxy.
+type ProxyStats struct {
+	// Active is the number of currently relayed sessions, Sessions the
+	// number of sessions relayed so far.
+	Active       int
+	Sessions     uint64
+	DialFailures uint64
+}
+
+type statsCounter struct {
+	lock        sync.Mutex
+	stats       Stats
+	connectedAt time.Time
+}
+
+func (s *statsCounter) connected() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.Connects++
+	if s.stats.Connects > 1 {
+		s.stats.Reconnects++
+	}
+	s.connectedAt = time.Now()
+}
+
+// disconnected ends the current connection, err being the error which
+// ended the read loop.
+func (s *statsCounter) disconnected(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.connectedAt.IsZero() {
+		s.stats.ConnectedFor += time.Since(s.connectedAt)
+		s.connectedAt = time.Time{}
+	}
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		s.stats.CloseCode = closeErr.Code
+		s.stats.CloseText = closeErr.Text
+	}
+}
+
+func (s *statsCounter) sent(size int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.MessagesSent++
+	s.stats.BytesSent += uint64(size)
+}
+
+func (s *statsCounter) received(size int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stats.MessagesReceived++
+	s.stats.BytesReceived += uint64(size)
+}
+
+func (s *statsCounter) snapshot() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.stats
+	if !s.connectedAt.IsZero() {
+		stats.ConnectedFor += time.Since(s.connectedAt)
+		stats.Connected = true
+	}
+	return stats
+}
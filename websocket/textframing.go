@@ -0,0 +1,134 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// TextFramingHeader negotiates text-only framing in the handshake, for
+// intermediaries which mangle binary frames. It is only used if both ends
+// enable it.
+const TextFramingHeader = "X-Text-Framing"
+
+const textFramingBase64 = "base64"
+
+// With text-only framing a binary payload is sent as text frame of the
+// tag, textFramingBinary and the payload in standard base64, which costs 2
+// bytes plus a third of the payload. Text starting with the tag is escaped
+// by the tag and textFramingText, 2 bytes, all other text is sent as is.
+const (
+	textFramingTag    byte = 0x01
+	textFramingBinary byte = 'b'
+	textFramingText   byte = 't'
+)
+
+var ErrTextFraming = errors.New("invalid text framing tag")
+
+// encodeTextFrame returns the text frame of a message.
+func encodeTextFrame(messageType int, data []byte) (int, []byte) {
+	switch {
+	case messageType == websocket.BinaryMessage:
+		frame := make([]byte, 2+base64.StdEncoding.EncodedLen(len(data)))
+		frame[0], frame[1] = textFramingTag, textFramingBinary
+		base64.StdEncoding.Encode(frame[2:], data)
+		return websocket.TextMessage, frame
+	case messageType == websocket.TextMessage && len(data) > 0 && data[0] == textFramingTag:
+		return messageType, append([]byte{textFramingTag, textFramingText}, data...)
+	default:
+		return messageType, data
+	}
+}
+
+// decodeTextFrame reverses encodeTextFrame, untagged messages pass.
+func decodeTextFrame(messageType int, data []byte) (int, []byte, error) {
+	if messageType != websocket.TextMessage || len(data) == 0 || data[0] != textFramingTag {
+		return messageType, data, nil
+	}
+	if len(data) < 2 {
+		return messageType, nil, ErrTextFraming
+	}
+
+	switch data[1] {
+	case textFramingText:
+		return messageType, data[2:], nil
+	case textFramingBinary:
+		plain := make([]byte, base64.StdEncoding.DecodedLen(len(data)-2))
+		n, err := base64.StdEncoding.Decode(plain, data[2:])
+		if err != nil {
+			return messageType, nil, errors.Join(ErrTextFraming, err)
+		}
+		return websocket.BinaryMessage, plain[:n], nil
+	default:
+		return messageType, nil, ErrTextFraming
+	}
+}
+
+// textFrameWriter streams a message as text frame, tagged so the content
+// needs no checks: binary base64 encoded, text escaped.
+type textFrameWriter struct {
+	io.Writer
+	frame   io.WriteCloser
+	encoder io.WriteCloser
+}
+
+func newTextFrameWriter(conn *websocket.Conn, messageType int) (io.WriteCloser, error) {
+	frame, err := conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return nil, err
+	}
+	w := &textFrameWriter{Writer: frame, frame: frame}
+	tag := []byte{textFramingTag, textFramingText}
+	if messageType == websocket.BinaryMessage {
+		tag[1] = textFramingBinary
+		w.encoder = base64.NewEncoder(base64.StdEncoding, frame)
+		w.Writer = w.encoder
+	}
+	if _, err = frame.Write(tag); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *textFrameWriter) Close() error {
+	if w.encoder != nil {
+		if err := w.encoder.Close(); err != nil {
+			return err
+		}
+	}
+	return w.frame.Close()
+}
+
+// acceptsTextFraming reports whether the handshake header enables
+// text-only framing.
+func acceptsTextFraming(header http.Header) bool {
+	return header.Get(TextFramingHeader) == textFramingBase64
+}
@@ -0,0 +1,76 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expiringTokenAuth checks a header holding a token of ExpiringToken.
+type expiringTokenAuth struct {
+	header  string
+	secret  []byte
+	maxSkew time.Duration
+}
+
+// ExpiringToken returns a token issued at now for SetExpiringTokenAuth:
+// the unix time in seconds and the hex HMAC-SHA256 of it with secret,
+// separated by a dot.
+func ExpiringToken(secret []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return timestamp + "." + expiringTokenMac(secret, timestamp)
+}
+
+func expiringTokenMac(secret []byte, timestamp string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// valid checks the signature of the token and that it was issued within
+// maxSkew of now, in the past or in the future.
+func (a *expiringTokenAuth) valid(header http.Header, now time.Time) bool {
+	timestamp, signature, found := strings.Cut(header.Get(a.header), ".")
+	expected := expiringTokenMac(a.secret, timestamp)
+	signed := subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)),
+		[]byte(expected)) == 1
+	if !found || !signed {
+		return false
+	}
+	issued, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(issued, 0))
+	return age <= a.maxSkew && age >= -a.maxSkew
+}
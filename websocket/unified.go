@@ -0,0 +1,75 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+// Item carries either a Message or an Event. Exactly one of both is set.
+type Item struct {
+	Message *Message
+	Event   *Event
+}
+
+func (i Item) IsMessage() bool {
+	return i.Message != nil
+}
+
+type UnifiedChannel struct {
+	channel chan<- Item
+}
+
+func NewUnifiedChannel(channel chan<- Item) *UnifiedChannel {
+	return &UnifiedChannel{
+		channel: channel,
+	}
+}
+
+func (u *UnifiedChannel) deliver(item Item) {
+	if u.channel != nil {
+		u.channel <- item
+	} else {
+		logError("Unified2Channel", "channel is nil")
+	}
+}
+
+func (u *UnifiedChannel) OnReceive(msg Message) {
+	logDebug("Unified2Channel", "onReceive: %v", msg)
+	u.deliver(Item{Message: &msg})
+}
+
+func (u *UnifiedChannel) OnDisconnect(id int) {
+	logDebug("Unified2Channel", "onDisconnect: %v", id)
+	u.deliver(Item{Event: &Event{Type: Disconnect, Id: id}})
+}
+
+func (u *UnifiedChannel) OnConnect(id int) {
+	logDebug("Unified2Channel", "onConnect: %v", id)
+	u.deliver(Item{Event: &Event{Type: Connect, Id: id}})
+}
+
+func (u *UnifiedChannel) OnFailure(exited bool, err error) {
+	logDebug("Unified2Channel", "onFailure: %v", err)
+	evnt := failureEvent(exited, err)
+	u.deliver(Item{Event: &evnt})
+}
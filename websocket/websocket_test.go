@@ -23,67 +23,121 @@
  *  POSSIBILITY OF SUCH DAMAGE.
  */
 
-package websocket
+package websocket_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
 	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket/websockettest"
 	ccrypt "github.com/ChrIgiSta/go-utils/crypto"
+	gorilla "github.com/gorilla/websocket"
 )
 
+// dial connects client to the in-memory server with header and returns
+// what ConnectAndServe returns.
+func dial(server *websockettest.ServerConn, client *websocket.Client,
+	header map[string]string) error {
+
+	client.SetNetDial(server.NetDial())
+	return client.ConnectAndServe(websockettest.URL, header)
+}
+
+// dialRaw opens a plain gorilla connection to the in-memory server.
+func dialRaw(server *websockettest.ServerConn, header http.Header) (*gorilla.Conn, *http.Response, error) {
+	dialer := gorilla.Dialer{NetDialContext: server.NetDial()}
+	return dialer.Dial(websockettest.URL, header)
+}
+
+// listenLocal listens on a free local port, for tests needing tcp, and
+// returns the listener and its port.
+func listenLocal(t *testing.T) (net.Listener, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return listener, port
+}
+
 func TestWebsocketNoTls(t *testing.T) {
 	var (
-		testClient *EventsToChannel
-		testServer *EventsToChannel
+		testClient *websocket.EventsToChannel
+		testServer *websocket.EventsToChannel
 
-		sRxCh   chan Message = make(chan Message, 10)
-		cRxCh   chan Message = make(chan Message, 10)
-		sEvntCh chan Event   = make(chan Event, 10)
-		cEvntCh chan Event   = make(chan Event, 10)
+		sRxCh   chan websocket.Message = make(chan websocket.Message, 10)
+		cRxCh   chan websocket.Message = make(chan websocket.Message, 10)
+		sEvntCh chan websocket.Event   = make(chan websocket.Event, 10)
+		cEvntCh chan websocket.Event   = make(chan websocket.Event, 10)
 	)
 
-	testClient = NewEventsToChannel(cRxCh, cEvntCh)
-	testServer = NewEventsToChannel(sRxCh, sEvntCh)
+	testClient = websocket.NewEventsToChannel(cRxCh, cEvntCh)
+	testServer = websocket.NewEventsToChannel(sRxCh, sEvntCh)
 
-	client := NewClient(false, testClient)
-	server := NewServer("ws://localhost:33221/testPath", testServer)
+	client := websocket.NewClient(false, testClient)
+	server := websockettest.NewServer(testServer)
 
-	server.SetAuthHeader(&AuthHeader{
+	server.SetAuthHeader(&websocket.AuthHeader{
 		HeaderRequired: map[string]string{
 			"Token": "12345",
 		},
-		ValueHashAlgo: HashAlgoNone,
+		ValueHashAlgo: websocket.HashAlgoNone,
 	})
 
-	go func() { _ = server.ListenAndServe() }()
-
-	time.Sleep(2 * time.Second)
-
 	go func() {
-		_ = client.ConnectAndServe("ws://localhost:33221/testPath", map[string]string{
+		_ = dial(server, client, map[string]string{
 			"Token": "12345",
 		})
 	}()
 
-	time.Sleep(1 * time.Second)
-
 	evnt := <-sEvntCh
-	if evnt.Type == Connect {
+	if evnt.Type == websocket.Connect {
 		t.Logf("client <%d> @ server connected", evnt.Id)
 	} else {
 		t.Error("no connected event received @server")
 	}
 
 	evnt = <-cEvntCh
-	if evnt.Type == Connect {
+	if evnt.Type == websocket.Connect {
 		t.Logf("client <%d> to server connected", evnt.Id)
 	} else {
 		t.Error("no connected event received @client")
 	}
 
-	server.Broadcast(&Message{
+	server.Broadcast(&websocket.Message{
 		MessageType: 1,
 		Data:        []byte("Hello Client"),
 	})
@@ -108,23 +162,15 @@ func TestWebsocketNoTls(t *testing.T) {
 		t.Error(err)
 	}
 
-	time.Sleep(1 * time.Second)
+	if evnt = <-sEvntCh; evnt.Type != websocket.Disconnect {
+		t.Error("no disconnected event received @server")
+	}
 	server.Close()
 }
 
 func TestWebsocketTls(t *testing.T) {
-	var (
-		testClient *EventsToChannel
-		testServer *EventsToChannel
-
-		sRxCh   chan Message = make(chan Message, 10)
-		cRxCh   chan Message = make(chan Message, 10)
-		sEvntCh chan Event   = make(chan Event, 10)
-		cEvntCh chan Event   = make(chan Event, 10)
-	)
-
-	testClient = NewEventsToChannel(cRxCh, cEvntCh)
-	testServer = NewEventsToChannel(sRxCh, sEvntCh)
+	testClient := websocket.NewRecorder()
+	testServer := websocket.NewRecorder()
 
 	cert, key, err := ccrypt.CreateSelfsignedX509Certificate(big.NewInt(123),
 		100, ccrypt.KeyLength4096Bit,
@@ -141,27 +187,32 @@ func TestWebsocketTls(t *testing.T) {
 		t.Error(err)
 	}
 
-	client := NewClient(true, testClient)
-	server := NewServer("wss://localhost:33221/testPath", testServer)
+	listener, port := listenLocal(t)
+	client := websocket.NewClient(true, testClient)
+	server := websocket.NewServer("wss://localhost:"+port+"/testPath", testServer)
 
 	server.SetupTls(cert, key)
 
 	client.AddRootCa(cert)
 	client.DisableCommonNameCheck() // Doesn't work ...
 
-	go func() { _ = server.ListenAndServe() }()
-
-	time.Sleep(2 * time.Second) // wait for server
+	go func() { _ = server.Serve(listener) }()
 
 	go func() {
-		_ = client.ConnectAndServe("wss://localhost:33221/testPath", nil)
+		_ = client.ConnectAndServe("wss://localhost:"+port+"/testPath", nil)
 	}()
 
-	evnt := <-sEvntCh
-	if evnt.Type == Connect {
-		t.Logf("client <%d> connected", evnt.Id)
-	} else {
-		t.Error("no connected event received")
+	id := testServer.WaitForConnect(t, 5*time.Second)
+	t.Logf("client <%d> connected", id)
+	testClient.WaitForConnect(t, 5*time.Second)
+
+	err = client.SendTxt([]byte("Hello TLS"))
+	if err != nil {
+		t.Error(err)
+	}
+	msg := testServer.WaitForMessage(t, 5*time.Second)
+	if string(msg.Data) != "Hello TLS" || msg.ClientId != id {
+		t.Error("wrong msg client->server: ", string(msg.Data))
 	}
 
 	err = client.Disconnect()
@@ -169,6 +220,2772 @@ func TestWebsocketTls(t *testing.T) {
 		t.Error(err)
 	}
 
-	time.Sleep(1 * time.Second)
+	if testServer.WaitForDisconnect(t, 5*time.Second) != id {
+		t.Error("wrong client disconnected")
+	}
+	server.Close()
+}
+
+func TestUnifiedChannelOrder(t *testing.T) {
+	ch := make(chan websocket.Item, 10)
+	unified := websocket.NewUnifiedChannel(ch)
+
+	unified.OnConnect(1)
+	unified.OnReceive(websocket.Message{MessageType: 1, Data: []byte("a"), ClientId: 1})
+	unified.OnReceive(websocket.Message{MessageType: 1, Data: []byte("b"), ClientId: 1})
+	unified.OnDisconnect(1)
+	unified.OnFailure(true, errors.New("exit"))
+
+	item := <-ch
+	if item.IsMessage() || item.Event.Type != websocket.Connect {
+		t.Error("expected connect first, got ", item)
+	}
+	for _, expected := range []string{"a", "b"} {
+		item = <-ch
+		if !item.IsMessage() || string(item.Message.Data) != expected {
+			t.Error("expected message ", expected, " got ", item)
+		}
+	}
+	item = <-ch
+	if item.IsMessage() || item.Event.Type != websocket.Disconnect {
+		t.Error("expected disconnect, got ", item)
+	}
+	item = <-ch
+	if item.IsMessage() || item.Event.Type != websocket.FailureWithExit {
+		t.Error("expected failure, got ", item)
+	}
+}
+
+func TestRingBufferEvents(t *testing.T) {
+	ring := websocket.NewRingBufferEvents(nil, 3)
+	ring.SetPayloadPrefix(2)
+
+	for _, data := range []string{"aaa", "bbb", "ccc", "ddd"} {
+		ring.OnReceive(websocket.Message{MessageType: 1, Data: []byte(data)})
+	}
+	ring.OnConnect(1)
+
+	snapshot := ring.Snapshot()
+	if len(snapshot) != 3 {
+		t.Fatal("expected 3 messages, got ", len(snapshot))
+	}
+	for i, expected := range []string{"bb", "cc", "dd"} {
+		if string(snapshot[i].Data) != expected {
+			t.Error("expected ", expected, " got ", string(snapshot[i].Data))
+		}
+	}
+
+	events := ring.SnapshotEvents()
+	if len(events) != 1 || events[0].Type != websocket.Connect {
+		t.Error("unexpected events: ", events)
+	}
+}
+
+func TestFilteredEvents(t *testing.T) {
+	ring := websocket.NewRingBufferEvents(nil, 10)
+	filtered := websocket.NewFilteredEvents(ring, websocket.FilterOptions{
+		SuppressTypes: []websocket.EventType{websocket.Connect},
+		MessagePredicate: func(msg websocket.Message) bool {
+			return msg.MessageType == gorilla.BinaryMessage
+		},
+	})
+
+	filtered.OnConnect(1)
+	filtered.OnReceive(websocket.Message{MessageType: gorilla.TextMessage})
+	filtered.OnReceive(websocket.Message{MessageType: gorilla.BinaryMessage})
+	filtered.OnDisconnect(1)
+
+	if len(ring.Snapshot()) != 1 || len(ring.SnapshotEvents()) != 1 {
+		t.Error("unexpected forwarded items")
+	}
+	counts := filtered.Filtered()
+	if counts.Messages != 1 || counts.Events != 1 {
+		t.Error("unexpected filter counts: ", counts)
+	}
+}
+
+func TestPerClientChannelsNotDrained(t *testing.T) {
+	perClient := websocket.NewPerClientChannels(0)
+
+	connected := make(chan struct{})
+	go func() {
+		perClient.OnConnect(1)
+		perClient.OnConnect(2)
+		close(connected)
+	}()
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("connect blocked on the undrained new clients channel")
+	}
+	if _, ok := perClient.Client(2); !ok {
+		t.Error("client not served before its notification")
+	}
+	for _, want := range []int{1, 2} {
+		select {
+		case id := <-perClient.NewClients():
+			if id != want {
+				t.Errorf("notified client %d, expected %d", id, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("notification of client ", want, " dropped")
+		}
+	}
+}
+
+func TestPerClientChannelsDisconnectBlocked(t *testing.T) {
+	perClient := websocket.NewPerClientChannels(0)
+	perClient.OnConnect(1)
+
+	received := make(chan struct{})
+	go func() {
+		perClient.OnReceive(websocket.Message{Data: []byte("unread"), ClientId: 1})
+		close(received)
+	}()
+	// the receive blocks on the undrained channel until the disconnect
+	time.Sleep(10 * time.Millisecond)
+	perClient.OnDisconnect(1)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("receive still blocked after the disconnect")
+	}
+}
+
+func TestPerClientChannels(t *testing.T) {
+	perClient := websocket.NewPerClientChannels(10)
+
+	perClient.OnConnect(1)
+	perClient.OnConnect(2)
+	if id := <-perClient.NewClients(); id != 1 {
+		t.Error("expected client 1, got ", id)
+	}
+	<-perClient.NewClients()
+
+	perClient.OnReceive(websocket.Message{Data: []byte("one"), ClientId: 1})
+	perClient.OnReceive(websocket.Message{Data: []byte("two"), ClientId: 2})
+
+	ch, ok := perClient.Client(2)
+	if !ok {
+		t.Fatal("no channel for client 2")
+	}
+	if msg := <-ch; string(msg.Data) != "two" {
+		t.Error("wrong message for client 2: ", string(msg.Data))
+	}
+
+	perClient.OnDisconnect(2)
+	perClient.OnReceive(websocket.Message{Data: []byte("late"), ClientId: 2})
+	if _, open := <-ch; open {
+		t.Error("channel of client 2 not closed")
+	}
+	if _, ok = perClient.Client(2); ok {
+		t.Error("client 2 still known")
+	}
+}
+
+type ctxTestEvents struct {
+	*websocket.EventsToChannel
+	contexts chan context.Context
+}
+
+func (c *ctxTestEvents) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	c.contexts <- ctx
+	c.OnReceive(msg)
+}
+
+func TestCtxEvents(t *testing.T) {
+	var (
+		sRxCh   chan websocket.Message = make(chan websocket.Message, 10)
+		sEvntCh chan websocket.Event   = make(chan websocket.Event, 10)
+	)
+
+	serverEvents := &ctxTestEvents{
+		EventsToChannel: websocket.NewEventsToChannel(sRxCh, sEvntCh),
+		contexts:        make(chan context.Context, 10),
+	}
+	clientEvents := websocket.NewRecorder()
+	server, client := websockettest.NewPair(t, serverEvents, clientEvents)
+
+	evnt := <-sEvntCh
+	if evnt.Type != websocket.Connect {
+		t.Fatal("no connect event")
+	}
+	if err := client.SendTxt([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := <-serverEvents.contexts
+	<-sRxCh
+	if id, ok := websocket.ClientIdFromContext(ctx); !ok || id != evnt.Id {
+		t.Error("wrong client id in context: ", id)
+	}
+	if ctx.Err() != nil {
+		t.Error("context cancelled while connected")
+	}
+
 	server.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("context not cancelled on server close")
+	}
+	_ = client.Disconnect()
+}
+
+func TestBatchingEvents(t *testing.T) {
+	batchCh := make(chan []websocket.Message, 10)
+	eventCh := make(chan websocket.Event, 10)
+
+	batching := websocket.NewBatchingEvents(batchCh, 3, 50*time.Millisecond)
+	batching.SetEventChannel(eventCh)
+
+	for i := 0; i < 4; i++ {
+		batching.OnReceive(websocket.Message{Data: []byte{byte(i)}})
+	}
+	if batch := <-batchCh; len(batch) != 3 || batch[2].Data[0] != 2 {
+		t.Error("unexpected full batch: ", batch)
+	}
+
+	select {
+	case batch := <-batchCh:
+		if len(batch) != 1 || batch[0].Data[0] != 3 {
+			t.Error("unexpected delayed batch: ", batch)
+		}
+	case <-time.After(time.Second):
+		t.Error("delayed batch not flushed")
+	}
+
+	batching.OnReceive(websocket.Message{Data: []byte{4}})
+	batching.OnDisconnect(1)
+	if len(batchCh) != 1 || len(eventCh) != 1 {
+		t.Error("pending batch not flushed before event")
+	}
+}
+
+type panickingEvents struct {
+	websocket.Events
+}
+
+func (p *panickingEvents) OnReceive(msg websocket.Message) {
+	var nilMap map[string]int
+	nilMap[string(msg.Data)]++
+}
+
+func TestRecoveringEvents(t *testing.T) {
+	var callbacks []string
+
+	ring := websocket.NewRingBufferEvents(nil, 10)
+	recovering := websocket.NewRecoveringEvents(&panickingEvents{ring},
+		func(callback string, recovered any, stack []byte) {
+			callbacks = append(callbacks, callback)
+		})
+
+	recovering.OnReceive(websocket.Message{Data: []byte("boom")})
+	recovering.OnConnect(1)
+
+	if len(callbacks) != 1 || callbacks[0] != "OnReceive" {
+		t.Error("unexpected panic reports: ", callbacks)
+	}
+	events := ring.SnapshotEvents()
+	if len(events) != 2 || events[0].Type != websocket.Failure || events[1].Type != websocket.Connect {
+		t.Error("unexpected events: ", events)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	msg := websocket.Message{
+		MessageType: gorilla.BinaryMessage,
+		Data:        []byte{0x00, 0xff, 0x10},
+		ClientId:    42,
+		Origin:      "node-a",
+	}
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded websocket.Message
+	if err = json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.MessageType != msg.MessageType || decoded.ClientId != msg.ClientId ||
+		decoded.Origin != msg.Origin || !bytes.Equal(decoded.Data, msg.Data) {
+		t.Error("message not equal after round trip: ", decoded)
+	}
+
+	buffer := bytes.Buffer{}
+	writer := websocket.NewJSONLWriterEvents(&buffer)
+	writer.OnConnect(1)
+	writer.OnReceive(msg)
+	writer.OnFailure(true, &websocket.ClassifiedError{
+		Kind: websocket.KindMessageTooBig,
+		Err:  gorilla.ErrReadLimit,
+	})
+
+	var records []websocket.JSONLRecord
+	scanner := bufio.NewScanner(&buffer)
+	for scanner.Scan() {
+		var record websocket.JSONLRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatal("expected 3 records, got ", len(records))
+	}
+	if records[0].Event == nil || records[0].Event.Type != websocket.Connect {
+		t.Error("expected connect record")
+	}
+	if records[1].Message == nil || !bytes.Equal(records[1].Message.Data, msg.Data) {
+		t.Error("expected message record")
+	}
+	if records[2].Event == nil || records[2].Event.Type != websocket.FailureWithExit ||
+		records[2].Event.Kind != websocket.KindMessageTooBig || records[2].Event.Err == nil {
+		t.Error("unexpected failure record: ", records[2].Event)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	pongs := make(chan time.Duration, 10)
+
+	server := websockettest.NewServer(websocket.NewRecorder())
+	server.SetKeepalive(50*time.Millisecond, time.Second)
+	server.SetOnPong(func(id int, rtt time.Duration) { pongs <- rtt })
+	defer server.Close()
+
+	client := server.NewClient(t, websocket.NewRecorder())
+
+	select {
+	case rtt := <-pongs:
+		if rtt <= 0 || rtt > time.Second {
+			t.Error("implausible rtt: ", rtt)
+		}
+	case <-time.After(time.Second):
+		t.Error("no pong received")
+	}
+
+	_ = client.Disconnect()
+}
+
+func TestServerCloseCodes(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetReadLimit(8)
+	server.EnableTextHeartbeat("ping", "pong", 300*time.Millisecond)
+	defer server.Close()
+
+	closeCode := func(server *websockettest.ServerConn, connected func(client *websocket.Client)) int {
+		t.Helper()
+		events := websocket.NewRecorder()
+		client := websocket.NewClient(false, events)
+		done := make(chan struct{})
+		go func() {
+			_ = dial(server, client, nil)
+			close(done)
+		}()
+		events.WaitForConnect(t, time.Second)
+		connected(client)
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("client not closed")
+		}
+		return client.Stats().CloseCode
+	}
+
+	kicked := closeCode(server, func(*websocket.Client) {
+		_ = server.Disconnect(serverEvents.WaitForConnect(t, time.Second))
+	})
+	if kicked != gorilla.CloseNormalClosure {
+		t.Errorf("kick: close code %d", kicked)
+	}
+	tooBig := closeCode(server, func(client *websocket.Client) {
+		_ = client.SendTxt([]byte("more than eight bytes"))
+	})
+	if tooBig != gorilla.CloseMessageTooBig {
+		t.Errorf("read limit: close code %d", tooBig)
+	}
+	silent := closeCode(server, func(*websocket.Client) {})
+	if silent != gorilla.ClosePolicyViolation {
+		t.Errorf("heartbeat timeout: close code %d", silent)
+	}
+
+	shutdown := websockettest.NewServer(websocket.NewRecorder())
+	goingAway := closeCode(shutdown, func(*websocket.Client) {
+		_ = shutdown.Close()
+	})
+	if goingAway != gorilla.CloseGoingAway {
+		t.Errorf("shutdown: close code %d", goingAway)
+	}
+}
+
+func TestTextHeartbeat(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.EnableTextHeartbeat("ping", "pong", 150*time.Millisecond)
+	defer server.Close()
+
+	clientEvents := websocket.NewRecorder()
+	client := websocket.NewClient(false, clientEvents)
+	client.EnableTextHeartbeat("ping", "pong", 30*time.Millisecond, 100*time.Millisecond)
+	server.Connect(t, client)
+
+	time.Sleep(300 * time.Millisecond)
+	if err := client.SendTxt([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "hello" {
+		t.Errorf("received %q instead of the first message", msg.Data)
+	}
+	if len(clientEvents.Messages()) != 0 {
+		t.Error("pong delivered: ", clientEvents.Messages())
+	}
+	for _, evnt := range append(clientEvents.EventsSeen(), serverEvents.EventsSeen()...) {
+		if evnt.Type != websocket.Connect {
+			t.Error("unexpected event: ", evnt)
+		}
+	}
+	_ = client.Disconnect()
+
+	// without pings the server evicts the client
+	silentEvents := websocket.NewRecorder()
+	server.NewClient(t, silentEvents)
+	silentEvents.WaitForDisconnect(t, time.Second)
+	timedOut := false
+	for _, evnt := range serverEvents.EventsSeen() {
+		timedOut = timedOut || evnt.Kind == websocket.KindReadTimeout
+	}
+	if !timedOut {
+		t.Error("no timeout reported: ", serverEvents.EventsSeen())
+	}
+
+	// a server not answering fails the client
+	mute := websockettest.NewServer(websocket.NewRecorder())
+	defer mute.Close()
+
+	clientEvents = websocket.NewRecorder()
+	client = websocket.NewClient(false, clientEvents)
+	client.EnableTextHeartbeat("ping", "pong", 30*time.Millisecond, 50*time.Millisecond)
+	mute.Connect(t, client)
+	clientEvents.WaitForDisconnect(t, time.Second)
+	if evnt := clientEvents.EventsSeen()[1]; evnt.Kind != websocket.KindReadTimeout {
+		t.Error("expected a heartbeat timeout, got ", evnt)
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetClientBandwidthLimit(40000)
+	server.SetClientReadBandwidthLimit(40000)
+	defer server.Close()
+
+	clientEvents := websocket.NewRecorder()
+	client := server.NewClient(t, clientEvents)
+	defer func() { _ = client.Disconnect() }()
+	id := client.ClientId
+
+	// the burst of one second passes at once
+	msg := &websocket.Message{MessageType: websocket.BinaryMessage, Data: make([]byte, 10000)}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := server.Send(id, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Error("burst throttled: ", elapsed)
+	}
+
+	// a broadcast is queued, the following send waits behind it
+	start = time.Now()
+	server.Broadcast(msg)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("broadcast waited for a throttled client: ", elapsed)
+	}
+	if err := server.Send(id, msg); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("not throttled: ", elapsed)
+	}
+
+	info := server.Clients()[0]
+	if info.WriteLimit != 40000 || info.Throttled < 400*time.Millisecond ||
+		info.WriteUtilization < 0.5 {
+		t.Errorf("client info %+v", info)
+	}
+	for i := 0; i < 6; i++ {
+		clientEvents.WaitForMessage(t, time.Second)
+	}
+
+	// the read loop pauses for the read limit
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		if err := client.Send(*msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		serverEvents.WaitForMessage(t, time.Second)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("reading not throttled: ", elapsed)
+	}
+	if info = server.Clients()[0]; info.ReadLimit != 40000 || info.ReadUtilization < 0.5 {
+		t.Errorf("client info %+v", info)
+	}
+}
+
+func TestTLSHandshakeHook(t *testing.T) {
+	cert, key, err := ccrypt.CreateSelfsignedX509Certificate(big.NewInt(7),
+		1, ccrypt.KeyLength2048Bit,
+		ccrypt.CertificateSubject{CommonName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, port := listenLocal(t)
+	url := "wss://127.0.0.1:" + port + "/tls"
+	server := websocket.NewServer(url, websocket.NewRecorder())
+	server.SetupTls(cert, key)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	type handshake struct {
+		state     tls.ConnectionState
+		verifyErr error
+	}
+	handshakes := make(chan handshake, 1)
+	hook := func(state tls.ConnectionState, verifyErr error) {
+		handshakes <- handshake{state, verifyErr}
+	}
+
+	// verified: the handshake fails but the hook sees the chain
+	client := websocket.NewClient(false, websocket.NewRecorder())
+	client.SetOnTLSHandshake(hook)
+	err = client.ConnectAndServe(url, nil)
+	if websocket.KindOf(err) != websocket.KindTLSHandshake {
+		t.Error("expected tls handshake failure, got ", err)
+	}
+	h := <-handshakes
+	if h.verifyErr == nil || len(h.state.PeerCertificates) == 0 {
+		t.Error("hook without chain or verify error: ", h.verifyErr)
+	}
+
+	// skipped: connects, the hook still reports the verify error
+	events := websocket.NewRecorder()
+	client = websocket.NewClient(true, events)
+	client.SetOnTLSHandshake(hook)
+	go func() { _ = client.ConnectAndServe(url, nil) }()
+	events.WaitForConnect(t, time.Second)
+
+	h = <-handshakes
+	if h.verifyErr == nil {
+		t.Error("expected verify error with skipped verification")
+	}
+	state, ok := client.TLSConnectionState()
+	if !ok || len(state.PeerCertificates) == 0 {
+		t.Error("no tls connection state")
+	}
+
+	_ = client.Disconnect()
+}
+
+func TestSubprotocols(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetSubprotocols("v2", "v1")
+	defer server.Close()
+
+	for _, tc := range []struct {
+		offered  []string
+		selected string
+		rejected bool
+	}{
+		{offered: []string{"v1"}, selected: "v1"},
+		{offered: []string{"v1", "v2"}, selected: "v2"},
+		{offered: nil, selected: ""},
+		{offered: []string{"v3"}, rejected: true},
+	} {
+		events := websocket.NewRecorder()
+		client := websocket.NewClient(false, events)
+		client.SetSubprotocols(tc.offered...)
+
+		if tc.rejected {
+			if err := dial(server, client, nil); err == nil {
+				t.Errorf("%v: expected handshake failure", tc.offered)
+			}
+			continue
+		}
+
+		id := server.Connect(t, client)
+
+		if got := client.Subprotocol(); got != tc.selected {
+			t.Errorf("%v: client selected %q, want %q", tc.offered, got, tc.selected)
+		}
+		if got := server.Subprotocol(id); got != tc.selected {
+			t.Errorf("%v: server selected %q, want %q", tc.offered, got, tc.selected)
+		}
+
+		_ = client.Disconnect()
+		serverEvents.WaitForDisconnect(t, time.Second)
+	}
+}
+
+func TestTlsSetupWhileDialing(t *testing.T) {
+	cert, _, err := ccrypt.CreateSelfsignedX509Certificate(big.NewInt(9),
+		1, ccrypt.KeyLength2048Bit,
+		ccrypt.CertificateSubject{CommonName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := websocket.NewClient(false, websocket.NewRecorder())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			client.AddRootCa(cert)
+			client.DisableCommonNameCheck()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		_ = client.DialTLSConfig("localhost")
+	}
+	<-done
+	if client.DialTLSConfig("localhost").VerifyPeerCertificate == nil {
+		t.Error("common name check still enabled")
+	}
+}
+
+func TestDisableCommonNameCheckOrder(t *testing.T) {
+	ca, cert, _ := issueCertificate(t)
+	block, _ := pem.Decode(cert)
+
+	for _, caFirst := range []bool{true, false} {
+		client := websocket.NewClient(false, websocket.NewRecorder())
+		if caFirst {
+			client.AddRootCa(ca)
+			client.DisableCommonNameCheck()
+		} else {
+			client.DisableCommonNameCheck()
+			client.AddRootCa(ca)
+		}
+
+		config := client.DialTLSConfig("other.host")
+		if config.VerifyPeerCertificate == nil {
+			t.Fatalf("ca first %v: common name check still enabled", caFirst)
+		}
+		if err := config.VerifyPeerCertificate([][]byte{block.Bytes}, nil); err != nil {
+			t.Errorf("ca first %v: %v", caFirst, err)
+		}
+	}
+}
+
+func TestAddRootCaFile(t *testing.T) {
+	cert, _, err := ccrypt.CreateSelfsignedX509Certificate(big.NewInt(8),
+		1, ccrypt.KeyLength2048Bit,
+		ccrypt.CertificateSubject{CommonName: "localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath := dir + "/ca.pem"
+	junkPath := dir + "/junk.pem"
+	if err = os.WriteFile(certPath, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(junkPath, []byte("no pem here"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := websocket.NewClient(false, websocket.NewRecorder())
+	if err = client.AddRootCaFile(certPath); err != nil {
+		t.Error(err)
+	}
+	if client.DialTLSConfig("localhost").RootCAs == nil {
+		t.Error("root ca not used for verification")
+	}
+	if err = client.AddRootCaFile(junkPath); err == nil {
+		t.Error("expected error for file without certificates")
+	}
+	if err = client.AddRootCaFile(dir + "/missing.pem"); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+// issueCertificate returns a ca and a localhost certificate with key
+// signed by it, as pem.
+func issueCertificate(t *testing.T) (ca []byte, cert []byte, key []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(11),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate,
+		&caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(12),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDer}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestAddRootCa(t *testing.T) {
+	ca, cert, key := issueCertificate(t)
+	listener, port := listenLocal(t)
+	url := "wss://localhost:" + port + "/ca"
+	server := websocket.NewServer(url, websocket.NewRecorder())
+	server.SetupTls(cert, key)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	// the ca is unknown without AddRootCa
+	err := websocket.NewClient(false, websocket.NewRecorder()).ConnectAndServe(url, nil)
+	if websocket.KindOf(err) != websocket.KindTLSHandshake {
+		t.Error("expected unknown authority, got ", err)
+	}
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.AddRootCa(ca)
+	go func() { _ = client.ConnectAndServe(url, nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+}
+
+func TestDisconnectBeforeConnect(t *testing.T) {
+	client := websocket.NewClient(false, websocket.NewRecorder())
+
+	done := make(chan error, 1)
+	go func() { done <- client.Disconnect() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("disconnect: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnect blocked without a connection")
+	}
+}
+
+func TestDisconnectDuringDial(t *testing.T) {
+	client := websocket.NewClient(false, websocket.NewRecorder())
+	client.SetReconnect(utils.NewBackoff(), 0)
+	dialing := make(chan struct{}, 1)
+	client.SetNetDial(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		dialing <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	served := make(chan error, 1)
+	go func() { served <- client.ConnectAndServe("ws://unreachable.invalid/", nil) }()
+	<-dialing
+
+	disconnected := make(chan struct{})
+	go func() {
+		_ = client.Disconnect()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("disconnect blocked on the pending dial")
+	}
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("ConnectAndServe did not return")
+	}
+}
+
+func TestOnReconnected(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetReconnect(&utils.Backoff{Initial: 10 * time.Millisecond,
+		Max: 50 * time.Millisecond}, 0)
+	attempts := make(chan int, 10)
+	var fail atomic.Bool
+	// a send of another goroutine during the hook goes out after it
+	interleaved := make(chan error, 10)
+	client.SetOnReconnected(func(attempt int) error {
+		attempts <- attempt
+		concurrent := make(chan error, 1)
+		go func() { concurrent <- client.SendTxt([]byte("interleaved")) }()
+		select {
+		case err := <-concurrent:
+			return fmt.Errorf("send not held back: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		go func() { interleaved <- <-concurrent }()
+		if err := client.SendTxt([]byte("subscribe")); err != nil {
+			return err
+		}
+		if fail.Swap(false) {
+			return errors.New("subscription refused")
+		}
+		return nil
+	})
+	go func() { _ = dial(server, client, nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	select {
+	case attempt := <-attempts:
+		t.Fatalf("hook ran on the initial connect, attempt %d", attempt)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	expectReconnect := func(want ...int) {
+		t.Helper()
+		for i, attempt := range want {
+			select {
+			case got := <-attempts:
+				if got != attempt {
+					t.Errorf("attempt %d, want %d", got, attempt)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("no reconnect attempt %d", attempt)
+			}
+			if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "subscribe" {
+				t.Errorf("unexpected message %q", msg.Data)
+			}
+			err := <-interleaved
+			if i < len(want)-1 {
+				// the connection of the failed hook is gone
+				if !errors.Is(err, websocket.ErrNotConnected) {
+					t.Errorf("send held by a failed hook: %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("send held by the hook: %v", err)
+			}
+			if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "interleaved" {
+				t.Errorf("unexpected message %q", msg.Data)
+			}
+		}
+	}
+
+	_ = server.Disconnect(id)
+	expectReconnect(1)
+	id = serverEvents.WaitForConnect(t, time.Second)
+
+	// a failing hook drops the connection and the next attempt follows
+	fail.Store(true)
+	_ = server.Disconnect(id)
+	expectReconnect(1, 2)
+	reported := false
+	for _, evnt := range events.EventsSeen() {
+		if evnt.Type == websocket.Failure && evnt.Err != nil &&
+			strings.Contains(evnt.Err.Error(), "subscription refused") {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Error("hook error not reported")
+	}
+}
+
+// addrEvents reports the remote address of each connect.
+type addrEvents struct {
+	*websocket.Recorder
+	addrs chan net.Addr
+}
+
+func (e addrEvents) OnConnectCtx(ctx context.Context, id int) {
+	addr, _ := websocket.RemoteAddrFromContext(ctx)
+	e.addrs <- addr
+	e.OnConnect(id)
+}
+
+func TestResolverRotation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	serverEvents := websocket.NewRecorder()
+	server := websocket.NewServer("ws://"+listener.Addr().String()+"/resolve", serverEvents)
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	var lock sync.Mutex
+	var lookups int
+	var dialed []string
+	events := websocket.NewRecorder()
+	connectedTo := make(chan net.Addr, 2)
+	client := websocket.NewClient(false, addrEvents{Recorder: events, addrs: connectedTo})
+	client.SetReconnect(&utils.Backoff{Initial: 10 * time.Millisecond,
+		Max: 50 * time.Millisecond}, 0)
+	client.SetResolver(func(_ context.Context, host string) ([]netip.Addr, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if host != "broker.test" {
+			return nil, fmt.Errorf("unexpected host %q", host)
+		}
+		lookups++
+		// nothing listens on the first one
+		return []netip.Addr{netip.MustParseAddr("127.0.0.3"),
+			netip.MustParseAddr("127.0.0.1")}, nil
+	})
+	client.SetNetDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		lock.Lock()
+		dialed = append(dialed, addr)
+		lock.Unlock()
+		var d net.Dialer
+		return d.DialContext(ctx, network, addr)
+	})
+	go func() { _ = client.ConnectAndServe("ws://broker.test:"+port+"/resolve", nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	if addr := client.RemoteAddr(); addr == nil || addr.String() != "127.0.0.1:"+port {
+		t.Errorf("connected to %v", addr)
+	}
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	_ = server.Disconnect(id)
+	events.WaitForDisconnect(t, time.Second)
+	events.WaitForConnect(t, 2*time.Second)
+	for i := 0; i < 2; i++ {
+		if addr := <-connectedTo; addr == nil || addr.String() != "127.0.0.1:"+port {
+			t.Errorf("connect event with address %v", addr)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if lookups != 2 {
+		t.Errorf("%d lookups for 2 connects", lookups)
+	}
+	// the reconnect starts at the next address
+	want := []string{"127.0.0.3:" + port, "127.0.0.1:" + port, "127.0.0.1:" + port}
+	if strings.Join(dialed, " ") != strings.Join(want, " ") {
+		t.Errorf("dialed %v, want %v", dialed, want)
+	}
+}
+
+func TestDefaultResolverReconnect(t *testing.T) {
+	first, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(first.Addr().String())
+	second, err := net.Listen("tcp", "127.0.0.2:"+port)
+	if err != nil {
+		first.Close()
+		t.Skip("no second loopback address: ", err)
+	}
+	var servers []*websocket.Server
+	var recorders []*websocket.Recorder
+	for _, listener := range []net.Listener{first, second} {
+		recorder := websocket.NewRecorder()
+		server := websocket.NewServer("ws://"+listener.Addr().String()+"/resolve", recorder)
+		go func(l net.Listener) { _ = server.Serve(l) }(listener)
+		defer server.Close()
+		servers = append(servers, server)
+		recorders = append(recorders, recorder)
+	}
+
+	var lookups atomic.Int32
+	defer websocket.SetDefaultResolver(func(_ context.Context, host string) ([]netip.Addr, error) {
+		if host != "broker.test" {
+			return nil, fmt.Errorf("unexpected host %q", host)
+		}
+		lookups.Add(1)
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1"),
+			netip.MustParseAddr("127.0.0.2")}, nil
+	})()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetReconnect(&utils.Backoff{Initial: 10 * time.Millisecond,
+		Max: 50 * time.Millisecond}, 0)
+	go func() { _ = client.ConnectAndServe("ws://broker.test:"+port+"/resolve", nil) }()
+	defer client.Disconnect()
+
+	// each connect resolves again and goes on to the next address
+	want := []string{"127.0.0.1:" + port, "127.0.0.2:" + port}
+	for i, server := range servers {
+		events.WaitForConnect(t, time.Second)
+		id := recorders[i].WaitForConnect(t, time.Second)
+		if addr := client.RemoteAddr(); addr == nil || addr.String() != want[i] {
+			t.Errorf("connect %d to %v, want %s", i, addr, want[i])
+		}
+		_ = server.Disconnect(id)
+		events.WaitForDisconnect(t, time.Second)
+	}
+	if n := lookups.Load(); n < 2 {
+		t.Errorf("%d lookups for 2 connects", n)
+	}
+}
+
+func TestHandshakeErrorBody(t *testing.T) {
+	const bodySize = 256 << 20
+	for _, status := range []int{http.StatusInternalServerError, http.StatusUnauthorized} {
+		written := make(chan int64, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(bodySize))
+			w.WriteHeader(status)
+			chunk := bytes.Repeat([]byte("x"), 64<<10)
+			var n int64
+			for n < bodySize {
+				m, err := w.Write(chunk)
+				n += int64(m)
+				if err != nil {
+					break
+				}
+			}
+			written <- n
+		}))
+
+		client := websocket.NewClient(false, websocket.NewRecorder())
+		done := make(chan error, 1)
+		go func() { done <- client.ConnectAndServe("ws"+strings.TrimPrefix(srv.URL, "http"), nil) }()
+		select {
+		case err := <-done:
+			if !errors.Is(err, gorilla.ErrBadHandshake) {
+				t.Errorf("status %d: expected bad handshake, got %v", status, err)
+			}
+			if status == http.StatusUnauthorized && websocket.KindOf(err) != websocket.KindAuthRejected {
+				t.Errorf("expected auth rejected, got %v", websocket.KindOf(err))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("status %d: ConnectAndServe blocked on the error body", status)
+		}
+		select {
+		case n := <-written:
+			if n >= bodySize {
+				t.Errorf("status %d: whole error body was consumed", status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("status %d: response body left open", status)
+		}
+		srv.Close()
+	}
+}
+
+func TestSendWhileConnecting(t *testing.T) {
+	websocket.SetLogger(websocket.NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer websocket.SetLogger(nil)
+
+	lookup, looking := make(chan struct{}), make(chan struct{}, 1)
+	server := websockettest.NewServer(websocket.NewRecorder())
+	server.RequireChallengeAuth(func(keyId string) ([]byte, bool) {
+		select {
+		case looking <- struct{}{}:
+		default:
+		}
+		<-lookup
+		return []byte("secret"), true
+	}, time.Second)
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetChallengeAuth("device", []byte("secret"))
+	client.SetNetDial(server.NetDial())
+	if err := client.SendTxt([]byte("early")); !errors.Is(err, websocket.ErrNotConnected) {
+		t.Fatal("send before connect: ", err)
+	}
+
+	go func() { _ = client.ConnectAndServe(websockettest.URL, nil) }()
+	// the server waits for the secret, the client for the verdict
+	<-looking
+	if err := client.SendTxt([]byte("during")); !errors.Is(err, websocket.ErrNotConnected) {
+		t.Error("send during the challenge: ", err)
+	}
+	close(lookup)
+	events.WaitForConnect(t, time.Second)
+	if err := client.SendTxt([]byte("connected")); err != nil {
+		t.Error("send when connected: ", err)
+	}
+
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = client.SendTxt([]byte("noise"))
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		_ = client.Disconnect()
+		if err := client.SendTxt([]byte("late")); !errors.Is(err, websocket.ErrNotConnected) {
+			t.Error("send after disconnect: ", err)
+		}
+		go func() { _ = client.ConnectAndServe(websockettest.URL, nil) }()
+		events.WaitForConnect(t, time.Second)
+	}
+	close(stop)
+	<-sending
+	_ = client.Disconnect()
+}
+
+func TestConnectAndServeTwice(t *testing.T) {
+	server := websockettest.NewServer(websocket.NewRecorder())
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetNetDial(server.NetDial())
+	stopSending := make(chan struct{})
+	defer close(stopSending)
+	go func() {
+		for {
+			select {
+			case <-stopSending:
+				return
+			default:
+				_ = client.SendTxt([]byte("noise"))
+			}
+		}
+	}()
+
+	for round := 0; round < 20; round++ {
+		errs := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			go func() { errs <- client.ConnectAndServe(websockettest.URL, nil) }()
+		}
+		for i := 0; i < 2; i++ {
+			if err := <-errs; !errors.Is(err, websocket.ErrAlreadyConnected) {
+				t.Fatalf("round %d: concurrent call returned %v", round, err)
+			}
+		}
+		events.WaitForConnect(t, time.Second)
+
+		disconnected := make(chan struct{})
+		for i := 0; i < 2; i++ {
+			go func() {
+				_ = client.Disconnect()
+				disconnected <- struct{}{}
+			}()
+		}
+		<-disconnected
+		<-disconnected
+		// served is closed before ConnectAndServe hands back its result
+		select {
+		case <-errs:
+		case <-time.After(time.Second):
+			t.Fatalf("round %d: still serving after Disconnect", round)
+		}
+	}
+}
+
+func TestMutualTls(t *testing.T) {
+	subject := ccrypt.CertificateSubject{CommonName: "localhost"}
+	serverCert, serverKey, err := ccrypt.CreateSelfsignedX509Certificate(
+		big.NewInt(9), 1, ccrypt.KeyLength2048Bit, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey, err := ccrypt.CreateSelfsignedX509Certificate(
+		big.NewInt(10), 1, ccrypt.KeyLength2048Bit, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, port := listenLocal(t)
+	url := "wss://127.0.0.1:" + port + "/mtls"
+	server := websocket.NewServer(url, websocket.NewRecorder())
+	server.SetupTls(serverCert, serverKey)
+	if err = server.RequireClientCert(clientCert); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	defer server.Close()
+
+	client := websocket.NewClient(true, websocket.NewRecorder())
+	if err = client.ConnectAndServe(url, nil); err == nil {
+		t.Error("connected without client certificate")
+	}
+
+	if err = client.SetClientCertificate(clientCert, serverKey); err == nil {
+		t.Error("expected error for mismatching key")
+	}
+	if err = client.SetClientCertificate(clientCert, clientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	events := websocket.NewRecorder()
+	client = websocket.NewClient(true, events)
+	_ = client.SetClientCertificate(clientCert, clientKey)
+	go func() { _ = client.ConnectAndServe(url, nil) }()
+	events.WaitForConnect(t, time.Second)
+
+	_ = client.Disconnect()
+}
+
+func TestClientStats(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := server.NewClient(t, events)
+	id := client.ClientId
+
+	_ = client.SendTxt([]byte("ab"))
+	_ = client.Send(websocket.Message{MessageType: websocket.BinaryMessage, Data: []byte("cde")})
+	_ = server.Send(id, &websocket.Message{MessageType: websocket.TextMessage, Data: []byte("xyz")})
+	events.WaitForMessage(t, time.Second)
+
+	stats := client.Stats()
+	if stats.MessagesSent != 2 || stats.BytesSent != 5 {
+		t.Errorf("sent %d messages, %d bytes", stats.MessagesSent, stats.BytesSent)
+	}
+	if stats.MessagesReceived != 1 || stats.BytesReceived != 3 {
+		t.Errorf("received %d messages, %d bytes",
+			stats.MessagesReceived, stats.BytesReceived)
+	}
+	if stats.Connects != 1 || stats.Reconnects != 0 || stats.ConnectedFor <= 0 {
+		t.Errorf("unexpected connection stats: %+v", stats)
+	}
+
+	_ = client.Disconnect()
+}
+
+func TestAuthHeader(t *testing.T) {
+	server := websockettest.NewServer(websocket.NewRecorder())
+	server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoSHA256))
+	defer server.Close()
+
+	digest, err := websocket.HashAuthValue("secret", websocket.HashAlgoSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b" {
+		t.Error("unexpected digest: ", digest)
+	}
+
+	for _, value := range []string{"secret", "", "wrong"} {
+		client := websocket.NewClient(false, websocket.NewRecorder())
+		err = dial(server, client, map[string]string{"X-Token": value})
+		if websocket.KindOf(err) != websocket.KindAuthRejected {
+			t.Errorf("%q: expected auth rejected, got %v", value, err)
+		}
+	}
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	go func() { _ = dial(server, client, map[string]string{"X-Token": digest}) }()
+	events.WaitForConnect(t, time.Second)
+	_ = client.Disconnect()
+}
+
+func TestAuthHeaderValues(t *testing.T) {
+	server := websockettest.NewServer(websocket.NewRecorder())
+	defer server.Close()
+
+	try := func(header map[string]string) error {
+		t.Helper()
+		client := websocket.NewClient(false, websocket.NewRecorder())
+		errCh := make(chan error, 1)
+		go func() { errCh <- dial(server, client, header) }()
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(300 * time.Millisecond):
+			_ = client.Disconnect()
+			return nil
+		}
+	}
+	digest := func(value string) string {
+		hashed, _ := websocket.HashAuthValue(value, websocket.HashAlgoSHA256)
+		return hashed
+	}
+
+	// rotation: the old and the new token are valid
+	server.SetAuthHeader(websocket.NewAuthHeaderValues(map[string][]string{
+		"X-Token": {"old", "new"},
+	}, websocket.HashAlgoSHA256, websocket.AuthRequireAll))
+	for _, token := range []string{"old", "new"} {
+		if err := try(map[string]string{"X-Token": digest(token)}); err != nil {
+			t.Errorf("%s token rejected: %v", token, err)
+		}
+	}
+	if err := try(map[string]string{"X-Token": digest("other")}); websocket.KindOf(err) != websocket.KindAuthRejected {
+		t.Errorf("unknown token: %v", err)
+	}
+
+	accepted := map[string][]string{"X-Token": {"t"}, "X-Api-Key": {"k"}}
+	server.SetAuthHeader(websocket.NewAuthHeaderValues(accepted, websocket.HashAlgoNone, websocket.AuthRequireAny))
+	for _, header := range []map[string]string{{"X-Token": "t"}, {"X-Api-Key": "k"}} {
+		if err := try(header); err != nil {
+			t.Errorf("any of %v rejected: %v", header, err)
+		}
+	}
+	if err := try(map[string]string{"X-Token": "k"}); websocket.KindOf(err) != websocket.KindAuthRejected {
+		t.Errorf("wrong value accepted: %v", err)
+	}
+
+	server.SetAuthHeader(websocket.NewAuthHeaderValues(accepted, websocket.HashAlgoNone, websocket.AuthRequireAll))
+	if err := try(map[string]string{"X-Token": "t", "X-Api-Key": "k"}); err != nil {
+		t.Errorf("all headers rejected: %v", err)
+	}
+	wrongValue := try(map[string]string{"X-Token": "t", "X-Api-Key": "x"})
+	missing := try(map[string]string{"X-Token": "t"})
+	var valueErr, missingErr *websocket.HandshakeError
+	if !errors.As(wrongValue, &valueErr) || !errors.As(missing, &missingErr) {
+		t.Fatalf("expected rejections, got %v and %v", wrongValue, missing)
+	}
+	if valueErr.StatusCode != missingErr.StatusCode ||
+		!bytes.Equal(valueErr.Body, missingErr.Body) {
+		t.Error("rejections tell the wrong value from the missing header")
+	}
+}
+
+func TestExpiringTokenAuth(t *testing.T) {
+	secret := []byte("token secret")
+	server := websockettest.NewServer(websocket.NewRecorder())
+	server.SetExpiringTokenAuth("X-Token", secret, time.Minute)
+	defer server.Close()
+
+	try := func(client *websocket.Client, header map[string]string) error {
+		t.Helper()
+		errCh := make(chan error, 1)
+		go func() { errCh <- dial(server, client, header) }()
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(300 * time.Millisecond):
+			_ = client.Disconnect()
+			return nil
+		}
+	}
+	tryToken := func(token string) error {
+		t.Helper()
+		return try(websocket.NewClient(false, websocket.NewRecorder()), map[string]string{"X-Token": token})
+	}
+
+	now := time.Now()
+	for _, tc := range []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"fresh", websocket.ExpiringToken(secret, now), true},
+		{"skewed past", websocket.ExpiringToken(secret, now.Add(-30*time.Second)), true},
+		{"skewed future", websocket.ExpiringToken(secret, now.Add(30*time.Second)), true},
+		{"expired", websocket.ExpiringToken(secret, now.Add(-2*time.Minute)), false},
+		{"future dated", websocket.ExpiringToken(secret, now.Add(2*time.Minute)), false},
+		{"wrong secret", websocket.ExpiringToken([]byte("other"), now), false},
+		{"malformed", "not a token", false},
+		{"missing", "", false},
+	} {
+		err := tryToken(tc.token)
+		if tc.valid && err != nil {
+			t.Errorf("%s token rejected: %v", tc.name, err)
+		}
+		if !tc.valid && websocket.KindOf(err) != websocket.KindAuthRejected {
+			t.Errorf("%s token: %v", tc.name, err)
+		}
+	}
+
+	// tokens are not tracked, a valid one is accepted again
+	token := websocket.ExpiringToken(secret, time.Now())
+	for i := 0; i < 2; i++ {
+		if err := tryToken(token); err != nil {
+			t.Errorf("replay %d rejected: %v", i, err)
+		}
+	}
+
+	client := websocket.NewClient(false, websocket.NewRecorder())
+	client.SetExpiringToken("X-Token", secret)
+	if err := try(client, nil); err != nil {
+		t.Errorf("client token rejected: %v", err)
+	}
+	client.SetExpiringToken("X-Token", []byte("other"))
+	if err := try(client, nil); websocket.KindOf(err) != websocket.KindAuthRejected {
+		t.Errorf("client token of other secret: %v", err)
+	}
+}
+
+func TestAuthRejectionResponse(t *testing.T) {
+	server := websockettest.NewServer(websocket.NewRecorder())
+	server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoNone))
+	defer server.Close()
+
+	connect := func() *websocket.HandshakeError {
+		t.Helper()
+		err := dial(server, websocket.NewClient(false, websocket.NewRecorder()),
+			map[string]string{"X-Token": "expired"})
+		var handshakeErr *websocket.HandshakeError
+		if !errors.As(err, &handshakeErr) {
+			t.Fatalf("expected a handshake error, got %v", err)
+		}
+		if !errors.Is(err, gorilla.ErrBadHandshake) {
+			t.Error("bad handshake not in the chain of ", err)
+		}
+		return handshakeErr
+	}
+
+	bare := connect()
+	if bare.StatusCode != http.StatusUnauthorized || len(bare.Body) != 0 {
+		t.Errorf("unexpected default rejection: %d %q", bare.StatusCode, bare.Body)
+	}
+
+	server.SetAuthRejectionResponse(&websocket.AuthRejection{
+		ContentType: "application/json",
+		Body:        []byte(`{"error":"token expired"}`),
+		Header:      http.Header{"Www-Authenticate": {`Bearer error="invalid_token"`}},
+	})
+	rejected := connect()
+	if rejected.StatusCode != http.StatusUnauthorized ||
+		string(rejected.Body) != `{"error":"token expired"}` ||
+		rejected.Header.Get("Content-Type") != "application/json" ||
+		rejected.Header.Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+		t.Errorf("unexpected rejection: %d %q %v", rejected.StatusCode, rejected.Body,
+			rejected.Header)
+	}
+
+	server.SetAuthRejectionResponse(&websocket.AuthRejection{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Retry-After": {"30"}},
+	})
+	busy := connect()
+	if busy.StatusCode != http.StatusServiceUnavailable || busy.Header.Get("Retry-After") != "30" {
+		t.Errorf("unexpected rejection: %d %v", busy.StatusCode, busy.Header)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	var shedding atomic.Bool
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetLoadShedding(shedding.Load, 1500*time.Millisecond)
+	defer server.Close()
+
+	client := server.NewClient(t, websocket.NewRecorder())
+	defer client.Disconnect()
+
+	shedding.Store(true)
+	err := dial(server, websocket.NewClient(false, websocket.NewRecorder()), nil)
+	var refused *websocket.HandshakeError
+	if !errors.As(err, &refused) {
+		t.Fatalf("expected a refused handshake, got %v", err)
+	}
+	if refused.StatusCode != http.StatusServiceUnavailable ||
+		refused.Header.Get("Retry-After") != "2" {
+		t.Errorf("unexpected refusal: %d %v", refused.StatusCode, refused.Header)
+	}
+	stats := server.Stats()
+	if !stats.Shedding || stats.ShedUpgrades != 1 || stats.RejectedUpgrades != 1 ||
+		stats.Clients != 1 {
+		t.Errorf("unexpected stats while shedding: %+v", stats)
+	}
+
+	// connected clients are unaffected
+	_ = client.SendTxt([]byte("still here"))
+	serverEvents.WaitForMessage(t, time.Second)
+
+	shedding.Store(false)
+	if server.Stats().Shedding {
+		t.Error("still shedding")
+	}
+	other := server.NewClient(t, websocket.NewRecorder())
+	defer other.Disconnect()
+
+	// switched on and off while requests come in
+	switched := make(chan struct{})
+	go func() {
+		defer close(switched)
+		for i := 0; i < 20; i++ {
+			server.SetLoadShedding(shedding.Load, time.Second)
+			server.SetLoadShedding(nil, 0)
+		}
+	}()
+	httpClient := http.Client{Transport: &http.Transport{DialContext: server.NetDial()}}
+	for i := 0; i < 5; i++ {
+		if resp, err := httpClient.Get(websockettest.URL); err == nil {
+			resp.Body.Close()
+		}
+		_ = server.Stats()
+	}
+	<-switched
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	websocket.SetLogger(websocket.NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer websocket.SetLogger(nil)
+
+	const simultaneous = 8
+	for _, tc := range []struct {
+		policy websocket.DuplicatePolicy
+	}{
+		{websocket.DuplicateRejectNew},
+		{websocket.DuplicateKickOld},
+	} {
+		server := websockettest.NewServer(websocket.NewRecorder())
+		server.SetIdentity(func(r *http.Request) string { return r.Header.Get("X-User") })
+		server.SetDuplicatePolicy(tc.policy)
+
+		type connection struct {
+			client *websocket.Client
+			done   chan error
+		}
+		connect := func(user string) connection {
+			c := connection{client: websocket.NewClient(false, websocket.NewRecorder()), done: make(chan error, 1)}
+			go func() {
+				c.done <- dial(server, c.client, map[string]string{"X-User": user})
+			}()
+			return c
+		}
+		// waitClients waits until the server lists count clients
+		waitClients := func(count int) {
+			t.Helper()
+			for i := 0; i < 100 && len(server.Clients()) != count; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := len(server.Clients()); n != count {
+				t.Fatalf("policy %d: %d clients, want %d", tc.policy, n, count)
+			}
+		}
+		conflict := func(err error) bool {
+			var refused *websocket.HandshakeError
+			return errors.As(err, &refused) && refused.StatusCode == http.StatusConflict
+		}
+
+		first := connect("alice")
+		waitClients(1)
+		other := connect("bob")
+		waitClients(2)
+		second := connect("alice")
+		switch tc.policy {
+		case websocket.DuplicateRejectNew:
+			if err := <-second.done; !conflict(err) {
+				t.Errorf("duplicate not rejected: %v", err)
+			}
+			_ = first.client.Disconnect()
+			waitClients(1)
+			// the identity is free again
+			second = connect("alice")
+			waitClients(2)
+		case websocket.DuplicateKickOld:
+			<-first.done
+			if code := first.client.Stats().CloseCode; code != websocket.CloseDuplicateConnection {
+				t.Errorf("replaced client closed with %d", code)
+			}
+			waitClients(2)
+		}
+		_ = second.client.Disconnect()
+		_ = other.client.Disconnect()
+		waitClients(0)
+
+		// nearly simultaneous connections leave one of them connected
+		var connections []connection
+		for i := 0; i < simultaneous; i++ {
+			connections = append(connections, connect("carol"))
+		}
+		ended := 0
+		for _, c := range connections {
+			select {
+			case err := <-c.done:
+				ended++
+				switch tc.policy {
+				case websocket.DuplicateRejectNew:
+					if !conflict(err) {
+						t.Errorf("unexpected rejection: %v", err)
+					}
+				case websocket.DuplicateKickOld:
+					if code := c.client.Stats().CloseCode; code != websocket.CloseDuplicateConnection {
+						t.Errorf("replaced client closed with %d: %v", code, err)
+					}
+				}
+			case <-time.After(time.Second):
+			}
+		}
+		if ended != simultaneous-1 {
+			t.Errorf("policy %d: %d of %d connections ended", tc.policy, ended, simultaneous)
+		}
+		waitClients(1)
+		for _, c := range connections {
+			_ = c.client.Disconnect()
+		}
+		waitClients(0)
+		if n := server.Identities(); n != 0 {
+			t.Errorf("policy %d: %d identities left", tc.policy, n)
+		}
+		_ = server.Close()
+	}
+}
+
+func TestClientFailureId(t *testing.T) {
+	wrapped := fmt.Errorf("send: %w", &websocket.ClientError{ClientId: 7, Err: websocket.ErrReadTimeout})
+	if websocket.ClientIdOf(wrapped) != 7 || !errors.Is(wrapped, websocket.ErrReadTimeout) {
+		t.Errorf("client error not found in %v", wrapped)
+	}
+	if id := websocket.ClientIdOf(errors.New("exited")); id != -1 {
+		t.Errorf("failure without client has id %d", id)
+	}
+
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetReadLimit(8)
+	defer server.Close()
+
+	client := server.NewClient(t, websocket.NewRecorder())
+	defer client.Disconnect()
+	id := client.ClientId
+	_ = client.SendTxt([]byte("more than eight bytes"))
+
+	if failure := serverEvents.WaitForFailure(t, time.Second); failure.Id != id ||
+		failure.Kind != websocket.KindMessageTooBig {
+		t.Errorf("expected too big failure of client %d, got %+v", id, failure)
+	}
+}
+
+func TestSetupAfterStart(t *testing.T) {
+	server := websockettest.NewServer(websocket.NewRecorder())
+	defer server.Close()
+	// the server is serving once a client connected
+	_ = server.NewClient(t, websocket.NewRecorder()).Disconnect()
+
+	ca, cert, key := issueCertificate(t)
+	err := server.SetupTls(cert, key)
+	if !errors.Is(err, websocket.ErrServerStarted) {
+		t.Error("SetupTls after start: ", err)
+	}
+	if err = server.RequireClientCert(ca); !errors.Is(err, websocket.ErrServerStarted) {
+		t.Error("RequireClientCert after start: ", err)
+	}
+
+	// swapping the auth header races with handshakes in flight
+	server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoNone))
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoNone))
+				server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "other", websocket.HashAlgoNone))
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		err = dial(server, websocket.NewClient(false, websocket.NewRecorder()),
+			map[string]string{"X-Token": "wrong"})
+		if websocket.KindOf(err) != websocket.KindAuthRejected {
+			t.Errorf("expected auth rejected, got %v", err)
+		}
+	}
+	close(stop)
+	<-swapped
+
+	// the swapped header applies to the next handshake
+	server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "wrong", websocket.HashAlgoNone))
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	go func() { _ = dial(server, client, map[string]string{"X-Token": "wrong"}) }()
+	events.WaitForConnect(t, time.Second)
+	_ = client.Disconnect()
+}
+
+func TestBroadcastDuringTeardown(t *testing.T) {
+	// the default logger is not safe for concurrent use
+	websocket.SetLogger(websocket.NewSlogLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	defer websocket.SetLogger(nil)
+
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	defer server.Close()
+
+	stop := make(chan struct{})
+	broadcasting := make(chan struct{})
+	go func() {
+		defer close(broadcasting)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				server.Broadcast(&websocket.Message{MessageType: websocket.TextMessage, Data: []byte("storm")})
+			}
+		}
+	}()
+
+	const clients = 4
+	cycle := func(byServer bool) {
+		var done [clients]chan struct{}
+		for i := range done {
+			done[i] = make(chan struct{})
+			events := websocket.NewRecorder()
+			client := websocket.NewClient(false, events)
+			go func(done chan struct{}) {
+				_ = dial(server, client, nil)
+				close(done)
+			}(done[i])
+			events.WaitForConnect(t, time.Second)
+			if !byServer {
+				go func() { _ = client.Disconnect() }()
+			}
+		}
+		if byServer {
+			for start := time.Now(); len(server.Clients()) < clients; time.Sleep(time.Millisecond) {
+				if time.Since(start) > time.Second {
+					t.Fatal("clients not listed")
+				}
+			}
+			for _, info := range server.Clients() {
+				go func(id int) { _ = server.Disconnect(id) }(info.Id)
+			}
+		}
+		for _, d := range done {
+			select {
+			case <-d:
+			case <-time.After(2 * time.Second):
+				t.Fatal("client not disconnected")
+			}
+		}
+		for start := time.Now(); len(server.Clients()) > 0; time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatal("clients still listed after teardown")
+			}
+		}
+	}
+
+	// clients closed by the server must be skipped without failures
+	for i := 0; i < 10; i++ {
+		cycle(true)
+	}
+	if errs := server.Stats().BroadcastErrors; errs != 0 {
+		t.Errorf("%d broadcast errors on clients closed by the server", errs)
+	}
+	for _, evnt := range serverEvents.EventsSeen() {
+		if evnt.Type == websocket.Failure {
+			t.Error("failure on teardown: ", evnt.Err)
+		}
+	}
+
+	// a peer closing may still reset a write in flight, only must not race
+	for i := 0; i < 10; i++ {
+		cycle(false)
+	}
+	close(stop)
+	<-broadcasting
+}
+
+// deadListener accepts connections whose writes fail once dead is set,
+// while reads go on, like a socket the read loop did not notice dying.
+type deadListener struct {
+	net.Listener
+	dead *atomic.Bool
+}
+
+func (l deadListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return deadConn{Conn: conn, dead: l.dead}, nil
+}
+
+type deadConn struct {
+	net.Conn
+	dead *atomic.Bool
+}
+
+func (c deadConn) Write(b []byte) (int, error) {
+	if c.dead.Load() {
+		return 0, syscall.EPIPE
+	}
+	return c.Conn.Write(b)
+}
+
+func TestPongTimeoutReportedOnce(t *testing.T) {
+	listener, _ := listenLocal(t)
+	var dead atomic.Bool
+	server := websocket.NewServer("ws://"+listener.Addr().String()+"/pong", websocket.NewRecorder())
+	go func() { _ = server.Serve(deadListener{Listener: listener, dead: &dead}) }()
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetKeepalive(30*time.Millisecond, 100*time.Millisecond)
+	go func() { _ = client.ConnectAndServe("ws://"+listener.Addr().String()+"/pong", nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	// the server can't answer the pings anymore
+	dead.Store(true)
+	events.WaitForDisconnect(t, time.Second)
+
+	var failures []websocket.Event
+	for _, evnt := range events.EventsSeen() {
+		if evnt.Type == websocket.Failure || evnt.Type == websocket.FailureWithExit {
+			failures = append(failures, evnt)
+		}
+	}
+	if len(failures) != 1 || failures[0].Kind != websocket.KindReadTimeout {
+		t.Errorf("expected one pong timeout, got %v", failures)
+	}
+}
+
+func TestBroadcastDropsDeadClient(t *testing.T) {
+	listener, _ := listenLocal(t)
+	var dead atomic.Bool
+	serverEvents := websocket.NewRecorder()
+	server := websocket.NewServer("ws://"+listener.Addr().String()+"/dead", serverEvents)
+	go func() { _ = server.Serve(deadListener{Listener: listener, dead: &dead}) }()
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	go func() { _ = client.ConnectAndServe("ws://"+listener.Addr().String()+"/dead", nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	dead.Store(true)
+	server.Broadcast(&websocket.Message{MessageType: websocket.TextMessage, Data: []byte("lost")})
+	if clients := server.Clients(); len(clients) != 0 {
+		t.Errorf("dead client still in the pool: %+v", clients)
+	}
+	server.Broadcast(&websocket.Message{MessageType: websocket.TextMessage, Data: []byte("nobody")})
+	if errs := server.Stats().BroadcastErrors; errs != 1 {
+		t.Errorf("%d broadcast errors, expected 1", errs)
+	}
+
+	if disconnected := serverEvents.WaitForDisconnect(t, time.Second); disconnected != id {
+		t.Errorf("disconnect of %d, expected %d", disconnected, id)
+	}
+	time.Sleep(100 * time.Millisecond)
+	disconnects := 0
+	for _, evnt := range serverEvents.EventsSeen() {
+		if evnt.Type == websocket.Disconnect {
+			disconnects++
+		}
+	}
+	if disconnects != 1 {
+		t.Errorf("%d disconnects reported", disconnects)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetReadLimit(8)
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetReadLimit(4)
+	errCh := make(chan error, 1)
+	go func() { errCh <- dial(server, client, nil) }()
+	events.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	_ = server.Send(id, &websocket.Message{MessageType: websocket.TextMessage, Data: []byte("12345")})
+	select {
+	case err := <-errCh:
+		if websocket.KindOf(err) != websocket.KindMessageTooBig {
+			t.Error("expected message too big, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client not closed after exceeding the read limit")
+	}
+
+	events = websocket.NewRecorder()
+	client = websocket.NewClient(false, events)
+	server.Connect(t, client)
+	_ = client.SendTxt([]byte("123456789"))
+	serverEvents.WaitForDisconnect(t, time.Second) // first client
+	serverEvents.WaitForDisconnect(t, time.Second)
+
+	found := false
+	for _, evnt := range serverEvents.EventsSeen() {
+		if evnt.Type == websocket.Failure && evnt.Kind == websocket.KindMessageTooBig {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("server did not report the oversized message")
+	}
+	_ = client.Disconnect()
+}
+
+func TestServerClients(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	errCh := make(chan error, 1)
+	go func() { errCh <- dial(server, client, nil) }()
+	events.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	clients := server.Clients()
+	if len(clients) != 1 || clients[0].Id != id || clients[0].RemoteAddr == "" ||
+		clients[0].ConnectedAt.IsZero() {
+		t.Fatalf("unexpected clients: %+v", clients)
+	}
+
+	_ = client.SendTxt([]byte("abc"))
+	serverEvents.WaitForMessage(t, time.Second)
+	if err := server.Send(id, &websocket.Message{MessageType: websocket.TextMessage, Data: []byte("de")}); err != nil {
+		t.Fatal(err)
+	}
+	events.WaitForMessage(t, time.Second)
+
+	stats := server.Stats()
+	if stats.Clients != 1 || stats.Connects != 1 ||
+		stats.MessagesReceived != 1 || stats.BytesReceived != 3 ||
+		stats.MessagesSent != 1 || stats.BytesSent != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	if err := server.Disconnect(id); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Error("expected clean return on normal closure, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client not disconnected")
+	}
+	events.WaitForDisconnect(t, time.Second)
+	for _, evnt := range events.EventsSeen() {
+		if evnt.Type == websocket.Failure || evnt.Type == websocket.FailureWithExit {
+			t.Error("failure reported on normal closure: ", evnt.Err)
+		}
+	}
+	serverEvents.WaitForDisconnect(t, time.Second)
+	if len(server.Clients()) != 0 {
+		t.Error("client still listed after disconnect")
+	}
+	if server.Disconnect(id) == nil {
+		t.Error("expected error for unknown client")
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	listener := websocket.NewNetListener(server.Server)
+	defer server.Close()
+
+	serverDone := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			_, _ = conn.Write([]byte("echo " + scanner.Text() + "\n"))
+		}
+		serverDone <- scanner.Err()
+	}()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	conn := websocket.NewNetConn(client)
+	server.Connect(t, client)
+
+	if addr := conn.RemoteAddr(); addr == nil || addr.Network() != "pipe" {
+		t.Error("unexpected remote address ", conn.RemoteAddr())
+	}
+
+	reader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("one\ntw"))
+	_, _ = conn.Write([]byte("o\n"))
+	for _, want := range []string{"echo one\n", "echo two\n"} {
+		if line, err := reader.ReadString('\n'); err != nil || line != want {
+			t.Errorf("got %q, %v, want %q", line, err, want)
+		}
+	}
+
+	// a read timeout keeps the connection usable
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var netErr net.Error
+	if _, err := reader.ReadByte(); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Error("expected timeout, got ", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	_, _ = conn.Write([]byte("three\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "echo three\n" {
+		t.Errorf("after timeout: %q, %v", line, err)
+	}
+
+	// other messages are passed on
+	_ = client.SendTxt([]byte("text"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "text" {
+		t.Errorf("unexpected message %q", msg.Data)
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Error(err)
+	}
+	select {
+	case err := <-serverDone:
+		if err != nil {
+			t.Error("server side: ", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server side did not see EOF")
+	}
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("write after close succeeded")
+	}
+	if stats := client.Stats(); stats.CloseCode != gorilla.CloseNormalClosure {
+		t.Errorf("no close handshake, close code %d", stats.CloseCode)
+	}
+}
+
+type echoTestEvents struct {
+	*websocket.Recorder
+	server *websocket.Server
+}
+
+func (e *echoTestEvents) OnReceive(msg websocket.Message) {
+	e.Recorder.OnReceive(msg)
+	_ = e.server.Send(msg.ClientId, &msg)
+}
+
+func TestPipe(t *testing.T) {
+	serverEvents := &echoTestEvents{Recorder: websocket.NewRecorder()}
+	server := websockettest.NewServer(serverEvents)
+	serverEvents.server = server.Server
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	go func() { _ = dial(server, client, nil) }()
+	defer client.Disconnect()
+
+	// lines, started before the connection is up
+	reader, writer := io.Pipe()
+	output, outputWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- websocket.Pipe(context.Background(), client, reader, outputWriter, websocket.PipeOptions{})
+	}()
+	lines := bufio.NewReader(output)
+	_, _ = writer.Write([]byte("one\r\ntwo\n"))
+	for _, want := range []string{"one\n", "two\n"} {
+		if line, err := lines.ReadString('\n'); err != nil || line != want {
+			t.Errorf("got %q, %v, want %q", line, err, want)
+		}
+	}
+	msg := serverEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.TextMessage || string(msg.Data) != "one" {
+		t.Errorf("unexpected message %d %q", msg.MessageType, msg.Data)
+	}
+	serverEvents.WaitForMessage(t, time.Second)
+	_ = writer.Close()
+	if err := <-done; err != nil {
+		t.Error("expected nil on EOF, got ", err)
+	}
+	if client.EventHandler() != websocket.Events(events) {
+		t.Error("event handler not restored")
+	}
+
+	// whole stream, ended by the context
+	ctx, cancel := context.WithCancel(context.Background())
+	var received bytes.Buffer
+	go func() {
+		done <- websocket.Pipe(ctx, client, bytes.NewReader([]byte{0, 1, 2}), &received,
+			websocket.PipeOptions{Framing: websocket.FramingStream})
+	}()
+	msg = serverEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.BinaryMessage || !bytes.Equal(msg.Data, []byte{0, 1, 2}) {
+		t.Errorf("unexpected message %d %v", msg.MessageType, msg.Data)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	cancel()
+
+	// the connection ending ends the pipe
+	reader, writer = io.Pipe()
+	defer writer.Close()
+	go func() {
+		done <- websocket.Pipe(context.Background(), client, reader, io.Discard,
+			websocket.PipeOptions{Framing: websocket.FramingChunk})
+	}()
+	_, _ = writer.Write([]byte("chunk"))
+	id := serverEvents.WaitForMessage(t, time.Second).ClientId
+	_ = serverEvents.server.Disconnect(id)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("expected nil on normal closure, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("pipe not ended by the disconnect")
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	backendEvents := &echoTestEvents{Recorder: websocket.NewRecorder()}
+	backend := websockettest.NewServer(backendEvents)
+	backendEvents.server = backend.Server
+	defer backend.Close()
+
+	proxy := websocket.NewReverseProxy(func(r *http.Request) string {
+		if r.URL.Path == "/dead" {
+			return "ws://dead.invalid/"
+		}
+		return websockettest.URL
+	})
+	backendDial := backend.NetDial()
+	proxy.SetClientFactory(func(events websocket.Events) *websocket.Client {
+		client := websocket.NewClient(false, events)
+		client.SetNetDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "dead.invalid:") {
+				return nil, errors.New("connection refused")
+			}
+			return backendDial(ctx, network, addr)
+		})
+		return client
+	})
+	proxyServer := websockettest.NewServer(websocket.NewRecorder())
+	proxyServer.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoNone))
+	proxyServer.SetHandler(proxy)
+	defer proxyServer.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	go func() { _ = dial(proxyServer, client, map[string]string{"X-Token": "secret"}) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	// message types are kept
+	for _, msg := range []websocket.Message{
+		{MessageType: websocket.TextMessage, Data: []byte("hi")},
+		{MessageType: websocket.BinaryMessage, Data: []byte{1, 2}},
+	} {
+		if err := client.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := events.WaitForMessage(t, time.Second)
+		if got.MessageType != msg.MessageType || !bytes.Equal(got.Data, msg.Data) {
+			t.Errorf("got %d %q, want %d %q", got.MessageType, got.Data,
+				msg.MessageType, msg.Data)
+		}
+	}
+	if stats := proxy.Stats(); stats.Active != 1 || stats.Sessions != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// the backend's close code reaches the client
+	id := backendEvents.WaitForMessage(t, time.Second).ClientId
+	_ = backendEvents.server.WriteClose(id, 4002, "bye")
+	events.WaitForDisconnect(t, time.Second)
+	if stats := client.Stats(); stats.CloseCode != 4002 || stats.CloseText != "bye" {
+		t.Errorf("close %d %q, want 4002 \"bye\"", stats.CloseCode, stats.CloseText)
+	}
+	for start := time.Now(); proxy.Stats().Active != 0; {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("session still active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// so does a normal closure, which is no failure of the backend client
+	for _, code := range []int{gorilla.CloseNormalClosure, gorilla.CloseGoingAway} {
+		backendEvents.Reset()
+		events := websocket.NewRecorder()
+		client := websocket.NewClient(false, events)
+		go func() { _ = dial(proxyServer, client, map[string]string{"X-Token": "secret"}) }()
+		events.WaitForConnect(t, time.Second)
+		id := backendEvents.WaitForConnect(t, time.Second)
+		_ = backendEvents.server.WriteClose(id, code, "done")
+		events.WaitForDisconnect(t, 3*time.Second)
+		if stats := client.Stats(); stats.CloseCode != code || stats.CloseText != "done" {
+			t.Errorf("close %d %q, want %d \"done\"", stats.CloseCode, stats.CloseText, code)
+		}
+		_ = client.Disconnect()
+	}
+
+	// failing dial answered before the upgrade
+	dialer := gorilla.Dialer{NetDialContext: proxyServer.NetDial()}
+	_, resp, err := dialer.Dial(websockettest.URL+"dead", http.Header{"X-Token": {"secret"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502, got %v %v", resp, err)
+	}
+	if proxy.Stats().DialFailures != 1 {
+		t.Errorf("unexpected stats %+v", proxy.Stats())
+	}
+
+	// auth is checked by the server
+	_, resp, err = dialRaw(proxyServer, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %v %v", resp, err)
+	}
+}
+
+func TestBroadcastBackend(t *testing.T) {
+	backend := websocket.NewMemoryBackend()
+	var (
+		servers []*websocket.Server
+		clients []*websocket.Recorder
+	)
+	for i := 0; i < 2; i++ {
+		server := websockettest.NewServer(websocket.NewRecorder())
+		if err := server.SetBroadcastBackend(backend, "room"); err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		events := websocket.NewRecorder()
+		client := server.NewClient(t, events)
+		defer client.Disconnect()
+
+		servers = append(servers, server.Server)
+		clients = append(clients, events)
+	}
+	if servers[0].InstanceId() == servers[1].InstanceId() {
+		t.Error("instance ids not unique")
+	}
+
+	// the clients of both instances receive each broadcast exactly once
+	servers[0].Broadcast(&websocket.Message{MessageType: websocket.TextMessage, Data: []byte("one")})
+	servers[1].Broadcast(&websocket.Message{MessageType: websocket.BinaryMessage, Data: []byte("two")})
+	for _, events := range clients {
+		for _, want := range []string{"one", "two"} {
+			if msg := events.WaitForMessage(t, time.Second); string(msg.Data) != want {
+				t.Errorf("got %q, want %q", msg.Data, want)
+			}
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, events := range clients {
+		if count := len(events.Messages()); count != 2 {
+			t.Errorf("%d messages received, want 2", count)
+		}
+	}
+}
+
+func TestHub(t *testing.T) {
+	hub := websocket.NewHub()
+
+	eventsA := websocket.NewRecorder()
+	serverA := websockettest.NewServer(eventsA)
+	serverA.SetHub(hub)
+	defer serverA.Close()
+
+	// embedded in an own http server
+	eventsB := websocket.NewRecorder()
+	serverB := websocket.NewServer("ws://localhost/", eventsB)
+	serverB.SetHub(hub)
+	embedded := httptest.NewServer(serverB)
+	defer embedded.Close()
+	defer serverB.Close()
+
+	var clients []*websocket.Recorder
+	eventsClientA := websocket.NewRecorder()
+	clientA := serverA.NewClient(t, eventsClientA)
+	defer clientA.Disconnect()
+	idA := clientA.ClientId
+	clients = append(clients, eventsClientA)
+
+	eventsClientB := websocket.NewRecorder()
+	clientB := websocket.NewClient(false, eventsClientB)
+	go func() { _ = clientB.ConnectAndServe("ws"+strings.TrimPrefix(embedded.URL, "http")+"/", nil) }()
+	defer clientB.Disconnect()
+	eventsClientB.WaitForConnect(t, time.Second)
+	idB := eventsB.WaitForConnect(t, time.Second)
+	clients = append(clients, eventsClientB)
+
+	if len(serverA.Clients()) != 2 || hub.Stats().Connects != 2 {
+		t.Errorf("clients of both servers expected: %+v", hub.Clients())
+	}
+
+	// one broadcast reaches both servers' clients
+	serverA.Broadcast(&websocket.Message{MessageType: websocket.TextMessage, Data: []byte("all")})
+	for _, events := range clients {
+		if msg := events.WaitForMessage(t, time.Second); string(msg.Data) != "all" {
+			t.Errorf("got %q", msg.Data)
+		}
+	}
+
+	// rooms and metadata
+	if err := hub.Join(idB, "room"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.Join(-1, "room"); !errors.Is(err, websocket.ErrNoClient) {
+		t.Errorf("expected ErrNoClient, got %v", err)
+	}
+	_ = hub.SetMetadata(idB, "user", "bob")
+	if user, _ := hub.Metadata(idB, "user"); user != "bob" {
+		t.Errorf("metadata %v", user)
+	}
+	if rooms := hub.Rooms(idB); len(rooms) != 1 || rooms[0] != "room" {
+		t.Errorf("rooms %v", rooms)
+	}
+	hub.BroadcastRoom("room", &websocket.Message{MessageType: websocket.TextMessage, Data: []byte("room")})
+	if msg := clients[1].WaitForMessage(t, time.Second); string(msg.Data) != "room" {
+		t.Errorf("got %q", msg.Data)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(clients[0].Messages()) != 1 {
+		t.Error("room message reached a client outside the room")
+	}
+
+	// kicked clients leave their rooms and metadata
+	if err := hub.Kick(idB); err != nil {
+		t.Fatal(err)
+	}
+	eventsB.WaitForDisconnect(t, time.Second)
+	if len(hub.Members("room")) != 0 || len(hub.Clients()) != 1 {
+		t.Errorf("kicked client left: %v %+v", hub.Members("room"), hub.Clients())
+	}
+	if _, ok := hub.Metadata(idB, "user"); ok {
+		t.Error("metadata left")
+	}
+	if idA == idB {
+		t.Error("ids not unique")
+	}
+}
+
+func TestExpvar(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoNone))
+	server.PublishExpvar("test_server")
+	defer server.Close()
+
+	_, _, err := dialRaw(server, nil)
+	if err == nil {
+		t.Fatal("expected rejected upgrade")
+	}
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.PublishExpvar("test_client")
+	go func() { _ = dial(server, client, map[string]string{"X-Token": "secret"}) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	_ = client.SendTxt([]byte("hello"))
+	serverEvents.WaitForMessage(t, time.Second)
+
+	// registering again is no error
+	server.PublishExpvar("test_server")
+	if expvar.Get("test_taken") == nil {
+		expvar.Publish("test_taken", new(expvar.Int))
+	}
+	server.PublishExpvar("test_taken")
+
+	serverVars := expvar.Get("test_server").(*expvar.Map)
+	for key, want := range map[string]string{
+		"connections":       "1",
+		"connections_total": "1",
+		"messages_in":       "1",
+		"bytes_in":          "5",
+		"rejected_upgrades": "1",
+		"broadcast_errors":  "0",
+	} {
+		if got := serverVars.Get(key).String(); got != want {
+			t.Errorf("server %s: %s, want %s", key, got, want)
+		}
+	}
+	clientVars := expvar.Get("test_client").(*expvar.Map)
+	for key, want := range map[string]string{
+		"connections":  "1",
+		"messages_out": "1",
+		"bytes_out":    "5",
+	} {
+		if got := clientVars.Get(key).String(); got != want {
+			t.Errorf("client %s: %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	// a stale socket file is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	serverEvents := websocket.NewRecorder()
+	server := websocket.NewServer("unix://"+socket+":/ws", serverEvents)
+	server.SetSocketMode(0o600)
+	go func() { _ = server.ListenAndServe() }()
+
+	// the client retries until the server listens
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetReconnect(&utils.Backoff{Initial: 10 * time.Millisecond,
+		Max: 50 * time.Millisecond}, 0)
+	go func() { _ = client.ConnectAndServe("unix://"+socket+":/ws", nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v", info.Mode())
+	}
+
+	if err = client.SendTxt([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "hello" {
+		t.Errorf("received %q", msg.Data)
+	}
+
+	if err = server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket file left: %v", err)
+	}
+}
+
+func TestPayloadCompression(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	if err := server.SetPayloadCompression(64, 12); err == nil {
+		t.Error("invalid level accepted")
+	}
+	if err := server.SetPayloadCompression(64, gzip.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	if err := client.SetPayloadCompression(64, gzip.BestSpeed); err != nil {
+		t.Fatal(err)
+	}
+	id := server.Connect(t, client)
+	defer client.Disconnect()
+
+	large := bytes.Repeat([]byte("compress me "), 100)
+	if err := client.SendTxt(large); err != nil {
+		t.Fatal(err)
+	}
+	msg := serverEvents.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.TextMessage || !bytes.Equal(msg.Data, large) {
+		t.Errorf("received %d %q", msg.MessageType, msg.Data)
+	}
+	if received := server.Stats().BytesReceived; received >= uint64(len(large)) {
+		t.Errorf("%d bytes on the wire, not compressed", received)
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write(large)
+	_ = zw.Close()
+	for _, data := range [][]byte{[]byte("small"), buf.Bytes(), large} {
+		if err := server.Send(id, &websocket.Message{MessageType: websocket.BinaryMessage, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		msg = events.WaitForMessage(t, time.Second)
+		if msg.MessageType != websocket.BinaryMessage || !bytes.Equal(msg.Data, data) {
+			t.Errorf("received %d %q", msg.MessageType, msg.Data)
+		}
+	}
+
+	w, err := server.NextWriter(id, websocket.TextMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write(large)
+	_ = w.Close()
+	if msg = events.WaitForMessage(t, time.Second); !bytes.Equal(msg.Data, large) {
+		t.Errorf("streamed %q", msg.Data)
+	}
+
+	// a peer without compression gets plain payloads
+	plainEvents := websocket.NewRecorder()
+	plain := server.NewClient(t, plainEvents)
+	defer plain.Disconnect()
+	_ = server.Send(plain.ClientId, &websocket.Message{MessageType: websocket.TextMessage, Data: large})
+	if msg = plainEvents.WaitForMessage(t, time.Second); !bytes.Equal(msg.Data, large) {
+		t.Errorf("unaware peer received %q", msg.Data)
+	}
+}
+
+func TestTextOnlyFraming(t *testing.T) {
+	binary := []byte{0x00, 0xff, 0x01, 'b', 0x80}
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.EnableTextOnlyFraming()
+	if err := server.SetPayloadCompression(64, gzip.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.EnableTextOnlyFraming()
+	go func() { _ = dial(server, client, nil) }()
+	defer client.Disconnect()
+	events.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+
+	for _, msg := range []websocket.Message{{MessageType: websocket.BinaryMessage, Data: binary},
+		{MessageType: websocket.TextMessage, Data: []byte("\x01tagged")},
+		{MessageType: websocket.TextMessage, Data: []byte("plain")}} {
+
+		if err := client.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		received := serverEvents.WaitForMessage(t, time.Second)
+		if received.MessageType != msg.MessageType || !bytes.Equal(received.Data, msg.Data) {
+			t.Errorf("sent %d %q, received %d %q", msg.MessageType, msg.Data,
+				received.MessageType, received.Data)
+		}
+	}
+
+	w, err := server.NextWriter(id, websocket.BinaryMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write(binary)
+	_, _ = w.Write(binary)
+	_ = w.Close()
+	msg := events.WaitForMessage(t, time.Second)
+	if msg.MessageType != websocket.BinaryMessage || !bytes.Equal(msg.Data, append(binary, binary...)) {
+		t.Errorf("streamed %d %q", msg.MessageType, msg.Data)
+	}
+
+	// compressed payloads are binary and framed as text too
+	large := bytes.Repeat(binary, 100)
+	server.Broadcast(&websocket.Message{MessageType: websocket.BinaryMessage, Data: large})
+	if msg = events.WaitForMessage(t, time.Second); !bytes.Equal(msg.Data, large) {
+		t.Errorf("received %q", msg.Data)
+	}
+
+	// on the wire only text frames arrive
+	conn, _, err := dialRaw(server,
+		http.Header{websocket.TextFramingHeader: {websocket.TextFramingBase64}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rawId := serverEvents.WaitForConnect(t, time.Second)
+	_ = server.Send(rawId, &websocket.Message{MessageType: websocket.BinaryMessage, Data: binary})
+	frameType, frame, err := conn.ReadMessage()
+	if err != nil || frameType != websocket.TextMessage || string(frame) != "\x01bAP8BYoA=" {
+		t.Errorf("frame %d %q: %v", frameType, frame, err)
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("\x01x"))
+	if evnt := serverEvents.WaitForFailure(t, time.Second); !errors.Is(evnt.Err, websocket.ErrTextFraming) {
+		t.Error("bad tag not reported: ", evnt)
+	}
+}
+
+func TestChallengeAuth(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	server.RequireChallengeAuth(func(keyId string) ([]byte, bool) {
+		if keyId == "device-1" {
+			return []byte("secret"), true
+		}
+		return nil, false
+	}, 200*time.Millisecond)
+	defer server.Close()
+
+	events := websocket.NewRecorder()
+	client := websocket.NewClient(false, events)
+	client.SetChallengeAuth("device-1", []byte("secret"))
+	server.Connect(t, client)
+	defer client.Disconnect()
+	_ = client.SendTxt([]byte("authenticated"))
+	if msg := serverEvents.WaitForMessage(t, time.Second); string(msg.Data) != "authenticated" {
+		t.Errorf("received %q", msg.Data)
+	}
+	if len(events.Messages()) != 0 {
+		t.Error("challenge delivered: ", events.Messages())
+	}
+
+	for keyId, reason := range map[string]string{"device-1": "wrong response",
+		"device-2": "unknown key"} {
+
+		rejected := websocket.NewClient(false, websocket.NewRecorder())
+		rejected.SetChallengeAuth(keyId, []byte("guess"))
+		err := dial(server, rejected, nil)
+		var challengeErr *websocket.ChallengeError
+		if !errors.As(err, &challengeErr) || challengeErr.Reason != reason ||
+			!errors.Is(err, websocket.ErrAuthRejected) {
+			t.Errorf("%s: expected %q, got %v", keyId, reason, err)
+		}
+		var clientErr *websocket.ClientError
+		evnt := serverEvents.WaitForFailure(t, time.Second)
+		if !errors.As(evnt.Err, &clientErr) || clientErr.RemoteAddr == "" ||
+			!errors.As(evnt.Err, &challengeErr) {
+			t.Errorf("%s: server failure %v", keyId, evnt.Err)
+		}
+	}
+
+	// a client not answering is rejected, its messages never delivered
+	conn, _, err := dialRaw(server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, challenge, err := conn.ReadMessage()
+	if err != nil || !bytes.Contains(challenge, []byte(`"challenge"`)) {
+		t.Fatalf("challenge %q: %v", challenge, err)
+	}
+	_ = conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_, _, err = conn.ReadMessage()
+	if !gorilla.IsCloseError(err, websocket.CloseChallengeFailed) {
+		t.Error("expected close 4401, got ", err)
+	}
+
+	conn, _, err = dialRaw(server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _, _ = conn.ReadMessage()
+	_, _, err = conn.ReadMessage()
+	var closeErr *gorilla.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseChallengeFailed ||
+		closeErr.Text != "no response in time" {
+		t.Error("expected timeout close, got ", err)
+	}
+
+	for i := 0; i < 100 && server.Stats().RejectedUpgrades < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rejected := server.Stats().RejectedUpgrades; rejected != 4 {
+		t.Errorf("%d rejected", rejected)
+	}
+	failures, connects := 0, 0
+	for _, evnt := range serverEvents.EventsSeen() {
+		if errors.Is(evnt.Err, websocket.ErrAuthRejected) {
+			failures++
+		}
+		if evnt.Type == websocket.Connect {
+			connects++
+		}
+	}
+	if failures != 4 || connects != 1 || len(serverEvents.Messages()) != 1 {
+		t.Errorf("%d failures, %d connects, messages %v", failures, connects,
+			serverEvents.Messages())
+	}
+}
+
+func TestPresence(t *testing.T) {
+	serverEvents := websocket.NewRecorder()
+	server := websockettest.NewServer(serverEvents)
+	hub := server.Hub()
+	hub.SetPresenceDebounce(300 * time.Millisecond)
+	defer server.Close()
+
+	connect := func() (*websocket.Client, *websocket.Recorder, int) {
+		events := websocket.NewRecorder()
+		client := server.NewClient(t, events)
+		return client.Client, events, client.ClientId
+	}
+	presence := func(events *websocket.Recorder, eventType string, keys ...string) {
+		t.Helper()
+		evnt, ok := websocket.ParsePresence(events.WaitForMessage(t, time.Second))
+		if !ok || evnt.Room != "room" || evnt.Type != eventType || len(evnt.Members) != len(keys) {
+			t.Fatalf("expected %s of %v, got %+v", eventType, keys, evnt)
+		}
+		for i, key := range keys {
+			if evnt.Members[i].Key != key {
+				t.Errorf("%s: member %d is %q, expected %q", eventType, i, evnt.Members[i].Key, key)
+			}
+		}
+	}
+
+	alice, aliceEvents, aliceId := connect()
+	defer alice.Disconnect()
+	err := hub.JoinPresence(aliceId, "room", websocket.Member{Key: "alice", Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	presence(aliceEvents, websocket.PresenceSnapshot, "alice")
+
+	bob, bobEvents, bobId := connect()
+	_ = hub.JoinPresence(bobId, "room", websocket.Member{Key: "bob", Metadata: map[string]any{"status": "busy"}})
+	presence(bobEvents, websocket.PresenceSnapshot, "alice", "bob")
+	presence(aliceEvents, websocket.PresenceJoin, "bob")
+
+	entries := server.Presence("room")
+	if len(entries) != 2 || entries[1].Metadata["status"] != "busy" ||
+		len(entries[1].ClientIds) != 1 || entries[1].ClientIds[0] != bobId {
+		t.Errorf("presence %+v", entries)
+	}
+
+	// a quick reconnect is not announced
+	_ = bob.Disconnect()
+	serverEvents.WaitForDisconnect(t, time.Second)
+	bob, bobEvents, bobId = connect()
+	_ = hub.JoinPresence(bobId, "room", websocket.Member{Key: "bob"})
+	presence(bobEvents, websocket.PresenceSnapshot, "alice", "bob")
+
+	_ = bob.Disconnect()
+	presence(aliceEvents, websocket.PresenceLeave, "bob")
+	if entries = server.Presence("room"); len(entries) != 1 || entries[0].Key != "alice" {
+		t.Errorf("presence after leave %+v", entries)
+	}
+	if n := len(aliceEvents.Messages()); n != 3 {
+		t.Errorf("alice received %d messages", n)
+	}
+
+	if _, ok := websocket.ParsePresence(websocket.Message{MessageType: websocket.TextMessage, Data: []byte(`{"x":1}`)}); ok {
+		t.Error("parsed other message as presence")
+	}
+	if err = hub.JoinPresence(-1, "room", websocket.Member{}); !errors.Is(err, websocket.ErrNoClient) {
+		t.Errorf("expected ErrNoClient, got %v", err)
+	}
 }
@@ -0,0 +1,178 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websockettest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// buffer is one direction of a pipe. Unlike net.Pipe writes do not wait
+// for the reader, so both read loops may write, e.g. pongs, at once.
+// Writes after the reader closed are dropped, like on a socket which did
+// not see the reset of its peer yet.
+type buffer struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	data     bytes.Buffer
+	closed   bool
+	dropping bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newBuffer() *buffer {
+	b := &buffer{}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *buffer) read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for b.data.Len() == 0 {
+		if b.closed || b.dropping {
+			return 0, io.EOF
+		}
+		if !b.deadline.IsZero() && !time.Now().Before(b.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	return b.data.Read(p)
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if b.dropping {
+		return len(p), nil
+	}
+	b.cond.Broadcast()
+	return b.data.Write(p)
+}
+
+func (b *buffer) setDeadline(t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.deadline = t
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if !t.IsZero() {
+		b.timer = time.AfterFunc(time.Until(t), func() {
+			b.lock.Lock()
+			b.cond.Broadcast()
+			b.lock.Unlock()
+		})
+	}
+	b.cond.Broadcast()
+}
+
+// close ends the buffer. For the reading end closing it, what was not
+// read yet is discarded and further writes are dropped.
+func (b *buffer) close(reader bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if reader {
+		b.data.Reset()
+		b.dropping = true
+	} else {
+		b.closed = true
+	}
+	b.cond.Broadcast()
+}
+
+// pipeConn is one end of a pipe. Data written before Close is still read
+// by the other end.
+type pipeConn struct {
+	in, out       *buffer
+	local, remote net.Addr
+}
+
+// newPipe returns the ends of pipe n, with addresses unique to it.
+func newPipe(n uint64) (client, server net.Conn) {
+	toServer, toClient := newBuffer(), newBuffer()
+	clientAddr := pipeAddr(fmt.Sprintf("client-%d", n))
+	serverAddr := pipeAddr(fmt.Sprintf("server-%d", n))
+	client = &pipeConn{in: toClient, out: toServer, local: clientAddr, remote: serverAddr}
+	server = &pipeConn{in: toServer, out: toClient, local: serverAddr, remote: clientAddr}
+	return client, server
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.out.write(p)
+}
+
+func (c *pipeConn) Close() error {
+	c.in.close(true)
+	c.out.close(false)
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes do not block.
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,322 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package websockettest connects websocket servers and clients in memory,
+// for tests without sockets. The connections run the same handshake, read
+// loops and event dispatch as over tcp.
+package websockettest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/chaos"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+// URL is the url the servers and clients are created with.
+const URL = "ws://websockettest/"
+
+// ConnectTimeout limits waiting for both ends to report a connection.
+var ConnectTimeout = 5 * time.Second
+
+// ServerConn is a server accepting in-memory connections.
+type ServerConn struct {
+	*websocket.Server
+
+	listener  *listener
+	serveOnce sync.Once
+	lock      sync.Mutex
+	connected chan int
+}
+
+// ClientConn is a client connected to a ServerConn. ClientId is its id on
+// the server for the first connection.
+type ClientConn struct {
+	*websocket.Client
+	ClientId int
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// NewServer returns a server with events, configure it before the first
+// client connects.
+func NewServer(events websocket.Events) *ServerConn {
+	s := &ServerConn{
+		listener:  newListener(),
+		connected: make(chan int, 16),
+	}
+	s.Server = websocket.NewServer(URL, &connectEvents{
+		Events: events,
+		onConnect: func(id int) {
+			select {
+			case s.connected <- id:
+			default:
+			}
+		},
+	})
+	return s
+}
+
+// NewPair returns a server and a client connected to it.
+func NewPair(tb testing.TB, serverEvents, clientEvents websocket.Events) (*ServerConn, *ClientConn) {
+	tb.Helper()
+
+	server := NewServer(serverEvents)
+	return server, server.NewClient(tb, clientEvents)
+}
+
+// NewClient returns a further client connected to the server.
+func (s *ServerConn) NewClient(tb testing.TB, events websocket.Events) *ClientConn {
+	tb.Helper()
+
+	return s.connectClient(tb, websocket.NewClient(false, events))
+}
+
+// Connect connects a configured client to the server and returns its id
+// on the server. It returns once both ends reported the connection, and
+// fails tb if they do not within ConnectTimeout. Reconnects of the client
+// connect to the server again.
+func (s *ServerConn) Connect(tb testing.TB, client *websocket.Client) int {
+	tb.Helper()
+
+	return s.connect(tb, client, s.listener.dial)
+}
+
+func (s *ServerConn) connectClient(tb testing.TB, client *websocket.Client) *ClientConn {
+	tb.Helper()
+
+	c := &ClientConn{Client: client}
+	c.ClientId = s.connect(tb, client, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := s.listener.dial(ctx, network, addr)
+		if err == nil {
+			c.lock.Lock()
+			c.conn = conn
+			c.lock.Unlock()
+		}
+		return conn, err
+	})
+	return c
+}
+
+// SetChaos misbehaves on received messages of the server as configured by
+// config, disconnects break the connection. Call it before the first
+// client connects.
+func (s *ServerConn) SetChaos(config chaos.Config) *chaos.Events {
+	events := chaos.Wrap(s.EventHandler(), config)
+	events.SetDisconnect(func(id int) { _ = s.Break(id) })
+	s.SetEventHandler(events)
+	return events
+}
+
+// ConnectChaos connects a configured client like Connect, misbehaving on
+// its received messages as configured by config. Disconnects break the
+// connection, a client with reconnect set reconnects.
+func (s *ServerConn) ConnectChaos(tb testing.TB, client *websocket.Client,
+	config chaos.Config) (*ClientConn, *chaos.Events) {
+
+	tb.Helper()
+
+	events := chaos.Wrap(client.EventHandler(), config)
+	client.SetEventHandler(events)
+	c := s.connectClient(tb, client)
+	events.SetDisconnect(func(int) { c.Break() })
+	return c, events
+}
+
+// Break drops the connection of a client without a close frame, like a
+// failing network.
+func (s *ServerConn) Break(clientId int) error {
+	for _, client := range s.Clients() {
+		if client.Id == clientId {
+			return s.listener.breakConn(client.RemoteAddr)
+		}
+	}
+	return websocket.ErrNoClient
+}
+
+// Break drops the current connection of the client without a close frame.
+func (c *ClientConn) Break() {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// NetDial returns the dial of the in-memory connections, for clients
+// connecting by their own, e.g. through a protocol layer. Set it by
+// Client.SetNetDial and connect to URL.
+func (s *ServerConn) NetDial() websocket.NetDialFunc {
+	s.serve()
+	return s.listener.dial
+}
+
+func (s *ServerConn) serve() {
+	s.serveOnce.Do(func() {
+		go func() { _ = s.Server.Serve(s.listener) }()
+	})
+}
+
+func (s *ServerConn) connect(tb testing.TB, client *websocket.Client,
+	dial websocket.NetDialFunc) int {
+
+	tb.Helper()
+	s.serve()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	clientConnected := make(chan struct{})
+	var once sync.Once
+	events := client.EventHandler()
+	client.SetEventHandler(&connectEvents{
+		Events:    events,
+		onConnect: func(int) { once.Do(func() { close(clientConnected) }) },
+	})
+	defer client.SetEventHandler(events)
+
+	client.SetNetDial(dial)
+	served := make(chan error, 1)
+	go func() { served <- client.ConnectAndServe(URL, nil) }()
+
+	timeout := time.NewTimer(ConnectTimeout)
+	defer timeout.Stop()
+
+	clientId := 0
+	for clientId == 0 || clientConnected != nil {
+		select {
+		case clientId = <-s.connected:
+		case <-clientConnected:
+			clientConnected = nil
+		case err := <-served:
+			tb.Fatalf("websockettest: connect: %v", err)
+		case <-timeout.C:
+			tb.Fatalf("websockettest: connect timed out after %v", ConnectTimeout)
+		}
+	}
+	return clientId
+}
+
+// connectEvents reports connects to onConnect after passing them on.
+type connectEvents struct {
+	websocket.Events
+	onConnect func(id int)
+}
+
+func (e *connectEvents) OnConnect(id int) {
+	e.Events.OnConnect(id)
+	e.onConnect(id)
+}
+
+func (e *connectEvents) OnConnectCtx(ctx context.Context, id int) {
+	if ctxEvents, ok := e.Events.(websocket.ConnectCtxEvents); ok {
+		ctxEvents.OnConnectCtx(ctx, id)
+	} else {
+		e.Events.OnConnect(id)
+	}
+	e.onConnect(id)
+}
+
+func (e *connectEvents) OnReceiveCtx(ctx context.Context, msg websocket.Message) {
+	if ctxEvents, ok := e.Events.(websocket.CtxEvents); ok {
+		ctxEvents.OnReceiveCtx(ctx, msg)
+	} else {
+		e.Events.OnReceive(msg)
+	}
+}
+
+// listener accepts the server ends of the dialed pipes.
+type listener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+
+	lock    sync.Mutex
+	dialed  uint64
+	servers map[string]net.Conn
+}
+
+func newListener() *listener {
+	return &listener{
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+		servers: make(map[string]net.Conn),
+	}
+}
+
+func (l *listener) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	l.lock.Lock()
+	l.dialed++
+	client, server := newPipe(l.dialed)
+	l.servers[client.LocalAddr().String()] = server
+	l.lock.Unlock()
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// breakConn closes the server end of the pipe dialed from remoteAddr.
+func (l *listener) breakConn(remoteAddr string) error {
+	l.lock.Lock()
+	server := l.servers[remoteAddr]
+	delete(l.servers, remoteAddr)
+	l.lock.Unlock()
+
+	if server == nil {
+		return websocket.ErrNoClient
+	}
+	return server.Close()
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return pipeAddr("server")
+}
@@ -0,0 +1,288 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websockettest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ChrIgiSta/go-easy-websockets/chaos"
+	"github.com/ChrIgiSta/go-easy-websockets/utils"
+	"github.com/ChrIgiSta/go-easy-websockets/websocket"
+)
+
+func TestPair(t *testing.T) {
+	serverEvents, clientEvents := NewRecorder(), NewRecorder()
+	server, client := NewPair(t, serverEvents, clientEvents)
+	defer server.Close()
+	if id := serverEvents.WaitForConnect(t, time.Second); id != client.ClientId {
+		t.Errorf("connected %d, client id %d", id, client.ClientId)
+	}
+	clientEvents.WaitForConnect(t, time.Second)
+
+	for _, msg := range []websocket.Message{
+		{MessageType: websocket.TextMessage, Data: []byte("text")},
+		{MessageType: websocket.BinaryMessage, Data: []byte{0, 1, 0xff}},
+	} {
+		if err := client.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		got := serverEvents.WaitForMessage(t, time.Second)
+		if got.MessageType != msg.MessageType || !bytes.Equal(got.Data, msg.Data) ||
+			got.ClientId != client.ClientId {
+			t.Errorf("server received %+v", got)
+		}
+		if err := server.Send(client.ClientId, &msg); err != nil {
+			t.Fatal(err)
+		}
+		got = clientEvents.WaitForMessage(t, time.Second)
+		if got.MessageType != msg.MessageType || !bytes.Equal(got.Data, msg.Data) {
+			t.Errorf("client received %+v", got)
+		}
+	}
+
+	otherEvents := NewRecorder()
+	other := server.NewClient(t, otherEvents)
+	if other.ClientId == client.ClientId {
+		t.Error("same client id")
+	}
+	server.Broadcast(&websocket.Message{MessageType: websocket.TextMessage, Data: []byte("all")})
+	for _, events := range []*Recorder{clientEvents, otherEvents} {
+		if got := events.WaitForMessage(t, time.Second); string(got.Data) != "all" {
+			t.Errorf("broadcast received %q", got.Data)
+		}
+	}
+
+	// the client closes
+	if err := other.Disconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if id := serverEvents.WaitForDisconnect(t, time.Second); id != other.ClientId {
+		t.Errorf("disconnected %d", id)
+	}
+	// the server closes
+	if err := server.Disconnect(client.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	clientEvents.WaitForDisconnect(t, time.Second)
+	serverEvents.WaitForDisconnect(t, time.Second)
+}
+
+func TestConcurrentSenders(t *testing.T) {
+	const senders, messages = 8, 200
+
+	serverEvents, clientEvents := NewRecorder(), NewRecorder()
+	server, client := NewPair(t, serverEvents, clientEvents)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				msg := websocket.Message{MessageType: websocket.TextMessage,
+					Data: []byte(fmt.Sprintf("%d %d", i, n))}
+				if err := client.Send(msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < messages; n++ {
+				msg := &websocket.Message{MessageType: websocket.BinaryMessage,
+					Data: []byte(fmt.Sprintf("%d %d", i, n))}
+				if err := server.Send(client.ClientId, msg); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, events := range []*Recorder{serverEvents, clientEvents} {
+		next := make([]int, senders)
+		for k := 0; k < senders*messages; k++ {
+			var i, n int
+			data := events.WaitForMessage(t, time.Second).Data
+			if _, err := fmt.Sscanf(string(data), "%d %d", &i, &n); err != nil {
+				t.Fatal(err)
+			}
+			if n != next[i] {
+				t.Fatalf("sender %d: message %d after %d", i, n, next[i]-1)
+			}
+			next[i]++
+		}
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	serverEvents, clientEvents := NewRecorder(), NewRecorder()
+	server := NewServer(serverEvents)
+	client := websocket.NewClient(false, clientEvents)
+	client.SetKeepalive(10*time.Millisecond, time.Second)
+	pongs := make(chan struct{}, 1)
+	client.SetOnPong(func(id int, rtt time.Duration) {
+		select {
+		case pongs <- struct{}{}:
+		default:
+		}
+	})
+	server.Connect(t, client)
+	select {
+	case <-pongs:
+	case <-time.After(time.Second):
+		t.Error("no pong")
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clientEvents.WaitForDisconnect(t, time.Second)
+	serverEvents.WaitForDisconnect(t, time.Second)
+	if err := client.Send(websocket.Message{MessageType: websocket.TextMessage}); err == nil {
+		t.Error("sent after the server closed")
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	clientEvents := NewRecorder()
+	server, client := NewPair(t, NewRecorder(), clientEvents)
+	defer server.Close()
+
+	// the close reply to the gone server end is dropped like on a socket
+	if err := server.Disconnect(client.ClientId); err != nil {
+		t.Fatal(err)
+	}
+	clientEvents.WaitForDisconnect(t, time.Second)
+	if stats := client.Stats(); stats.CloseCode != 1000 {
+		t.Errorf("close code %d, want 1000", stats.CloseCode)
+	}
+	for _, evnt := range clientEvents.EventsSeen() {
+		if evnt.Err != nil {
+			t.Error("failure on a normal closure: ", evnt.Err)
+		}
+	}
+}
+
+// fatalTB records the failure of Fatalf and ends the calling goroutine
+// like testing.T does.
+type fatalTB struct {
+	testing.TB
+	failed chan string
+}
+
+func (f *fatalTB) Helper() {}
+
+func (f *fatalTB) Fatalf(format string, args ...any) {
+	f.failed <- fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func TestConnectFails(t *testing.T) {
+	server := NewServer(NewRecorder())
+	server.SetAuthHeader(websocket.NewAuthHeader("X-Token", "secret", websocket.HashAlgoNone))
+	defer server.Close()
+
+	tb := &fatalTB{TB: t, failed: make(chan string, 1)}
+	go server.Connect(tb, websocket.NewClient(false, NewRecorder()))
+
+	select {
+	case msg := <-tb.failed:
+		t.Log(msg)
+	case <-time.After(2 * ConnectTimeout):
+		t.Fatal("rejected connect not reported")
+	}
+}
+
+func TestChaos(t *testing.T) {
+	serverEvents := NewRecorder()
+	server := NewServer(serverEvents)
+	defer server.Close()
+	serverChaos := server.SetChaos(chaos.Config{Seed: 1, DropRate: 0.5})
+
+	clientEvents := NewRecorder()
+	wsClient := websocket.NewClient(false, clientEvents)
+	backoff := utils.NewBackoff()
+	backoff.Initial = 10 * time.Millisecond
+	wsClient.SetReconnect(backoff, 0)
+	// only the first connection is disconnected
+	disconnects := 0
+	client, clientChaos := server.ConnectChaos(t, wsClient, chaos.Config{
+		Seed: 1,
+		DisconnectAfter: func(*rand.Rand) time.Duration {
+			if disconnects++; disconnects == 1 {
+				return 50 * time.Millisecond
+			}
+			return time.Hour
+		},
+	})
+	defer client.Disconnect()
+
+	for i := 0; i < 20; i++ {
+		if err := client.Send(websocket.Message{MessageType: websocket.TextMessage, Data: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	if counters := serverChaos.Counters(); counters.Dropped == 0 ||
+		int(counters.Dropped)+len(serverEvents.Messages()) != 20 {
+		t.Errorf("%d received, counters %+v", len(serverEvents.Messages()), counters)
+	}
+
+	// the broken connection is reconnected
+	clientEvents.WaitForConnect(t, time.Second)
+	clientEvents.WaitForDisconnect(t, time.Second)
+	clientEvents.WaitForConnect(t, time.Second)
+	if clientChaos.Counters().Disconnected == 0 {
+		t.Error("no disconnect counted")
+	}
+
+	// the server breaks a connection
+	first := serverEvents.WaitForConnect(t, time.Second)
+	id := serverEvents.WaitForConnect(t, time.Second)
+	if disconnected := serverEvents.WaitForDisconnect(t, time.Second); disconnected != first {
+		t.Errorf("disconnected %d", disconnected)
+	}
+	if err := server.Break(id); err != nil {
+		t.Fatal(err)
+	}
+	if disconnected := serverEvents.WaitForDisconnect(t, time.Second); disconnected != id {
+		t.Errorf("disconnected %d", disconnected)
+	}
+	clientEvents.WaitForDisconnect(t, time.Second)
+	if err := server.Break(id); err == nil {
+		t.Error("broke a gone connection")
+	}
+}
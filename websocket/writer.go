@@ -0,0 +1,124 @@
+/**
+ * Copyright © 2024, Staufi Tech - Switzerland
+ * All rights reserved.
+ *
+ *   ________________________   ___ _     ________________  _  ____
+ *  / _____  _  ____________/  / __|_|   /_______________  | | ___/
+ * ( (____ _| |_ _____ _   _ _| |__ _      | |_____  ____| |_|_
+ *  \____ (_   _|____ | | | (_   __) |     | | ___ |/ ___)  _  \
+ *  _____) )| |_/ ___ | |_| | | |  | |     | | ____( (___| | | |
+ * (______/  \__)_____|____/  |_|  |_|     |_|_____)\____)_| |_|
+ *
+ *
+ *  THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ *  AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ *  IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ *  ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+ *  LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+ *  CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+ *  SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+ *  INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+ *  CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ *  ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ *  POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotConnected is returned by sends of a client before its connection
+// is established (OnConnect) and after it ended or Disconnect was called.
+var ErrNotConnected = errors.New("not connected")
+
+// messageWriter streams one message and holds the write lock of its
+// connection until closed.
+type messageWriter struct {
+	w      io.WriteCloser
+	size   int
+	unlock func()
+	sent   func(size int)
+	once   sync.Once
+}
+
+func (m *messageWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.size += n
+	if err != nil {
+		err = classifyError(err, dirWrite, nil)
+	}
+	return n, err
+}
+
+// Close flushes the last frame of the message and releases the
+// connection.
+func (m *messageWriter) Close() (err error) {
+	err = net.ErrClosed
+	m.once.Do(func() {
+		defer m.unlock()
+
+		if err = m.w.Close(); err != nil {
+			err = classifyError(err, dirWrite, nil)
+			return
+		}
+		m.sent(m.size)
+	})
+	return err
+}
+
+// nextWriter streams uncompressed, marked as such if the connection
+// negotiated payload compression, and in a text frame with text-only
+// framing.
+func nextWriter(conn *websocket.Conn, messageType int, lock *sync.Mutex,
+	stats *statsCounter, payload *payloadCompression, textFramed bool) (io.WriteCloser, error) {
+
+	var w io.WriteCloser
+	var err error
+	if textFramed && (messageType == TextMessage || messageType == BinaryMessage) {
+		w, err = newTextFrameWriter(conn, messageType)
+	} else {
+		w, err = conn.NextWriter(messageType)
+	}
+	if err == nil && payload != nil {
+		_, err = w.Write([]byte{prefixPlain})
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, classifyError(err, dirWrite, nil)
+	}
+	return &messageWriter{w: w, unlock: lock.Unlock, sent: stats.sent}, nil
+}
+
+// NextWriter streams a message in frames instead of buffering it, e.g. for
+// an encoder. Other sends wait until the writer is closed, which must
+// happen in any case.
+func (c *Client) NextWriter(messageType int) (io.WriteCloser, error) {
+	c.writeLock.Lock()
+
+	c.lock.Lock()
+	conn, payload, textFramed := c.conn, c.payload, c.textFramed
+	c.lock.Unlock()
+	if conn == nil {
+		c.writeLock.Unlock()
+		return nil, ErrNotConnected
+	}
+	return nextWriter(conn, messageType, &c.writeLock, &c.stats, payload, textFramed)
+}
+
+// NextWriter streams a message to a client like Client.NextWriter.
+func (s *Server) NextWriter(clientId int, messageType int) (io.WriteCloser, error) {
+	client := s.client(clientId)
+	if client == nil {
+		return nil, ErrNoClient
+	}
+	client.writeLock.Lock()
+	return nextWriter(client.conn, messageType, &client.writeLock, &s.hub.stats,
+		client.payload, client.textFramed)
+}